@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+analyze sums up the games in replay files of import-mrt: how often
+every side hit, how long the moves took, where the shots went and how
+long the moves took to get around the collectors.
+
+The time of a move is from when the move before it was first seen to
+when it was, so it's the thinking of the side that made it plus the
+propagation of both moves. The spread of a move is from the first
+collector peer seeing it to the last one, that is how long it took to
+propagate as far as it did.
+*/
+
+// sideStats is what one prefix did in a game, or in all of them
+type sideStats struct {
+	prefix      string
+	shots, hits int
+	moves       int
+	time        time.Duration
+	heat        [maxBoardSize][maxBoardSize]int
+}
+
+func (s *sideStats) accuracy() string {
+	if s.shots == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(s.hits)*100/float64(s.shots))
+}
+
+func (s *sideStats) moveTime() string {
+	if s.moves == 0 {
+		return "-"
+	}
+	return (s.time / time.Duration(s.moves)).Round(time.Second).String()
+}
+
+func (s *sideStats) add(o *sideStats) {
+	s.shots += o.shots
+	s.hits += o.hits
+	s.moves += o.moves
+	s.time += o.time
+	for y := range o.heat {
+		for x := range o.heat[y] {
+			s.heat[y][x] += o.heat[y][x]
+		}
+	}
+}
+
+type gameStats struct {
+	replay    mrtReplay
+	sides     []*sideStats
+	moveTimes []time.Duration
+	spreads   []time.Duration
+	peers     []int
+}
+
+// analyzeReplay goes through the moves of r, the results of a move
+// only come with the next one so a shot is counted once they are known.
+func analyzeReplay(r mrtReplay) gameStats {
+	g := gameStats{replay: r}
+	sides := make(map[string]*sideStats)
+	for _, p := range r.Prefixes {
+		s := &sideStats{prefix: p}
+		sides[p] = s
+		g.sides = append(g.sides, s)
+	}
+
+	for i, rm := range r.Moves {
+		s := sides[rm.Prefix]
+		if s == nil {
+			continue
+		}
+		g.peers = append(g.peers, rm.Peers)
+		if !rm.At.IsZero() && rm.LastSeen.After(rm.At) {
+			g.spreads = append(g.spreads, rm.LastSeen.Sub(rm.At))
+		}
+		if i > 0 {
+			prev := r.Moves[i-1]
+			if prev.Counter == rm.Counter-1 && !prev.At.IsZero() && rm.At.After(prev.At) {
+				d := rm.At.Sub(prev.At)
+				g.moveTimes = append(g.moveTimes, d)
+				s.moves++
+				s.time += d
+			}
+		}
+
+		if rm.GameOver || i+1 >= len(r.Moves) {
+			continue
+		}
+		next := r.Moves[i+1]
+		if next.Counter != rm.Counter+1 || next.Prefix == rm.Prefix {
+			continue
+		}
+		for j, c := range rm.shots(r.Salvo) {
+			if c.X < 0 || c.X >= maxBoardSize || c.Y < 0 || c.Y >= maxBoardSize {
+				continue
+			}
+			s.shots++
+			s.heat[c.Y][c.X]++
+			if next.hit(j, r.Salvo) {
+				s.hits++
+			}
+		}
+	}
+	return g
+}
+
+// durationSummary is the percentiles of ds
+func durationSummary(ds []time.Duration) string {
+	if len(ds) == 0 {
+		return "none"
+	}
+	ds = append([]time.Duration(nil), ds...)
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	at := func(p int) string {
+		return ds[(len(ds)-1)*p/100].Round(time.Millisecond).String()
+	}
+	return fmt.Sprintf("min %s, median %s, 90th %s, max %s",
+		at(0), at(50), at(90), at(100))
+}
+
+var histogramBuckets = []time.Duration{time.Second, 5 * time.Second,
+	15 * time.Second, time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// durationHistogram draws how many of ds fall in each of the buckets
+func durationHistogram(ds []time.Duration) string {
+	counts := make([]int, len(histogramBuckets)+1)
+	most := 0
+	for _, d := range ds {
+		i := sort.Search(len(histogramBuckets), func(i int) bool { return d < histogramBuckets[i] })
+		counts[i]++
+		if counts[i] > most {
+			most = counts[i]
+		}
+	}
+
+	var b strings.Builder
+	for i, n := range counts {
+		label := "more"
+		if i < len(histogramBuckets) {
+			label = "< " + histogramBuckets[i].String()
+		}
+		bar := 0
+		if most > 0 {
+			bar = (n*40 + most - 1) / most
+		}
+		fmt.Fprintf(&b, "  %-8s %5d %s\n", label, n, strings.Repeat("#", bar))
+	}
+	return b.String()
+}
+
+const heatShades = " .:-=+*#%@"
+
+// drawHeatmap draws the heat of a width x height board, hotter cells
+// get denser characters.
+func drawHeatmap(heat [maxBoardSize][maxBoardSize]int, width, height int) string {
+	most := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if heat[y][x] > most {
+				most = heat[y][x]
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("    ")
+	for x := 0; x < width; x++ {
+		fmt.Fprintf(&b, "%c ", 'A'+x)
+	}
+	b.WriteString("\n")
+	for y := 0; y < height; y++ {
+		fmt.Fprintf(&b, "%2d  ", y)
+		for x := 0; x < width; x++ {
+			shade := 0
+			if most > 0 && heat[y][x] > 0 {
+				shade = 1 + heat[y][x]*(len(heatShades)-2)/most
+			}
+			fmt.Fprintf(&b, "%c ", heatShades[shade])
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// heatColor goes from white for no shots to red for the most of them
+func heatColor(n, most int) color.RGBA {
+	if most == 0 {
+		return color.RGBA{255, 255, 255, 255}
+	}
+	v := uint8(255 - 255*n/most)
+	return color.RGBA{255, v, v, 255}
+}
+
+const heatCellSize = 32
+
+// writeHeatmap writes the heat as a PNG or SVG image, by the extension
+// of path.
+func writeHeatmap(path string, heat [maxBoardSize][maxBoardSize]int, width, height int) error {
+	most := 0
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if heat[y][x] > most {
+				most = heat[y][x]
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		img := image.NewRGBA(image.Rect(0, 0, width*heatCellSize, height*heatCellSize))
+		for py := 0; py < height*heatCellSize; py++ {
+			for px := 0; px < width*heatCellSize; px++ {
+				c := heatColor(heat[py/heatCellSize][px/heatCellSize], most)
+				if px%heatCellSize == 0 || py%heatCellSize == 0 {
+					c = color.RGBA{192, 192, 192, 255}
+				}
+				img.SetRGBA(px, py, c)
+			}
+		}
+		if err := png.Encode(&out, img); err != nil {
+			return err
+		}
+	case ".svg":
+		fmt.Fprintf(&out, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">\n",
+			width*heatCellSize, height*heatCellSize)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				c := heatColor(heat[y][x], most)
+				fmt.Fprintf(&out, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" "+
+					"fill=\"#%02x%02x%02x\" stroke=\"#c0c0c0\"><title>%s: %d</title></rect>\n",
+					x*heatCellSize, y*heatCellSize, heatCellSize, heatCellSize,
+					c.R, c.G, c.B, cell{x, y}, heat[y][x])
+			}
+		}
+		out.WriteString("</svg>\n")
+	default:
+		return fmt.Errorf("Heatmaps are written as .png or .svg, not %s", path)
+	}
+	return writeFileAtomic(path, out.Bytes(), 0644)
+}
+
+func readReplays(path string) ([]mrtReplay, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var replays []mrtReplay
+	if err := json.Unmarshal(b, &replays); err != nil {
+		return nil, fmt.Errorf("%s is not a replay file of import-mrt: %s", path, err.Error())
+	}
+	return replays, nil
+}
+
+// runAnalyze is the analyze command.
+func runAnalyze(args []string) error {
+	fs := flag.NewFlagSet("analyze", flag.ExitOnError)
+	heatmap := fs.String("heatmap", "", "Also draw the heatmap of the shots into this .png or .svg file")
+	prefix := fs.String("prefix", "", "Only sum up the shots fired by this prefix, to see where it aims")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s analyze [flags] <replay file>...\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("analyze needs replay files, see import-mrt")
+	}
+
+	var games []gameStats
+	for _, path := range fs.Args() {
+		replays, err := readReplays(path)
+		if err != nil {
+			return err
+		}
+		for _, r := range replays {
+			games = append(games, analyzeReplay(r))
+		}
+	}
+
+	total := &sideStats{}
+	var moveTimes, spreads []time.Duration
+	width, height, peers, peerMoves := 0, 0, 0, 0
+
+	fmt.Printf("%-4s %-20s %6s %5s %6s %9s %8s\n",
+		"game", "prefix", "moves", "shots", "hits", "accuracy", "per move")
+	for i, g := range games {
+		r := g.replay
+		for _, s := range g.sides {
+			who := s.prefix
+			if r.Winner == s.prefix {
+				who += " *"
+			}
+			fmt.Printf("%-4d %-20s %6d %5d %6d %9s %8s\n",
+				i+1, who, s.moves, s.shots, s.hits, s.accuracy(), s.moveTime())
+			if *prefix == "" || *prefix == s.prefix {
+				total.add(s)
+			}
+		}
+		moveTimes = append(moveTimes, g.moveTimes...)
+		spreads = append(spreads, g.spreads...)
+		for _, p := range g.peers {
+			peers += p
+			peerMoves++
+		}
+		if r.Width > width && r.Width <= maxBoardSize {
+			width = r.Width
+		}
+		if r.Height > height && r.Height <= maxBoardSize {
+			height = r.Height
+		}
+	}
+	fmt.Printf("(* won)\n\n")
+
+	who := "all sides"
+	if *prefix != "" {
+		who = *prefix
+	}
+	fmt.Printf("%d games, %s: %d shots, %d hits, %s accuracy, %s per move\n",
+		len(games), who, total.shots, total.hits, total.accuracy(), total.moveTime())
+	if peerMoves > 0 {
+		fmt.Printf("A move was seen by %.1f collector peers on average\n",
+			float64(peers)/float64(peerMoves))
+	}
+	fmt.Printf("\nTime per move: %s\n%s", durationSummary(moveTimes), durationHistogram(moveTimes))
+	fmt.Printf("\nPropagation spread: %s\n%s", durationSummary(spreads), durationHistogram(spreads))
+
+	if width == 0 || height == 0 {
+		return nil
+	}
+	fmt.Printf("\nShots fired by %s\n%s", who, drawHeatmap(total.heat, width, height))
+	if *heatmap != "" {
+		return writeHeatmap(*heatmap, total.heat, width, height)
+	}
+	return nil
+}
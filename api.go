@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var apiListen = flag.String("api", "",
+	"Serve the control API on this address, like 127.0.0.1:8180")
+
+var apiMoves = flag.Bool("apiMoves", false,
+	"With serve, wait for the moves to come over -api instead of picking them with the bot")
+
+/*
+The control API lets scripts and other UIs drive the games of a running
+daemon, instead of each of them talking to the router:
+
+GET  /games                 every game being played
+GET  /games/<name>          its boards and moves
+POST /games/<name>/fire     {"Shots": ["A1"]}, when it's our turn
+POST /games/<name>/resync   ask the other side to resend what we miss
+GET  /games/<name>/timeline what it saw and announced, see timeline.go
+GET  /games/<name>/diff     what we announce against the router, see diff.go
+
+POST /reload                read -config again, see reload.go
+
+and for teams, see team.go:
+
+GET  /team
+GET  /games/<name>/export
+POST /games/<name>/vote
+
+Everything is done on the event loop of the game, so it's never touched
+by two goroutines at once. The ctl command is a client of it. There's
+no authentication, keep it on localhost.
+*/
+
+var errGameGone = fmt.Errorf("The game is over")
+
+// apiCall is run on the event loop of a game
+type apiCall struct {
+	f    func(l *gameLoop) (interface{}, error)
+	done chan apiResult
+}
+
+type apiResult struct {
+	v   interface{}
+	err error
+}
+
+var apiLoops = make(map[string]*gameLoop)
+var apiLoopsMu sync.Mutex
+var apiOnce sync.Once
+
+type apiGame struct {
+	Name       string
+	ASN        int
+	Prefix     string
+	PeerPrefix string
+	Moves      int
+	OurTurn    bool
+	Shots      int
+	Over, Won  bool
+	// the session to the other side is down
+	Offline bool
+	// classic, salvo, ctf or salvo+ctf
+	Mode string
+}
+
+type apiBoards struct {
+	apiGame
+	Local, Remote [][]string
+	History       []move
+}
+
+func gameInfo(g *game) apiGame {
+	m := g.match
+	return apiGame{
+		Name:       m.Name,
+		ASN:        m.ASN,
+		Prefix:     m.Prefix,
+		PeerPrefix: m.PeerPrefix,
+		Moves:      len(g.moves),
+		OurTurn:    g.ourTurn() && !g.over,
+		Shots:      g.salvoSize(),
+		Over:       g.over,
+		Won:        g.won,
+		Offline:    !g.offlineSince.IsZero(),
+		Mode:       modeName(g.mode()),
+	}
+}
+
+// startAPI serves the control API if -api is set, once.
+func startAPI() {
+	if *apiListen == "" {
+		return
+	}
+	apiOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/games", serveAPIGames)
+		mux.HandleFunc("/games/", serveAPIGame)
+		mux.HandleFunc("/team", serveAPITeam)
+		mux.HandleFunc("/reload", serveAPIReload)
+
+		go func() {
+			mainLog.Fatalf("Unable to serve control API %s",
+				http.ListenAndServe(*apiListen, mux).Error())
+		}()
+		mainLog.Infof("Control API running on %s", *apiListen)
+	})
+}
+
+func registerLoop(l *gameLoop) {
+	apiLoopsMu.Lock()
+	defer apiLoopsMu.Unlock()
+	apiLoops[l.g.match.Name] = l
+}
+
+func unregisterLoop(l *gameLoop) {
+	apiLoopsMu.Lock()
+	defer apiLoopsMu.Unlock()
+	if apiLoops[l.g.match.Name] == l {
+		delete(apiLoops, l.g.match.Name)
+	}
+}
+
+func findLoop(name string) *gameLoop {
+	apiLoopsMu.Lock()
+	defer apiLoopsMu.Unlock()
+	return apiLoops[name]
+}
+
+// call runs f on the event loop of l and returns what it did.
+func (l *gameLoop) call(f func(l *gameLoop) (interface{}, error)) (interface{}, error) {
+	c := apiCall{f, make(chan apiResult, 1)}
+	select {
+	case l.calls <- c:
+	case <-l.done:
+		return nil, errGameGone
+	}
+	r := <-c.done
+	return r.v, r.err
+}
+
+func serveAPIGames(w http.ResponseWriter, r *http.Request) {
+	apiLoopsMu.Lock()
+	loops := make([]*gameLoop, 0, len(apiLoops))
+	for _, l := range apiLoops {
+		loops = append(loops, l)
+	}
+	apiLoopsMu.Unlock()
+
+	o := make([]apiGame, 0, len(loops))
+	for _, l := range loops {
+		v, err := l.call(func(l *gameLoop) (interface{}, error) {
+			return gameInfo(l.g), nil
+		})
+		if err == nil {
+			o = append(o, v.(apiGame))
+		}
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i].Name < o[j].Name })
+	writeJSON(w, o)
+}
+
+func serveAPIReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Reload is a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	changed, err := reloadConfig()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string][]string{"Changed": changed})
+}
+
+func serveAPIGame(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/games/"), "/")
+	l := findLoop(parts[0])
+	if l == nil {
+		http.Error(w, "No such game", http.StatusNotFound)
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var f func(l *gameLoop) (interface{}, error)
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		f = func(l *gameLoop) (interface{}, error) {
+			return apiBoards{
+				apiGame: gameInfo(l.g),
+				Local:   boardStrings(l.g.LocalB),
+				Remote:  boardStrings(l.g.RemoteB),
+				History: append([]move(nil), l.g.moves...),
+			}, nil
+		}
+	case action == "fire" && r.Method == http.MethodPost:
+		var req struct {
+			Shots []string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f = func(l *gameLoop) (interface{}, error) {
+			g := l.g
+			if g.over || !g.ourTurn() {
+				return nil, fmt.Errorf("Not your turn yet")
+			}
+			shots := parseShots(strings.Join(req.Shots, " "), g.salvoSize(), g.RemoteB)
+			if shots == nil {
+				return nil, fmt.Errorf("Invalid shots, %d are needed", g.salvoSize())
+			}
+			l.fire(shots)
+			return gameInfo(g), nil
+		}
+	case action == "vote" && r.Method == http.MethodPost:
+		var req struct {
+			Shots []string
+			Voter string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Voter == "" {
+			req.Voter = voterName(r)
+		}
+		f = func(l *gameLoop) (interface{}, error) {
+			g := l.g
+			if l.ballot == nil {
+				return nil, errNotTeam
+			}
+			if g.over || !g.ourTurn() {
+				return nil, fmt.Errorf("Not your turn yet")
+			}
+			shots := parseShots(strings.Join(req.Shots, " "), g.salvoSize(), g.RemoteB)
+			if shots == nil {
+				return nil, fmt.Errorf("Invalid shots, %d are needed", g.salvoSize())
+			}
+			l.ballot.vote(req.Voter, shots)
+			return l.votes(), nil
+		}
+	case action == "timeline" && r.Method == http.MethodGet:
+		f = func(l *gameLoop) (interface{}, error) {
+			return l.g.match.timeline.list(), nil
+		}
+	case action == "diff" && r.Method == http.MethodGet:
+		f = func(l *gameLoop) (interface{}, error) {
+			return diffOf(l.g), nil
+		}
+	case action == "export" && r.Method == http.MethodGet:
+		v, err := l.call(func(l *gameLoop) (interface{}, error) {
+			return exportGame(stateOf(l.g)), nil
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, v)
+		return
+	case action == "resync" && r.Method == http.MethodPost:
+		f = func(l *gameLoop) (interface{}, error) {
+			g := l.g
+			g.requested = -1
+			return gameInfo(g), g.requestResync(len(g.moves))
+		}
+	default:
+		http.Error(w, "Unknown action", http.StatusNotFound)
+		return
+	}
+
+	v, err := l.call(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, v)
+}
+
+// runCtl is the ctl command, a client of the control API.
+func runCtl(args []string) error {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	addr := fs.String("api", "127.0.0.1:8180", "Address of the control API")
+	voter := fs.String("voter", "", "Name to vote under, the address we vote from without it")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [-api addr] games | board <game> | "+
+			"fire <game> <shots...> | vote <game> <shots...> | resync <game> | "+
+			"export <game> | diff <game> | reload\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return fmt.Errorf("ctl needs a command")
+	}
+
+	base := "http://" + *addr
+	var resp *http.Response
+	var err error
+	switch {
+	case args[0] == "games" && len(args) == 1:
+		resp, err = http.Get(base + "/games")
+	case args[0] == "board" && len(args) == 2:
+		resp, err = http.Get(base + "/games/" + args[1])
+	case args[0] == "fire" && len(args) >= 3:
+		b, _ := json.Marshal(map[string][]string{"Shots": args[2:]})
+		resp, err = http.Post(base+"/games/"+args[1]+"/fire", "application/json", bytes.NewReader(b))
+	case args[0] == "vote" && len(args) >= 3:
+		b, _ := json.Marshal(map[string]interface{}{"Shots": args[2:], "Voter": *voter})
+		resp, err = http.Post(base+"/games/"+args[1]+"/vote", "application/json", bytes.NewReader(b))
+	case args[0] == "resync" && len(args) == 2:
+		resp, err = http.Post(base+"/games/"+args[1]+"/resync", "application/json", nil)
+	case args[0] == "export" && len(args) == 2:
+		resp, err = http.Get(base + "/games/" + args[1] + "/export")
+	case args[0] == "diff" && len(args) == 2:
+		resp, err = http.Get(base + "/games/" + args[1] + "/diff")
+	case args[0] == "reload" && len(args) == 1:
+		resp, err = http.Post(base+"/reload", "application/json", nil)
+	default:
+		fs.Usage()
+		return fmt.Errorf("Unknown ctl command %s", strings.Join(args, " "))
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+
+	switch args[0] {
+	case "board":
+		var b apiBoards
+		if err := json.Unmarshal(body, &b); err == nil {
+			printAPIBoards(b)
+			return nil
+		}
+	case "vote":
+		var v apiVotes
+		if err := json.Unmarshal(body, &v); err == nil {
+			printVotes(v)
+			return nil
+		}
+	case "export":
+		fmt.Print(string(body))
+		return nil
+	case "diff":
+		var d routeDiff
+		if err := json.Unmarshal(body, &d); err == nil {
+			fmt.Print(describeDiff(d, false))
+			return nil
+		}
+	}
+	var out bytes.Buffer
+	json.Indent(&out, body, "", "  ")
+	fmt.Println(out.String())
+	return nil
+}
+
+// printAPIBoards draws the boards of a game as play would.
+func printAPIBoards(b apiBoards) {
+	local, remote := boardFromStrings(b.Local), boardFromStrings(b.Remote)
+	fmt.Print(boardTitles(local, "Your Side", "Player Two"))
+	fmt.Print(combineBoard(local, remote))
+	turn := "theirs"
+	if b.OurTurn {
+		turn = "ours"
+	} else if b.Offline {
+		turn = "theirs, offline"
+	}
+	fmt.Printf("%s: %d moves, turn: %s, over: %v, won: %v\n", b.Name, b.Moves, turn, b.Over, b.Won)
+}
+
+func boardFromStrings(rows [][]string) battleShipBoard {
+	b := newBoard(0, len(rows))
+	for y, row := range rows {
+		if y >= maxBoardSize || len(row) > maxBoardSize {
+			break
+		}
+		b.Width = len(row)
+		for x, s := range row {
+			for _, st := range []boardState{stateEmpty, stateShip, stateHit, stateAttempt} {
+				if st.String() == s {
+					b.Board[y][x] = st
+				}
+			}
+		}
+	}
+	return b
+}
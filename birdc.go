@@ -1,15 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"encoding/binary"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
-	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bamiaux/iobit"
 )
@@ -19,7 +19,16 @@ type bgpCommunity struct {
 	Data uint16
 }
 
+// RFC 8092 large community, used for anything that doesn't fit
+// into 16 bits
+type bgpLargeCommunity struct {
+	Global uint32
+	Data1  uint32
+	Data2  uint32
+}
+
 var birdCommunityRegex = regexp.MustCompile(`\((\d+,\d+)\)`)
+var birdLargeCommunityRegex = regexp.MustCompile(`\((\d+), ?(\d+), ?(\d+)\)`)
 
 var monitoredPrefix = flag.String(
 	"peerprefix", "1.1.1.0/24", "the prefix of the other side")
@@ -34,10 +43,10 @@ var configPath = flag.String("confFile", "/etc/bird/bird.conf",
 	"Where to write config file")
 
 var sockPath = flag.String("sockFile", "/run/bird/bird.ctl",
-	"Where to write config file")
+	"The bird control socket, or a tcp:// or tls:// address forwarded to it")
 
 /*
-Three Communities are used:
+Three Community types are used:
 
 
 Type 1: Game counter, Moves up
@@ -61,8 +70,127 @@ S = Hit or Miss on last move
 +-------------------------------+
 |T|T|X|X|X|X|-|-|Y|Y|Y|Y|S|S|-|-|
 +-------------------------------+
+
+S is 0 for a miss and 1 for a hit, with the results codec it is 2
+if the hit sunk a ship, which one is told with extSunk.
+
+Type 3: Extended, carries control
+messages that are not moves, there
+can be more than one of these.
+
+T = Type
+E = Extended type
+P = Payload
+
++-------------------------------+
+|T|T|E|E|E|E|P|P|P|P|P|P|P|P|P|P|
++-------------------------------+
+
+Type 0 is reserved. The extended types are listed in messages.go.
 */
 
+// the T field
+const (
+	typeCounter  = 1
+	typePosition = 2
+	typeExtended = 3
+)
+
+const (
+	// extResyncRequest asks the peer to (re)announce the move with
+	// the counter in the payload (lower 10 bits only).
+	extResyncRequest = 1
+	// extReplay marks the move as a replay of an old one sent in
+	// response to a extResyncRequest.
+	extReplay = 2
+	// extGameOver is sent instead of a move by the side that lost
+	// all its ships, the position is meaningless. The payload is one
+	// of the gameOver reasons.
+	extGameOver = 3
+	// extSunk tells that the last move of the other side sunk the
+	// ship with the index in the payload, in the order of the fleet
+	// of the game. Results codec only.
+	extSunk = 4
+	// extProtocolError rejects the last move of the peer as illegal,
+	// it is sent along our own last move and the peer is expected to
+	// make its move again. The payload is the reject reason in the
+	// upper 4 bits and the number of moves rejected so far in the
+	// lower 6, so a new rejection can be told from an old one.
+	extProtocolError = 5
+	// extNewGame is sent along our last move once a game is over, it
+	// asks for a rematch with the game ID in the payload (lower 10
+	// bits only), see rematch.go.
+	extNewGame = 6
+	// extGameTag is sent along every move once there was a handshake,
+	// the payload is the game tag of handshake.go. A move with another
+	// tag is of another game and ignored.
+	extGameTag = 7
+)
+
+// the Z field is 14 bits, so the counter wraps every counterMod moves
+// and is compared in serial number arithmetic (RFC 1982)
+const counterMod = 1 << 14
+
+// expandCounter turns a counter off the wire into the full counter
+// closest to near, half of the counter space either side of it.
+func expandCounter(wire, near int) int {
+	d := (wire - near) & (counterMod - 1)
+	if d >= counterMod/2 {
+		d -= counterMod
+	}
+	return near + d
+}
+
+// the S field
+const (
+	resultMiss = 0
+	resultHit  = 1
+	resultSunk = 2
+)
+
+// payload of extGameOver
+const (
+	gameOverSunk      = 0
+	gameOverSurrender = 1
+	// the flag was shot, see ctf.go
+	gameOverFlag = 2
+)
+
+// reasons of extProtocolError
+const (
+	rejectOutside  = 1
+	rejectRepeated = 2
+	rejectSalvo    = 3
+)
+
+var rejectReasons = map[int]string{
+	rejectOutside:  "shot outside of the board",
+	rejectRepeated: "shot at the same cell twice",
+	rejectSalvo:    "wrong number of shots",
+}
+
+type extendedCommunity struct {
+	Type    int
+	Payload int
+}
+
+type bgpMessage struct {
+	Counter         int
+	X, Y            int
+	HitOrMissOnLast int
+	Extended        []extendedCommunity
+	Large           []bgpLargeCommunity
+}
+
+func (m bgpMessage) extended(t int) (extendedCommunity, bool) {
+	for _, e := range m.Extended {
+		if e.Type == t {
+			return e, true
+		}
+	}
+	return extendedCommunity{}, false
+}
+
 func numberToBitReader(in uint16) iobit.Reader {
 	actually := uint16(in)
 
@@ -76,62 +204,97 @@ var errNotEnoughData = fmt.Errorf("Not enough data to make a move")
 var errInvalidType = fmt.Errorf("Invalid community type found")
 var errDupeType = fmt.Errorf("Duplicate data read")
 
-func readBGP() (gameIncrementor, X, Y, HitOrMissOnLast int, err error) {
-	communities := readCommunities(*monitoredPrefix)
+func readBGPFrom(prefix string) (msg bgpMessage, err error) {
+	communities, large, err := readCommunities(prefix)
+	if err != nil {
+		return bgpMessage{}, err
+	}
+	return decodeMessage(*communityAS, communities, large)
+}
+
+// legacyCodec is the move in the 16 bit communities above, see codec.go
+type legacyCodec struct{}
+
+func (legacyCodec) encode(msg bgpMessage) ([]bgpCommunity, []bgpLargeCommunity) {
+	extended := make([]uint16, 0, len(msg.Extended))
+	for _, e := range msg.Extended {
+		extended = append(extended, genExtendedCommunity(e.Type, e.Payload))
+	}
+	return gameCommunities(msg.Counter, msg.X, msg.Y, msg.HitOrMissOnLast,
+		extended...), msg.Large
+}
 
+// decode picks the move out of the communities of a route, only the
+// ones of the game on asn are looked at.
+func (legacyCodec) decode(asn int, communities []bgpCommunity,
+	large []bgpLargeCommunity) (msg bgpMessage, err error) {
 	readCounter, readPosition := false, false
 
+	for _, community := range large {
+		if community.Global == uint32(asn) {
+			msg.Large = append(msg.Large, community)
+		}
+	}
+
 	for _, community := range communities {
-		if community.AS == uint16(*communityAS) {
+		if community.AS == uint16(asn) {
 			// okay, so we are now interested!
 			r := numberToBitReader(community.Data)
 			t := r.Uint8(2)
 
-			if t == 1 {
+			if t == typeCounter {
 				// Counter
 				if readCounter {
 					// uh we have read it twice, oh dear?
-					return 0, 0, 0, 0, errDupeType
+					return bgpMessage{}, errDupeType
 				}
 				readCounter = true
 				c := r.Uint16(14)
-				gameIncrementor = int(c)
+				msg.Counter = int(c)
 
-			} else if t == 2 {
+			} else if t == typePosition {
 				if readPosition {
 					// uh we have read it twice, oh dear?
-					return 0, 0, 0, 0, errDupeType
+					return bgpMessage{}, errDupeType
 				}
 				readPosition = true
 				xp := r.Uint16(4)
-				X = int(xp)
+				msg.X = int(xp)
 				r.Skip(2)
 				yp := r.Uint16(4)
-				Y = int(yp)
+				msg.Y = int(yp)
 				hs := r.Uint16(2)
-				HitOrMissOnLast = int(hs)
+				msg.HitOrMissOnLast = int(hs)
+
+			} else if t == typeExtended {
+				et := r.Uint8(4)
+				p := r.Uint16(10)
+				msg.Extended = append(msg.Extended, extendedCommunity{
+					Type:    int(et),
+					Payload: int(p),
+				})
 
 			} else {
-				return 0, 0, 0, 0, errInvalidType
+				return bgpMessage{}, errInvalidType
 			}
 		}
 	}
 
 	if readCounter && readPosition {
-		return gameIncrementor, X, Y, HitOrMissOnLast, nil
+		return msg, nil
 	}
-	return 0, 0, 0, 0, errNotEnoughData
+	return bgpMessage{}, errNotEnoughData
 }
 
 func testBGPCode() {
-	for x := 0; x < 10; x++ {
-		for y := 0; y < 10; y++ {
+	for x := 0; x < maxBoardSize; x++ {
+		for y := 0; y < maxBoardSize; y++ {
 			_, c2 := genCommunities(1, x, y, 0)
 
 			r := numberToBitReader(c2)
 			t := r.Uint8(2)
-			if t != 2 {
-				log.Printf("WTF??")
+			if t != typePosition {
+				transportLog.Errorf("Self test: got type %d != sent %d", t, typePosition)
 			}
 			xp := r.Uint16(4)
 			X := int(xp)
@@ -140,22 +303,34 @@ func testBGPCode() {
 			Y := int(yp)
 			// hs := r.Uint16(2)
 			if X != x {
-				fmt.Printf("Logic error X: Got %d != Sent %d\n", X, x)
+				transportLog.Errorf("Self test: got X %d != sent %d", X, x)
 			}
 
 			if Y != y {
-				fmt.Printf("Logic error Y: Got %d != Sent %d\n", Y, y)
+				transportLog.Errorf("Self test: got Y %d != sent %d", Y, y)
 			}
 		}
 	}
+
+	for p := 0; p < 1024; p++ {
+		r := numberToBitReader(genExtendedCommunity(extResyncRequest, p))
+		if t := r.Uint8(2); t != typeExtended {
+			transportLog.Errorf("Self test: got type %d != sent %d", t, typeExtended)
+		}
+		et, ep := r.Uint8(4), r.Uint16(10)
+		if et != extResyncRequest || int(ep) != p {
+			transportLog.Errorf("Self test: got extended %d/%d != sent %d/%d",
+				et, ep, extResyncRequest, p)
+		}
+	}
 }
 
 func genCommunities(gameIncrementor, X, Y, HitOrMissOnLast int) (uint16, uint16) {
 	counternumberbytes := make([]byte, 2)
 	counternumberbits := iobit.NewWriter(counternumberbytes)
 
-	counternumberbits.PutUint16(2, 1)
-	counternumberbits.PutUint16(14, uint16(gameIncrementor))
+	counternumberbits.PutUint16(2, typeCounter)
+	counternumberbits.PutUint16(14, uint16(gameIncrementor&(counterMod-1)))
 	counternumberbits.Flush()
 
 	counterCommunity := binary.BigEndian.Uint16(counternumberbytes)
@@ -163,7 +338,7 @@ func genCommunities(gameIncrementor, X, Y, HitOrMissOnLast int) (uint16, uint16)
 	positionnumberbytes := make([]byte, 2)
 	positionnumberbits := iobit.NewWriter(positionnumberbytes)
 
-	positionnumberbits.PutUint16(2, 2)
+	positionnumberbits.PutUint16(2, typePosition)
 	positionnumberbits.PutUint16(4, uint16(X))
 	positionnumberbits.PutUint16(2, 0) // pad
 	positionnumberbits.PutUint16(4, uint16(Y))
@@ -175,113 +350,262 @@ func genCommunities(gameIncrementor, X, Y, HitOrMissOnLast int) (uint16, uint16)
 	return counterCommunity, positionCommunity
 }
 
-func writeBGP(gameIncrementor, X, Y, HitOrMissOnLast int) error {
-	counterCommunity, positionCommunity :=
-		genCommunities(gameIncrementor, X, Y, HitOrMissOnLast)
+func genExtendedCommunity(extType, payload int) uint16 {
+	extbytes := make([]byte, 2)
+	extbits := iobit.NewWriter(extbytes)
 
-	// Now we have the two community strings counterCommunity and positionCommunity
+	extbits.PutUint16(2, typeExtended)
+	extbits.PutUint16(4, uint16(extType))
+	extbits.PutUint16(10, uint16(payload))
+	extbits.Flush()
 
-	templatestring := fmt.Sprintf(
-		"\nbgp_community.add((%d,%d));\nbgp_community.add((%d,%d));\n",
-		*communityAS, positionCommunity, *communityAS, counterCommunity)
+	return binary.BigEndian.Uint16(extbytes)
+}
 
-	templateBytes, err := ioutil.ReadFile(*templatePath)
-	if err != nil {
-		return err
-	}
+func gameCommunities(gameIncrementor, X, Y, HitOrMissOnLast int,
+	extended ...uint16) []bgpCommunity {
+	counterCommunity, positionCommunity :=
+		genCommunities(gameIncrementor, X, Y, HitOrMissOnLast)
 
-	birdConfigOutput := strings.Replace(string(templateBytes),
-		"###COMMUNITY###", templatestring, 1)
+	// Now we have the two community strings counterCommunity and positionCommunity
 
-	err = ioutil.WriteFile(*configPath, []byte(birdConfigOutput), 0640)
-	if err != nil {
-		return err
+	communities := []bgpCommunity{
+		{Data: positionCommunity},
+		{Data: counterCommunity},
 	}
-
-	// now reload bird
-	conn, err := net.Dial("unix", *sockPath)
-	if err != nil {
-		log.Fatalf("Unable to connect to bird %s", err.Error())
+	for _, e := range extended {
+		communities = append(communities, bgpCommunity{Data: e})
 	}
-	buffer := make([]byte, 90000)
-	conn.Read(buffer)
-	defer conn.Close()
+	return communities
+}
 
-	conn.Write([]byte(fmt.Sprintf("configure\n")))
+// birdRouter plays through bird, by rewriting its config and reading
+// routes over its control socket.
+type birdRouter struct {
+	routePaths
+	routeSessions
 
-	buffer = make([]byte, 90000)
-	_, err = conn.Read(buffer)
+	// set by lint, the export of the game prefix is checked after the
+	// next write
+	checkExport bool
+}
 
-	return err
+// newBirdRouter returns a birdRouter, the control socket is kept alive
+// until the router is stopped.
+func newBirdRouter() *birdRouter {
+	if *birdKeepalive > 0 {
+		go birdSock.keepalive(routerCtx, *birdKeepalive)
+	}
+	return &birdRouter{}
 }
 
-func resetBird() error {
+func (r *birdRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	o, lo, path, proto, err := birdReadRoute(ctx, prefix)
+	if err == nil {
+		r.set(prefix, path)
+		r.setSession(prefix, proto)
+	}
+	return o, lo, err
+}
 
-	templateBytes, err := ioutil.ReadFile(*templatePath)
-	if err != nil {
+// write puts the communities of all the matches in the bird config,
+// or only in -staticFile.
+func (r *birdRouter) write(ctx context.Context, ms []*match) error {
+	if err := r.install(ctx, ms); err != nil {
 		return err
 	}
+	if r.checkExport {
+		r.checkExport = false
+		return lintBirdExport(ctx, ms)
+	}
+	return nil
+}
 
-	birdConfigOutput := strings.Replace(string(templateBytes),
-		"###COMMUNITY###", "", 1)
+func (r *birdRouter) install(ctx context.Context, ms []*match) error {
+	if *birdStaticFile != "" {
+		return installBirdStatic(ctx, ms)
+	}
 
-	err = ioutil.WriteFile(*configPath, []byte(birdConfigOutput), 0640)
+	birdConfigOutput, err := renderBirdConfig(ms)
 	if err != nil {
 		return err
 	}
 
-	// now reload bird
-	conn, err := net.Dial("unix", *sockPath)
-	if err != nil {
-		log.Fatalf("Unable to connect to bird %s", err.Error())
+	for _, m := range ms {
+		birdcLog.Debugf("Reconfiguring bird with communities %v %v for %s",
+			m.communities, m.large, m.Name)
 	}
-	buffer := make([]byte, 90000)
-	conn.Read(buffer)
-	defer conn.Close()
 
-	conn.Write([]byte(fmt.Sprintf("configure\n")))
+	return installBirdConfig(ctx, birdConfigOutput)
+}
 
-	buffer = make([]byte, 90000)
-	_, err = conn.Read(buffer)
+var birdRetryTimeout = flag.Duration("birdRetry", 2*time.Minute,
+	"How long to keep trying to reach bird before giving up, "+
+		"so that a restart of it does not end the game")
+
+// birdRetry runs f until it works, backing off exponentially, for up
+// to -birdRetry or until ctx is done.
+func birdRetry(ctx context.Context, what string, f func() error) error {
+	delay := 100 * time.Millisecond
+	deadline := time.Now().Add(*birdRetryTimeout)
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
 
-	return err
-}
+		birdcLog.Warnf("Unable to %s, retrying in %s: %s", what, delay, err.Error())
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 
-func readCommunities(prefix string) (o []bgpCommunity) {
-	conn, err := net.Dial("unix", *sockPath)
-	if err != nil {
-		log.Fatalf("Unable to connect to bird %s", err.Error())
+		delay *= 2
+		if delay > 10*time.Second {
+			delay = 10 * time.Second
+		}
 	}
-	buffer := make([]byte, 90000)
-	conn.Read(buffer)
+}
 
-	defer conn.Close()
+// readBirdReply reads up to the last line of a reply, which is the
+// only one with a space right after its code.
+func readBirdReply(r *bufio.Reader) (string, error) {
+	var reply strings.Builder
+	for {
+		line, err := r.ReadString('\n')
+		reply.WriteString(line)
+		if err != nil {
+			return reply.String(), err
+		}
+		if birdReplyEnd(line) {
+			return reply.String(), nil
+		}
+	}
+}
 
-	conn.Write([]byte(fmt.Sprintf("show route all %s\n", prefix)))
+func birdReplyEnd(line string) bool {
+	if len(line) < 5 || line[4] != ' ' {
+		return false
+	}
+	for _, c := range line[:4] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
 
-	buffer = make([]byte, 90000)
-	n, err := conn.Read(buffer)
+var birdReplyErr = regexp.MustCompile(`(?m)^[89]\d{3}[ -](.*)$`)
 
-	if err != nil {
-		log.Fatalf("Unable to read from bird %s", err.Error())
+// birdReplyError returns the first error in a reply, which are the
+// lines with a 8xxx (runtime) or 9xxx (parse) code.
+func birdReplyError(reply string) error {
+	m := birdReplyErr.FindStringSubmatch(reply)
+	if m == nil {
+		return nil
 	}
+	return fmt.Errorf("bird: %s", strings.TrimSpace(m[1]))
+}
 
-	matches :=
-		birdCommunityRegex.FindAllStringSubmatch(string(buffer[:n]), -1)
+var birdASPathRegex = regexp.MustCompile(`(?m)BGP\.as_path:(.*)$`)
+
+// birdBestRoute cuts reply to show route all down to the first route,
+// the best one, the others can be older paths with older moves.
+func birdBestRoute(reply string) string {
+	lines := strings.Split(reply, "\n")
+	routes := 0
+	for i, line := range lines {
+		// after the code, or the space of the lines after the first
+		// one of a code
+		body := strings.TrimPrefix(line, " ")
+		if len(line) > 5 && line[4] == '-' {
+			body = line[5:]
+		}
+		if strings.HasPrefix(body, "\t") || !birdRouteProtocolRegex.MatchString(body) {
+			continue
+		}
+		if routes++; routes > 1 {
+			return strings.Join(lines[:i], "\n")
+		}
+	}
+	return reply
+}
 
-	o = make([]bgpCommunity, 0)
+// parseBirdRoute picks the communities and the AS path of the best route
+// out of the reply to show route all. Only the attribute lines are
+// looked at, and values that don't fit are left out rather than cut down
+// to size, as they could pass for ours then. bird wraps long sets, the
+// lines after the first of them start with two tabs.
+func parseBirdRoute(reply string) (o []bgpCommunity, lo []bgpLargeCommunity, path []uint32) {
+	o, lo = make([]bgpCommunity, 0), make([]bgpLargeCommunity, 0)
+	reply = birdBestRoute(reply)
+	attr := ""
+	for _, line := range strings.Split(reply, "\n") {
+		if i := strings.Index(line, "BGP.community:"); i >= 0 {
+			attr, line = "community", line[i:]
+		} else if i := strings.Index(line, "BGP.large_community:"); i >= 0 {
+			attr, line = "large_community", line[i:]
+		} else if !strings.HasPrefix(strings.TrimLeft(line, "0123456789- "), "\t\t") {
+			attr = ""
+		}
 
-	for _, v := range matches {
-		if len(v) == 2 {
-			bits := strings.Split(v[1], ",")
-			as, _ := strconv.ParseInt(bits[0], 10, 64)
-			data, _ := strconv.ParseInt(bits[1], 10, 64)
-			o = append(o, bgpCommunity{
-				AS:   uint16(as),
-				Data: uint16(data),
-			})
+		switch attr {
+		case "community":
+			for _, v := range birdCommunityRegex.FindAllStringSubmatch(line, -1) {
+				bits := strings.Split(v[1], ",")
+				as, err1 := strconv.ParseUint(bits[0], 10, 16)
+				data, err2 := strconv.ParseUint(bits[1], 10, 16)
+				if err1 != nil || err2 != nil {
+					continue
+				}
+				o = append(o, bgpCommunity{
+					AS:   uint16(as),
+					Data: uint16(data),
+				})
+			}
+		case "large_community":
+			for _, v := range birdLargeCommunityRegex.FindAllStringSubmatch(line, -1) {
+				global, err1 := strconv.ParseUint(v[1], 10, 32)
+				data1, err2 := strconv.ParseUint(v[2], 10, 32)
+				data2, err3 := strconv.ParseUint(v[3], 10, 32)
+				if err1 != nil || err2 != nil || err3 != nil {
+					continue
+				}
+				lo = append(lo, bgpLargeCommunity{
+					Global: uint32(global),
+					Data1:  uint32(data1),
+					Data2:  uint32(data2),
+				})
+			}
 		}
 	}
 
-	return o
+	if m := birdASPathRegex.FindStringSubmatch(reply); m != nil {
+		path = parseASPath(m[1])
+	}
+	return o, lo, path
+}
+
+// birdReadRoute returns the communities and the AS path of the route
+// to prefix.
+func birdReadRoute(ctx context.Context, prefix string) (o []bgpCommunity, lo []bgpLargeCommunity, path []uint32, proto string, err error) {
+	reply, err := birdCommand(ctx, fmt.Sprintf("show route all %s", prefix))
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	o, lo, path = parseBirdRoute(reply)
+	proto = birdRouteProtocol(reply)
+
+	birdcLog.Debugf("Read %d communities and %d large communities for %s from %s, AS path %v",
+		len(o), len(lo), prefix, proto, path)
+
+	return o, lo, path, proto, nil
 }
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// birdServer is a fake bird on a unix socket. configure loads the
+// config file the game writes and announces the prefixes of its static
+// routes with the communities the config adds to them, show route all
+// then answers with them as if they came back from the BGP session
+// peer1, along with the noise of a real bird: other attributes, other
+// communities and a second route that isn't the best one.
+type birdServer struct {
+	sock, conf string
+	l          net.Listener
+
+	mu     sync.Mutex
+	routes map[string]birdServerRoute
+	// the routes set by learn, which configure leaves alone
+	learned map[string]birdServerRoute
+	// every command in the order they came
+	commands []string
+	conns    []net.Conn
+	// configure check fails with this, if set
+	reject string
+	// the connection is closed instead of answering this command, by
+	// its number, like bird restarting in the middle of it
+	dropAt int
+}
+
+type birdServerRoute struct {
+	communities []bgpCommunity
+	large       []bgpLargeCommunity
+	// the raw attribute lines, if set the communities are ignored
+	attrs string
+}
+
+// newBirdServer starts a fake bird in dir, it reads the config from
+// conf once it's told to configure.
+func newBirdServer(t testing.TB, dir, conf string) *birdServer {
+	s := &birdServer{
+		sock:    filepath.Join(dir, "bird.ctl"),
+		conf:    conf,
+		routes:  make(map[string]birdServerRoute),
+		learned: make(map[string]birdServerRoute),
+	}
+	l, err := net.Listen("unix", s.sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// useBird points the bird flags at a fake bird in dir, with template as
+// -templateFile, and makes a birdRouter the active router. The flags
+// and the router are put back by the returned func.
+func useBird(t testing.TB, dir, template string) (*birdServer, func()) {
+	tp, cp, sp, r := *templatePath, *configPath, *sockPath, *birdRetryTimeout
+	router, ms, poll := activeRouter, matches, pollInterval
+	*templatePath, *configPath = filepath.Join(dir, "conf.orig"), filepath.Join(dir, "bird.conf")
+	if err := ioutil.WriteFile(*templatePath, []byte(template), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := newBirdServer(t, dir, *configPath)
+	*sockPath, *birdRetryTimeout = s.sock, time.Second
+	activeRouter, matches = &birdRouter{}, nil
+	pollInterval = time.Millisecond
+	return s, func() {
+		s.close()
+		*templatePath, *configPath, *sockPath, *birdRetryTimeout = tp, cp, sp, r
+		activeRouter, matches, pollInterval = router, ms, poll
+	}
+}
+
+func (s *birdServer) close() {
+	s.l.Close()
+	s.drop()
+}
+
+// drop closes the connections to bird, like a restart of it
+func (s *birdServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// learn makes bird show a route to prefix with the attribute lines of
+// attrs, as in show route all.
+func (s *birdServer) learn(prefix, attrs string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.learned[prefix] = birdServerRoute{attrs: attrs}
+}
+
+func (s *birdServer) exported(prefix string) (birdServerRoute, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.routes[prefix]
+	return r, ok
+}
+
+func (s *birdServer) sent(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var o []string
+	for _, c := range s.commands {
+		if strings.HasPrefix(c, prefix) {
+			o = append(o, c)
+		}
+	}
+	return o
+}
+
+func (s *birdServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "0001 BIRD 2.0.7 ready.\n")
+	r := bufio.NewReader(conn)
+	for {
+		cmd, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd = strings.TrimSpace(cmd)
+		s.mu.Lock()
+		s.commands = append(s.commands, cmd)
+		drop := len(s.commands) == s.dropAt
+		s.mu.Unlock()
+		if drop {
+			return
+		}
+		fmt.Fprint(conn, s.reply(cmd))
+	}
+}
+
+var birdServerCheck = regexp.MustCompile(`^configure check "(.*)"$`)
+var birdServerExport = regexp.MustCompile(`^show route (?:all )?(\S+) export (\S+)$`)
+
+func (s *birdServer) reply(cmd string) string {
+	switch {
+	case cmd == "show status":
+		return "1000-BIRD 2.0.7\n1011-Router ID is 192.0.2.1\n" +
+			" Current server time is 2020-01-01 12:00:00.000\n0013 Daemon is up and running\n"
+	case birdServerCheck.MatchString(cmd):
+		text, err := ioutil.ReadFile(birdServerCheck.FindStringSubmatch(cmd)[1])
+		s.mu.Lock()
+		reject := s.reject
+		s.mu.Unlock()
+		switch {
+		case err != nil:
+			return fmt.Sprintf("8002 %s: No such file or directory\n", cmd[17:len(cmd)-1])
+		case reject != "":
+			return fmt.Sprintf("9001 %s\n", reject)
+		case strings.Count(string(text), "{") != strings.Count(string(text), "}"):
+			return "9001 syntax error, unexpected END\n"
+		}
+		return "0020 Configuration OK\n"
+	case cmd == "configure" || cmd == "configure soft":
+		text, err := ioutil.ReadFile(s.conf)
+		if err != nil {
+			return "8002 bird.conf: No such file or directory\n"
+		}
+		routes := parseBirdServerConfig(string(text))
+		s.mu.Lock()
+		s.routes = routes
+		s.mu.Unlock()
+		return "0002-Reading configuration from " + s.conf + "\n0003 Reconfigured\n"
+	case strings.HasPrefix(cmd, "show protocols"):
+		return "2002-Name       Proto      Table      State  Since         Info\n" +
+			"1002-device1    Device     ---        up     12:00:00.000\n" +
+			" battleships_static Static     master4    up     12:00:00.000\n" +
+			" peer1      BGP        ---        up     12:00:00.000  Established\n" +
+			" peer2      BGP        ---        start  12:00:00.000  Active        Socket: Connection refused\n" +
+			"0000 \n"
+	case birdServerExport.MatchString(cmd):
+		m := birdServerExport.FindStringSubmatch(cmd)
+		route, ok := s.exported(m[1])
+		if !ok || m[2] != "peer1" {
+			return "8001 Network not found\n"
+		}
+		return birdServerRouteReply(m[1], "battleships_static", route) + "0000 \n"
+	case strings.HasPrefix(cmd, "show route all "):
+		prefix := strings.TrimPrefix(cmd, "show route all ")
+		s.mu.Lock()
+		route, ok := s.learned[prefix]
+		if !ok {
+			route, ok = s.routes[prefix]
+		}
+		s.mu.Unlock()
+		if !ok {
+			return "8001 Network not found\n"
+		}
+		return birdServerRouteReply(prefix, "peer1", route) + "0000 \n"
+	}
+	return "9001 syntax error, unexpected CF_SYM_UNDEFINED\n"
+}
+
+var birdServerNet = regexp.MustCompile(`if net = (\S+) then`)
+var birdServerStatic = regexp.MustCompile(`route (\S+) blackhole;`)
+var birdServerAdd = regexp.MustCompile(`bgp_(large_)?community\.add\(\((\d+),(\d+)(?:,(\d+))?\)\);`)
+
+// parseBirdServerConfig returns the routes of the static protocols of
+// text with the communities added to them, inside if net = ... or for
+// all of them.
+func parseBirdServerConfig(text string) map[string]birdServerRoute {
+	routes := make(map[string]birdServerRoute)
+	var everywhere birdServerRoute
+	for _, m := range birdServerStatic.FindAllStringSubmatch(text, -1) {
+		routes[m[1]] = birdServerRoute{}
+	}
+
+	prefix := ""
+	for _, line := range strings.Split(text, "\n") {
+		if m := birdServerNet.FindStringSubmatch(line); m != nil {
+			prefix = m[1]
+		}
+		for _, m := range birdServerAdd.FindAllStringSubmatch(line, -1) {
+			r := &everywhere
+			in, ok := routes[prefix]
+			if ok {
+				r = &in
+			}
+			var a, b, c uint32
+			fmt.Sscan(m[2], &a)
+			fmt.Sscan(m[3], &b)
+			if m[1] == "" {
+				r.communities = append(r.communities, bgpCommunity{AS: uint16(a), Data: uint16(b)})
+			} else {
+				fmt.Sscan(m[4], &c)
+				r.large = append(r.large, bgpLargeCommunity{Global: a, Data1: b, Data2: c})
+			}
+			if ok {
+				routes[prefix] = in
+			}
+		}
+		if strings.TrimSpace(line) == "}" {
+			prefix = ""
+		}
+	}
+
+	for p, r := range routes {
+		r.communities = append(r.communities, everywhere.communities...)
+		r.large = append(r.large, everywhere.large...)
+		routes[p] = r
+	}
+	return routes
+}
+
+// bird wraps the sets of show route all at about this many characters
+const birdServerWrap = 480
+
+// birdLines puts code before the first of lines, and a space before the
+// others, like bird does for the lines of one code
+func birdLines(code string, lines ...string) string {
+	o := ""
+	for i, l := range lines {
+		if i == 0 {
+			o += code + "-" + l + "\n"
+		} else {
+			o += " " + l + "\n"
+		}
+	}
+	return o
+}
+
+// birdSet is the lines of the attribute name with values, wrapped like
+// bird does
+func birdSet(name string, values []string) []string {
+	o := []string{"\t" + name + ":"}
+	for _, v := range values {
+		if len(o[len(o)-1])+len(v) > birdServerWrap {
+			o = append(o, "\t\t"+v)
+			continue
+		}
+		o[len(o)-1] += " " + v
+	}
+	return o
+}
+
+// birdServerRouteReply is how bird 2 shows route all, a route from
+// proto and an older one from peer2 behind it
+func birdServerRouteReply(prefix, proto string, r birdServerRoute) string {
+	attrs := strings.Split(strings.TrimSuffix(r.attrs, "\n"), "\n")
+	if r.attrs == "" {
+		communities := []string{"(65535,65281)"}
+		for _, c := range r.communities {
+			communities = append(communities, fmt.Sprintf("(%d,%d)", c.AS, c.Data))
+		}
+		large := []string{}
+		for _, c := range r.large {
+			large = append(large, fmt.Sprintf("(%d, %d, %d)", c.Global, c.Data1, c.Data2))
+		}
+		large = append(large, "(64496, 1, 1)")
+
+		attrs = []string{"\tBGP.origin: IGP", "\tBGP.as_path: 65001", "\tBGP.next_hop: 192.0.2.2",
+			"\tBGP.local_pref: 100"}
+		attrs = append(attrs, birdSet("BGP.community", communities)...)
+		attrs = append(attrs, "\tBGP.ext_community: (rt, 65001, 100)")
+		attrs = append(attrs, birdSet("BGP.large_community", large)...)
+	}
+	return birdLines("1007", "Table master4:",
+		fmt.Sprintf("%-20s unicast [%s 12:00:00.000 from 192.0.2.2] * (100) [AS65001i]", prefix, proto),
+		"\tvia 192.0.2.2 on eth0") +
+		birdLines("1008", "\tType: BGP univ") +
+		birdLines("1012", attrs...) +
+		birdLines("1007", "                     unicast [peer2 11:00:00.000 from 198.51.100.2] (100) [AS64496 65001i]",
+			"\tvia 198.51.100.2 on eth1") +
+		birdLines("1008", "\tType: BGP univ") +
+		birdLines("1012", "\tBGP.origin: IGP", "\tBGP.as_path: 64496 65001",
+			"\tBGP.community: (65000,1) (65000,2)")
+}
+
+// birdTestTemplate puts the communities of every game on its prefix
+const birdTestTemplate = "{{template \"static\" .}}\n{{template \"filter\" .}}\n" +
+	"protocol bgp peer1 {\n\tlocal as 65000;\n\tneighbor 192.0.2.2 as 65001;\n" +
+	"\tipv4 { export filter battleships_export; };\n}\n"
+
+func TestBirdStaticTemplate(t *testing.T) {
+	for _, c := range []struct {
+		prefixes []string
+		want     string
+	}{
+		{[]string{"10.0.0.0/24"},
+			"protocol static battleships_static {\n\tipv4;\n\troute 10.0.0.0/24 blackhole;\n}"},
+		{[]string{"2001:db8::/48"},
+			"protocol static battleships_static6 {\n\tipv6;\n\troute 2001:db8::/48 blackhole;\n}"},
+		{[]string{"2001:db8::/48", "10.0.0.0/24"},
+			"protocol static battleships_static {\n\tipv4;\n\troute 10.0.0.0/24 blackhole;\n}\n\n" +
+				"protocol static battleships_static6 {\n\tipv6;\n\troute 2001:db8::/48 blackhole;\n}"},
+		{nil, "protocol static battleships_static {\n\tipv4;\n}"},
+	} {
+		data := birdTemplateData{BirdVersion: 2, Prefixes: c.prefixes, Statics: birdStatics(c.prefixes)}
+		out, err := renderBirdTemplate("test", `{{template "static" .}}`, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != c.want {
+			t.Errorf("static of %v:\n%s\nwant:\n%s", c.prefixes, out, c.want)
+		}
+	}
+}
+
+func TestBirdReadCommunities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "battleships")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, done := useBird(t, dir, birdTestTemplate)
+	defer done()
+
+	// every community that could pass for one of ours, and some that
+	// are too big to be
+	s.learn("10.0.1.0/24", "\tBGP.origin: IGP\n\tBGP.as_path: 64496 65001\n"+
+		"\tBGP.community: (65000,1) (70000,1)\n"+
+		"\t\t(65000,65535)\n"+
+		"\tBGP.large_community: (65000, 36, 5) (65000,37,4294967295)\n"+
+		"\t\t(65000, 38, 4294967296)\n"+
+		"\tBGP.ext_community: (rt, 65000, 3)\n"+
+		"\t\t(ro, 65000, 4)\n")
+
+	communities, large, err := readCommunities("10.0.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []bgpCommunity{{65000, 1}, {65000, 65535}}
+	if !reflect.DeepEqual(communities, want) {
+		t.Errorf("communities = %v, want %v", communities, want)
+	}
+	wantLarge := []bgpLargeCommunity{{65000, 36, 5}, {65000, 37, 4294967295}}
+	if !reflect.DeepEqual(large, wantLarge) {
+		t.Errorf("large communities = %v, want %v", large, wantLarge)
+	}
+
+	r := activeRouter.(*birdRouter)
+	if path, _ := r.path("10.0.1.0/24"); !reflect.DeepEqual(path, []uint32{64496, 65001}) {
+		t.Errorf("AS path = %v", path)
+	}
+	if session, err := r.sessionOf("10.0.1.0/24"); err != nil || session != "peer1" {
+		t.Errorf("session = %s %v", session, err)
+	}
+
+	// bird went away and came back
+	s.drop()
+	if _, _, err := readCommunities("10.0.1.0/24"); err != nil {
+		t.Errorf("read after bird restarted = %v", err)
+	}
+	communities, large, err = readCommunities("10.0.9.0/24")
+	if err != nil || len(communities)+len(large) != 0 {
+		t.Errorf("read of an unknown prefix = %v %v %v", communities, large, err)
+	}
+}
+
+func TestBirdWriteMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "battleships")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, done := useBird(t, dir, birdTestTemplate)
+	defer done()
+
+	a := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	b := newMatch(65001, "10.0.2.0/24", "10.0.3.0/24")
+	for _, m := range []*match{a, b} {
+		if err := addMatch(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.writeMove(bgpMessage{Counter: 3, X: 4, Y: 5, HitOrMissOnLast: resultHit}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.writeMove(bgpMessage{Counter: 8, X: 1, Y: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range []*match{a, b} {
+		r, ok := s.exported(m.Prefix)
+		if !ok {
+			t.Fatalf("%s is not announced", m.Prefix)
+		}
+		if !reflect.DeepEqual(r.communities, m.communities) || len(r.large) != len(m.large) {
+			t.Errorf("%s is announced with %v %v, want %v %v", m.Prefix,
+				r.communities, r.large, m.communities, m.large)
+		}
+	}
+	if checks, reloads := len(s.sent("configure check")), len(s.sent("configure")); checks != 2 || reloads != 4 {
+		t.Errorf("%d configure checks and %d configures for 2 moves", checks, reloads)
+	}
+
+	// a config bird doesn't take is left out
+	before, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	s.reject = "bird.conf:3:1 syntax error"
+	s.mu.Unlock()
+	err = a.writeMove(bgpMessage{Counter: 5, X: 6, Y: 7})
+	if err == nil || !strings.Contains(err.Error(), "New config rejected") {
+		t.Errorf("write of a rejected config = %v", err)
+	}
+	after, _ := ioutil.ReadFile(*configPath)
+	if string(after) != string(before) {
+		t.Errorf("the rejected config was put in place")
+	}
+	s.mu.Lock()
+	s.reject = ""
+	s.mu.Unlock()
+
+	if err := resetBird(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*match{a, b} {
+		if r, ok := s.exported(m.Prefix); ok && len(r.communities)+len(r.large) > 0 {
+			t.Errorf("%s is still announced with %v %v after reset", m.Prefix, r.communities, r.large)
+		}
+	}
+}
+
+func TestBirdMoveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "battleships")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, done := useBird(t, dir, birdTestTemplate)
+	defer done()
+
+	// both sides play on the one bird, each reads the route of the
+	// other as it comes back from peer1
+	ma := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	mb := newMatch(65000, "10.0.1.0/24", "10.0.0.0/24")
+	for _, m := range []*match{ma, mb} {
+		if err := addMatch(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := newLoopbackGame(t, ma, true, true, true)
+	b := newLoopbackGame(t, mb, false, true, true)
+
+	// a few moves in bird restarts while reading a route
+	s.mu.Lock()
+	s.dropAt = len(s.commands) + 20
+	s.mu.Unlock()
+	playOut(t, a, b)
+	checkGame(t, a, b)
+}
+
+// BenchmarkBirdMove is the whole path of a move through bird, but for
+// bird itself: encode, render the config, install it and reconfigure,
+// then read the route back and decode it.
+func BenchmarkBirdMove(b *testing.B) {
+	dir, err := ioutil.TempDir("", "battleships")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, done := useBird(b, dir, "protocol static { route 10.0.0.0/24 blackhole; }\n"+
+		"filter battleships_export {\n\t{{template \"communities\" .}}\n\taccept;\n}\n")
+	defer done()
+
+	m := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	matches = []*match{m}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := m.writeMove(bgpMessage{Counter: i, X: i % 10, Y: i / 10 % 10}); err != nil {
+			b.Fatal(err)
+		}
+		communities, large, err := activeRouter.read(context.Background(), m.Prefix)
+		if err != nil {
+			b.Fatal(err)
+		}
+		msg, err := decodeMessage(m.ASN, communities, large)
+		if err != nil || msg.Counter != i%counterMod {
+			b.Fatalf("read back %v %v", msg, err)
+		}
+	}
+}
+
+func TestBirdLint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "battleships")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, done := useBird(t, dir, "")
+	defer done()
+	if err := os.Remove(*templatePath); err != nil {
+		t.Fatal(err)
+	}
+	m := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	r := &birdRouter{}
+	ctx := context.Background()
+
+	if err := r.lint(ctx, []*match{m}); err == nil || !strings.Contains(err.Error(), "No bird template") {
+		t.Errorf("lint without a template = %v", err)
+	}
+
+	if err := ioutil.WriteFile(*templatePath, []byte("protocol static { route 10.0.0.0/24 blackhole; }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.lint(ctx, []*match{m}); err == nil || !strings.Contains(err.Error(), "marker") {
+		t.Errorf("lint without a marker = %v", err)
+	}
+
+	if err := ioutil.WriteFile(*templatePath, []byte(birdTestTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.lint(ctx, []*match{m}); err != nil || !r.checkExport {
+		t.Errorf("lint = %v, checkExport %v", err, r.checkExport)
+	}
+	if err := r.write(ctx, []*match{m}); err != nil || r.checkExport {
+		t.Errorf("first write = %v, checkExport %v", err, r.checkExport)
+	}
+
+	lintExportWait = time.Millisecond
+	other := newMatch(65000, "10.0.2.0/24", "10.0.1.0/24")
+	if err := lintBirdExport(ctx, []*match{other}); err == nil || !strings.Contains(err.Error(), "peer1") {
+		t.Errorf("lintBirdExport of a prefix that isn't exported = %v", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var softReconfigure = flag.Bool("softReconfigure", false,
+	"Reload bird with configure soft, only if your setup picks up "+
+		"filter changes without a full reconfigure")
+
+// writeTempFile writes data next to path, so that it can be renamed
+// over it, and returns the name of the file.
+func writeTempFile(path string, data []byte, perm os.FileMode) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// writeFileAtomic replaces path with data, so that bird never sees a
+// half written config.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := writeTempFile(path, data, perm)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func birdReconfigureCommand() string {
+	if *softReconfigure {
+		return "configure soft"
+	}
+	return "configure"
+}
+
+func birdReconfigure(ctx context.Context) error {
+	reply, err := birdCommand(ctx, birdReconfigureCommand())
+	if err != nil {
+		return err
+	}
+	return birdReplyError(reply)
+}
+
+// installBirdConfig has bird check config before putting it in place
+// of -confFile and reloading, if bird then fails to load it the
+// previous config is put back.
+func installBirdConfig(ctx context.Context, config []byte) error {
+	old, oldErr := ioutil.ReadFile(*configPath)
+	if *dryRun {
+		fmt.Print(unifiedDiff(*configPath, string(old), string(config)))
+		dryRunCommand("birdc", "configure check \"<the new config>\"")
+		dryRunCommand("birdc", birdReconfigureCommand())
+		return nil
+	}
+
+	tmp, err := writeTempFile(*configPath, config, 0640)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	reply, err := birdCommand(ctx, fmt.Sprintf("configure check \"%s\"", tmp))
+	if err != nil {
+		return err
+	}
+	if err := birdReplyError(reply); err != nil {
+		return fmt.Errorf("New config rejected, %s", err.Error())
+	}
+
+	if err := os.Rename(tmp, *configPath); err != nil {
+		return err
+	}
+
+	err = birdReconfigure(ctx)
+	if err == nil {
+		return nil
+	}
+	if oldErr != nil {
+		// nothing to go back to
+		return err
+	}
+	return restoreBirdConfig(ctx, *configPath, old, err)
+}
+
+// restoreBirdConfig puts old back in path after bird failed to load
+// what replaced it with err, and reloads bird again.
+func restoreBirdConfig(ctx context.Context, path string, old []byte, err error) error {
+	birdcLog.Errorf("Bird failed to load the new config, restoring the old one: %s",
+		err.Error())
+	if rerr := writeFileAtomic(path, old, 0640); rerr != nil {
+		birdcLog.Errorf("Unable to restore the old config %s", rerr.Error())
+		return err
+	}
+	if rerr := birdReconfigure(ctx); rerr != nil {
+		birdcLog.Errorf("Bird failed to load the old config too %s", rerr.Error())
+	}
+	return err
+}
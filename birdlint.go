@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var lintSetup = flag.Bool("lint", true,
+	"Check the router setup before the first move, for bird the template and that "+
+		"the game prefix gets exported to the other side")
+
+/*
+A bird setup that can't play makes for a game that never starts, with
+nothing saying why. Before the first move the template is looked at:
+
+- -templateFile is there and parses
+- it has the ###COMMUNITY### marker, or {{template "communities" .}} or
+  {{template "filter" .}} which put the communities in
+- bird takes the config rendered from it, by configure check
+
+Once bird runs the config of the first move, the game prefix has to be
+exported over the BGP session of -peerSession, or any one that is up.
+With -staticFile the template isn't used, only the export is checked.
+-lint=false skips all of it, for setups that get there some other way.
+*/
+
+// linter is a router that can tell if it's set up to play before the
+// first move.
+type linter interface {
+	lint(ctx context.Context, ms []*match) error
+}
+
+// lintRouter checks the setup of the router for the games in ms.
+func lintRouter(ms []*match) error {
+	l, ok := activeRouter.(linter)
+	if !*lintSetup || !ok {
+		return nil
+	}
+	return l.lint(routerCtx, ms)
+}
+
+func (r *splitRouter) lint(ctx context.Context, ms []*match) error {
+	if l, ok := r.tx.(linter); ok {
+		return l.lint(ctx, ms)
+	}
+	return nil
+}
+
+func (r *bmpRouter) lint(ctx context.Context, ms []*match) error {
+	if l, ok := r.tx.(linter); ok {
+		return l.lint(ctx, ms)
+	}
+	return nil
+}
+
+// bird gets lintExportTries looks, lintExportWait apart, to export the
+// game prefix after the first move
+const lintExportTries = 5
+
+var lintExportWait = time.Second
+
+// the template has one of these if it adds the communities
+var birdCommunityMarkers = []string{"###COMMUNITY###", `template "communities"`, `template "filter"`}
+
+func (r *birdRouter) lint(ctx context.Context, ms []*match) error {
+	if *birdStaticFile == "" {
+		if err := lintBirdTemplate(ctx, ms); err != nil {
+			return err
+		}
+	}
+	r.checkExport = !*dryRun
+	return nil
+}
+
+func lintBirdTemplate(ctx context.Context, ms []*match) error {
+	text, err := ioutil.ReadFile(*templatePath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("No bird template %s, see -templateFile, init-bird writes one",
+			*templatePath)
+	}
+	if err != nil {
+		return err
+	}
+
+	marked := false
+	for _, marker := range birdCommunityMarkers {
+		marked = marked || strings.Contains(string(text), marker)
+	}
+	if !marked {
+		return fmt.Errorf("%s has no ###COMMUNITY### marker or {{template \"communities\" .}}, "+
+			"the moves would never be announced", *templatePath)
+	}
+
+	config, err := renderBirdConfig(ms)
+	if err != nil {
+		return fmt.Errorf("Unable to render %s: %s", *templatePath, err.Error())
+	}
+	for _, m := range ms {
+		if m.Prefix != "" && !strings.Contains(string(config), m.Prefix) {
+			birdcLog.Warnf("Nothing in %s mentions %s, the game prefix has to come from "+
+				"somewhere else, {{template \"static\" .}} originates it", *templatePath, m.Prefix)
+		}
+	}
+
+	tmp, err := writeTempFile(*configPath, config, 0640)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	reply, err := birdCommand(ctx, fmt.Sprintf("configure check \"%s\"", tmp))
+	if err != nil {
+		return err
+	}
+	if err := birdReplyError(reply); err != nil {
+		return fmt.Errorf("bird rejects the config rendered from %s, %s (-dry-run shows it)",
+			*templatePath, err.Error())
+	}
+	return nil
+}
+
+// parseBirdBGPProtocols returns the established BGP protocols in the
+// reply to show protocols.
+func parseBirdBGPProtocols(reply string) []string {
+	var o []string
+	for _, line := range strings.Split(reply, "\n") {
+		if len(line) > 5 && line[4] == '-' {
+			line = line[5:]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != "BGP" {
+			continue
+		}
+		if fields[3] == "up" && strings.Contains(line, "Established") {
+			o = append(o, fields[0])
+		}
+	}
+	return o
+}
+
+// lintBirdExport makes sure bird exports the prefixes of ms to the
+// other side, once it runs the config of the first move.
+func lintBirdExport(ctx context.Context, ms []*match) error {
+	protos := []string{*peerSession}
+	if *peerSession == "" {
+		reply, err := birdCommand(ctx, "show protocols")
+		if err != nil {
+			return err
+		}
+		if protos = parseBirdBGPProtocols(reply); len(protos) == 0 {
+			birdcLog.Warnf("No BGP session of bird is up, unable to tell if the game prefix is exported")
+			return nil
+		}
+	}
+
+	for _, m := range ms {
+		if m.Prefix == "" {
+			continue
+		}
+		exported := false
+		for try := 0; !exported && try < lintExportTries; try++ {
+			if try > 0 {
+				select {
+				case <-time.After(lintExportWait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			for _, p := range protos {
+				reply, err := birdCommand(ctx, fmt.Sprintf("show route %s export %s", m.Prefix, p))
+				if err != nil {
+					return err
+				}
+				if birdReplyError(reply) == nil && strings.Contains(reply, m.Prefix) {
+					exported = true
+					break
+				}
+			}
+		}
+		if !exported {
+			return fmt.Errorf("bird doesn't export %s to %s, check the export filter of the "+
+				"session to the other side", m.Prefix, strings.Join(protos, ", "))
+		}
+	}
+	birdcLog.Infof("bird exports the game prefix to %s", strings.Join(protos, ", "))
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"net"
+	"sync"
+	"time"
+)
+
+var birdKeepalive = flag.Duration("birdKeepalive", 30*time.Second,
+	"How often the connection to the bird control socket is checked "+
+		"while idle, 0 to never")
+
+// birdSocket is the connection to the bird control socket, it's kept
+// open between commands, which take turns on it. It's dialed again once
+// it fails or -sockFile changes.
+type birdSocket struct {
+	mu       sync.Mutex
+	path     string
+	conn     net.Conn
+	r        *bufio.Reader
+	lastUsed time.Time
+}
+
+var birdSock = &birdSocket{}
+
+// birdCommand runs cmd on the bird control socket, retrying if bird
+// can't be reached, and returns its reply.
+func birdCommand(ctx context.Context, cmd string) (string, error) {
+	return birdSock.command(ctx, cmd)
+}
+
+func (s *birdSocket) command(ctx context.Context, cmd string) (reply string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = birdRetry(ctx, cmd, func() error {
+		reply, err = s.exchange(ctx, cmd)
+		if err != nil {
+			// whatever is left of the reply would be read as the
+			// reply of the next command
+			s.closeLocked()
+		}
+		return err
+	})
+	return reply, err
+}
+
+// exchange sends cmd and reads the reply, s has to be locked.
+func (s *birdSocket) exchange(ctx context.Context, cmd string) (string, error) {
+	if s.conn == nil || s.path != *sockPath {
+		if err := s.dial(ctx); err != nil {
+			return "", err
+		}
+	}
+	conn := s.conn
+	defer watchContext(ctx, func() { conn.Close() })()
+
+	conn.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(*readTimeout))
+	reply, err := readBirdReply(s.r)
+	if err == nil {
+		s.lastUsed = time.Now()
+	}
+	return reply, err
+}
+
+func (s *birdSocket) dial(ctx context.Context) error {
+	s.closeLocked()
+
+	conn, err := dialControl(ctx, *sockPath)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+
+	// the greeting
+	conn.SetReadDeadline(time.Now().Add(*readTimeout))
+	if _, err := readBirdReply(r); err != nil {
+		conn.Close()
+		return err
+	}
+	birdcLog.Debugf("Connected to bird on %s", *sockPath)
+	s.path, s.conn, s.r = *sockPath, conn, r
+	return nil
+}
+
+func (s *birdSocket) closeLocked() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.r = nil, nil
+	}
+}
+
+// keepalive asks bird for its status whenever the connection was idle
+// for every, so a bird that went away is dialed again before the next
+// move rather than during it. The connection is closed once ctx is done.
+func (s *birdSocket) keepalive(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.closeLocked()
+			s.mu.Unlock()
+			return
+		case <-t.C:
+		}
+
+		s.mu.Lock()
+		if time.Since(s.lastUsed) >= every {
+			pingCtx, cancel := context.WithTimeout(ctx, *readTimeout)
+			if _, err := s.exchange(pingCtx, "show status"); err != nil {
+				birdcLog.Debugf("bird control socket is down: %s", err.Error())
+				s.closeLocked()
+			}
+			cancel()
+		}
+		s.mu.Unlock()
+	}
+}
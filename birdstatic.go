@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+var birdStaticFile = flag.String("staticFile", "",
+	"Only rewrite this file, a static protocol with the game routes and "+
+		"their communities included from bird.conf, instead of the whole "+
+		"-confFile. bird 2 only")
+
+/*
+On a router that carries real traffic rewriting the whole config on
+every move is a bit much. With -staticFile only a file holding the
+static protocol of the game prefixes is rewritten, the communities are
+set on the static routes themselves:
+
+protocol static battleships_static {
+	ipv4;
+	route 10.1.0.0/24 blackhole {
+		bgp_community.add((23456,16385));
+	};
+}
+
+bird.conf has to include it once and export it to the peer, the rest
+of the config is left alone:
+
+include "/etc/bird/battleships.conf";
+
+protocol bgp battleships_peer {
+	...
+	ipv4 {
+		export where proto = "battleships_static";
+	};
+}
+
+bird still reads its whole config on configure, but only the static
+protocol changes so nothing else is restarted. -softReconfigure works
+too.
+*/
+
+// birdStaticProtocols renders the static protocols of the prefixes of
+// ms, one per address family.
+func birdStaticProtocols(ms []*match) (string, error) {
+	if *birdVersion < 2 {
+		return "", fmt.Errorf("-staticFile needs bird 2, bird 1 static routes can't carry communities")
+	}
+
+	data := birdTemplateFor(ms)
+	routes := map[string][]string{}
+	for _, prefix := range data.Prefixes {
+		family, err := prefixFamily(prefix)
+		if err != nil {
+			return "", err
+		}
+
+		var attrs strings.Builder
+		for _, g := range data.Games {
+			if g.Prefix != prefix {
+				continue
+			}
+			for _, c := range g.Communities {
+				fmt.Fprintf(&attrs, "\t\tbgp_community.add((%d,%d));\n", c.AS, c.Data)
+			}
+			for _, c := range g.LargeCommunities {
+				fmt.Fprintf(&attrs, "\t\tbgp_large_community.add((%d,%d,%d));\n",
+					c.Global, c.Data1, c.Data2)
+			}
+		}
+		route := fmt.Sprintf("\troute %s blackhole;\n", prefix)
+		if attrs.Len() > 0 {
+			route = fmt.Sprintf("\troute %s blackhole {\n%s\t};\n", prefix, attrs.String())
+		}
+		routes[family] = append(routes[family], route)
+	}
+
+	o := "# Written by bgp-battleships on every move, see -staticFile\n"
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if len(routes[family]) == 0 {
+			continue
+		}
+		name := "battleships_static"
+		if family == "ipv6" {
+			name += "6"
+		}
+		o += fmt.Sprintf("\nprotocol static %s {\n\t%s;\n%s}\n",
+			name, family, strings.Join(routes[family], ""))
+	}
+	return o, nil
+}
+
+// installBirdStatic rewrites -staticFile, has bird check its whole
+// config with it and reloads. The old file is put back if bird doesn't
+// take the new one.
+func installBirdStatic(ctx context.Context, ms []*match) error {
+	config, err := birdStaticProtocols(ms)
+	if err != nil {
+		return err
+	}
+
+	old, oldErr := ioutil.ReadFile(*birdStaticFile)
+	if *dryRun {
+		fmt.Print(unifiedDiff(*birdStaticFile, string(old), config))
+		dryRunCommand("birdc", "configure check")
+		dryRunCommand("birdc", birdReconfigureCommand())
+		return nil
+	}
+
+	if err := writeFileAtomic(*birdStaticFile, []byte(config), 0640); err != nil {
+		return err
+	}
+
+	// the file is in place already, so a check of the current config
+	// is a check of the new one
+	reply, err := birdCommand(ctx, "configure check")
+	if err == nil {
+		err = birdReplyError(reply)
+		if err != nil {
+			err = fmt.Errorf("New config rejected, %s", err.Error())
+		}
+	}
+	if err == nil {
+		err = birdReconfigure(ctx)
+	}
+	if err == nil || oldErr != nil {
+		return err
+	}
+	return restoreBirdConfig(ctx, *birdStaticFile, old, err)
+}
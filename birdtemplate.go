@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var ourPrefix = flag.String("prefix", "",
+	"The prefix we announce, for the static and filter templates")
+
+var birdVersion = flag.Int("birdVersion", 2,
+	"Major version of bird, the generated static protocol differs")
+
+/*
+The template file is a text/template rendered with birdTemplateData,
+on top of the fields these templates can be used in it:
+
+{{template "communities" .}}   bgp_community.add() of everything we announce
+{{template "static" .}}        a static protocol originating the prefixes,
+                               one per address family
+{{template "filter" .}}        an export filter for the prefixes, each with
+                               the communities of its games
+
+Every game has its own entry in .Games, with the same fields as the
+top level ones. "communities" can be used on them too.
+
+The ###COMMUNITY### marker of older templates is still replaced with
+the communities.
+*/
+
+type birdTemplateData struct {
+	CommunityASN int
+	Prefix       string
+	PeerPrefix   string
+	BirdVersion  int
+
+	Communities      []bgpCommunity
+	LargeCommunities []bgpLargeCommunity
+
+	Games    []birdTemplateData
+	Prefixes []string
+	// the prefixes by address family, for the static template
+	Statics []birdStatic
+}
+
+// birdStatic is a static protocol of the prefixes of one address
+// family, named as in birdStaticProtocols.
+type birdStatic struct {
+	Name     string
+	Family   string
+	Prefixes []string
+}
+
+// prefixFamily is the bird channel of prefix, ipv4 or ipv6
+func prefixFamily(prefix string) (string, error) {
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return "", fmt.Errorf("Invalid game prefix %s", prefix)
+	}
+	if ip.To4() == nil {
+		return "ipv6", nil
+	}
+	return "ipv4", nil
+}
+
+// birdStatics groups prefixes by address family, there's always one
+// for ipv4 even without any prefix. Prefixes that don't parse are left
+// to bird to complain about, in the ipv4 one.
+func birdStatics(prefixes []string) []birdStatic {
+	o := []birdStatic{{Name: "battleships_static", Family: "ipv4"}}
+	for _, prefix := range prefixes {
+		if family, _ := prefixFamily(prefix); family == "ipv6" {
+			if len(o) == 1 {
+				o = append(o, birdStatic{Name: "battleships_static6", Family: "ipv6"})
+			}
+			o[1].Prefixes = append(o[1].Prefixes, prefix)
+			continue
+		}
+		o[0].Prefixes = append(o[0].Prefixes, prefix)
+	}
+	if len(o) == 2 && len(o[0].Prefixes) == 0 {
+		o = o[1:]
+	}
+	return o
+}
+
+const birdTemplates = `
+{{- define "communities" -}}
+{{range .Communities}}bgp_community.add(({{.AS}},{{.Data}}));
+{{end}}{{range .LargeCommunities}}bgp_large_community.add(({{.Global}},{{.Data1}},{{.Data2}}));
+{{end}}
+{{- end -}}
+
+{{- define "static" -}}
+{{- range $i, $s := .Statics}}
+{{- if $i}}
+
+{{end -}}
+protocol static {{$s.Name}} {
+{{- if ge $.BirdVersion 2}}
+	{{$s.Family}};
+{{- end}}
+{{- range $s.Prefixes}}
+	route {{.}} blackhole;
+{{- end}}
+}
+{{- end}}
+{{- end -}}
+
+{{- define "filter" -}}
+filter battleships_export {
+{{- range .Games}}
+	if net = {{.Prefix}} then {
+		{{template "communities" .}}
+	}
+{{- end}}
+{{- range .Prefixes}}
+	if net = {{.}} then accept;
+{{- end}}
+	reject;
+}
+{{- end -}}
+`
+
+// birdTemplateFor fills the template data from the flags and the
+// games in ms.
+func birdTemplateFor(ms []*match) birdTemplateData {
+	data := birdTemplateData{
+		CommunityASN: *communityAS,
+		Prefix:       *ourPrefix,
+		PeerPrefix:   *monitoredPrefix,
+		BirdVersion:  *birdVersion,
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range ms {
+		data.Communities = append(data.Communities, m.communities...)
+		data.LargeCommunities = append(data.LargeCommunities, m.large...)
+		data.Games = append(data.Games, birdTemplateData{
+			CommunityASN:     m.ASN,
+			Prefix:           m.Prefix,
+			PeerPrefix:       m.PeerPrefix,
+			BirdVersion:      *birdVersion,
+			Communities:      m.communities,
+			LargeCommunities: m.large,
+		})
+		if m.Prefix != "" && !seen[m.Prefix] {
+			seen[m.Prefix] = true
+			data.Prefixes = append(data.Prefixes, m.Prefix)
+		}
+	}
+	if len(data.Prefixes) == 0 && *ourPrefix != "" {
+		data.Prefixes = []string{*ourPrefix}
+	}
+	data.Statics = birdStatics(data.Prefixes)
+	return data
+}
+
+// the definitions above are parsed once, every template gets a copy
+var birdDefs = template.Must(template.New("defs").Parse(birdTemplates))
+
+// birdTemplateCache is -templateFile parsed, it's parsed again only
+// once the file changes.
+var birdTemplateCache struct {
+	mu   sync.Mutex
+	path string
+	mod  time.Time
+	size int64
+	t    *template.Template
+}
+
+func cachedBirdTemplate(path string) (*template.Template, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &birdTemplateCache
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.t != nil && c.path == path && c.mod.Equal(fi.ModTime()) && c.size == fi.Size() {
+		return c.t, nil
+	}
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parseBirdTemplate(path, string(text))
+	if err != nil {
+		return nil, err
+	}
+	c.path, c.mod, c.size, c.t = path, fi.ModTime(), fi.Size(), t
+	return t, nil
+}
+
+func renderBirdConfig(ms []*match) ([]byte, error) {
+	t, err := cachedBirdTemplate(*templatePath)
+	if err != nil {
+		return nil, err
+	}
+	return executeBirdTemplate(t, birdTemplateFor(ms))
+}
+
+func parseBirdTemplate(name, text string) (*template.Template, error) {
+	t, err := birdDefs.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return t.New(name).Parse(text)
+}
+
+func renderBirdTemplate(name, text string, data birdTemplateData) ([]byte, error) {
+	t, err := parseBirdTemplate(name, text)
+	if err != nil {
+		return nil, err
+	}
+	return executeBirdTemplate(t, data)
+}
+
+func executeBirdTemplate(t *template.Template, data birdTemplateData) ([]byte, error) {
+	var out, marker bytes.Buffer
+	if err := t.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	if err := t.ExecuteTemplate(&marker, "communities", data); err != nil {
+		return nil, err
+	}
+
+	replacement := ""
+	if marker.Len() > 0 {
+		replacement = "\n" + marker.String()
+	}
+	return []byte(strings.Replace(out.String(),
+		"###COMMUNITY###", replacement, 1)), nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var bmpListen = flag.String("bmpListen", "",
+	"Receive the routes from the router over BMP on this address, like :11019, "+
+		"instead of asking it for them")
+
+/*
+With -bmpListen the router sends us every UPDATE it gets over BMP
+(RFC 7854), so moves are read from there instead of polling the router,
+with the time the router got them. Announcing still goes through the
+backend. For bird 2:
+
+protocol bmp {
+	station address ip 192.0.2.10 port 11019;
+	monitoring rib in pre_policy;
+}
+*/
+
+const (
+	bmpRouteMonitoring = 0
+	bmpPeerDown        = 2
+	bmpTermination     = 5
+)
+
+const (
+	bgpAttrASPath         = 2
+	bgpAttrCommunities    = 8
+	bgpAttrMPReach        = 14
+	bgpAttrMPUnreach      = 15
+	bgpAttrLargeCommunity = 32
+)
+
+var errBMPVersion = fmt.Errorf("Unsupported BMP version")
+var errBMPShort = fmt.Errorf("BMP message too short")
+
+type bmpRoute struct {
+	communities []bgpCommunity
+	large       []bgpLargeCommunity
+	path        []uint32
+	peer        string
+	at          time.Time
+}
+
+// bmpUpdate is what a route monitoring message tells
+type bmpUpdate struct {
+	peer      string
+	at        time.Time
+	announced []string
+	withdrawn []string
+	route     bmpRoute
+}
+
+// bmpRouter reads the routes from BMP and announces through tx.
+type bmpRouter struct {
+	tx router
+
+	mu     sync.Mutex
+	routes map[string]bmpRoute
+	// the peer every prefix was last heard from, and the peers that
+	// went down, see session.go
+	peers map[string]string
+	down  map[string]bool
+}
+
+func newBMPRouter(tx router, addr string) (*bmpRouter, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newBMPRoutes(tx)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				bmpLog.Errorf("Unable to accept BMP connection %s", err.Error())
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	bmpLog.Infof("Waiting for BMP on %s", addr)
+	return r, nil
+}
+
+func newBMPRoutes(tx router) *bmpRouter {
+	return &bmpRouter{tx: tx, routes: make(map[string]bmpRoute),
+		peers: make(map[string]string), down: make(map[string]bool)}
+}
+
+func (r *bmpRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route, ok := r.routes[prefix]
+	if !ok {
+		return nil, nil, fmt.Errorf("No route to %s over BMP", prefix)
+	}
+	return route.communities, route.large, nil
+}
+
+func (r *bmpRouter) path(prefix string) ([]uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	route, ok := r.routes[prefix]
+	return route.path, ok
+}
+
+func (r *bmpRouter) write(ctx context.Context, ms []*match) error {
+	return r.tx.write(ctx, ms)
+}
+
+func (r *bmpRouter) flow(ctx context.Context, rule flowRule, announce bool) error {
+	fr, ok := r.tx.(flowRouter)
+	if !ok {
+		return errNoFlowSpec
+	}
+	return fr.flow(ctx, rule, announce)
+}
+
+func (r *bmpRouter) serve(conn net.Conn) {
+	defer conn.Close()
+	bmpLog.Infof("BMP connection from %s", conn.RemoteAddr())
+
+	for {
+		t, body, err := readBMPMessage(conn)
+		if err != nil {
+			bmpLog.Errorf("BMP connection from %s failed: %s", conn.RemoteAddr(), err.Error())
+			return
+		}
+
+		switch t {
+		case bmpRouteMonitoring:
+			u, err := parseBMPRouteMonitoring(body)
+			if err != nil {
+				bmpLog.Warnf("Bad route monitoring message: %s", err.Error())
+				continue
+			}
+			r.update(u)
+		case bmpPeerDown:
+			peer, _, err := parseBMPPeerHeader(body)
+			if err != nil {
+				continue
+			}
+			r.peerDown(peer)
+		case bmpTermination:
+			bmpLog.Infof("BMP session from %s terminated", conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+func (r *bmpRouter) update(u bmpUpdate) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, prefix := range u.withdrawn {
+		if route, ok := r.routes[prefix]; ok && route.peer == u.peer {
+			delete(r.routes, prefix)
+		}
+	}
+	for _, prefix := range u.announced {
+		bmpLog.Debugf("Route to %s from %s at %s with communities %v %v", prefix,
+			u.peer, u.at.Format(time.RFC3339Nano), u.route.communities, u.route.large)
+		r.routes[prefix] = u.route
+		r.peers[prefix] = u.peer
+	}
+	delete(r.down, u.peer)
+}
+
+func (r *bmpRouter) peerDown(peer string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	bmpLog.Infof("Peer %s went down", peer)
+	r.down[peer] = true
+	for prefix, route := range r.routes {
+		if route.peer == peer {
+			delete(r.routes, prefix)
+		}
+	}
+}
+
+// readBMPMessage reads a whole message, it returns its type and what
+// comes after the common header.
+func readBMPMessage(rd io.Reader) (int, []byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(rd, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] != 3 {
+		return 0, nil, errBMPVersion
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length < 6 || length > 1<<20 {
+		return 0, nil, errBMPShort
+	}
+
+	body := make([]byte, length-6)
+	if _, err := io.ReadFull(rd, body); err != nil {
+		return 0, nil, err
+	}
+	return int(header[5]), body, nil
+}
+
+// parseBMPPeerHeader returns the peer address and timestamp of the per
+// peer header at the start of b.
+func parseBMPPeerHeader(b []byte) (string, time.Time, error) {
+	if len(b) < 42 {
+		return "", time.Time{}, errBMPShort
+	}
+	var peer net.IP
+	if b[1]&0x80 != 0 {
+		peer = net.IP(b[10:26])
+	} else {
+		peer = net.IP(b[22:26])
+	}
+	at := time.Unix(int64(binary.BigEndian.Uint32(b[34:38])),
+		int64(binary.BigEndian.Uint32(b[38:42]))*1000)
+	return peer.String(), at, nil
+}
+
+func parseBMPRouteMonitoring(b []byte) (bmpUpdate, error) {
+	peer, at, err := parseBMPPeerHeader(b)
+	if err != nil {
+		return bmpUpdate{}, err
+	}
+	// the A flag, the AS path has 2 byte ASNs
+	u, err := parseBGPUpdate(b[42:], b[1]&0x20 != 0)
+	if err != nil {
+		return bmpUpdate{}, err
+	}
+	u.peer, u.at = peer, at
+	u.route.peer, u.route.at = peer, at
+	return u, nil
+}
+
+// parseBGPASPath reads the AS_SEQUENCE segments of an AS_PATH, AS_SETs
+// are skipped. The path is nil if it ends in an AS_SET, the origin is
+// not known then.
+func parseBGPASPath(b []byte, as2 bool) ([]uint32, error) {
+	size := 4
+	if as2 {
+		size = 2
+	}
+	path := []uint32{}
+	lastSet := false
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1])*size {
+			return nil, errBMPShort
+		}
+		t, n := b[0], int(b[1])
+		lastSet = t != 2
+		for i := 0; i < n && t == 2; i++ {
+			v := b[2+i*size:]
+			if as2 {
+				path = append(path, uint32(binary.BigEndian.Uint16(v)))
+			} else {
+				path = append(path, binary.BigEndian.Uint32(v))
+			}
+		}
+		b = b[2+n*size:]
+	}
+	if lastSet {
+		return nil, nil
+	}
+	return path, nil
+}
+
+// parseNLRI reads prefixes in the length and address bytes encoding.
+func parseNLRI(b []byte, ipv6 bool) ([]string, error) {
+	size := 4
+	if ipv6 {
+		size = 16
+	}
+
+	var o []string
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+		if bits > size*8 || len(b) < 1+n {
+			return nil, fmt.Errorf("Bad NLRI")
+		}
+		ip := make(net.IP, size)
+		copy(ip, b[1:1+n])
+		o = append(o, (&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, size*8)}).String())
+		b = b[1+n:]
+	}
+	return o, nil
+}
+
+// parseBGPUpdate reads the prefixes and communities of a BGP UPDATE
+// message, with its header.
+func parseBGPUpdate(b []byte, as2 bool) (u bmpUpdate, err error) {
+	if len(b) < 23 || b[18] != 2 {
+		return u, fmt.Errorf("Not a BGP UPDATE")
+	}
+	length := int(binary.BigEndian.Uint16(b[16:18]))
+	if length > len(b) || length < 23 {
+		return u, errBMPShort
+	}
+	b = b[19:length]
+
+	wlen := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+wlen+2 {
+		return u, errBMPShort
+	}
+	if u.withdrawn, err = parseNLRI(b[2:2+wlen], false); err != nil {
+		return u, err
+	}
+	b = b[2+wlen:]
+
+	alen := int(binary.BigEndian.Uint16(b[0:2]))
+	if len(b) < 2+alen {
+		return u, errBMPShort
+	}
+	attrs, nlri := b[2:2+alen], b[2+alen:]
+	if u.announced, err = parseNLRI(nlri, false); err != nil {
+		return u, err
+	}
+
+	for len(attrs) >= 3 {
+		flags, t := attrs[0], attrs[1]
+		var alen, hlen int
+		if flags&0x10 != 0 {
+			if len(attrs) < 4 {
+				return u, errBMPShort
+			}
+			alen, hlen = int(binary.BigEndian.Uint16(attrs[2:4])), 4
+		} else {
+			alen, hlen = int(attrs[2]), 3
+		}
+		if len(attrs) < hlen+alen {
+			return u, errBMPShort
+		}
+		v := attrs[hlen : hlen+alen]
+		attrs = attrs[hlen+alen:]
+
+		switch t {
+		case bgpAttrASPath:
+			if u.route.path, err = parseBGPASPath(v, as2); err != nil {
+				return u, err
+			}
+		case bgpAttrCommunities:
+			for i := 0; i+4 <= len(v); i += 4 {
+				u.route.communities = append(u.route.communities, bgpCommunity{
+					AS:   binary.BigEndian.Uint16(v[i:]),
+					Data: binary.BigEndian.Uint16(v[i+2:]),
+				})
+			}
+		case bgpAttrLargeCommunity:
+			for i := 0; i+12 <= len(v); i += 12 {
+				u.route.large = append(u.route.large, bgpLargeCommunity{
+					Global: binary.BigEndian.Uint32(v[i:]),
+					Data1:  binary.BigEndian.Uint32(v[i+4:]),
+					Data2:  binary.BigEndian.Uint32(v[i+8:]),
+				})
+			}
+		case bgpAttrMPReach:
+			// AFI, SAFI, next hop, reserved byte, then the NLRI
+			if len(v) < 5 || int(v[3])+5 > len(v) {
+				return u, errBMPShort
+			}
+			ipv6 := binary.BigEndian.Uint16(v[0:2]) == 2
+			prefixes, err := parseNLRI(v[5+int(v[3]):], ipv6)
+			if err != nil {
+				return u, err
+			}
+			u.announced = append(u.announced, prefixes...)
+		case bgpAttrMPUnreach:
+			if len(v) < 3 {
+				return u, errBMPShort
+			}
+			ipv6 := binary.BigEndian.Uint16(v[0:2]) == 2
+			prefixes, err := parseNLRI(v[3:], ipv6)
+			if err != nil {
+				return u, err
+			}
+			u.withdrawn = append(u.withdrawn, prefixes...)
+		}
+	}
+	return u, nil
+}
@@ -23,21 +23,88 @@ const (
 	stateAttempt boardState = iota // 3
 )
 
+// the coordinates are 4 bits on the wire
+const maxBoardSize = 16
+
+type ship struct {
+	X, Y     int
+	Size     int
+	Sideways bool
+}
+
+func (s ship) cells() []cell {
+	o := make([]cell, 0, s.Size)
+	for i := 0; i < s.Size; i++ {
+		if s.Sideways {
+			o = append(o, cell{s.X + i, s.Y})
+		} else {
+			o = append(o, cell{s.X, s.Y + i})
+		}
+	}
+	return o
+}
+
+type cell struct {
+	X, Y int
+}
+
+func (c cell) String() string {
+	return fmt.Sprintf("%s%d", string(rune('A'+c.X)), c.Y)
+}
+
+// only the Width x Height top left corner of Board is used, Ships and
+// Flag are only known for our own board
 type battleShipBoard struct {
-	Board [10][10]boardState
+	Width, Height int
+	Board         [maxBoardSize][maxBoardSize]boardState
+	Ships         []ship
+	// nil unless we play capture the flag, see ctf.go
+	Flag *cell
+}
+
+func newBoard(width, height int) battleShipBoard {
+	return battleShipBoard{Width: width, Height: height}
+}
+
+func (b *battleShipBoard) inside(x, y int) bool {
+	return x >= 0 && y >= 0 && x < b.Width && y < b.Height
+}
+
+// rows past 9 need two characters for their label
+func (b *battleShipBoard) labelWidth() int {
+	if b.Height > 10 {
+		return 2
+	}
+	return 1
+}
+
+// drawWidth is how many characters wide a line of Draw is
+func (b *battleShipBoard) drawWidth() int {
+	return b.labelWidth()*2 + 1 + b.Width*2
 }
 
 func (b *battleShipBoard) Draw() string {
+	pad := strings.Repeat("_", b.labelWidth())
+	header := pad + "|"
+	for x := 0; x < b.Width; x++ {
+		header += string(rune('A'+x)) + "|"
+	}
+	header += pad + "\n"
+
 	str := ""
-	str += fmt.Sprint("_|A|B|C|D|E|F|G|H|I|J|_\n")
-	for y, stripe := range b.Board {
-		str += fmt.Sprintf("%d|", y)
-		for _, x := range stripe {
-			str += fmt.Sprintf("%s|", x.Draw())
+	str += header
+	for y := 0; y < b.Height; y++ {
+		str += fmt.Sprintf("%*d|", b.labelWidth(), y)
+		for x := 0; x < b.Width; x++ {
+			if b.flagAt(cell{x, y}) {
+				str += cflag + square + ansi.DefaultBG + ansi.DefaultFG + "|"
+				continue
+			}
+			str += fmt.Sprintf("%s|", b.Board[y][x].Draw())
 		}
-		str += fmt.Sprintf("%d\n", y)
+		str += fmt.Sprintf("%*d\n", b.labelWidth(), y)
 	}
-	str += fmt.Sprint("_|A|B|C|D|E|F|G|H|I|J|_\n")
+	str += header
 	return str
 }
 
@@ -45,6 +112,21 @@ var cblack = ansi.ColorCode("black+h:black")
 var cship = ansi.ColorCode("black+h:white")
 var chit = ansi.ColorCode("red+h:red")
 var cattempt = ansi.ColorCode("yellow:yellow")
+var cflag = ansi.ColorCode("blue+h:blue")
+
+func (b boardState) String() string {
+	switch b {
+	case stateEmpty:
+		return "empty"
+	case stateShip:
+		return "ship"
+	case stateHit:
+		return "hit"
+	case stateAttempt:
+		return "attempt"
+	}
+	return "unknown"
+}
 
 func (b boardState) Draw() string {
 	if b == stateEmpty {
@@ -62,27 +144,34 @@ func (b boardState) Draw() string {
 	return ""
 }
 
-func cordsToNumbers(in string) (X, Y int) {
-	in = strings.ToLower(in)
+func cordsToNumbers(in string, width, height int) (X, Y int) {
+	in = strings.ToLower(strings.TrimSpace(in))
+	if len(in) < 2 {
+		return -1, -1
+	}
 
 	i1 := int(in[0])
-	if i1 > 96 && i1 < 107 {
-		X = i1 - 97
+	if i1 >= 'a' && i1 < 'a'+width {
+		X = i1 - 'a'
 	} else {
 		return -1, -1
 	}
 
-	i2, err := strconv.ParseInt(string(in[1]), 10, 64)
+	i2, err := strconv.ParseInt(in[1:], 10, 64)
 	if err != nil {
 		return -1, -1
 	}
 
-	if i2 < 11 {
+	if i2 >= 0 && int(i2) < height {
 		return X, int(i2)
 	}
 	return -1, -1
 }
 
+func boardTitles(b battleShipBoard, left, right string) string {
+	return fmt.Sprintf("%-*s%s\n", b.drawWidth()+5, left, right)
+}
+
 func combineBoard(b1, b2 battleShipBoard) string {
 	b1r, b2r := b1.Draw(), b2.Draw()
 
@@ -96,58 +185,91 @@ func combineBoard(b1, b2 battleShipBoard) string {
 	return str
 }
 
-func makeBoard() battleShipBoard {
-	a := battleShipBoard{}
-	ri, _ := cr.Int(cr.Reader, big.NewInt(math.MaxInt64))
-	rand.Seed(ri.Int64())
+// sizes of the ships every player gets, set by -fleet
+var fleet = []int{5, 4, 3, 3, 2}
+
+var fleetNames = []string{"carrier", "battleship", "cruiser", "submarine", "destroyer"}
 
-	a = placeShip(5, a)
-	a = placeShip(4, a)
-	a = placeShip(3, a)
-	a = placeShip(3, a)
-	a = placeShip(2, a)
-	return a
+func shipName(i int) string {
+	if i < 0 || i >= len(fleetNames) {
+		return fmt.Sprintf("ship %d", i)
+	}
+	return fleetNames[i]
 }
 
-func placeShip(size int, bo battleShipBoard) battleShipBoard {
+// the fleet has to fit in the board with room to spare
+const minBoardSize = 5
 
-	for {
-		board := bo
-		sideways := rand.Int() % 2
+func validBoardSize(width, height int) bool {
+	return width >= minBoardSize && width <= maxBoardSize &&
+		height >= minBoardSize && height <= maxBoardSize
+}
 
-		if sideways == 0 { // ship goes up
-			X := rand.Int() % 10
-			Y := rand.Int() % 10
-			if Y+size > 10 {
-				continue
-			}
+func fleetCells() int {
+	n := 0
+	for _, size := range fleet {
+		n += size
+	}
+	return n
+}
 
-			for y := Y; y < Y+size; y++ {
-				if board.Board[y][X] != stateEmpty {
-					continue
-				}
-				board.Board[y][X] = stateShip
+// shipsLeft counts the cells of ships that have not been hit yet
+func (b *battleShipBoard) shipsLeft() int {
+	n := 0
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			if b.Board[y][x] == stateShip {
+				n++
 			}
-			bo = board
-			break
-		} else {
-			X := rand.Int() % 10
-			Y := rand.Int() % 10
+		}
+	}
+	return n
+}
 
-			if X+size > 10 {
-				continue
+// shipsAfloat counts the ships that have not been sunk yet
+func (b *battleShipBoard) shipsAfloat() int {
+	n := 0
+	for _, s := range b.Ships {
+		for _, c := range s.cells() {
+			if b.Board[c.Y][c.X] == stateShip {
+				n++
+				break
 			}
+		}
+	}
+	return n
+}
 
-			for x := X; x < X+size; x++ {
-				if board.Board[Y][x] != stateEmpty {
-					continue
-				}
-				board.Board[Y][x] = stateShip
+// sunkShip returns the index of the ship at c if it has been sunk,
+// -1 otherwise.
+func (b *battleShipBoard) sunkShip(c cell) int {
+	for i, s := range b.Ships {
+		cells := s.cells()
+		on, sunk := false, true
+		for _, sc := range cells {
+			if sc == c {
+				on = true
 			}
-			bo = board
-			break
+			if b.Board[sc.Y][sc.X] != stateHit {
+				sunk = false
+			}
+		}
+		if on && sunk {
+			return i
 		}
 	}
+	return -1
+}
 
-	return bo
+// makeBoard places the fleet at random, with -noTouch the ships don't
+// touch each other. With -ctf the flag is hidden too.
+func makeBoard(width, height int) (battleShipBoard, error) {
+	ri, _ := cr.Int(cr.Reader, big.NewInt(math.MaxInt64))
+	rand.Seed(ri.Int64())
+
+	b, err := randomLayout(width, height, *noTouch)
+	if err == nil && *ctfMode {
+		b.hideFlag()
+	}
+	return b, err
 }
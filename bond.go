@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var bondPrefixes = flag.String("bondPrefixes", "",
+	"More prefixes we announce, separated by commas, to carry the large communities "+
+		"of the game as 16 bit ones when large communities don't make it through")
+
+var peerBondPrefixes = flag.String("peerBondPrefixes", "",
+	"The -bondPrefixes of the other side, separated by commas")
+
+/*
+Bonding spreads what a game announces in large communities (the moves
+of the large codec, the handshake, board commitments, chat, salvos)
+over a few more prefixes, as 16 bit communities. It's for paths that
+only pass the 16 bit ones: the move of the legacy codec stays on the
+game prefix, everything else comes along on the bond prefixes. Both
+sides need them, in the same number.
+
+The large communities are written as 8 bytes each (Data1 and Data2,
+the ASN is the one of the game) one after the other, and that is cut
+in as many fragments as there are bond prefixes. A fragment is one byte
+per community, as communities are a set the position comes along:
+
+(ASN, position << 8 | byte)
+
+position 0    the index of the fragment
+position 1    how many fragments there are
+position 2-3  the generation, it goes up with every change
+position 4-   the bytes of the fragment, at most bondFragmentSize
+
+The receiving side only takes the fragments once all of them are there
+with the same generation, until then it keeps the last whole set.
+*/
+
+const bondFragmentSize = 256 - 4
+
+var errBondTooBig = fmt.Errorf("Too much to announce over the bond prefixes, add more of them")
+
+func splitPrefixes(list string) ([]string, error) {
+	var o []string
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(p); err != nil {
+			return nil, fmt.Errorf("Invalid bond prefix %s", p)
+		}
+		o = append(o, p)
+	}
+	return o, nil
+}
+
+// setBond sets up the bond prefixes of the flags on m
+func (m *match) setBond() error {
+	var err error
+	if m.bond, err = splitPrefixes(*bondPrefixes); err != nil {
+		return err
+	}
+	if m.peerBond, err = splitPrefixes(*peerBondPrefixes); err != nil {
+		return err
+	}
+	if len(m.bond) != len(m.peerBond) {
+		return fmt.Errorf("Both sides need as many bond prefixes, -bondPrefixes has %d "+
+			"and -peerBondPrefixes %d", len(m.bond), len(m.peerBond))
+	}
+	return nil
+}
+
+// bondFragments cuts large in n fragments with generation gen
+func bondFragments(asn int, large []bgpLargeCommunity, n, gen int) ([][]bgpCommunity, error) {
+	payload := make([]byte, 0, 8*len(large))
+	for _, c := range large {
+		var b [8]byte
+		binary.BigEndian.PutUint32(b[0:], c.Data1)
+		binary.BigEndian.PutUint32(b[4:], c.Data2)
+		payload = append(payload, b[:]...)
+	}
+	size := (len(payload) + n - 1) / n
+	if size > bondFragmentSize {
+		return nil, errBondTooBig
+	}
+
+	frags := make([][]bgpCommunity, n)
+	for i := range frags {
+		header := []byte{byte(i), byte(n), byte(gen >> 8), byte(gen)}
+		chunk := payload
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		payload = payload[len(chunk):]
+		for pos, b := range append(header, chunk...) {
+			frags[i] = append(frags[i], bgpCommunity{AS: uint16(asn), Data: uint16(pos<<8 | int(b))})
+		}
+	}
+	return frags, nil
+}
+
+type bondFragment struct {
+	index, count, gen int
+	data              []byte
+}
+
+// readBondFragment puts a fragment back together from the communities
+// of a bond prefix, ok is false if it isn't whole.
+func readBondFragment(asn int, communities []bgpCommunity) (f bondFragment, ok bool) {
+	bytes := make(map[int]byte)
+	for _, c := range communities {
+		if int(c.AS) == asn {
+			bytes[int(c.Data>>8)] = byte(c.Data)
+		}
+	}
+	for pos := 0; pos < 4; pos++ {
+		if _, ok := bytes[pos]; !ok {
+			return f, false
+		}
+	}
+	f.index, f.count = int(bytes[0]), int(bytes[1])
+	f.gen = int(bytes[2])<<8 | int(bytes[3])
+	for pos := 4; ; pos++ {
+		b, ok := bytes[pos]
+		if !ok {
+			break
+		}
+		f.data = append(f.data, b)
+	}
+	// a gap would leave bytes after the ones read
+	return f, len(f.data)+4 == len(bytes)
+}
+
+// joinBondFragments returns the large communities of frags, ok is false
+// unless they are all there and of the same generation.
+func joinBondFragments(asn int, frags []bondFragment) ([]bgpLargeCommunity, bool) {
+	var payload []byte
+	for i, f := range frags {
+		if f.index != i || f.count != len(frags) || f.gen != frags[0].gen {
+			return nil, false
+		}
+		payload = append(payload, f.data...)
+	}
+	if len(payload)%8 != 0 {
+		return nil, false
+	}
+
+	large := make([]bgpLargeCommunity, 0, len(payload)/8)
+	for b := payload; len(b) >= 8; b = b[8:] {
+		large = append(large, bgpLargeCommunity{
+			Global: uint32(asn),
+			Data1:  binary.BigEndian.Uint32(b[0:]),
+			Data2:  binary.BigEndian.Uint32(b[4:]),
+		})
+	}
+	return large, true
+}
+
+// stampBond moves the large communities of m to its bond prefixes, it's
+// called by stamp with matchesMu held.
+func (m *match) stampBond() {
+	if len(m.bond) == 0 {
+		return
+	}
+	key := fmt.Sprint(m.large)
+	if key != m.bondKey {
+		m.bondKey = key
+		m.bondGen = (m.bondGen + 1) % 65536
+	}
+	frags, err := bondFragments(m.ASN, m.large, len(m.bond), m.bondGen)
+	if err != nil {
+		m.log.Errorf("Unable to announce %d large communities: %s", len(m.large), err.Error())
+		return
+	}
+	m.bondRoutes = frags
+	m.large = nil
+}
+
+// readBond reads the large communities of the other side off its bond
+// prefixes, or the last ones that were whole.
+func (m *match) readBond() []bgpLargeCommunity {
+	frags := make([]bondFragment, len(m.peerBond))
+	for i, prefix := range m.peerBond {
+		communities, _, err := readCommunities(prefix)
+		if err != nil {
+			return m.bondLast
+		}
+		f, ok := readBondFragment(m.ASN, communities)
+		if !ok {
+			return m.bondLast
+		}
+		frags[i] = f
+	}
+	if large, ok := joinBondFragments(m.ASN, frags); ok {
+		m.bondLast = large
+	}
+	return m.bondLast
+}
+
+// withBonds adds a route for every bond prefix of ms, for the routers
+// to announce along with the games.
+func withBonds(ms []*match) []*match {
+	o := ms
+	for _, m := range ms {
+		for i, prefix := range m.bond {
+			if i >= len(m.bondRoutes) {
+				break
+			}
+			if len(o) == len(ms) {
+				o = append([]*match(nil), ms...)
+			}
+			o = append(o, &match{
+				Name:        fmt.Sprintf("%s/bond%d", m.Name, i),
+				ASN:         m.ASN,
+				Prefix:      prefix,
+				PeerPrefix:  m.peerBond[i],
+				log:         m.log,
+				communities: m.bondRoutes[i],
+			})
+		}
+	}
+	return o
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"sort"
+)
+
+var botMode = flag.Bool("bot", false,
+	"Let the computer pick the moves, to practice against it")
+
+// placements over cells that were hit count this much more, so that
+// once a ship is found it gets finished off before hunting again
+const botHitWeight = 20
+
+// botShots picks the n cells most likely to hold a ship, by counting
+// how many placements of the fleet still fit around the shots on b.
+// The cells of wrecks, ships already sunk, are as good as misses: no
+// other ship fits there, and their hits don't lead to one either.
+func botShots(b battleShipBoard, wrecks map[cell]bool, n int) []cell {
+	var density [maxBoardSize][maxBoardSize]int
+
+	for _, size := range fleet {
+		for y := 0; y < b.Height; y++ {
+			for x := 0; x < b.Width; x++ {
+				for _, sideways := range []bool{false, true} {
+					s := ship{X: x, Y: y, Size: size, Sideways: sideways}
+
+					fits, hits := true, 0
+					for _, c := range s.cells() {
+						if !b.inside(c.X, c.Y) || b.Board[c.Y][c.X] == stateAttempt || wrecks[c] {
+							fits = false
+							break
+						}
+						if b.Board[c.Y][c.X] == stateHit {
+							hits++
+						}
+					}
+					if !fits {
+						continue
+					}
+
+					for _, c := range s.cells() {
+						density[c.Y][c.X] += 1 + hits*botHitWeight
+					}
+				}
+			}
+		}
+	}
+
+	candidates := make([]cell, 0, b.Width*b.Height)
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			if b.Board[y][x] == stateEmpty {
+				candidates = append(candidates, cell{x, y})
+			}
+		}
+	}
+
+	// shuffle first so that ties are broken at random
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	sort.SliceStable(candidates, func(i, j int) bool {
+		ci, cj := candidates[i], candidates[j]
+		return density[ci.Y][ci.X] > density[cj.Y][cj.X]
+	})
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	return candidates[:n]
+}
+
+// markWreck finds where ship i of the other side, just sunk by one of
+// shots, lies on RemoteB. It's left out if the hits around the shots fit
+// the ship in more than one way.
+func (g *game) markWreck(i int, shots []cell) {
+	if i < 0 || i >= len(fleet) {
+		return
+	}
+	b := g.RemoteB
+
+	type placement struct{ first, last cell }
+	found := make(map[placement][]cell)
+	for _, s := range shots {
+		for _, sideways := range []bool{false, true} {
+			for off := 0; off < fleet[i]; off++ {
+				sh := ship{X: s.X, Y: s.Y - off, Size: fleet[i], Sideways: sideways}
+				if sideways {
+					sh.X, sh.Y = s.X-off, s.Y
+				}
+				cells := sh.cells()
+				fits := true
+				for _, c := range cells {
+					if !b.inside(c.X, c.Y) || b.Board[c.Y][c.X] != stateHit || g.peerWrecks[c] {
+						fits = false
+						break
+					}
+				}
+				if fits {
+					found[placement{cells[0], cells[len(cells)-1]}] = cells
+				}
+			}
+		}
+	}
+	if len(found) != 1 {
+		return
+	}
+
+	if g.peerWrecks == nil {
+		g.peerWrecks = make(map[cell]bool)
+	}
+	for _, cells := range found {
+		for _, c := range cells {
+			g.peerWrecks[c] = true
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+var botCmd = flag.String("botCmd", "",
+	"Run this program as the player, the game tells it what happens as JSON lines "+
+		"on its stdin and it answers with its moves on its stdout, see botcmd.go")
+
+/*
+-botCmd lets a bot written in any language play, every game starts the
+program (split on spaces, there is no shell) and talks to it in JSON,
+one object per line. The game writes events to its stdin:
+
+{"event":"start","width":10,"height":10,"salvo":false,"startFirst":true,
+ "fleet":[5,4,3,3,2],"ships":["B2v5","D0h4",...]}
+{"event":"turn","move":4,"shots":1}
+{"event":"move","move":5,"results":[{"cell":"B7","hit":true}],
+ "sunk":["cruiser"],"incoming":[{"cell":"D3","hit":true,"ship":"cruiser"}],
+ "lost":["cruiser"]}
+{"event":"chat","text":"good luck"}
+{"event":"over","won":true}
+
+turn comes whenever it's the bot's move, again if its last answer wasn't
+a valid move. move is a move of the other side: results are the shots of
+our last move, incoming the ones of the other side. Ships are written as
+in the notation of export. The program answers on its stdout with
+
+{"fire":["B7"]}              as many cells as the turn has shots
+{"say":"good game"}
+{"surrender":true}
+
+Lines that are not JSON are ignored, so a bot can print what it thinks
+to its stderr or, carefully, its stdout. The program is stopped when the
+game is over, with rematches the next game starts it again.
+*/
+
+type botEvent struct {
+	Event      string      `json:"event"`
+	Width      int         `json:"width,omitempty"`
+	Height     int         `json:"height,omitempty"`
+	Salvo      bool        `json:"salvo,omitempty"`
+	StartFirst bool        `json:"startFirst,omitempty"`
+	Fleet      []int       `json:"fleet,omitempty"`
+	Ships      []string    `json:"ships,omitempty"`
+	Move       *int        `json:"move,omitempty"`
+	Shots      int         `json:"shots,omitempty"`
+	Results    []botResult `json:"results,omitempty"`
+	Sunk       []string    `json:"sunk,omitempty"`
+	Incoming   []botResult `json:"incoming,omitempty"`
+	Lost       []string    `json:"lost,omitempty"`
+	Text       string      `json:"text,omitempty"`
+	Won        *bool       `json:"won,omitempty"`
+}
+
+type botResult struct {
+	Cell string `json:"cell"`
+	Hit  bool   `json:"hit"`
+	Ship string `json:"ship,omitempty"`
+}
+
+type botCommand struct {
+	Fire      []string `json:"fire"`
+	Say       string   `json:"say"`
+	Surrender bool     `json:"surrender"`
+}
+
+// how long the bot gets to exit once its game is over
+const botStopWait = 5 * time.Second
+
+var errBotAndBotCmd = fmt.Errorf("-botCmd plays instead of -bot, give only one of them")
+
+// extBot is the program of -botCmd
+type extBot struct {
+	cmd *exec.Cmd
+
+	mu  sync.Mutex
+	in  io.WriteCloser
+	enc *json.Encoder
+}
+
+// startBot starts -botCmd, its commands come in over l.lines as if they
+// were typed.
+func (l *gameLoop) startBot() error {
+	args := strings.Fields(*botCmd)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("Unable to start -botCmd %s", err.Error())
+	}
+	l.g.match.log.Infof("Playing with %s", args[0])
+
+	l.bot = &extBot{cmd: cmd, in: in, enc: json.NewEncoder(in)}
+	l.lines = make(chan string)
+	go readBotCommands(out, l.lines, l.done)
+
+	g := l.g
+	ships := make([]string, len(g.LocalB.Ships))
+	for i, s := range g.LocalB.Ships {
+		ships[i] = shipNotation(s)
+	}
+	l.bot.send(botEvent{Event: "start", Width: g.LocalB.Width, Height: g.LocalB.Height,
+		Salvo: g.salvo, StartFirst: g.startFirst, Fleet: fleet, Ships: ships})
+	return nil
+}
+
+// readBotCommands turns the commands of the bot into the lines they'd
+// be at the prompt.
+func readBotCommands(r io.Reader, lines chan<- string, done <-chan struct{}) {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var c botCommand
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			continue
+		}
+		var line string
+		switch {
+		case c.Surrender:
+			line = "surrender"
+		case c.Say != "":
+			line = "say " + c.Say
+		case len(c.Fire) > 0:
+			line = strings.Join(c.Fire, " ")
+		default:
+			continue
+		}
+		select {
+		case lines <- line + "\n":
+		case <-done:
+			return
+		}
+	}
+}
+
+func (b *extBot) send(ev botEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.enc.Encode(ev); err != nil {
+		mainLog.Debugf("Unable to tell the bot %s", err.Error())
+	}
+}
+
+// stop closes the stdin of the bot and waits for it, it's killed if it
+// doesn't go.
+func (b *extBot) stop() {
+	if b == nil {
+		return
+	}
+	b.in.Close()
+	exited := make(chan struct{})
+	go func() {
+		b.cmd.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(botStopWait):
+		b.cmd.Process.Kill()
+		<-exited
+	}
+}
+
+// moveEvent is the move event of move c of the other side
+func moveEvent(g *game, c int) botEvent {
+	m := g.moves[c]
+	ev := botEvent{Event: "move", Move: &c}
+	if c > 0 {
+		for i, s := range g.moves[c-1].shots(g.salvo) {
+			ev.Results = append(ev.Results, botResult{Cell: s.String(), Hit: m.hit(i, g.salvo)})
+		}
+	}
+	for _, i := range m.Sunk {
+		ev.Sunk = append(ev.Sunk, shipName(i))
+	}
+	if m.GameOver {
+		return ev
+	}
+	for _, s := range m.shots(g.salvo) {
+		r := botResult{Cell: s.String()}
+		if ship := g.LocalB.shipAt(s); ship >= 0 && g.LocalB.Board[s.Y][s.X] == stateHit {
+			r.Hit, r.Ship = true, shipName(ship)
+		}
+		ev.Incoming = append(ev.Incoming, r)
+	}
+	for _, i := range g.sunk {
+		ev.Lost = append(ev.Lost, shipName(i))
+	}
+	return ev
+}
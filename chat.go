@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+)
+
+/*
+Chat messages are sent as large communities, announced until the next
+one replaces them:
+
+(communityASN, chatHeader, ID << 8 | Length)
+(communityASN, chatText+i, 6 characters, 5 bits each, first one on top)
+
+The ID goes up with every message so that the same one is not shown
+twice. Only the characters of chatAlphabet can be sent, the rest are
+turned into '?'.
+*/
+
+const (
+	chatHeader = 64
+	chatText   = 65 // up to chatWords words
+)
+
+const chatWords = 16
+const chatPerWord = 6
+const maxChat = chatWords * chatPerWord
+
+const chatAlphabet = "abcdefghijklmnopqrstuvwxyz .,!?'"
+
+func chatCommunities(id int, text string) []bgpLargeCommunity {
+	text = strings.ToLower(text)
+	if len(text) > maxChat {
+		text = text[:maxChat]
+	}
+
+	o := []bgpLargeCommunity{sessionCommunity(chatHeader,
+		uint32(id&0xffffff)<<8|uint32(len(text)))}
+	for w := 0; w*chatPerWord < len(text); w++ {
+		var word uint32
+		for i := 0; i < chatPerWord; i++ {
+			c := strings.IndexByte(chatAlphabet, ' ')
+			if n := w*chatPerWord + i; n < len(text) {
+				c = strings.IndexByte(chatAlphabet, text[n])
+				if c < 0 {
+					c = strings.IndexByte(chatAlphabet, '?')
+				}
+			}
+			word |= uint32(c) << uint(5*(chatPerWord-1-i))
+		}
+		o = append(o, sessionCommunity(chatText+uint32(w), word))
+	}
+	return o
+}
+
+// readChat returns the chat message in large, ok is false if there is
+// none or some of it is missing.
+func readChat(large []bgpLargeCommunity) (id int, text string, ok bool) {
+	words := make(map[uint32]uint32)
+	header, length := false, 0
+	for _, c := range large {
+		if c.Data1 == chatHeader {
+			header = true
+			id, length = int(c.Data2>>8), int(c.Data2&0xff)
+		}
+		if c.Data1 >= chatText && c.Data1 < chatText+chatWords {
+			words[c.Data1-chatText] = c.Data2
+		}
+	}
+	if !header || length > maxChat {
+		return 0, "", false
+	}
+
+	b := make([]byte, 0, length)
+	for n := 0; n < length; n++ {
+		word, ok := words[uint32(n/chatPerWord)]
+		if !ok {
+			return 0, "", false
+		}
+		c := word >> uint(5*(chatPerWord-1-n%chatPerWord)) & 0x1f
+		b = append(b, chatAlphabet[c])
+	}
+	return id, string(b), true
+}
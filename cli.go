@@ -0,0 +1,243 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// command is a subcommand of the binary, it takes the global flags
+// named in flags, or parses its arguments itself if flags is nil.
+type command struct {
+	name    string
+	args    string
+	summary string
+	flags   []string
+	run     func(args []string) error
+}
+
+var logFlags = []string{"log-level", "log-format", "config"}
+
+var routerFlags = []string{"backend", "sockFile", "birdRetry", "birdKeepalive",
+	"controlCA", "controlCert", "controlKey", "exabgpIn", "exabgpOut", "bgpctl", "bgpctlSocket", "bmpListen", "observeMRT", "rxBackend",
+	"dialTimeout", "pollInterval", "readTimeout", "writeTimeout", "minAnnounceInterval", "peerSession", "dry-run", "checkPath",
+	"simDelay", "simJitter", "simReorder", "simDuplicate", "simStrip", "simSeed"}
+
+var configFlags = []string{"templateFile", "confFile", "softReconfigure",
+	"prefix", "birdVersion", "staticFile", "lint"}
+
+var gameFlags = []string{"peerprefix", "communityASN", "asn", "peerASN",
+	"width", "height", "salvo", "ctf", "handshake", "handshakeTimeout", "startfirst", "http", "stateDir",
+	"turnTimeout", "revealTimeout", "forfeitWithdraw", "risLive", "risLiveURL", "fleet", "noTouch",
+	"nuke", "nukeDuration", "rpki", "bestOf", "codec",
+	"resultServer", "resultKey", "resultMatch", "api", "apiMoves",
+	"notifyWebhook", "notifyDesktop", "notifySlack", "notifyMatrix",
+	"notifyMatrixToken", "notifyIRC", "team", "teamVote", "timeline", "timelineSize",
+	"bondPrefixes", "peerBondPrefixes", "history", "plain", "defend"}
+
+func flagList(groups ...[]string) []string {
+	o := []string{}
+	for _, g := range groups {
+		o = append(o, g...)
+	}
+	return o
+}
+
+var commands = []*command{
+	{
+		name:    "play",
+		summary: "Play a game, picking the moves at the keyboard (the default)",
+		flags:   flagList(logFlags, routerFlags, configFlags, gameFlags, []string{"bot", "botCmd", "place", "resume"}),
+		run:     playGame,
+	},
+	{
+		name:    "serve",
+		summary: "Play games as a daemon, with the moves picked by the bot",
+		flags:   flagList(logFlags, routerFlags, configFlags, gameFlags, []string{"game"}),
+		run:     serveGame,
+	},
+	{
+		name:    "royale",
+		summary: "Attack several defenders at once with a single route",
+		flags:   flagList(logFlags, routerFlags, configFlags, gameFlags, []string{"bot", "defender"}),
+		run:     playRoyale,
+	},
+	{
+		name:    "status",
+		summary: "Decode the communities announced by the other side, for debugging",
+		flags:   flagList(logFlags, routerFlags, []string{"peerprefix", "communityASN"}),
+		run:     showStatus,
+	},
+	{
+		name:    "probe",
+		summary: "Check that the communities of both sides make it through, run on both sides",
+		flags:   flagList(logFlags, routerFlags, configFlags, []string{"peerprefix", "communityASN", "probeTimeout"}),
+		run:     runProbe,
+	},
+	{
+		name:    "reset",
+		summary: "Remove all the game communities from the bird config",
+		flags:   flagList(logFlags, routerFlags, configFlags, []string{"communityASN"}),
+		run: func(args []string) error {
+			return resetBird()
+		},
+	},
+	{
+		name:    "spectate",
+		args:    "<prefix> <prefix>",
+		summary: "Watch the game between two prefixes, without announcing anything",
+		flags:   flagList(logFlags, routerFlags, []string{"communityASN", "width", "height", "salvo"}),
+		run: func(args []string) error {
+			if len(args) != 2 {
+				return fmt.Errorf("spectate needs two prefixes")
+			}
+			spectate(args[0], args[1])
+			return nil
+		},
+	},
+	{
+		name:    "init-bird",
+		summary: "Write a bird config for a game from scratch",
+		run:     initBird,
+	},
+	{
+		name:    "labgen",
+		summary: "Write a docker-compose lab with two peered bird routers and a game on each",
+		run:     labGen,
+	},
+	{
+		name:    "matchmaker",
+		summary: "Run a matchmaking server that pairs up players and keeps a leaderboard",
+		run:     runMatchmaker,
+	},
+	{
+		name:    "keygen",
+		args:    "<file>",
+		summary: "Write a new key for signing the results reported to a matchmaker",
+		run:     keygen,
+	},
+	{
+		name:    "ctl",
+		args:    "games | board <game> | fire <game> <shots...> | vote <game> <shots...> | resync <game> | export <game> | diff <game> | reload",
+		summary: "Talk to the control API of a running play or serve",
+		run:     runCtl,
+	},
+	{
+		name:    "export",
+		summary: "Write the game of a -stateDir file down, to share it or -resume it elsewhere",
+		run:     exportState,
+	},
+	{
+		name:    "import",
+		args:    "<file>",
+		summary: "Check a game written down with export and show its boards",
+		flags:   flagList(logFlags, []string{"stateDir"}),
+		run:     importNotation,
+	},
+	{
+		name:    "import-mrt",
+		summary: "Put together the games seen in MRT update dumps into a replay file",
+		run:     importMRT,
+	},
+	{
+		name:    "analyze",
+		summary: "Sum up the games in replay files: accuracy, move times, heatmaps",
+		run:     runAnalyze,
+	},
+	{
+		name:    "debug",
+		args:    "timeline",
+		summary: "Show what a game saw and announced, and where the two sides stopped agreeing",
+		run:     runDebug,
+	},
+	{
+		name:    "history",
+		args:    "list [n] | show <id> | vs <asn>",
+		summary: "Look through the games kept in the history database",
+		flags:   flagList(logFlags, []string{"history", "stateDir"}),
+		run:     runHistory,
+	},
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun %s <command> -h for the flags of a command.\n", os.Args[0])
+}
+
+// flagSet takes the global flags of the command, the values are still
+// the global ones.
+func (c *command) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	for _, name := range c.flags {
+		f := flag.CommandLine.Lookup(name)
+		if f == nil {
+			panic("unknown flag " + name)
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n\n%s\n\nFlags:\n",
+			os.Args[0], c.name, c.args, c.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runCommand runs the command named by the first argument, plain flags
+// with no command mean play.
+func runCommand(args []string) error {
+	name := "play"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return nil
+	}
+
+	c := findCommand(name)
+	if c == nil {
+		usage()
+		return fmt.Errorf("Unknown command %s", name)
+	}
+
+	if c.flags == nil {
+		return c.run(args)
+	}
+
+	fs := c.flagSet()
+	fs.Parse(args)
+	if err := setupConfig(fs); err != nil {
+		return err
+	}
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if fs.Lookup("fleet") != nil {
+		if err := setupFleet(); err != nil {
+			return err
+		}
+	}
+	// only the commands talking to the router take -backend, in a team
+	// only the leader does, see followTeam
+	if fs.Lookup("backend") != nil && (fs.Lookup("team") == nil || *teamList == "") {
+		if err := setupRouter(); err != nil {
+			return err
+		}
+	}
+	return c.run(fs.Args())
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var codecName = flag.String("codec", "auto",
+	"How moves go on the wire: auto (the best one both sides have), legacy or large. "+
+		"Without -handshake auto is legacy")
+
+/*
+How a move goes on the wire is up to its codec, the handshake picks the
+best one both sides announce in helloCodecs. legacy is the 16 bit
+communities described in birdc.go. large puts the whole move into large
+communities instead, which lifts the limits of 16 bits, and large
+communities make it through whenever the handshake did:
+
+(communityASN, moveCounter, counter)
+(communityASN, movePosition, X << 16 | Y << 8 | S)
+(communityASN, moveExtended, E << 16 | P)   one for each extended type
+
+The fields mean the same as in legacy. Whatever else the move carries
+(salvo shots, chat, ...) is large communities with either codec.
+
+An extended community codec would need the routers to read and write
+RFC 4360 communities, which none of the backends does yet.
+
+-risLive only sees moves of the legacy codec, RIS Live doesn't pass on
+large communities.
+*/
+
+const (
+	moveCounter  = 36
+	movePosition = 37
+	moveExtended = 38
+)
+
+// moveCodec turns the move of a bgpMessage into communities and back.
+type moveCodec interface {
+	// encode returns the communities of msg, their ASN is filled in
+	// when they are announced
+	encode(msg bgpMessage) ([]bgpCommunity, []bgpLargeCommunity)
+	// decode picks the move of the game on asn out of the communities
+	// of a route
+	decode(asn int, communities []bgpCommunity, large []bgpLargeCommunity) (bgpMessage, error)
+}
+
+type codecInfo struct {
+	bit   uint32
+	name  string
+	codec moveCodec
+}
+
+// moveCodecs are the codecs that carry moves, the best one first
+var moveCodecs = []codecInfo{
+	{codecLarge, "large", largeCodec{}},
+	{codecLegacy, "legacy", legacyCodec{}},
+}
+
+// localMoveCodecs are the bits of the move codecs -codec allows
+func localMoveCodecs() uint32 {
+	switch *codecName {
+	case "legacy":
+		return codecLegacy
+	case "large":
+		return codecLarge
+	}
+	return codecLegacy | codecLarge
+}
+
+// pickCodec returns the best move codec in codecs, nil if there is
+// none.
+func pickCodec(codecs uint32) *codecInfo {
+	for i, c := range moveCodecs {
+		if codecs&c.bit != 0 {
+			return &moveCodecs[i]
+		}
+	}
+	return nil
+}
+
+// flagCodec is the codec played without a handshake
+func flagCodec() *codecInfo {
+	if *codecName == "large" {
+		return pickCodec(codecLarge)
+	}
+	return pickCodec(codecLegacy)
+}
+
+func checkCodecFlag() error {
+	switch *codecName {
+	case "auto", "legacy", "large":
+		return nil
+	}
+	return fmt.Errorf("Unknown codec %s", *codecName)
+}
+
+// decodeMessage picks the move out of the communities of a route with
+// the codec it was sent with, for those who didn't take part in the
+// handshake.
+func decodeMessage(asn int, communities []bgpCommunity,
+	large []bgpLargeCommunity) (bgpMessage, error) {
+	for _, c := range large {
+		if c.Global == uint32(asn) && c.Data1 == moveCounter {
+			return largeCodec{}.decode(asn, communities, large)
+		}
+	}
+	return legacyCodec{}.decode(asn, communities, large)
+}
+
+var errBadPosition = fmt.Errorf("Position outside of any board")
+
+type largeCodec struct{}
+
+func (largeCodec) encode(msg bgpMessage) ([]bgpCommunity, []bgpLargeCommunity) {
+	large := []bgpLargeCommunity{
+		sessionCommunity(moveCounter, uint32(msg.Counter)),
+		sessionCommunity(movePosition, uint32(msg.X<<16|msg.Y<<8|msg.HitOrMissOnLast)),
+	}
+	for _, e := range msg.Extended {
+		large = append(large, sessionCommunity(moveExtended, uint32(e.Type<<16|e.Payload)))
+	}
+	return nil, append(large, msg.Large...)
+}
+
+func (largeCodec) decode(asn int, communities []bgpCommunity,
+	large []bgpLargeCommunity) (msg bgpMessage, err error) {
+	readCounter, readPosition := false, false
+
+	for _, c := range large {
+		if c.Global != uint32(asn) {
+			continue
+		}
+		msg.Large = append(msg.Large, c)
+
+		switch c.Data1 {
+		case moveCounter:
+			if readCounter {
+				return bgpMessage{}, errDupeType
+			}
+			readCounter = true
+			msg.Counter = int(c.Data2)
+		case movePosition:
+			if readPosition {
+				return bgpMessage{}, errDupeType
+			}
+			readPosition = true
+			msg.X = int(c.Data2 >> 16 & 0xff)
+			msg.Y = int(c.Data2 >> 8 & 0xff)
+			msg.HitOrMissOnLast = int(c.Data2 & 0xff)
+		case moveExtended:
+			msg.Extended = append(msg.Extended, extendedCommunity{
+				Type:    int(c.Data2 >> 16),
+				Payload: int(c.Data2 & 0xffff),
+			})
+		}
+	}
+
+	if !readCounter || !readPosition {
+		return bgpMessage{}, errNotEnoughData
+	}
+	// 8 bits go further than any board, legacy can't say more than 15
+	if msg.X >= maxBoardSize || msg.Y >= maxBoardSize {
+		return bgpMessage{}, errBadPosition
+	}
+	return msg, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	cr "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+/*
+Both sides commit to their ship placement at the start of the game,
+so that it can be checked at the end that no ships were moved:
+
+(communityASN, boardCommit+i, word i of SHA-256(salt | layout))
+
+Once the game is over the salt and layout are revealed:
+
+(communityASN, boardSalt+i, word i of salt)
+(communityASN, boardLayout+i, word i of layout)
+
+The layout has a bit for each cell of a 16x16 board, row by row,
+set where a ship is. In capture the flag the flag goes along, see ctf.go.
+*/
+
+const (
+	boardCommit = 16 // 8 words
+	boardSalt   = 24 // 4 words
+	boardLayout = 28 // 8 words
+)
+
+var errNoCommitment = fmt.Errorf("Other side did not commit to its board")
+var errNoReveal = fmt.Errorf("Board not revealed yet")
+var errCommitMismatch = fmt.Errorf("Revealed board does not match the commitment")
+var errResultMismatch = fmt.Errorf("Revealed board does not match the reported hits")
+var errFleetMismatch = fmt.Errorf("Revealed board does not have a full fleet")
+
+type boardCommitment struct {
+	Salt   [16]byte
+	Layout [32]byte
+	Hash   [32]byte
+	// only in capture the flag
+	Flag *cell
+}
+
+func packLayout(b battleShipBoard) (layout [32]byte) {
+	for y, stripe := range b.Board {
+		for x, s := range stripe {
+			if s == stateShip || s == stateHit {
+				i := y*maxBoardSize + x
+				layout[i/8] |= 0x80 >> uint(i%8)
+			}
+		}
+	}
+	return layout
+}
+
+func unpackLayout(layout [32]byte, width, height int) battleShipBoard {
+	b := newBoard(width, height)
+	for y := range b.Board {
+		for x := range b.Board[y] {
+			i := y*maxBoardSize + x
+			if layout[i/8]&(0x80>>uint(i%8)) != 0 {
+				b.Board[y][x] = stateShip
+			}
+		}
+	}
+	return b
+}
+
+func layoutHash(salt [16]byte, layout [32]byte, flag *cell) [32]byte {
+	b := append(salt[:], layout[:]...)
+	if flag != nil {
+		b = append(b, byte(flag.X<<4|flag.Y))
+	}
+	return sha256.Sum256(b)
+}
+
+func commitBoard(b battleShipBoard) (boardCommitment, error) {
+	c := boardCommitment{Layout: packLayout(b), Flag: b.Flag}
+	if _, err := cr.Read(c.Salt[:]); err != nil {
+		return c, err
+	}
+	c.Hash = layoutHash(c.Salt, c.Layout, c.Flag)
+	return c, nil
+}
+
+func wordCommunities(field uint32, data []byte) []bgpLargeCommunity {
+	o := make([]bgpLargeCommunity, 0, len(data)/4)
+	for i := 0; i < len(data)/4; i++ {
+		o = append(o, sessionCommunity(field+uint32(i),
+			binary.BigEndian.Uint32(data[i*4:])))
+	}
+	return o
+}
+
+// readWords fills data from the communities written by wordCommunities,
+// it returns false if some are missing. large only has the communities
+// of the game, as in bgpMessage.
+func readWords(large []bgpLargeCommunity, field uint32, data []byte) bool {
+	words := uint32(len(data) / 4)
+	seen := 0
+	for _, c := range large {
+		if c.Data1 < field || c.Data1 >= field+words {
+			continue
+		}
+		i := c.Data1 - field
+		binary.BigEndian.PutUint32(data[i*4:], c.Data2)
+		seen |= 1 << i
+	}
+	return seen == 1<<words-1
+}
+
+func (c boardCommitment) commitCommunities() []bgpLargeCommunity {
+	return wordCommunities(boardCommit, c.Hash[:])
+}
+
+func (c boardCommitment) revealCommunities() []bgpLargeCommunity {
+	o := append(wordCommunities(boardSalt, c.Salt[:]),
+		wordCommunities(boardLayout, c.Layout[:])...)
+	if c.Flag != nil {
+		o = append(o, flagCommunity(*c.Flag))
+	}
+	return o
+}
+
+func readBoardCommitment(large []bgpLargeCommunity) (hash [32]byte, ok bool) {
+	ok = readWords(large, boardCommit, hash[:])
+	return hash, ok
+}
+
+// verifyBoard checks the board revealed by the other side against the
+// hash it committed to and the hits and misses it reported on remote.
+func verifyBoard(hash [32]byte, large []bgpLargeCommunity, remote battleShipBoard) error {
+	var salt [16]byte
+	var layout [32]byte
+	if !readWords(large, boardSalt, salt[:]) ||
+		!readWords(large, boardLayout, layout[:]) {
+		return errNoReveal
+	}
+
+	var flag *cell
+	if f, ok := readFlag(large); ok {
+		flag = &f
+	}
+	if layoutHash(salt, layout, flag) != hash {
+		return errCommitMismatch
+	}
+
+	// ships outside of the board would not be counted
+	b := unpackLayout(layout, maxBoardSize, maxBoardSize)
+	if !fleetLayout(b) {
+		return errFleetMismatch
+	}
+	if flag != nil && (!remote.inside(flag.X, flag.Y) || b.Board[flag.Y][flag.X] == stateShip) {
+		return errFlagMismatch
+	}
+
+	for y, stripe := range b.Board {
+		for x, s := range stripe {
+			ship := s == stateShip
+			if ship && !remote.inside(x, y) {
+				return errFleetMismatch
+			}
+
+			r := remote.Board[y][x]
+			if (r == stateHit && !ship) || (r == stateAttempt && ship) {
+				return errResultMismatch
+			}
+		}
+	}
+	return nil
+}
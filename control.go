@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+)
+
+var controlCA = flag.String("controlCA", "",
+	"The CA certificate the router side of a tls:// -sockFile or -exabgpIn is checked "+
+		"against, the system ones without it")
+
+var controlCert = flag.String("controlCert", "",
+	"Client certificate to log in to a tls:// -sockFile or -exabgpIn with")
+
+var controlKey = flag.String("controlKey", "",
+	"The key of -controlCert")
+
+/*
+The control channel to the router doesn't have to be a unix socket or a
+named pipe on this machine, -sockFile and -exabgpIn/-exabgpOut also take
+
+tcp://host:port    plain TCP, for a tunnel or a trusted network
+tls://host:port    TLS, with -controlCA and -controlCert/-controlKey
+
+so the game can run on a laptop, Windows and macOS included, while the
+router lives in a rack. Something has to forward the connection to the
+router there, for bird:
+
+socat openssl-listen:3179,reuseaddr,fork,cert=server.pem,cafile=ca.pem \
+	unix-connect:/run/bird/bird.ctl
+
+with cafile (and verify, the default) only the holders of a client
+certificate signed by ca.pem get in, that is the authentication. ExaBGP
+is the same with a process that relays its API to the connection, give
+both -exabgpIn and -exabgpOut the address.
+
+bird still reads its config from files: with a remote bird the reading
+side works as is, to announce -confFile (or -staticFile) has to be where
+bird sees it too, like a shared mount, or announce through another
+router and read through bird with -rxBackend.
+*/
+
+var errControlKey = fmt.Errorf("-controlCert needs -controlKey")
+
+// remoteControl tells if addr is a tcp:// or tls:// address
+func remoteControl(addr string) bool {
+	return strings.HasPrefix(addr, "tcp://") || strings.HasPrefix(addr, "tls://")
+}
+
+func controlTLSConfig(host string) (*tls.Config, error) {
+	c := &tls.Config{ServerName: host}
+	if *controlCA != "" {
+		pem, err := ioutil.ReadFile(*controlCA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in %s", *controlCA)
+		}
+	}
+	if *controlCert != "" {
+		if *controlKey == "" {
+			return nil, errControlKey
+		}
+		cert, err := tls.LoadX509KeyPair(*controlCert, *controlKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// dialControl connects to the control channel of a router, a unix socket
+// unless addr is tcp:// or tls://.
+func dialControl(ctx context.Context, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: *dialTimeout}
+	switch {
+	case strings.HasPrefix(addr, "tcp://"):
+		return d.DialContext(ctx, "tcp", strings.TrimPrefix(addr, "tcp://"))
+	case strings.HasPrefix(addr, "tls://"):
+		hostport := strings.TrimPrefix(addr, "tls://")
+		host, _, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return nil, err
+		}
+		config, err := controlTLSConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := d.DialContext(ctx, "tcp", hostport)
+		if err != nil {
+			return nil, err
+		}
+		tc := tls.Client(conn, config)
+		tc.SetDeadline(time.Now().Add(*dialTimeout))
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS to %s failed: %s", hostport, err.Error())
+		}
+		tc.SetDeadline(time.Time{})
+		return tc, nil
+	}
+	return d.DialContext(ctx, "unix", addr)
+}
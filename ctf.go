@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+var ctfMode = flag.Bool("ctf", false,
+	"Play capture the flag, every board hides a flag and the first shot at it wins the game")
+
+/*
+In capture the flag (modeFlag in the handshake) every board hides a flag
+on a cell without a ship, picked at random or with -place. A shot at it
+ends the game right away: the side whose flag it was sends its GameOver
+move with the gameOverFlag payload, with the result of the shot (a miss,
+there is no ship there) as usual.
+
+The flag is part of the board commitment, the hash is then
+
+SHA-256(salt | layout | X << 4 | Y)
+
+and it's revealed with the rest of the board:
+
+(communityASN, boardFlag, X << 8 | Y)
+
+Whoever captured it checks that the flag was revealed where it shot,
+the other side that it never shot the flag without the game ending.
+*/
+
+const boardFlag = 57
+
+var errFlagMismatch = fmt.Errorf("Revealed flag does not match how the game ended")
+
+// hideFlag puts the flag of b on a cell without a ship picked at
+// random.
+func (b *battleShipBoard) hideFlag() {
+	var free []cell
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			if b.Board[y][x] == stateEmpty {
+				free = append(free, cell{x, y})
+			}
+		}
+	}
+	if len(free) > 0 {
+		c := free[rand.Intn(len(free))]
+		b.Flag = &c
+	}
+}
+
+// flagAt tells if the flag of b is on c
+func (b *battleShipBoard) flagAt(c cell) bool {
+	return b.Flag != nil && *b.Flag == c
+}
+
+func flagCommunity(c cell) bgpLargeCommunity {
+	return sessionCommunity(boardFlag, uint32(c.X<<8|c.Y))
+}
+
+// readFlag returns the flag revealed in large, if it is.
+func readFlag(large []bgpLargeCommunity) (cell, bool) {
+	for _, c := range large {
+		if c.Data1 == boardFlag {
+			return cell{X: int(c.Data2 >> 8 & 0xff), Y: int(c.Data2 & 0xff)}, true
+		}
+	}
+	return cell{}, false
+}
+
+// checkFlag makes sure the flag the other side revealed agrees with how
+// the game ended, we shot it only if we captured it.
+func (g *game) checkFlag(large []bgpLargeCommunity) error {
+	f, ok := readFlag(large)
+	if !ok || !g.RemoteB.inside(f.X, f.Y) {
+		return errFlagMismatch
+	}
+	shot := g.RemoteB.Board[f.Y][f.X] == stateAttempt
+	if shot != (g.won && g.captured) {
+		return errFlagMismatch
+	}
+	return nil
+}
+
+// mode is the game mode of g, as in the handshake
+func (g *game) mode() uint32 {
+	mode := uint32(modeClassic)
+	if g.salvo {
+		mode |= modeSalvo
+	}
+	if g.ctf {
+		mode |= modeFlag
+	}
+	return mode
+}
+
+// modeName is how mode is written, as in the Mode tag of export
+func modeName(mode uint32) string {
+	var o []string
+	if mode&modeSalvo != 0 {
+		o = append(o, "salvo")
+	}
+	if mode&modeFlag != 0 {
+		o = append(o, "ctf")
+	}
+	if len(o) == 0 {
+		return "classic"
+	}
+	return strings.Join(o, "+")
+}
+
+// parseModeName reads a mode written by modeName
+func parseModeName(name string) (uint32, error) {
+	var mode uint32
+	for _, f := range strings.Split(name, "+") {
+		switch f {
+		case "classic":
+		case "salvo":
+			mode |= modeSalvo
+		case "ctf":
+			mode |= modeFlag
+		default:
+			return 0, fmt.Errorf("Unknown game mode %s", name)
+		}
+	}
+	return mode, nil
+}
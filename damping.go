@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var minAnnounceInterval = flag.Duration("minAnnounceInterval", 0,
+	"Wait at least this long between two changes to what we announce, so that "+
+		"upstreams don't damp the game prefix for flapping")
+
+/*
+Route flap damping (RFC 2439, and the RIPE-580 defaults) gives a prefix
+a penalty for every update and suppresses it for a while once the
+penalty is high enough, which a game announcing a new move every few
+seconds can get. -minAnnounceInterval spaces out the announcements, a
+move made sooner waits.
+
+With -risLive, our prefix being withdrawn at a collector peer shortly
+after we changed it, while we still announce it, looks like damping: a
+warning is logged and the interval doubles (from dampingBackoff if there
+is none), up to 16 times. It goes back once nothing was seen for
+dampingHalfLife, the usual half life of a penalty.
+*/
+
+const (
+	dampingBackoff  = 10 * time.Second
+	dampingHalfLife = 15 * time.Minute
+	// how soon after our change a withdrawal is blamed on damping
+	dampingWindow = 5 * time.Minute
+	dampingMax    = 16
+)
+
+// announceLimiter spaces out the writes to the router
+type announceLimiter struct {
+	mu      sync.Mutex
+	last    time.Time
+	backoff int
+	damped  time.Time
+}
+
+var limiter = &announceLimiter{backoff: 1}
+
+func (a *announceLimiter) interval() time.Duration {
+	if a.backoff > 1 && time.Since(a.damped) > dampingHalfLife {
+		mainLog.Infof("No damping seen for %s, announcing at the usual pace again", dampingHalfLife)
+		a.backoff = 1
+	}
+	if a.backoff == 1 {
+		return *minAnnounceInterval
+	}
+	base := *minAnnounceInterval
+	if base < dampingBackoff {
+		base = dampingBackoff
+	}
+	return base * time.Duration(a.backoff)
+}
+
+// wait holds a write back until the interval since the last one is
+// over.
+func (a *announceLimiter) wait(ctx context.Context) error {
+	a.mu.Lock()
+	next := a.last.Add(a.interval())
+	a.mu.Unlock()
+
+	if d := time.Until(next); d > 0 {
+		mainLog.Debugf("Holding the announcement back for %s", d.Round(time.Millisecond))
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	a.mu.Lock()
+	a.last = time.Now()
+	a.mu.Unlock()
+	return nil
+}
+
+// withdrawn is told that a collector peer withdrew the prefix of m, it
+// backs off if that came soon after we changed it.
+func (a *announceLimiter) withdrawn(m *match, peer string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	since := time.Since(a.last)
+	if a.last.IsZero() || since > dampingWindow {
+		return
+	}
+	if a.backoff < dampingMax {
+		a.backoff *= 2
+	}
+	a.damped = time.Now()
+	m.log.Warnf("%s withdrew %s %s after we changed it, it's likely damping the prefix "+
+		"for flapping, waiting %s between announcements for now", peer, m.Prefix,
+		since.Round(time.Second), a.interval())
+}
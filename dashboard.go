@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var httpListen = flag.String("http", "",
+	"Serve a web dashboard of the game on this address, like :8080")
+
+type dashboardMove struct {
+	Counter int
+	Ours    bool
+	Shots   []string
+	Time    time.Time
+	// for our moves, how long the other side took to answer, that's
+	// its thinking as much as the way there and back
+	AnswerTime string `json:",omitempty"`
+	// how long they took to reach the RIS collectors, with -risLive
+	Propagation string `json:",omitempty"`
+}
+
+type dashboardState struct {
+	Width, Height int
+	Local, Remote [][]string
+	Moves         []dashboardMove
+
+	Prefix      string
+	LastPoll    time.Time
+	RouterError string
+
+	Over, Won bool
+	Offline   bool
+	// the BGP session to the other side, up or down, empty if the
+	// router can't tell
+	Session string `json:",omitempty"`
+	// our flag in capture the flag, like E5
+	Flag string `json:",omitempty"`
+	// the last chat message of the other side
+	Chat string `json:",omitempty"`
+}
+
+// dashboard keeps a copy of the game state for the web UI, so that the
+// HTTP handlers never touch the game itself. A nil dashboard does
+// nothing.
+type dashboard struct {
+	mu          sync.Mutex
+	state       dashboardState
+	subscribers map[chan []byte]bool
+}
+
+func startDashboard(addr, prefix string) *dashboard {
+	if addr == "" {
+		return nil
+	}
+
+	d := &dashboard{
+		state:       dashboardState{Prefix: prefix},
+		subscribers: make(map[chan []byte]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, dashboardPage)
+	})
+	mux.HandleFunc("/state", d.serveState)
+	mux.HandleFunc("/events", d.serveEvents)
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	go func() {
+		dashboardLog.Fatalf("Unable to serve dashboard %s",
+			http.ListenAndServe(addr, mux).Error())
+	}()
+
+	dashboardLog.Infof("Dashboard running on %s", addr)
+	return d
+}
+
+func boardStrings(b battleShipBoard) [][]string {
+	o := make([][]string, b.Height)
+	for y := range o {
+		o[y] = make([]string, b.Width)
+		for x := range o[y] {
+			o[y][x] = b.Board[y][x].String()
+		}
+	}
+	return o
+}
+
+// update copies the state of g, it has to be called from the goroutine
+// that owns g.
+func (d *dashboard) update(g *game) {
+	if d == nil {
+		return
+	}
+
+	moves := make([]dashboardMove, 0, len(g.moves))
+	for c, m := range g.moves {
+		dm := dashboardMove{Counter: c, Ours: g.ours(c), Time: m.At}
+		for _, s := range m.shots(g.salvo) {
+			dm.Shots = append(dm.Shots, s.String())
+		}
+		if dm.Ours && c+1 < len(g.moves) {
+			dm.AnswerTime = g.moves[c+1].At.Sub(m.At).Round(time.Second).String()
+		}
+		if first, last, peers := g.match.prop.delay(c); dm.Ours && peers > 0 {
+			dm.Propagation = fmt.Sprintf("%s - %s, %d peers",
+				first.Round(time.Second), last.Round(time.Second), peers)
+		}
+		moves = append(moves, dm)
+	}
+
+	d.mu.Lock()
+	d.state.Width, d.state.Height = g.LocalB.Width, g.LocalB.Height
+	d.state.Local = boardStrings(g.LocalB)
+	d.state.Remote = boardStrings(g.RemoteB)
+	d.state.Moves = moves
+	d.state.Over, d.state.Won = g.over, g.won
+	d.state.Offline = !g.offlineSince.IsZero()
+	d.state.Session = ""
+	if canSession(activeRouter) {
+		d.state.Session = "up"
+		if d.state.Offline {
+			d.state.Session = "down"
+		}
+	}
+	d.state.Chat = g.chatText
+	d.state.Flag = ""
+	if g.LocalB.Flag != nil {
+		d.state.Flag = g.LocalB.Flag.String()
+	}
+	d.mu.Unlock()
+
+	d.broadcast()
+}
+
+// polled records the outcome of reading the other side's communities.
+func (d *dashboard) polled(err error) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	changed := (err == nil) != (d.state.RouterError == "")
+	d.state.LastPoll = time.Now()
+	d.state.RouterError = ""
+	if err != nil {
+		d.state.RouterError = err.Error()
+	}
+	d.mu.Unlock()
+
+	if changed {
+		d.broadcast()
+	}
+}
+
+func (d *dashboard) marshal() []byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, _ := json.Marshal(d.state)
+	return b
+}
+
+func (d *dashboard) broadcast() {
+	b := d.marshal()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ch := range d.subscribers {
+		select {
+		case ch <- b:
+		default:
+			// slow client, it will get the next one
+		}
+	}
+}
+
+// serveMetrics exports the propagation of the moves of every game.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	matchesMu.Lock()
+	ms := append([]*match(nil), matches...)
+	matchesMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range ms {
+		m.prop.writeMetrics(w)
+	}
+}
+
+func (d *dashboard) serveState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(d.marshal())
+}
+
+// serveEvents streams the state as server-sent events on every change.
+func (d *dashboard) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ch := make(chan []byte, 4)
+	d.mu.Lock()
+	d.subscribers[ch] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.subscribers, ch)
+		d.mu.Unlock()
+	}()
+
+	fmt.Fprintf(w, "data: %s\n\n", d.marshal())
+	flusher.Flush()
+
+	for {
+		select {
+		case b := <-ch:
+			fmt.Fprintf(w, "data: %s\n\n", b)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>BGP Battleships</title>
+<style>
+body { font-family: monospace; background: #111; color: #ddd; }
+.boards { display: flex; gap: 40px; }
+table.board { border-collapse: collapse; }
+table.board td { width: 18px; height: 18px; text-align: center; }
+td.empty { background: #333; }
+td.ship { background: #eee; }
+td.hit { background: #d22; }
+td.attempt { background: #cc0; }
+td.flag { background: #36f; }
+#status.error { color: #f55; }
+#moves td { padding: 0 8px; }
+</style>
+</head>
+<body>
+<h1>BGP Battleships</h1>
+<div id="status"></div>
+<div id="chat"></div>
+<div class="boards">
+<div><h2>Your Side</h2><table class="board" id="local"></table></div>
+<div><h2>Player Two</h2><table class="board" id="remote"></table></div>
+</div>
+<h2>Moves</h2>
+<table id="moves"></table>
+<script>
+function drawBoard(el, rows, flag) {
+	var letters = "ABCDEFGHIJKLMNOP";
+	var html = "<tr><td></td>";
+	for (var x = 0; x < (rows[0] || []).length; x++) html += "<td>" + letters[x] + "</td>";
+	html += "</tr>";
+	rows.forEach(function(row, y) {
+		html += "<tr><td>" + y + "</td>";
+		row.forEach(function(c, x) {
+			if (flag == letters[x] + y) c = "flag";
+			html += '<td class="' + c + '"></td>';
+		});
+		html += "</tr>";
+	});
+	el.innerHTML = html;
+}
+
+function draw(s) {
+	drawBoard(document.getElementById("local"), s.Local || [], s.Flag);
+	drawBoard(document.getElementById("remote"), s.Remote || []);
+
+	var status = document.getElementById("status");
+	var text = "Watching " + s.Prefix + ", last polled " + new Date(s.LastPoll).toLocaleTimeString();
+	if (s.Session) text += ", BGP session " + s.Session;
+	if (s.RouterError) text += ", router error: " + s.RouterError;
+	if (s.Offline && !s.Over) text += " - opponent offline";
+	if (s.Over) text += s.Won ? " - you won!" : " - you lost!";
+	status.textContent = text;
+	status.className = s.RouterError ? "error" : "";
+	document.getElementById("chat").textContent = s.Chat ? "Them: " + s.Chat : "";
+
+	var html = "<tr><th>#</th><th>Who</th><th>Shots</th><th>Time</th><th>Answered in</th><th>Reached collectors</th></tr>";
+	(s.Moves || []).slice().reverse().forEach(function(m) {
+		html += "<tr><td>" + m.Counter + "</td><td>" + (m.Ours ? "You" : "Them") + "</td><td>" +
+			(m.Shots || []).join(" ") + "</td><td>" + new Date(m.Time).toLocaleTimeString() +
+			"</td><td>" + (m.AnswerTime || "") + "</td><td>" + (m.Propagation || "") + "</td></tr>";
+	});
+	document.getElementById("moves").innerHTML = html;
+}
+
+new EventSource("/events").onmessage = function(e) { draw(JSON.parse(e.data)); };
+</script>
+</body>
+</html>
+`
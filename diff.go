@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mgutz/ansi"
+)
+
+/*
+diff, at the prompt or as ctl diff <game> (GET /games/<name>/diff), puts
+side by side what we think we announce, what the router shows of our
+route and what was last read of the route of the other side:
+
+  = (65000,16389)   in both
+  - (65000,16390)   announced by us, but not on the router (yet)
+  + (65000,16388)   on the router, but not announced by us anymore
+
+A route with - and + lines is the router still announcing an older
+move, which is what the other side sees. bird is asked for the route as
+it exports it over the session of the other side, -peerSession or the
+one its route comes from, or for the route in its table until that is
+known. The other routers show the route of our prefix as they read it.
+*/
+
+// announcedRouter is a router that can tell what it announces to the
+// other side, rather than what it has in its table.
+type announcedRouter interface {
+	// announced returns the communities on the route to prefix as the
+	// other side on peerPrefix gets it, and where they were looked at
+	announced(ctx context.Context, prefix, peerPrefix string) ([]bgpCommunity, []bgpLargeCommunity, string, error)
+}
+
+type diffCommunity struct {
+	Community string
+	Text      string `json:",omitempty"`
+	Problem   string `json:",omitempty"`
+	// announced by us, on the router
+	Announced bool `json:",omitempty"`
+	Router    bool `json:",omitempty"`
+}
+
+type routeDiff struct {
+	Game   string
+	Prefix string
+	Ours   []diffCommunity
+	// where the router was looked at, like export to peer1
+	RouterView string
+	RouterErr  string `json:",omitempty"`
+
+	PeerPrefix string
+	Seen       []diffCommunity
+	SeenAt     time.Time
+	SeenErr    string `json:",omitempty"`
+	// the counter of the move last seen, -1 if none was, and how many
+	// moves we have
+	Counter int
+	Moves   int
+}
+
+func (r *birdRouter) announced(ctx context.Context, prefix, peerPrefix string) ([]bgpCommunity, []bgpLargeCommunity, string, error) {
+	cmd, view := "show route all "+prefix, "table"
+	if session, err := r.sessionOf(peerPrefix); err == nil {
+		cmd, view = fmt.Sprintf("show route all %s export %s", prefix, session), "export to "+session
+	}
+	reply, err := birdCommand(ctx, cmd)
+	if err == nil {
+		err = birdReplyError(reply)
+	}
+	if err != nil {
+		return nil, nil, view, err
+	}
+	o, lo, _ := parseBirdRoute(reply)
+	return o, lo, view, nil
+}
+
+func (r *splitRouter) announced(ctx context.Context, prefix, peerPrefix string) ([]bgpCommunity, []bgpLargeCommunity, string, error) {
+	return readAnnounced(ctx, r.tx, prefix, peerPrefix)
+}
+
+func (r *bmpRouter) announced(ctx context.Context, prefix, peerPrefix string) ([]bgpCommunity, []bgpLargeCommunity, string, error) {
+	return readAnnounced(ctx, r.tx, prefix, peerPrefix)
+}
+
+// readAnnounced asks r what it announces on prefix, routers that can't
+// tell show the route as they read it.
+func readAnnounced(ctx context.Context, r router, prefix, peerPrefix string) ([]bgpCommunity, []bgpLargeCommunity, string, error) {
+	if ar, ok := r.(announcedRouter); ok {
+		return ar.announced(ctx, prefix, peerPrefix)
+	}
+	o, lo, err := r.read(ctx, prefix)
+	return o, lo, "route", err
+}
+
+// diffCommunities decodes the communities of the game on asn, the
+// others are only written out.
+func diffCommunities(asn int, communities []bgpCommunity, large []bgpLargeCommunity) []diffCommunity {
+	o := make([]diffCommunity, 0, len(communities)+len(large))
+	for _, c := range communities {
+		d := diffCommunity{Community: fmt.Sprintf("(%d,%d)", c.AS, c.Data)}
+		if int(c.AS) == asn {
+			_, d.Text, d.Problem = decodeCommunity(c)
+		}
+		o = append(o, d)
+	}
+	for _, c := range large {
+		d := diffCommunity{Community: fmt.Sprintf("(%d,%d,%d)", c.Global, c.Data1, c.Data2)}
+		if c.Global == uint32(asn) {
+			d.Text, d.Problem = decodeLargeCommunity(c)
+		}
+		o = append(o, d)
+	}
+	return o
+}
+
+// diffOf puts together the diff of g, the router is asked for our
+// route.
+func diffOf(g *game) routeDiff {
+	m := g.match
+	d := routeDiff{Game: m.Name, Prefix: m.Prefix, PeerPrefix: m.PeerPrefix,
+		Counter: -1, Moves: len(g.moves)}
+
+	matchesMu.Lock()
+	d.Ours = diffCommunities(m.ASN, m.communities, m.large)
+	matchesMu.Unlock()
+
+	communities, large, view, err := readAnnounced(routerCtx, activeRouter, m.Prefix, m.PeerPrefix)
+	d.RouterView = view
+	if err != nil {
+		d.RouterErr = err.Error()
+	}
+	index := make(map[string]int)
+	for i := range d.Ours {
+		d.Ours[i].Announced = true
+		index[d.Ours[i].Community] = i
+	}
+	for _, c := range diffCommunities(m.ASN, communities, large) {
+		if i, ok := index[c.Community]; ok {
+			d.Ours[i].Router = true
+			continue
+		}
+		c.Router = true
+		d.Ours = append(d.Ours, c)
+	}
+
+	m.timeline.mu.Lock()
+	route, seen := m.timeline.route, m.timeline.seen
+	m.timeline.mu.Unlock()
+	if !seen.At.IsZero() {
+		d.Seen = diffCommunities(m.ASN, route.communities, route.large)
+		d.SeenAt, d.SeenErr, d.Counter = seen.At, seen.Err, seen.Counter
+	}
+	return d
+}
+
+var cdiffSame = ansi.ColorCode("green")
+var cdiffMissing = ansi.ColorCode("red+h")
+var cdiffExtra = ansi.ColorCode("yellow+h")
+
+// describeDiff writes d out, the lines that differ in colour unless
+// plain is set.
+func describeDiff(d routeDiff, plain bool) string {
+	paint := func(code, s string) string {
+		if plain {
+			return s
+		}
+		return code + s + ansi.Reset
+	}
+	line := func(b *strings.Builder, mark string, c diffCommunity, note string) {
+		text := c.Text
+		if note != "" {
+			text += "  " + note
+		}
+		fmt.Fprintf(b, "  %s %-22s %s\n", mark, c.Community, text)
+		if c.Problem != "" {
+			fmt.Fprintf(b, "    !! %s\n", c.Problem)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: our route %s as we announce it and on the router (%s)\n",
+		d.Game, d.Prefix, d.RouterView)
+	missing, extra := 0, 0
+	for _, c := range d.Ours {
+		switch {
+		case c.Announced && c.Router:
+			line(&b, paint(cdiffSame, "="), c, "")
+		case c.Announced:
+			missing++
+			line(&b, paint(cdiffMissing, "-"), c, paint(cdiffMissing, "not on the router"))
+		default:
+			extra++
+			line(&b, paint(cdiffExtra, "+"), c, paint(cdiffExtra, "not announced by us"))
+		}
+	}
+	switch {
+	case d.RouterErr != "":
+		fmt.Fprintf(&b, "%s\n", paint(cdiffMissing, "Unable to read it from the router: "+d.RouterErr))
+	case missing+extra == 0:
+		fmt.Fprintf(&b, "%s\n", paint(cdiffSame, "The router announces what we do"))
+	default:
+		fmt.Fprintf(&b, "%s\n", paint(cdiffMissing, fmt.Sprintf("%d of ours are not on the router and "+
+			"%d on it aren't ours, the other side sees an older move until it catches up",
+			missing, extra)))
+	}
+
+	if d.SeenAt.IsZero() {
+		fmt.Fprintf(&b, "\nNothing read of the route of the other side %s yet\n", d.PeerPrefix)
+		return b.String()
+	}
+	fmt.Fprintf(&b, "\nThe route of the other side %s, as read since %s\n",
+		d.PeerPrefix, d.SeenAt.Local().Format("15:04:05"))
+	for _, c := range d.Seen {
+		line(&b, " ", c, "")
+	}
+	switch c := expandCounter(d.Counter, d.Moves); {
+	case d.SeenErr != "":
+		fmt.Fprintf(&b, "%s\n", paint(cdiffMissing, "Not taken as a move: "+d.SeenErr))
+	case d.Counter < 0:
+		fmt.Fprintf(&b, "%s\n", paint(cdiffExtra, "No move on it"))
+	case c >= d.Moves:
+		fmt.Fprintf(&b, "%s\n", paint(cdiffMissing, fmt.Sprintf("The other side is at move %d, "+
+			"we have %d moves", c, d.Moves)))
+	case c < d.Moves-2:
+		fmt.Fprintf(&b, "%s\n", paint(cdiffExtra, fmt.Sprintf("Move %d, the other side is behind "+
+			"our %d moves", c, d.Moves)))
+	default:
+		fmt.Fprintf(&b, "%s\n", paint(cdiffSame, fmt.Sprintf("Move %d, up to date with our %d moves",
+			c, d.Moves)))
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var dryRun = flag.Bool("dry-run", false,
+	"Print the config changes and router commands instead of making them, "+
+		"to check what the game would do to a router before trusting it")
+
+// dryRunCommand shows a command that would have been sent to the
+// router.
+func dryRunCommand(router, cmd string) {
+	fmt.Printf("dry-run %s> %s\n", router, cmd)
+}
+
+// how many unchanged lines are shown around a change
+const diffContext = 3
+
+// unifiedDiff compares the lines of old and new, like diff -u. Configs
+// are short enough for the plain LCS table.
+func unifiedDiff(name, old, new string) string {
+	a := strings.SplitAfter(old, "\n")
+	b := strings.SplitAfter(new, "\n")
+	if a[len(a)-1] == "" {
+		a = a[:len(a)-1]
+	}
+	if b[len(b)-1] == "" {
+		b = b[:len(b)-1]
+	}
+
+	// lcs[i][j] is the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	type diffLine struct {
+		op   byte
+		text string
+		// line numbers in a and b, before this line
+		ai, bi int
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i], i, j})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i], i, j})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var o strings.Builder
+	for k := 0; k < len(lines); {
+		if lines[k].op == ' ' {
+			k++
+			continue
+		}
+
+		// a hunk runs until diffContext*2 unchanged lines in a row
+		start := k - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end, same := k, 0
+		for ; end < len(lines) && same <= diffContext*2; end++ {
+			if lines[end].op == ' ' {
+				same++
+			} else {
+				same = 0
+			}
+		}
+		end -= same - diffContext
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		if o.Len() == 0 {
+			fmt.Fprintf(&o, "--- %s\n+++ %s (new)\n", name, name)
+		}
+		na, nb := 0, 0
+		for _, l := range lines[start:end] {
+			if l.op != '+' {
+				na++
+			}
+			if l.op != '-' {
+				nb++
+			}
+		}
+		fmt.Fprintf(&o, "@@ -%d,%d +%d,%d @@\n",
+			hunkStart(lines[start].ai, na), na, hunkStart(lines[start].bi, nb), nb)
+		for _, l := range lines[start:end] {
+			o.WriteByte(l.op)
+			o.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				o.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		k = end
+	}
+	return o.String()
+}
+
+// diff counts lines from 1, but an empty side of a hunk is given by the
+// line before it
+func hunkStart(i, n int) int {
+	if n == 0 {
+		return i
+	}
+	return i + 1
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var exabgpIn = flag.String("exabgpIn", "",
+	"Where ExaBGP writes its JSON API messages to us, like a named pipe, "+
+		"or a tcp:// or tls:// address relayed to ExaBGP")
+
+var exabgpOut = flag.String("exabgpOut", "",
+	"Where we write ExaBGP API commands to, like a named pipe, or the "+
+		"address of -exabgpIn")
+
+/*
+The exabgp backend speaks the ExaBGP API, the received updates have to
+be JSON encoded. As the game itself uses stdin and stdout the API is
+spoken over two named pipes, relayed by the ExaBGP process:
+
+process battleships {
+	run /bin/sh -c "cat /run/battleships.out & exec cat > /run/battleships.in";
+	encoder json;
+}
+
+neighbor 192.0.2.1 {
+	...
+	api {
+		processes [ battleships ];
+		receive { parsed; update; }
+	}
+}
+*/
+
+// exabgpWriter is a named pipe or a connection, see control.go
+type exabgpWriter interface {
+	io.Writer
+	SetWriteDeadline(t time.Time) error
+}
+
+type exabgpRouter struct {
+	out exabgpWriter
+
+	mu     sync.Mutex
+	routes map[string]exabgpRoute
+	// what we announced, to withdraw what's gone
+	announced map[string]bool
+	// FlowSpec rules announced, see nuke.go
+	flows map[flowRule]bool
+}
+
+type exabgpRoute struct {
+	communities []bgpCommunity
+	large       []bgpLargeCommunity
+	path        []uint32
+}
+
+type exabgpMessage struct {
+	Type     string `json:"type"`
+	Neighbor struct {
+		Message struct {
+			Update struct {
+				Attribute struct {
+					Community      [][2]uint32     `json:"community"`
+					LargeCommunity [][3]uint32     `json:"large-community"`
+					ASPath         json.RawMessage `json:"as-path"`
+				} `json:"attribute"`
+				// family -> next hop -> NLRIs
+				Announce map[string]map[string]json.RawMessage `json:"announce"`
+				// family -> NLRIs
+				Withdraw map[string]json.RawMessage `json:"withdraw"`
+			} `json:"update"`
+		} `json:"message"`
+	} `json:"neighbor"`
+}
+
+var errExaBGPPipes = fmt.Errorf("The exabgp backend needs -exabgpIn and -exabgpOut")
+
+var errExaBGPRemote = fmt.Errorf("Over the network -exabgpIn and -exabgpOut are the same address")
+
+func newExaBGPRouter(in, out string) (*exabgpRouter, error) {
+	if in == "" || out == "" {
+		return nil, errExaBGPPipes
+	}
+
+	var w exabgpWriter
+	var r io.Reader
+	if remoteControl(in) || remoteControl(out) {
+		if in != out {
+			return nil, errExaBGPRemote
+		}
+		conn, err := dialControl(context.Background(), in)
+		if err != nil {
+			return nil, err
+		}
+		exabgpLog.Infof("Connected to ExaBGP on %s", in)
+		w, r = conn, conn
+	} else {
+		// opening a named pipe blocks until the other side opens it too
+		exabgpLog.Infof("Waiting for ExaBGP on %s and %s", in, out)
+		f, err := os.OpenFile(out, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		rf, err := os.Open(in)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		w, r = f, rf
+	}
+
+	e := &exabgpRouter{
+		out:       w,
+		routes:    make(map[string]exabgpRoute),
+		announced: make(map[string]bool),
+		flows:     make(map[flowRule]bool),
+	}
+	go e.receive(r)
+	return e, nil
+}
+
+// nlriPrefixes gets the prefixes out of a list of NLRIs, which depending
+// on the version of ExaBGP is a list of objects with the prefix in them
+// or an object keyed by the prefixes.
+func nlriPrefixes(raw json.RawMessage) []string {
+	var list []struct {
+		NLRI string `json:"nlri"`
+	}
+	if json.Unmarshal(raw, &list) == nil {
+		o := make([]string, 0, len(list))
+		for _, n := range list {
+			o = append(o, n.NLRI)
+		}
+		return o
+	}
+
+	var keyed map[string]json.RawMessage
+	json.Unmarshal(raw, &keyed)
+	o := make([]string, 0, len(keyed))
+	for prefix := range keyed {
+		o = append(o, prefix)
+	}
+	return o
+}
+
+func (e *exabgpRouter) receive(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var msg exabgpMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			exabgpLog.Debugf("Ignoring non JSON line from ExaBGP: %s", scanner.Text())
+			continue
+		}
+		if msg.Type != "update" {
+			continue
+		}
+		e.update(msg)
+	}
+	if err := scanner.Err(); err != nil {
+		exabgpLog.Errorf("Unable to read from ExaBGP %s", err.Error())
+	} else {
+		exabgpLog.Errorf("ExaBGP went away")
+	}
+}
+
+func (e *exabgpRouter) update(msg exabgpMessage) {
+	u := msg.Neighbor.Message.Update
+
+	route := exabgpRoute{path: exabgpASPath(u.Attribute.ASPath)}
+	for _, c := range u.Attribute.Community {
+		route.communities = append(route.communities,
+			bgpCommunity{AS: uint16(c[0]), Data: uint16(c[1])})
+	}
+	for _, c := range u.Attribute.LargeCommunity {
+		route.large = append(route.large,
+			bgpLargeCommunity{Global: c[0], Data1: c[1], Data2: c[2]})
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, nlris := range u.Withdraw {
+		for _, prefix := range nlriPrefixes(nlris) {
+			delete(e.routes, prefix)
+		}
+	}
+	for _, hops := range u.Announce {
+		for _, nlris := range hops {
+			for _, prefix := range nlriPrefixes(nlris) {
+				e.routes[prefix] = route
+				exabgpLog.Debugf("Route to %s with communities %v %v",
+					prefix, route.communities, route.large)
+			}
+		}
+	}
+}
+
+// exabgpASPath reads the as-path attribute, a list of ASNs in ExaBGP 4
+// and the segments in ExaBGP 5.
+func exabgpASPath(raw json.RawMessage) []uint32 {
+	var path []uint32
+	if json.Unmarshal(raw, &path) == nil {
+		return path
+	}
+
+	var segments map[string]struct {
+		Element string   `json:"element"`
+		Value   []uint32 `json:"value"`
+	}
+	if json.Unmarshal(raw, &segments) != nil {
+		return nil
+	}
+	for i := 0; i < len(segments); i++ {
+		s := segments[strconv.Itoa(i)]
+		if s.Element == "as-sequence" {
+			path = append(path, s.Value...)
+		}
+	}
+	return path
+}
+
+func (e *exabgpRouter) path(prefix string) ([]uint32, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	route, ok := e.routes[prefix]
+	return route.path, ok
+}
+
+func (e *exabgpRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	route, ok := e.routes[prefix]
+	if !ok {
+		return nil, nil, fmt.Errorf("No route to %s from ExaBGP", prefix)
+	}
+	return route.communities, route.large, nil
+}
+
+func exabgpAnnounce(prefix string, route exabgpRoute) string {
+	cmd := "announce route " + prefix + " next-hop self"
+	if len(route.communities) > 0 {
+		c := make([]string, 0, len(route.communities))
+		for _, community := range route.communities {
+			c = append(c, fmt.Sprintf("%d:%d", community.AS, community.Data))
+		}
+		cmd += " community [" + strings.Join(c, " ") + "]"
+	}
+	if len(route.large) > 0 {
+		c := make([]string, 0, len(route.large))
+		for _, community := range route.large {
+			c = append(c, fmt.Sprintf("%d:%d:%d",
+				community.Global, community.Data1, community.Data2))
+		}
+		cmd += " large-community [" + strings.Join(c, " ") + "]"
+	}
+	return cmd
+}
+
+// write announces every prefix of ms with the communities of all the
+// matches on it, ExaBGP replaces the attributes of routes it already
+// announces.
+func (e *exabgpRouter) write(ctx context.Context, ms []*match) error {
+	routes := make(map[string]exabgpRoute)
+	for _, m := range ms {
+		if m.Prefix == "" {
+			return fmt.Errorf("Game %s needs a prefix to announce", m.Name)
+		}
+		r := routes[m.Prefix]
+		r.communities = append(r.communities, m.communities...)
+		r.large = append(r.large, m.large...)
+		routes[m.Prefix] = r
+	}
+
+	var cmds []string
+	for prefix, route := range routes {
+		cmds = append(cmds, exabgpAnnounce(prefix, route))
+	}
+	sort.Strings(cmds)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for prefix := range e.announced {
+		if _, ok := routes[prefix]; !ok {
+			cmds = append(cmds, "withdraw route "+prefix+" next-hop self")
+			delete(e.announced, prefix)
+		}
+	}
+	for prefix := range routes {
+		e.announced[prefix] = true
+	}
+	if len(ms) == 0 {
+		// we're going away, so is the nuke
+		for r := range e.flows {
+			cmds = append(cmds, "withdraw "+exabgpFlow(r))
+			delete(e.flows, r)
+		}
+	}
+
+	return e.send(ctx, cmds)
+}
+
+func exabgpFlow(r flowRule) string {
+	return fmt.Sprintf("flow route { match { destination %s; protocol =%d; "+
+		"destination-port =%d; } then { discard; } }", r.Destination, r.Protocol, r.Port)
+}
+
+func (e *exabgpRouter) flow(ctx context.Context, r flowRule, announce bool) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	cmd := "withdraw " + exabgpFlow(r)
+	if announce {
+		cmd = "announce " + exabgpFlow(r)
+		e.flows[r] = true
+	} else {
+		delete(e.flows, r)
+	}
+	return e.send(ctx, []string{cmd})
+}
+
+// send writes API commands, e.mu has to be held.
+func (e *exabgpRouter) send(ctx context.Context, cmds []string) error {
+	if *dryRun {
+		for _, cmd := range cmds {
+			dryRunCommand("exabgp", cmd)
+		}
+		return nil
+	}
+
+	// ExaBGP not reading the pipe would block us forever
+	e.out.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	defer watchContext(ctx, func() { e.out.SetWriteDeadline(time.Unix(1, 0)) })()
+
+	for _, cmd := range cmds {
+		exabgpLog.Debugf("> %s", cmd)
+		if _, err := fmt.Fprintln(e.out, cmd); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var fleetFlag = flag.String("fleet", "classic",
+	"Ships to play with, a preset (classic, russian or small) or a list "+
+		"of sizes or name:size, like carrier:5,cruiser:3,3,2")
+
+/*
+Both sides have to play with the same fleet, it's announced in the
+handshake as the size of every ship, 4 bits each with the first ship in
+the top bits, 8 ships to a word:
+
+(communityASN, helloFleet+i, word i)
+
+A side that doesn't announce its fleet plays the classic one. Sunk
+ships are told by their index in the fleet.
+*/
+
+type fleetShip struct {
+	name string
+	size int
+}
+
+var fleetPresets = map[string][]fleetShip{
+	"classic": {
+		{"carrier", 5}, {"battleship", 4}, {"cruiser", 3}, {"submarine", 3},
+		{"destroyer", 2},
+	},
+	"russian": {
+		{"battleship", 4}, {"cruiser", 3}, {"cruiser", 3},
+		{"destroyer", 2}, {"destroyer", 2}, {"destroyer", 2},
+		{"submarine", 1}, {"submarine", 1}, {"submarine", 1}, {"submarine", 1},
+	},
+	"small": {
+		{"cruiser", 3}, {"destroyer", 2}, {"destroyer", 2},
+	},
+}
+
+// names of ships given only by their size
+var shipSizeNames = map[int]string{
+	1: "submarine",
+	2: "destroyer",
+	3: "cruiser",
+	4: "battleship",
+	5: "carrier",
+}
+
+// 2 words of 8 ships
+const maxFleet = 16
+
+var errBadFleet = fmt.Errorf("A fleet has 1 to 16 ships of 1 to 15 cells")
+var errOtherFleet = fmt.Errorf("Other side wants to play with another fleet")
+
+// parseFleet reads a -fleet value.
+func parseFleet(spec string) ([]fleetShip, error) {
+	if preset, ok := fleetPresets[spec]; ok {
+		return preset, nil
+	}
+
+	var o []fleetShip
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.TrimSpace(f)
+		name, sizeText := "", f
+		if i := strings.LastIndex(f, ":"); i >= 0 {
+			name, sizeText = f[:i], f[i+1:]
+		}
+		size, err := strconv.Atoi(sizeText)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown fleet %s", spec)
+		}
+		if size < 1 || size > 15 {
+			return nil, errBadFleet
+		}
+		if name == "" {
+			name = shipSizeNames[size]
+		}
+		if name == "" {
+			name = fmt.Sprintf("%d cell ship", size)
+		}
+		o = append(o, fleetShip{name, size})
+	}
+	if len(o) > maxFleet {
+		return nil, errBadFleet
+	}
+	return o, nil
+}
+
+// setupFleet puts the ships of -fleet in fleet and fleetNames, it has
+// to be called once the flags are parsed.
+func setupFleet() error {
+	ships, err := parseFleet(*fleetFlag)
+	if err != nil {
+		return err
+	}
+
+	fleet, fleetNames = nil, nil
+	for _, s := range ships {
+		fleet = append(fleet, s.size)
+		fleetNames = append(fleetNames, s.name)
+	}
+	return nil
+}
+
+// fleetFits tells if the fleet can be placed on a width x height board
+// with some room left.
+func fleetFits(width, height int) bool {
+	for _, size := range fleet {
+		if size > width && size > height {
+			return false
+		}
+	}
+	return fleetCells()*4 <= width*height*3
+}
+
+func fleetWords(sizes []int) (w [2]uint32) {
+	for i, size := range sizes {
+		w[i/8] |= uint32(size) << uint(28-4*(i%8))
+	}
+	return w
+}
+
+func readFleetWords(w [2]uint32) []int {
+	var o []int
+	for i := 0; i < maxFleet; i++ {
+		size := int(w[i/8] >> uint(28-4*(i%8)) & 0xf)
+		if size == 0 {
+			break
+		}
+		o = append(o, size)
+	}
+	return o
+}
+
+func fleetCommunities() []bgpLargeCommunity {
+	w := fleetWords(fleet)
+	return []bgpLargeCommunity{
+		sessionCommunity(helloFleet, w[0]),
+		sessionCommunity(helloFleet+1, w[1]),
+	}
+}
+
+// helloFleetSizes returns the fleet the other side announced in its
+// hello, the classic one if it didn't.
+func helloFleetSizes(hello map[uint32]uint32) []int {
+	if _, ok := hello[helloFleet]; !ok {
+		var o []int
+		for _, s := range fleetPresets["classic"] {
+			o = append(o, s.size)
+		}
+		return o
+	}
+	return readFleetWords([2]uint32{hello[helloFleet], hello[helloFleet+1]})
+}
+
+func sameFleet(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fleetLayout tells if the ship cells of b are made of exactly the
+// ships of the fleet.
+func fleetLayout(b battleShipBoard) bool {
+	if b.shipsLeft() != fleetCells() {
+		return false
+	}
+	return coverShips(&b, make([]bool, len(fleet)))
+}
+
+// coverShips takes ships of the fleet that are not used yet off the
+// ship cells of b until none are left. The first ship cell left has to
+// be the top or left end of a ship.
+func coverShips(b *battleShipBoard, used []bool) bool {
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			if b.Board[y][x] != stateShip {
+				continue
+			}
+
+			tried := make(map[int]bool)
+			for i, size := range fleet {
+				if used[i] || tried[size] {
+					continue
+				}
+				tried[size] = true
+
+				for _, sideways := range []bool{false, true} {
+					s := ship{X: x, Y: y, Size: size, Sideways: sideways}
+					if !b.setShip(s, stateShip, stateEmpty) {
+						continue
+					}
+					used[i] = true
+					if coverShips(b, used) {
+						return true
+					}
+					used[i] = false
+					b.setShip(s, stateEmpty, stateShip)
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// setShip turns the cells of s from one state to another, if they are
+// all inside the board and in the from state.
+func (b *battleShipBoard) setShip(s ship, from, to boardState) bool {
+	for _, c := range s.cells() {
+		if !b.inside(c.X, c.Y) || b.Board[c.Y][c.X] != from {
+			return false
+		}
+	}
+	for _, c := range s.cells() {
+		b.Board[c.Y][c.X] = to
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// Run with go test -fuzz FuzzDecodeMessage (or FuzzBirdRoute).
+
+// fuzzCommunities turns fuzzer bytes into communities, the first byte
+// says how many of them are 16 bit ones, the rest are large ones.
+func fuzzCommunities(data []byte) ([]bgpCommunity, []bgpLargeCommunity) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	n, data := int(data[0]), data[1:]
+
+	var communities []bgpCommunity
+	for ; n > 0 && len(data) >= 4; n-- {
+		communities = append(communities, bgpCommunity{
+			AS:   binary.BigEndian.Uint16(data),
+			Data: binary.BigEndian.Uint16(data[2:]),
+		})
+		data = data[4:]
+	}
+
+	var large []bgpLargeCommunity
+	for ; len(data) >= 12; data = data[12:] {
+		large = append(large, bgpLargeCommunity{
+			Global: binary.BigEndian.Uint32(data),
+			Data1:  binary.BigEndian.Uint32(data[4:]),
+			Data2:  binary.BigEndian.Uint32(data[8:]),
+		})
+	}
+	return communities, large
+}
+
+func fuzzSeed(communities []bgpCommunity, large []bgpLargeCommunity) []byte {
+	b := []byte{byte(len(communities))}
+	for _, c := range communities {
+		b = append(b, byte(c.AS>>8), byte(c.AS), byte(c.Data>>8), byte(c.Data))
+	}
+	for _, c := range large {
+		for _, v := range []uint32{c.Global, c.Data1, c.Data2} {
+			b = append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	return b
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	asn := 23456
+	for _, c := range moveCodecs {
+		msg := bgpMessage{Counter: 7, X: 3, Y: 9, HitOrMissOnLast: resultSunk,
+			Extended: []extendedCommunity{{extSunk, 2}}}
+		communities, large := c.codec.encode(msg)
+		for i := range communities {
+			communities[i].AS = uint16(asn)
+		}
+		for i := range large {
+			large[i].Global = uint32(asn)
+		}
+		large = append(large, chatCommunities(1, "hello there")...)
+		f.Add(fuzzSeed(communities, large))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		communities, large := fuzzCommunities(data)
+		for _, c := range communities {
+			decodeCommunity(c)
+		}
+		for _, c := range large {
+			decodeLargeCommunity(c)
+		}
+		readChat(large)
+		helloFields(asn, large)
+
+		for _, salvo := range []bool{false, true} {
+			msg, err := decodeMessage(asn, communities, large)
+			if err != nil {
+				continue
+			}
+			if msg.X < 0 || msg.X >= maxBoardSize || msg.Y < 0 || msg.Y >= maxBoardSize {
+				t.Fatalf("decoded a position outside of any board: %d,%d", msg.X, msg.Y)
+			}
+			m := messageMove(msg, salvo)
+			for _, s := range m.shots(salvo) {
+				if s.X < 0 || s.Y < 0 {
+					t.Fatalf("decoded a negative shot %v", s)
+				}
+			}
+		}
+	})
+}
+
+func FuzzBirdRoute(f *testing.F) {
+	f.Add("1007-10.0.1.0/24 unicast [peer1 12:00:00] * (100) [AS65001i]\n" +
+		"1008-\tType: BGP univ\n" +
+		"1012-\tBGP.origin: IGP\n" +
+		" \tBGP.as_path: 65002 {65003 65004} 65001\n" +
+		" \tBGP.community: (23456,16385) (23456,33000)\n" +
+		" \tBGP.large_community: (23456, 36, 1) (23456, 37, 197120)\n" +
+		"0000 \n")
+	f.Add("8001 Network not found\n")
+
+	f.Fuzz(func(t *testing.T, reply string) {
+		o, lo, _ := parseBirdRoute(reply)
+		decodeMessage(23456, o, lo)
+	})
+}
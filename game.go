@@ -0,0 +1,542 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type move struct {
+	X, Y            int
+	HitOrMissOnLast int
+	// in salvo mode all the shots of the move, and the result of
+	// each shot of the last move as a bitmask
+	Salvo     []cell
+	SalvoHits int
+	// set on the last message of the side that lost, it carries only
+	// the result of the last move
+	GameOver  bool
+	Surrender bool
+	// the game ended on a shot at the flag of the side that lost
+	Captured bool
+	// ships the last move of the other side sunk, results codec only
+	Sunk []int
+
+	// when the move was made or seen, local only
+	At time.Time
+}
+
+// game holds the state of a match. Every move made by either side is
+// kept in moves, indexed by its counter, so that they can be replayed
+// to a peer that lost track of the game.
+type game struct {
+	match *match
+
+	LocalB  battleShipBoard
+	RemoteB battleShipBoard
+
+	startFirst bool
+	moves      []move
+
+	salvo bool
+	// capture the flag, LocalB has the flag
+	ctf bool
+	// the results codec was negotiated, sunk ships are told
+	results bool
+	// both sides set -nuke
+	nukes bool
+	// from the handshake, or -peerASN, 0 if not known
+	peerASN uint32
+	// set if we are the attacker of a battle royale, see royale.go
+	royale *royale
+
+	// result of the last move the other side made on us, a bitmask
+	// in salvo mode
+	hitmiss int
+	// ships of ours the last move of the other side sunk
+	sunk []int
+	// ships of the other side we sunk
+	peerSunk []int
+	// the cells of them, as far as they could be told, see markWreck
+	peerWrecks map[cell]bool
+
+	// counter we asked the peer to resend, -1 if we are in sync
+	requested int
+	// counter we last replayed to the peer
+	replayed int
+
+	over, won bool
+	// we gave up, the game is over as soon as finish is called
+	surrendered bool
+	// the game ended on a shot at a flag, ours if we lost
+	captured bool
+	// the other side ran out of time
+	forfeited bool
+
+	// when every counter was first seen, and when we started
+	seen    map[int]time.Time
+	started time.Time
+	// counter of the turn the other side was warned about
+	warned int
+	// since when the session to the other side is down, and how long
+	// the turn pausedTurn was paused for so far
+	offlineSince time.Time
+	paused       time.Duration
+	pausedTurn   int
+
+	// ID of the last chat message of the other side shown, -1 if none
+	chatSeen int
+	chatText string
+
+	// moves of the other side we rejected, the last one of them, and
+	// the last rejection of ours we took back a move for, -1 if none
+	rejections    int
+	rejected      string
+	peerRejection int
+
+	commitment     boardCommitment
+	peerCommit     [32]byte
+	havePeerCommit bool
+}
+
+func newGame(m *match, local battleShipBoard, startFirst bool) *game {
+	return &game{
+		match:      m,
+		LocalB:     local,
+		RemoteB:    newBoard(local.Width, local.Height),
+		startFirst: startFirst,
+		requested:  -1,
+		replayed:   -1,
+		chatSeen:   -1,
+		seen:       make(map[int]time.Time),
+		started:    time.Now(),
+		warned:     -1,
+
+		peerRejection: -1,
+	}
+}
+
+// ours tells if the move with counter c is made by us, the side that
+// starts first gets the even ones.
+func (g *game) ours(c int) bool {
+	return (c%2 == 0) == g.startFirst
+}
+
+func (g *game) ourTurn() bool {
+	return g.ours(len(g.moves))
+}
+
+// lastOwn returns the last move we made and its counter
+func (g *game) lastOwn() (int, move) {
+	for i := len(g.moves) - 1; i >= 0; i-- {
+		if g.ours(i) {
+			return i, g.moves[i]
+		}
+	}
+	return 0, move{}
+}
+
+func (g *game) announce(c int, m move, extended ...extendedCommunity) error {
+	if g.royale != nil {
+		return g.royale.announce(g, c, m)
+	}
+	if m.GameOver {
+		reason := gameOverSunk
+		if m.Surrender {
+			reason = gameOverSurrender
+		} else if m.Captured {
+			reason = gameOverFlag
+		}
+		extended = append(extended, extendedCommunity{extGameOver, reason})
+	}
+	for _, i := range m.Sunk {
+		extended = append(extended, extendedCommunity{extSunk, i})
+	}
+	msg := bgpMessage{
+		Counter:         c,
+		X:               m.X,
+		Y:               m.Y,
+		HitOrMissOnLast: m.HitOrMissOnLast,
+		Extended:        extended,
+	}
+	if g.salvo {
+		msg.Large = salvoCommunities(m)
+	}
+	return g.match.writeMove(msg)
+}
+
+// salvoSize is how many shots we get for our next move
+func (g *game) salvoSize() int {
+	if !g.salvo {
+		return 1
+	}
+	return g.LocalB.shipsAfloat()
+}
+
+// shots returns all the shots of a move
+func (m move) shots(salvo bool) []cell {
+	if salvo || m.GameOver {
+		return m.Salvo
+	}
+	return []cell{{m.X, m.Y}}
+}
+
+// hit tells if shot i of the move before m was a hit
+func (m move) hit(i int, salvo bool) bool {
+	if salvo {
+		return m.SalvoHits&(1<<uint(i)) != 0
+	}
+	return m.HitOrMissOnLast == resultHit || m.HitOrMissOnLast == resultSunk
+}
+
+func messageMove(msg bgpMessage, salvo bool) move {
+	over, gameOver := msg.extended(extGameOver)
+	m := move{
+		X:               msg.X,
+		Y:               msg.Y,
+		HitOrMissOnLast: msg.HitOrMissOnLast,
+		GameOver:        gameOver,
+		Surrender:       gameOver && over.Payload == gameOverSurrender,
+		Captured:        gameOver && over.Payload == gameOverFlag,
+		At:              time.Now(),
+	}
+	for _, e := range msg.Extended {
+		if e.Type == extSunk {
+			m.Sunk = append(m.Sunk, e.Payload)
+		}
+	}
+	if salvo {
+		m.Salvo, m.SalvoHits = readSalvo(msg.Large)
+	}
+	return m
+}
+
+// result is the S field for our next move
+func (g *game) result() int {
+	if g.results && g.hitmiss&1 != 0 && len(g.sunk) > 0 {
+		return resultSunk
+	}
+	return g.hitmiss & 1
+}
+
+func (g *game) fire(shots []cell) error {
+	m := move{
+		X:               shots[0].X,
+		Y:               shots[0].Y,
+		HitOrMissOnLast: g.result(),
+		At:              time.Now(),
+	}
+	if g.results {
+		m.Sunk = g.sunk
+	}
+	if g.salvo {
+		m.Salvo, m.SalvoHits = shots, g.hitmiss
+	}
+	g.moves = append(g.moves, m)
+	g.observe(len(g.moves) - 1)
+	g.match.prop.sent(len(g.moves)-1, m.At)
+	g.note(false, "fired move %d at %v", len(g.moves)-1, shots)
+	return g.announce(len(g.moves)-1, m)
+}
+
+// apply records m as the move with the next counter and updates the
+// boards if it was made by the other side.
+func (g *game) apply(m move) {
+	c := len(g.moves)
+	g.moves = append(g.moves, m)
+	g.observe(c)
+	g.note(false, "took move %d at %v", c, m.shots(g.salvo))
+
+	if g.ours(c) {
+		// only happens on replays, the result will come with the
+		// next move of the other side
+		return
+	}
+
+	// First, process if we got a hit or not.
+	if c > 0 {
+		for i, s := range g.moves[c-1].shots(g.salvo) {
+			if m.hit(i, g.salvo) {
+				g.RemoteB.Board[s.Y][s.X] = stateHit
+				g.match.log.Infof("%s: It's a Hit!", s)
+			} else {
+				g.RemoteB.Board[s.Y][s.X] = stateAttempt
+				g.match.log.Infof("%s: It's a Miss!", s)
+			}
+		}
+	}
+
+	for _, i := range m.Sunk {
+		g.match.log.Infof("You sunk their %s!", shipName(i))
+		g.peerSunk = append(g.peerSunk, i)
+		if c > 0 {
+			g.markWreck(i, g.moves[c-1].shots(g.salvo))
+		}
+	}
+
+	if m.GameOver {
+		if m.Surrender {
+			g.match.log.Infof("The other side surrendered")
+		}
+		if m.Captured {
+			g.match.log.Infof("You captured their flag!")
+		}
+		g.over, g.won, g.captured = true, true, m.Captured
+		return
+	}
+
+	// Now... did we get hit?
+	g.hitmiss = 0
+	g.sunk = nil
+	for i, s := range m.shots(g.salvo) {
+		g.match.log.Infof("The other side played a %s", s)
+		if g.LocalB.Board[s.Y][s.X] == stateShip {
+			g.hitmiss |= 1 << uint(i)
+			g.LocalB.Board[s.Y][s.X] = stateHit
+			if ship := g.LocalB.sunkShip(s); ship >= 0 {
+				g.match.log.Infof("They sunk your %s!", shipName(ship))
+				g.sunk = append(g.sunk, ship)
+			}
+		} else {
+			g.LocalB.Board[s.Y][s.X] = stateAttempt
+		}
+		if g.ctf && g.LocalB.flagAt(s) {
+			g.match.log.Infof("They captured your flag at %s!", s)
+			g.captured = true
+		}
+	}
+
+	if g.LocalB.shipsLeft() == 0 || g.captured {
+		g.over, g.won = true, false
+	}
+}
+
+// handle processes a message read from the other side, it returns true
+// once a new move has been applied and it is our turn again.
+func (g *game) handle(msg bgpMessage) (bool, error) {
+	if id, ok := readGameID(msg.Large); ok && id != g.match.gameID {
+		// what's left of another game
+		return false, nil
+	}
+	if *royaleDefend {
+		msg = royaleView(msg, uint32(*localASN))
+	}
+
+	if hash, ok := readBoardCommitment(msg.Large); ok {
+		if !g.havePeerCommit {
+			g.peerCommit, g.havePeerCommit = hash, true
+		} else if hash != g.peerCommit {
+			g.match.log.Warnf("The other side changed its board commitment!")
+			g.note(true, "the other side changed its board commitment")
+		}
+	}
+
+	if id, text, ok := readChat(msg.Large); ok && id != g.chatSeen {
+		g.chatSeen, g.chatText = id, text
+	}
+
+	g.dispatchExtended(msg)
+
+	if e, ok := msg.extended(extProtocolError); ok && e.Payload != g.peerRejection {
+		g.peerRejection = e.Payload
+		return g.retract(e.Payload >> 6), nil
+	}
+
+	if e, ok := msg.extended(extResyncRequest); ok {
+		return false, g.replay(g.fullCounter(e.Payload))
+	}
+
+	expected := len(g.moves)
+	c := expandCounter(msg.Counter, expected)
+	g.observe(c)
+
+	if c < expected {
+		// old news
+		return false, nil
+	}
+	if c > expected {
+		// we missed some moves, ask for them before going on
+		if g.requested != expected {
+			g.match.log.Warnf("Counter gap, expected %d but the other side is at %d",
+				expected, c)
+		}
+		return false, g.requestResync(expected)
+	}
+
+	m := messageMove(msg, g.salvo)
+	if g.salvo && (!hasSalvoHits(msg.Large) || !m.GameOver && len(m.Salvo) == 0) {
+		// the large communities of the salvo didn't make it (yet), every
+		// move has its hits and a salvo is never empty
+		return false, nil
+	}
+	if reason := g.validate(m); reason != 0 {
+		return false, g.reject(m, reason)
+	}
+
+	g.apply(m)
+
+	if _, ok := msg.extended(extReplay); ok {
+		return false, g.requestResync(len(g.moves))
+	}
+
+	g.requested = -1
+	return true, nil
+}
+
+// validate checks a move of the other side before it's applied, it
+// returns the reason to reject it or 0 if it's fine.
+func (g *game) validate(m move) int {
+	if m.GameOver {
+		return 0
+	}
+
+	shots := m.shots(g.salvo)
+	if g.salvo && len(shots) > len(fleet) {
+		g.match.log.Warnf("The other side sent a salvo of %d shots", len(shots))
+		return rejectSalvo
+	}
+
+	fired := make(map[cell]bool)
+	for _, s := range shots {
+		if !g.LocalB.inside(s.X, s.Y) {
+			g.match.log.Warnf("The other side played outside of the board: %d,%d",
+				s.X, s.Y)
+			return rejectOutside
+		}
+		state := g.LocalB.Board[s.Y][s.X]
+		if fired[s] || state == stateHit || state == stateAttempt {
+			g.match.log.Warnf("The other side played %s again", s)
+			return rejectRepeated
+		}
+		fired[s] = true
+	}
+	return 0
+}
+
+// reject tells the other side its move is illegal, once for every
+// move it makes.
+func (g *game) reject(m move, reason int) error {
+	key := fmt.Sprint(len(g.moves), m.shots(g.salvo))
+	if key == g.rejected {
+		return nil
+	}
+	g.rejected = key
+	g.rejections++
+
+	g.match.log.Warnf("Rejecting move %d of the other side: %s", len(g.moves),
+		rejectReasons[reason])
+	g.note(true, "rejected move %d of the other side: %s", len(g.moves), rejectReasons[reason])
+
+	lc, last := g.lastOwn()
+	return g.announce(lc, last,
+		extendedCommunity{extProtocolError, reason<<6 | g.rejections%64})
+}
+
+// retract takes back our last move after the other side rejected it,
+// it returns true if it's our turn again.
+func (g *game) retract(reason int) bool {
+	c := len(g.moves) - 1
+	why, ok := rejectReasons[reason]
+	if !ok {
+		why = fmt.Sprintf("reason %d", reason)
+	}
+	if c < 0 || !g.ours(c) {
+		g.match.log.Warnf("The other side rejected a move we didn't make: %s", why)
+		return false
+	}
+
+	g.match.log.Errorf("The other side rejected move %d: %s, make it again", c, why)
+	g.moves = g.moves[:c]
+	g.note(true, "the other side rejected move %d: %s", c, why)
+	return true
+}
+
+// requestResync asks the other side to resend the move with counter c,
+// our own last move is kept announced alongside the request.
+func (g *game) requestResync(c int) error {
+	if g.requested == c {
+		return nil
+	}
+	g.requested = c
+
+	g.match.log.Infof("Asking the other side to resend move %d", c)
+	g.note(true, "asked the other side to resend move %d", c)
+
+	lc, last := g.lastOwn()
+	return g.announce(lc, last,
+		extendedCommunity{extResyncRequest, c % 1024})
+}
+
+// replay announces the move with counter c again, marked as a replay
+// unless it is the latest one.
+func (g *game) replay(c int) error {
+	if c < 0 || c >= len(g.moves) || c == g.replayed {
+		return nil
+	}
+	g.replayed = c
+
+	m := g.moves[c]
+	g.note(true, "the other side asked for move %d again", c)
+	if c == len(g.moves)-1 {
+		return g.announce(c, m)
+	}
+
+	g.match.log.Infof("Replaying move %d to the other side", c)
+	return g.announce(c, m, extendedCommunity{extReplay, 0})
+}
+
+// fullCounter expands the lower 10 bits of a counter carried in an
+// extended community to the closest counter not ahead of our own.
+func (g *game) fullCounter(p int) int {
+	c := len(g.moves)&^1023 | p
+	if c > len(g.moves) {
+		c -= 1024
+	}
+	return c
+}
+
+// finish is called once the game is over, it reveals our board and
+// tells the other side if we lost.
+func (g *game) finish() error {
+	g.match.addSession(g.commitment.revealCommunities()...)
+
+	if !g.won {
+		m := move{
+			HitOrMissOnLast: g.result(),
+			GameOver:        true,
+			Surrender:       g.surrendered,
+			Captured:        g.captured && !g.surrendered,
+			At:              time.Now(),
+		}
+		if g.results {
+			m.Sunk = g.sunk
+		}
+		if g.salvo {
+			m.SalvoHits = g.hitmiss
+		}
+		g.moves = append(g.moves, m)
+	}
+
+	c, m := g.lastOwn()
+	return g.announce(c, m)
+}
+
+// surrender gives up the game, it has to be our turn.
+func (g *game) surrender() {
+	g.over, g.won, g.surrendered = true, false, true
+}
+
+// checkReveal verifies the board the other side revealed at the end of
+// the game, it returns false while it's not revealed yet.
+func (g *game) checkReveal(msg bgpMessage) (bool, error) {
+	if !g.havePeerCommit {
+		return true, errNoCommitment
+	}
+	err := verifyBoard(g.peerCommit, msg.Large, g.RemoteB)
+	if err == errNoReveal {
+		return false, nil
+	}
+	if err == nil && g.ctf {
+		err = g.checkFlag(msg.Large)
+	}
+	return true, err
+}
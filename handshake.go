@@ -0,0 +1,329 @@
+package main
+
+import (
+	cr "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"time"
+)
+
+var localASN = flag.Int("asn", 0,
+	"Our own ASN, announced to the other side in the handshake")
+
+var peerASN = flag.Int("peerASN", 0,
+	"The ASN we expect the other side to have, 0 to accept any")
+
+var boardWidth = flag.Int("width", 10,
+	"Width of the board, the smaller one of both sides is used")
+
+var boardHeight = flag.Int("height", 10,
+	"Height of the board, the smaller one of both sides is used")
+
+var salvoMode = flag.Bool("salvo", false,
+	"Play the salvo variant, one shot per ship left each turn")
+
+var doHandshake = flag.Bool("handshake", true,
+	"Negotiate the game with the other side before starting, "+
+		"-startfirst is ignored if this is set")
+
+var handshakeTimeout = flag.Duration("handshakeTimeout", 10*time.Minute,
+	"How long to wait on the other side to answer the handshake or a rematch, 0 for no limit")
+
+/*
+The handshake is done with large communities, that are announced
+for the whole game:
+
+(communityASN, Field, Value)
+
+Both sides announce their version, codecs, board size, ASN, fleet and
+the ID of the game (0 for the first one, see rematch.go). The board
+size is Width << 8 | Height, the smallest width and height of both
+sides is played on. Both sides have to agree on the game mode, a
+bitmask of modeSalvo and modeFlag.
+
+Each side also commits to a random 32 bit seed, with
+
+SHA-256(ASN | salt | seed)
+
+in 8 words from helloCommit on. Once the other side's commitment is
+seen the seed is revealed in helloSeed, and the 128 bit salt in 4 words
+from helloSalt (field 12) on; the salt keeps the seed from being found
+by trying them all. The XOR of both seeds then decides who goes first,
+so neither side can pick it.
+
+Both seeds and both ASNs also make the game tag, 10 bits that go along
+every move as extGameTag. Two unrelated games on the same community ASN
+that end up on one route (through a route server, or someone else
+picking 23456 too) then don't take each other's moves: a move with a tag
+other than ours, or without one, is ignored.
+*/
+
+const protocolVersion = 2
+
+const (
+	helloVersion   = 1
+	helloCodecs    = 2
+	helloBoardSize = 3
+	helloASN       = 4
+	helloSeed      = 6
+	helloMode      = 7
+	helloFleet     = 8 // 2 words, see fleet.go
+	helloGameID    = 10
+	helloSalt      = 12  // 4 words
+	helloCommit    = 104 // 8 words
+)
+
+const (
+	modeClassic = 0
+	modeSalvo   = 1 << 0
+	// capture the flag, see ctf.go
+	modeFlag = 1 << 1
+)
+
+func localMode() uint32 {
+	mode := uint32(modeClassic)
+	if *salvoMode {
+		mode |= modeSalvo
+	}
+	if *ctfMode {
+		mode |= modeFlag
+	}
+	return mode
+}
+
+// codec capabilities, as a bitmask
+const (
+	codecLegacy = 1 << 0
+	// sunk ships are told, see extSunk
+	codecResults = 1 << 1
+	// the winner announces a FlowSpec rule, see nuke.go
+	codecNuke = 1 << 2
+	// the moves are large communities, see codec.go
+	codecLarge = 1 << 3
+)
+
+const supportedCodecs = codecLegacy | codecResults | codecLarge
+
+// localCodecs are the codecs we announce, of the move codecs only the
+// ones -codec allows, and the joke ones only if asked and the router
+// can play them
+func localCodecs() uint32 {
+	codecs := supportedCodecs&^(codecLegacy|codecLarge) | localMoveCodecs()
+	if *nukeMode && canFlow(activeRouter) {
+		codecs |= codecNuke
+	}
+	return codecs
+}
+
+type session struct {
+	PeerASN       uint32
+	Codecs        uint32
+	Width, Height int
+	Mode          uint32
+	StartFirst    bool
+	// see gameTag
+	Tag int
+}
+
+var errVersionMismatch = fmt.Errorf("Other side speaks a different protocol version")
+var errNoCommonCodec = fmt.Errorf("No codec supported by both sides")
+var errBadBoardSize = fmt.Errorf("Other side announced an invalid board size")
+var errWrongPeerASN = fmt.Errorf("Other side announced an unexpected ASN")
+var errBadCommitment = fmt.Errorf("Other side's seed does not match its commitment")
+var errSameSeed = fmt.Errorf("Both sides picked the same ASN and seed")
+var errNoAnswer = fmt.Errorf("Other side did not answer within -handshakeTimeout")
+
+// answerLate tells if the other side took longer than -handshakeTimeout
+// since start to answer.
+func answerLate(start time.Time) bool {
+	return *handshakeTimeout > 0 && time.Since(start) > *handshakeTimeout
+}
+
+// seedCommitment is what asn commits to before revealing its seed, see
+// the handshake.
+func seedCommitment(asn uint32, salt [16]byte, seed uint32) [32]byte {
+	b := make([]byte, 24)
+	binary.BigEndian.PutUint32(b[0:4], asn)
+	copy(b[4:20], salt[:])
+	binary.BigEndian.PutUint32(b[20:24], seed)
+	return sha256.Sum256(b)
+}
+
+// gameTag is the tag of the game between two ASNs with those seeds, it
+// is never 0.
+func gameTag(asn, peerASN, seed, peerSeed uint32) int {
+	if asn > peerASN {
+		asn, peerASN = peerASN, asn
+	}
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b[0:4], asn)
+	binary.BigEndian.PutUint32(b[4:8], peerASN)
+	binary.BigEndian.PutUint32(b[8:12], seed^peerSeed)
+	sum := sha256.Sum256(b)
+	return int(binary.BigEndian.Uint16(sum[:2]))%1023 + 1
+}
+
+// sessionCommunity makes a large community of the game, its ASN is
+// filled in when it's announced.
+func sessionCommunity(field, value uint32) bgpLargeCommunity {
+	return bgpLargeCommunity{
+		Data1: field,
+		Data2: value,
+	}
+}
+
+// readHello returns the handshake fields announced on prefix.
+func readHello(prefix string) (map[uint32]uint32, error) {
+	_, large, err := readCommunities(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return helloFields(*communityAS, large), nil
+}
+
+func helloFields(asn int, large []bgpLargeCommunity) map[uint32]uint32 {
+	fields := make(map[uint32]uint32)
+	for _, c := range large {
+		if c.Global != uint32(asn) {
+			continue
+		}
+		if c.Data1 >= helloVersion && c.Data1 <= helloGameID ||
+			c.Data1 >= helloSalt && c.Data1 < helloSalt+4 ||
+			c.Data1 >= helloCommit && c.Data1 < helloCommit+8 {
+			fields[c.Data1] = c.Data2
+		}
+	}
+	return fields
+}
+
+// helloWords fills data from the hello fields written by
+// wordCommunities, it returns false if some are missing.
+func helloWords(hello map[uint32]uint32, field uint32, data []byte) bool {
+	for i := 0; i < len(data)/4; i++ {
+		v, ok := hello[field+uint32(i)]
+		if !ok {
+			return false
+		}
+		binary.BigEndian.PutUint32(data[i*4:], v)
+	}
+	return true
+}
+
+func handshake(m *match) (session, error) {
+	seedBytes := make([]byte, 4)
+	if _, err := cr.Read(seedBytes); err != nil {
+		return session{}, err
+	}
+	seed := binary.BigEndian.Uint32(seedBytes)
+	var salt [16]byte
+	if _, err := cr.Read(salt[:]); err != nil {
+		return session{}, err
+	}
+	asn := uint32(*localASN)
+	commit := seedCommitment(asn, salt, seed)
+
+	m.addSession(
+		sessionCommunity(helloVersion, protocolVersion),
+		sessionCommunity(helloCodecs, localCodecs()),
+		sessionCommunity(helloBoardSize, uint32(*boardWidth<<8|*boardHeight)),
+		sessionCommunity(helloASN, asn),
+		sessionCommunity(helloMode, localMode()),
+		sessionCommunity(helloGameID, uint32(m.gameID)),
+	)
+	m.addSession(wordCommunities(helloCommit, commit[:])...)
+	m.addSession(fleetCommunities()...)
+	if err := m.writeSession(); err != nil {
+		return session{}, err
+	}
+
+	m.log.Infof("Waiting for the other side to say hello...")
+
+	revealed := false
+	start := time.Now()
+	for {
+		time.Sleep(pollInterval)
+		if answerLate(start) {
+			return session{}, errNoAnswer
+		}
+
+		hello, err := m.readHello()
+		if err != nil {
+			progress("E")
+			continue
+		}
+		var peerCommit [32]byte
+		if !helloWords(hello, helloCommit, peerCommit[:]) || hello[helloGameID] != uint32(m.gameID) {
+			// not there yet, or still on the last game
+			progress(".")
+			continue
+		}
+
+		if hello[helloVersion] != protocolVersion {
+			return session{}, errVersionMismatch
+		}
+		s := session{
+			PeerASN: hello[helloASN],
+			Codecs:  hello[helloCodecs] & localCodecs(),
+			Width:   int(hello[helloBoardSize] >> 8),
+			Height:  int(hello[helloBoardSize] & 0xff),
+			Mode:    hello[helloMode],
+		}
+		if pickCodec(s.Codecs) == nil {
+			return session{}, errNoCommonCodec
+		}
+		if s.Mode != localMode() {
+			return session{}, fmt.Errorf("Other side wants to play %s, not %s",
+				modeName(s.Mode), modeName(localMode()))
+		}
+		if !sameFleet(helloFleetSizes(hello), fleet) {
+			return session{}, errOtherFleet
+		}
+		if !validBoardSize(s.Width, s.Height) {
+			return session{}, errBadBoardSize
+		}
+		if *boardWidth < s.Width {
+			s.Width = *boardWidth
+		}
+		if *boardHeight < s.Height {
+			s.Height = *boardHeight
+		}
+		if *peerASN != 0 && s.PeerASN != uint32(*peerASN) {
+			return session{}, errWrongPeerASN
+		}
+
+		if !revealed {
+			m.addSession(sessionCommunity(helloSeed, seed))
+			m.addSession(wordCommunities(helloSalt, salt[:])...)
+			if err := m.writeSession(); err != nil {
+				return session{}, err
+			}
+			revealed = true
+		}
+
+		var peerSalt [16]byte
+		peerSeed, ok := hello[helloSeed]
+		if !ok || !helloWords(hello, helloSalt, peerSalt[:]) {
+			progress(".")
+			continue
+		}
+		if seedCommitment(s.PeerASN, peerSalt, peerSeed) != peerCommit {
+			return session{}, errBadCommitment
+		}
+
+		if asn == s.PeerASN && seed == peerSeed {
+			return session{}, errSameSeed
+		}
+
+		// the side with the lower ASN (or seed) goes first on an even
+		// XOR of both seeds
+		weAreLow := asn < s.PeerASN || (asn == s.PeerASN && seed < peerSeed)
+		s.StartFirst = ((seed^peerSeed)%2 == 0) == weAreLow
+		s.Tag = gameTag(asn, s.PeerASN, seed, peerSeed)
+
+		m.log.Infof("Handshake done with AS%d, playing on %dx%d, we go first: %v, game tag %d",
+			s.PeerASN, s.Width, s.Height, s.StartFirst, s.Tag)
+		return s, nil
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+var historyDB = flag.String("history", "",
+	"Keep every finished game in this SQLite database, history.db in -stateDir without it")
+
+/*
+Every game that is over goes into the history database, with its moves
+and who it was against, so that it's still there once we exit:
+
+history list          the last games
+history show <id>     a game, written down as export does
+history vs <asn>      the games against an ASN, and how they went
+
+The notation of a game is kept whole, history show prints it so it can
+be given to import or play -resume.
+*/
+
+const historySchema = `
+CREATE TABLE IF NOT EXISTS games (
+	id INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	community_asn INTEGER NOT NULL,
+	prefix TEXT NOT NULL,
+	peer_prefix TEXT NOT NULL,
+	opponent_asn INTEGER NOT NULL,
+	started DATETIME NOT NULL,
+	ended DATETIME NOT NULL,
+	result TEXT NOT NULL,
+	moves INTEGER NOT NULL,
+	width INTEGER NOT NULL,
+	height INTEGER NOT NULL,
+	salvo BOOLEAN NOT NULL,
+	notation TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS games_opponent ON games (opponent_asn);
+CREATE TABLE IF NOT EXISTS moves (
+	game_id INTEGER NOT NULL REFERENCES games (id),
+	counter INTEGER NOT NULL,
+	ours BOOLEAN NOT NULL,
+	shots TEXT NOT NULL,
+	hits INTEGER NOT NULL,
+	at DATETIME,
+	PRIMARY KEY (game_id, counter)
+);
+`
+
+func historyPath() string {
+	if *historyDB != "" {
+		return *historyDB
+	}
+	if *stateDir != "" {
+		return filepath.Join(*stateDir, "history.db")
+	}
+	return ""
+}
+
+func openHistory(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Unable to set up the history in %s: %s", path, err.Error())
+	}
+	return db, nil
+}
+
+func gameResult(g *game) string {
+	switch {
+	case g.forfeited:
+		return "won by forfeit"
+	case g.won:
+		return "won"
+	case g.surrendered:
+		return "surrendered"
+	}
+	return "lost"
+}
+
+// recordHistory adds g to the history database, if there's one.
+func recordHistory(g *game) error {
+	path := historyPath()
+	if path == "" {
+		return nil
+	}
+	db, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	m := g.match
+	res, err := tx.Exec(`INSERT INTO games (name, community_asn, prefix, peer_prefix,
+		opponent_asn, started, ended, result, moves, width, height, salvo, notation)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		m.Name, m.ASN, m.Prefix, m.PeerPrefix, g.peerASN, g.started, time.Now(),
+		gameResult(g), len(g.moves), g.LocalB.Width, g.LocalB.Height, g.salvo,
+		exportGame(stateOf(g)))
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	for c, mv := range g.moves {
+		var shots []string
+		for _, s := range mv.shots(g.salvo) {
+			shots = append(shots, s.String())
+		}
+		hits := 0
+		if c+1 < len(g.moves) && !g.moves[c+1].GameOver {
+			for i := range shots {
+				if g.moves[c+1].hit(i, g.salvo) {
+					hits++
+				}
+			}
+		}
+		var at interface{}
+		if !mv.At.IsZero() {
+			at = mv.At
+		}
+		if _, err := tx.Exec(`INSERT INTO moves (game_id, counter, ours, shots, hits, at)
+			VALUES (?, ?, ?, ?, ?, ?)`, id, c, g.ours(c), strings.Join(shots, " "), hits, at); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	m.log.Infof("Game kept in the history as %d", id)
+	return nil
+}
+
+type historyGame struct {
+	id                   int
+	name                 string
+	opponent             int
+	started, ended       time.Time
+	result               string
+	moves, width, height int
+	salvo                bool
+	peerPrefix, notation string
+}
+
+func (h historyGame) String() string {
+	mode := ""
+	if h.salvo {
+		mode = " salvo"
+	}
+	return fmt.Sprintf("%-5d %-16s %-22s AS%-10d %-14s %4d moves  %dx%d%s  %s",
+		h.id, h.ended.Local().Format("2006-01-02 15:04"), h.peerPrefix, h.opponent,
+		h.result, h.moves, h.width, h.height, mode, h.ended.Sub(h.started).Round(time.Second))
+}
+
+func queryHistory(db *sql.DB, where string, args ...interface{}) ([]historyGame, error) {
+	rows, err := db.Query(`SELECT id, name, opponent_asn, started, ended, result, moves,
+		width, height, salvo, peer_prefix, notation FROM games `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var o []historyGame
+	for rows.Next() {
+		var h historyGame
+		if err := rows.Scan(&h.id, &h.name, &h.opponent, &h.started, &h.ended, &h.result,
+			&h.moves, &h.width, &h.height, &h.salvo, &h.peerPrefix, &h.notation); err != nil {
+			return nil, err
+		}
+		o = append(o, h)
+	}
+	return o, rows.Err()
+}
+
+// runHistory is the history command.
+func runHistory(args []string) error {
+	path := historyPath()
+	if path == "" {
+		return fmt.Errorf("No history, see -history or -stateDir")
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("No history in %s yet", path)
+	}
+	db, err := openHistory(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch {
+	case len(args) >= 1 && args[0] == "list":
+		n := 20
+		if len(args) == 2 {
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return fmt.Errorf("history list takes how many games to show")
+			}
+		}
+		games, err := queryHistory(db, "ORDER BY id DESC LIMIT ?", n)
+		if err != nil {
+			return err
+		}
+		for _, h := range games {
+			fmt.Println(h)
+		}
+		return nil
+	case len(args) == 2 && args[0] == "show":
+		games, err := queryHistory(db, "WHERE id = ?", args[1])
+		if err != nil {
+			return err
+		}
+		if len(games) == 0 {
+			return fmt.Errorf("No game %s in the history", args[1])
+		}
+		fmt.Printf("%s\n\n%s", games[0], games[0].notation)
+		return nil
+	case len(args) == 2 && args[0] == "vs":
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(args[1]), "AS"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("Invalid ASN %s", args[1])
+		}
+		games, err := queryHistory(db, "WHERE opponent_asn = ? ORDER BY id", asn)
+		if err != nil {
+			return err
+		}
+		won := 0
+		for _, h := range games {
+			fmt.Println(h)
+			if strings.HasPrefix(h.result, "won") {
+				won++
+			}
+		}
+		fmt.Printf("\n%d games against AS%d, you won %d and lost %d\n",
+			len(games), asn, won, len(games)-won)
+		return nil
+	}
+	return fmt.Errorf("Usage: %s history list [n] | show <id> | vs <asn>", os.Args[0])
+}
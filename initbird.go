@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"text/template"
+)
+
+type bootstrapConfig struct {
+	LocalASN, PeerASN int
+	PeerIP            string
+	Prefix            string
+	RouterID          string
+	BirdVersion       int
+	Family            string
+}
+
+// bootstrapTemplate is a complete bird config, which is itself a
+// template for the game with the communities left in it.
+var bootstrapTemplate = template.Must(template.New("bootstrap").Delims("[[", "]]").Parse(
+	`# Generated by bgp-battleships init-bird, use it as -templateFile
+[[- if .RouterID]]
+router id [[.RouterID]];
+[[- end]]
+log syslog all;
+
+protocol device {
+	scan time 10;
+}
+
+protocol static battleships_static {
+[[- if ge .BirdVersion 2]]
+	[[.Family]];
+[[- end]]
+	route [[.Prefix]] blackhole;
+}
+
+filter battleships_export {
+	if net = [[.Prefix]] then {
+		{{template "communities" .}}
+		accept;
+	}
+	reject;
+}
+
+protocol bgp battleships_peer {
+	local as [[.LocalASN]];
+	neighbor [[.PeerIP]] as [[.PeerASN]];
+[[- if ge .BirdVersion 2]]
+	[[.Family]] {
+		import all;
+		export filter battleships_export;
+	};
+[[- else]]
+	import all;
+	export filter battleships_export;
+[[- end]]
+}
+`))
+
+func bootstrapBirdTemplate(c bootstrapConfig) (string, error) {
+	_, prefix, err := net.ParseCIDR(c.Prefix)
+	if err != nil {
+		return "", fmt.Errorf("Invalid game prefix %s", c.Prefix)
+	}
+	if net.ParseIP(c.PeerIP) == nil {
+		return "", fmt.Errorf("Invalid peer IP %s", c.PeerIP)
+	}
+	if c.LocalASN <= 0 || c.PeerASN <= 0 {
+		return "", fmt.Errorf("Both -asn and -peerASN are needed")
+	}
+
+	c.Prefix = prefix.String()
+	c.Family = "ipv4"
+	if prefix.IP.To4() == nil {
+		c.Family = "ipv6"
+	}
+
+	var out bytes.Buffer
+	if err := bootstrapTemplate.Execute(&out, c); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// writeBootstrapConfig renders the template text without communities to
+// path, so that bird can start before the game.
+func writeBootstrapConfig(path, text, prefix string, version int) error {
+	rendered, err := renderBirdTemplate("bootstrap", text, birdTemplateData{
+		Prefix:      prefix,
+		PeerPrefix:  *monitoredPrefix,
+		BirdVersion: version,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, rendered, 0640)
+}
+
+// initBird is the init-bird command, it writes a bird config template
+// for a game from scratch.
+func initBird(args []string) error {
+	fs := flag.NewFlagSet("init-bird", flag.ExitOnError)
+	localASN := fs.Int("asn", 0, "Our ASN")
+	peerASN := fs.Int("peerASN", 0, "The ASN of the other side")
+	peerIP := fs.String("peerIP", "", "The IP of the other side's router")
+	prefix := fs.String("prefix", "", "The prefix we announce for the game")
+	routerID := fs.String("routerID", "", "Router ID of bird, picked by bird if empty")
+	version := fs.Int("birdVersion", 2, "Major version of bird")
+	out := fs.String("o", "", "Where to write the template, stdout if empty")
+	conf := fs.String("conf", "", "Also write the template rendered without communities there")
+	fs.Parse(args)
+
+	text, err := bootstrapBirdTemplate(bootstrapConfig{
+		LocalASN:    *localASN,
+		PeerASN:     *peerASN,
+		PeerIP:      *peerIP,
+		Prefix:      *prefix,
+		RouterID:    *routerID,
+		BirdVersion: *version,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		fmt.Print(text)
+	} else if err := writeFileAtomic(*out, []byte(text), 0640); err != nil {
+		return err
+	}
+
+	if *conf != "" {
+		if err := writeBootstrapConfig(*conf, text, *prefix, *version); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s, load it with birdc configure\n", *conf)
+	}
+	return nil
+}
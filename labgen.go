@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+/*
+labgen writes a docker-compose lab with two bird containers peered
+together and a game container next to each one. Every game container
+shares /etc/bird and /run/bird with its bird, so it rewrites the config
+and talks to the control socket as it would on a real router. The
+paths are the same in both containers, as bird checks the config the
+game hands it by name. The game image is built from the Dockerfile of
+the source.
+*/
+
+type labSide struct {
+	Name       string
+	ASN        int
+	IP         string
+	Prefix     string
+	PeerASN    int
+	PeerIP     string
+	PeerPrefix string
+	Bot        bool
+}
+
+type labConfig struct {
+	Source string
+	Subnet string
+	Sides  []labSide
+}
+
+var labCompose = template.Must(template.New("compose").Parse(
+	`# Generated by bgp-battleships labgen
+version: "3"
+
+services:
+{{- range .Sides}}
+  bird-{{.Name}}:
+    build:
+      context: .
+      dockerfile: Dockerfile.bird
+    volumes:
+      - ./{{.Name}}/etc:/etc/bird
+      - ./{{.Name}}/run:/run/bird
+    networks:
+      battlenet:
+        ipv4_address: {{.IP}}
+
+  game-{{.Name}}:
+    build: {{$.Source}}
+    depends_on:
+      - bird-{{.Name}}
+    volumes:
+      - ./{{.Name}}/etc:/etc/bird
+      - ./{{.Name}}/run:/run/bird
+    network_mode: none
+{{- if .Bot}}
+    command: ["serve", "-asn", "{{.ASN}}", "-peerASN", "{{.PeerASN}}", "-prefix", "{{.Prefix}}", "-peerprefix", "{{.PeerPrefix}}"]
+{{- else}}
+    command: ["play", "-asn", "{{.ASN}}", "-peerASN", "{{.PeerASN}}", "-prefix", "{{.Prefix}}", "-peerprefix", "{{.PeerPrefix}}"]
+    stdin_open: true
+    tty: true
+{{- end}}
+{{end}}
+networks:
+  battlenet:
+    ipam:
+      config:
+        - subnet: {{.Subnet}}
+`))
+
+const labBirdDockerfile = `FROM debian:bookworm-slim
+RUN apt-get update && apt-get install -y --no-install-recommends bird2 && rm -rf /var/lib/apt/lists/*
+CMD ["bird", "-f", "-c", "/etc/bird/bird.conf", "-s", "/run/bird/bird.ctl"]
+`
+
+const labReadme = `Two bird routers peered with each other, with a game next to each.
+
+	docker-compose up -d
+	docker attach $(docker-compose ps -q game-a)
+
+The game of side b is played by the bot%s.
+`
+
+func writeLabSide(dir string, s labSide) error {
+	etc := filepath.Join(dir, s.Name, "etc")
+	run := filepath.Join(dir, s.Name, "run")
+	for _, d := range []string{etc, run} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+	}
+
+	text, err := bootstrapBirdTemplate(bootstrapConfig{
+		LocalASN:    s.ASN,
+		PeerASN:     s.PeerASN,
+		PeerIP:      s.PeerIP,
+		Prefix:      s.Prefix,
+		RouterID:    s.IP,
+		BirdVersion: 2,
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(etc, "conf.orig"), []byte(text), 0644); err != nil {
+		return err
+	}
+	return writeBootstrapConfig(filepath.Join(etc, "bird.conf"), text, s.Prefix, 2)
+}
+
+// labGen is the labgen command.
+func labGen(args []string) error {
+	fs := flag.NewFlagSet("labgen", flag.ExitOnError)
+	out := fs.String("o", "battleships-lab", "Directory to write the lab to")
+	src := fs.String("src", ".", "The bgp-battleships source the game image is built from")
+	bots := fs.Bool("bots", false, "Let the bot play side a too")
+	fs.Parse(args)
+
+	source, err := filepath.Abs(*src)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(source, "Dockerfile")); err != nil {
+		return fmt.Errorf("%s does not look like the bgp-battleships source", source)
+	}
+
+	lab := labConfig{
+		Source: source,
+		Subnet: "172.30.0.0/24",
+		Sides: []labSide{
+			{Name: "a", ASN: 65001, IP: "172.30.0.11", Prefix: "10.1.0.0/24", Bot: *bots},
+			{Name: "b", ASN: 65002, IP: "172.30.0.12", Prefix: "10.2.0.0/24", Bot: true},
+		},
+	}
+	for i := range lab.Sides {
+		peer := lab.Sides[1-i]
+		lab.Sides[i].PeerASN, lab.Sides[i].PeerIP = peer.ASN, peer.IP
+		lab.Sides[i].PeerPrefix = peer.Prefix
+	}
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	for _, s := range lab.Sides {
+		if err := writeLabSide(*out, s); err != nil {
+			return err
+		}
+	}
+
+	compose, err := os.Create(filepath.Join(*out, "docker-compose.yml"))
+	if err != nil {
+		return err
+	}
+	if err := labCompose.Execute(compose, lab); err != nil {
+		compose.Close()
+		return err
+	}
+	if err := compose.Close(); err != nil {
+		return err
+	}
+
+	botNote := ""
+	if *bots {
+		botNote = ", and so is side a, follow it with docker-compose logs -f"
+	}
+	files := map[string]string{
+		"Dockerfile.bird": labBirdDockerfile,
+		"README":          fmt.Sprintf(labReadme, botNote),
+	}
+	for name, data := range files {
+		if err := writeFileAtomic(filepath.Join(*out, name), []byte(data), 0644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote the lab to %s, start it with docker-compose up\n", *out)
+	return nil
+}
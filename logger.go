@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logLevelName = flag.String("log-level", "info",
+	"Lowest level to log: debug, info, warn or error")
+
+var logFormat = flag.String("log-format", "text",
+	"Format of the logs: text or json")
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+var minLogLevel = levelInfo
+var logJSON = false
+
+// serializes writes of JSON lines, log does it for the text ones
+var logMu sync.Mutex
+
+func setupLogging() error {
+	switch *logFormat {
+	case "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+	default:
+		return fmt.Errorf("Unknown log format %s", *logFormat)
+	}
+
+	for i, name := range levelNames {
+		if name == *logLevelName {
+			minLogLevel = logLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("Unknown log level %s", *logLevelName)
+}
+
+// logger prefixes everything it logs with the subsystem it belongs to.
+type logger struct {
+	subsystem string
+}
+
+var (
+	mainLog      = logger{"main"}
+	engineLog    = logger{"engine"}
+	transportLog = logger{"transport"}
+	birdcLog     = logger{"birdc"}
+	dashboardLog = logger{"dashboard"}
+	spectateLog  = logger{"spectate"}
+	exabgpLog    = logger{"exabgp"}
+	openbgpdLog  = logger{"openbgpd"}
+	bmpLog       = logger{"bmp"}
+	observerLog  = logger{"observer"}
+	risLog       = logger{"ris"}
+	rpkiLog      = logger{"rpki"}
+	notifyLog    = logger{"notify"}
+)
+
+type jsonLogLine struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	Subsystem string    `json:"subsystem"`
+	Msg       string    `json:"msg"`
+}
+
+func (l logger) output(level logLevel, format string, args ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	if !logJSON {
+		log.Printf("%-5s [%s] %s", strings.ToUpper(levelNames[level]), l.subsystem, msg)
+		return
+	}
+
+	b, _ := json.Marshal(jsonLogLine{
+		Time:      time.Now(),
+		Level:     levelNames[level],
+		Subsystem: l.subsystem,
+		Msg:       msg,
+	})
+	logMu.Lock()
+	os.Stderr.Write(append(b, '\n'))
+	logMu.Unlock()
+}
+
+func (l logger) Debugf(format string, args ...interface{}) {
+	l.output(levelDebug, format, args...)
+}
+
+func (l logger) Infof(format string, args ...interface{}) {
+	l.output(levelInfo, format, args...)
+}
+
+func (l logger) Warnf(format string, args ...interface{}) {
+	l.output(levelWarn, format, args...)
+}
+
+func (l logger) Errorf(format string, args ...interface{}) {
+	l.output(levelError, format, args...)
+}
+
+func (l logger) Fatalf(format string, args ...interface{}) {
+	l.output(levelError, format, args...)
+	os.Exit(1)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// routeEvent is what was read from the route of the other side
+type routeEvent struct {
+	msg bgpMessage
+	err error
+}
+
+// gameLoop plays a game on a single goroutine, the prompt and the
+// route of the other side are read by their own goroutines and come in
+// over channels, so nothing but run ever touches the game.
+type gameLoop struct {
+	g    *game
+	draw bool
+	dash *dashboard
+
+	// lines typed at the prompt, nil for the bot
+	lines chan string
+	// the route of the other side, read every pollInterval
+	routes chan routeEvent
+	// closed once the game is done, stops the readers
+	done chan struct{}
+	// the route and session readers, run waits for them before it
+	// returns
+	readers sync.WaitGroup
+	// from the control API
+	calls chan apiCall
+	// votes of the team on our next move, nil without -team
+	ballot *ballot
+	// the session to the other side going down or up, nil if the
+	// router can't tell
+	sessions chan bool
+	// the program of -botCmd and the last turn it was told
+	bot     *extBot
+	botTurn int
+	// the last chat message of the other side that was passed on
+	chatShown int
+
+	prompted bool
+}
+
+func newGameLoop(g *game, draw bool, dash *dashboard) *gameLoop {
+	l := &gameLoop{
+		g:         g,
+		draw:      draw,
+		dash:      dash,
+		routes:    make(chan routeEvent),
+		done:      make(chan struct{}),
+		calls:     make(chan apiCall),
+		botTurn:   -1,
+		chatShown: -1,
+	}
+	if !*botMode && *botCmd == "" {
+		l.lines = make(chan string)
+		go readLines(os.Stdin, l.lines, l.done)
+	}
+	if *teamList != "" {
+		l.ballot = &ballot{}
+	}
+	if canSession(activeRouter) {
+		sr := activeRouter.(sessionRouter)
+		l.sessions = make(chan bool)
+		l.readers.Add(1)
+		go func() {
+			defer l.readers.Done()
+			l.watchSession(sr)
+		}()
+	}
+	l.readers.Add(1)
+	go func() {
+		defer l.readers.Done()
+		l.poll()
+	}()
+	registerLoop(l)
+	return l
+}
+
+// readLines sends the lines read from r to lines until done is closed.
+func readLines(r io.Reader, lines chan<- string, done <-chan struct{}) {
+	reader := bufio.NewReader(r)
+	for {
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		select {
+		case lines <- text:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (l *gameLoop) poll() {
+	for {
+		select {
+		case <-time.After(pollInterval):
+		case <-l.done:
+			return
+		}
+
+		msg, err := l.g.match.readBGP()
+		select {
+		case l.routes <- routeEvent{msg, err}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *gameLoop) printBoards() {
+	if l.draw && *plainMode {
+		fmt.Print(describeLast(l.g))
+	} else if l.draw {
+		fmt.Print(boardTitles(l.g.LocalB, "Your Side", "Player Two"))
+		fmt.Print(combineBoard(l.g.LocalB, l.g.RemoteB))
+	}
+}
+
+// run plays the game until it's over and the board of the other side
+// is revealed.
+func (l *gameLoop) run() error {
+	defer l.readers.Wait()
+	defer close(l.done)
+	defer unregisterLoop(l)
+	defer l.ballot.stop()
+	g := l.g
+
+	if *botCmd != "" {
+		if err := l.startBot(); err != nil {
+			return err
+		}
+		defer l.bot.stop()
+	}
+
+	l.printBoards()
+	for !g.over {
+		if g.ourTurn() {
+			if l.ballot != nil {
+				l.ballot.open(len(g.moves))
+			} else if *botMode && !*apiMoves {
+				l.fire(botShots(g.RemoteB, g.peerWrecks, g.salvoSize()))
+				continue
+			}
+			if !*botMode {
+				l.prompt()
+			}
+		}
+
+		select {
+		case text := <-l.lines:
+			l.input(text)
+		case ev := <-l.routes:
+			l.route(ev)
+		case c := <-l.calls:
+			v, err := c.f(l)
+			c.done <- apiResult{v, err}
+		case <-l.ballot.closed():
+			l.elect()
+		case up := <-l.sessions:
+			l.session(up)
+		}
+
+		if g.checkTimer() {
+			l.dash.update(g)
+			l.printBoards()
+		}
+	}
+	return l.finish()
+}
+
+func (l *gameLoop) prompt() {
+	if l.prompted {
+		return
+	}
+	l.prompted = true
+
+	n := l.g.salvoSize()
+	switch {
+	case l.bot != nil:
+		if c := len(l.g.moves); c != l.botTurn {
+			l.botTurn = c
+			l.bot.send(botEvent{Event: "turn", Move: &c, Shots: n})
+		}
+	case *plainMode && n > 1:
+		fmt.Printf("Fire %d shots at: ", n)
+	case *plainMode:
+		fmt.Printf("Fire at: ")
+	case n > 1:
+		fmt.Printf("[%06d] Next %d Moves> ", len(l.g.moves), n)
+	default:
+		fmt.Printf("[%06d] Next Move> ", len(l.g.moves))
+	}
+}
+
+// input acts on a line typed at the prompt.
+func (l *gameLoop) input(text string) {
+	g, m := l.g, l.g.match
+	l.prompted = false
+
+	switch {
+	case strings.TrimSpace(text) == "board":
+		if *plainMode {
+			fmt.Print(describeBoards(g))
+		} else {
+			fmt.Print(boardTitles(g.LocalB, "Your Side", "Player Two"))
+			fmt.Print(combineBoard(g.LocalB, g.RemoteB))
+		}
+	case strings.TrimSpace(text) == "status":
+		fmt.Print(describeStatus(g))
+	case strings.TrimSpace(text) == "diff":
+		fmt.Print(describeDiff(diffOf(g), *plainMode))
+	case strings.HasPrefix(text, "say "):
+		if err := m.say(strings.TrimSpace(text[4:])); err != nil {
+			m.log.Errorf("Unable to announce chat message %s", err.Error())
+		}
+	case !g.ourTurn():
+		fmt.Printf("Not your turn yet\n")
+	case strings.TrimSpace(text) == "surrender":
+		g.surrender()
+	case l.ballot != nil:
+		if shots := parseShots(text, g.salvoSize(), g.RemoteB); shots != nil {
+			l.ballot.vote(*apiListen, shots)
+		} else {
+			l.botTurn = -1
+		}
+	default:
+		if shots := parseShots(text, g.salvoSize(), g.RemoteB); shots != nil {
+			l.fire(shots)
+		} else {
+			// tell the bot again
+			l.botTurn = -1
+		}
+	}
+}
+
+func (l *gameLoop) fire(shots []cell) {
+	g, m := l.g, l.g.match
+
+	m.log.Infof("Firing on %v...", shots)
+	if err := g.fire(shots); err != nil {
+		m.log.Errorf("Unable to announce move %s", err.Error())
+	}
+	l.dash.update(g)
+	saveState(g)
+
+	if l.draw {
+		fmt.Printf("waiting on players response...\n")
+	}
+}
+
+// route hands what the other side announces to the game.
+func (l *gameLoop) route(ev routeEvent) {
+	g := l.g
+
+	l.dash.polled(ev.err)
+	if l.draw && !g.ourTurn() {
+		if ev.err != nil {
+			progress("E")
+		} else {
+			progress(".")
+		}
+	}
+	if ev.err != nil {
+		return
+	}
+
+	newMove, err := g.handle(ev.msg)
+	if err != nil {
+		g.match.log.Errorf("Unable to announce resync %s", err.Error())
+	}
+	if g.chatSeen != l.chatShown {
+		l.chatShown = g.chatSeen
+		l.chat(g.chatText)
+	}
+	if newMove {
+		if c := len(g.moves) - 1; l.bot != nil && !g.ours(c) {
+			l.bot.send(moveEvent(g, c))
+		}
+		l.dash.update(g)
+		saveState(g)
+		l.printBoards()
+		if g.ourTurn() || g.over {
+			notifyMove(g)
+		}
+	}
+}
+
+// chat passes a chat message of the other side on to whoever plays:
+// the bot, the dashboard and the terminal.
+func (l *gameLoop) chat(text string) {
+	g := l.g
+	if l.bot != nil {
+		l.bot.send(botEvent{Event: "chat", Text: text})
+	}
+	l.dash.update(g)
+	switch {
+	case l.draw && *plainMode:
+		fmt.Printf("\nOpponent says: %s\n", text)
+	case l.draw:
+		fmt.Printf("\n<them> %s\n", text)
+	default:
+		g.match.log.Infof("The other side says %s", text)
+	}
+}
+
+// finish tells how the game ended, reveals our board and waits for the
+// other side to reveal its one.
+func (l *gameLoop) finish() error {
+	g, m := l.g, l.g.match
+
+	if g.forfeited {
+		m.log.Infof("The other side ran out of time, you won!")
+		if *forfeitWithdraw {
+			return m.withdraw()
+		}
+	} else if g.won && g.captured {
+		m.log.Infof("You captured the flag of the other side, you won!")
+	} else if g.won {
+		m.log.Infof("All ships of the other side are sunk, you won!")
+	} else if g.surrendered {
+		m.log.Infof("You surrendered")
+	} else if g.captured {
+		m.log.Infof("Your flag was captured, you lost!")
+	} else {
+		m.log.Infof("All your ships are sunk, you lost!")
+	}
+	l.bot.send(botEvent{Event: "over", Won: &g.won})
+
+	if err := g.finish(); err != nil {
+		m.log.Errorf("Unable to reveal board %s", err.Error())
+	}
+	l.dash.update(g)
+	saveState(g)
+
+	if g.forfeited {
+		// the other side is gone, don't wait on it
+		return nil
+	}
+
+	m.log.Infof("Waiting on the other side to reveal its board...")
+	l.waitReveal()
+	if g.won && g.nukes {
+		return nuke(m)
+	}
+	return nil
+}
+
+// waitReveal checks the board of the other side once it's revealed. The
+// API is still served meanwhile, and it gives up after -revealTimeout.
+func (l *gameLoop) waitReveal() {
+	g, m := l.g, l.g.match
+	expired, stop := revealExpired()
+	defer stop()
+
+	for {
+		select {
+		case ev := <-l.routes:
+			if ev.err != nil {
+				continue
+			}
+			done, err := g.checkReveal(ev.msg)
+			if !done {
+				continue
+			}
+			if err != nil {
+				m.log.Errorf("Unable to verify the board of the other side: %s", err.Error())
+			} else {
+				m.log.Infof("Board of the other side verified, no ships were moved")
+			}
+			return
+		case c := <-l.calls:
+			v, err := c.f(l)
+			c.done <- apiResult{v, err}
+		case <-expired:
+			m.log.Errorf("The other side did not reveal its board within %s", *revealTimeout)
+			return
+		}
+	}
+}
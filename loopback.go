@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+/*
+The loopback backend keeps the routes in memory, the communities of
+every match show up on its prefix. It lets games in the same process
+play each other without any router, serve can run both sides:
+
+	serve -backend loopback -game 65000,10.0.1.0/24,10.0.0.0/24 \
+		-game 65000,10.0.0.0/24,10.0.1.0/24
+
+and the tests use it to play whole games.
+*/
+
+type loopbackRouter struct {
+	mu     sync.Mutex
+	routes map[string]loopbackRoute
+}
+
+type loopbackRoute struct {
+	communities []bgpCommunity
+	large       []bgpLargeCommunity
+}
+
+func newLoopbackRouter() *loopbackRouter {
+	return &loopbackRouter{routes: make(map[string]loopbackRoute)}
+}
+
+func (r *loopbackRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route, ok := r.routes[prefix]
+	if !ok {
+		return nil, nil, fmt.Errorf("No route to %s", prefix)
+	}
+	return route.communities, route.large, nil
+}
+
+func (r *loopbackRouter) write(ctx context.Context, ms []*match) error {
+	routes := make(map[string]loopbackRoute)
+	for _, m := range ms {
+		if m.Prefix == "" {
+			return fmt.Errorf("Game %s needs a prefix to announce", m.Name)
+		}
+		route := routes[m.Prefix]
+		route.communities = append(route.communities, m.communities...)
+		route.large = append(route.large, m.large...)
+		routes[m.Prefix] = route
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes = routes
+	return nil
+}
@@ -0,0 +1,1223 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useLoopback makes a fresh loopback router the active router, the
+// router, matches and poll interval are put back once t is done.
+func useLoopback(t testing.TB) {
+	router, ms, poll := activeRouter, matches, pollInterval
+	t.Cleanup(func() {
+		activeRouter, matches, pollInterval = router, ms, poll
+	})
+	activeRouter = newLoopbackRouter()
+	matches = nil
+	pollInterval = time.Millisecond
+}
+
+// setupLoopback makes a fresh loopback router with two matches
+// playing each other on it.
+func setupLoopback(t *testing.T) (*match, *match) {
+	useLoopback(t)
+
+	a := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	b := newMatch(65000, "10.0.1.0/24", "10.0.0.0/24")
+	for _, m := range []*match{a, b} {
+		if err := addMatch(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return a, b
+}
+
+func newLoopbackGame(t *testing.T, m *match, startFirst, salvo, results bool) *game {
+	local, err := makeBoard(10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitment, err := commitBoard(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.addSession(commitment.commitCommunities()...)
+	if err := m.writeSession(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGame(m, local, startFirst)
+	g.commitment = commitment
+	g.salvo = salvo
+	g.results = results
+	return g
+}
+
+// playOut lets the bot play both sides until the game is over and both
+// boards are revealed.
+func playOut(t *testing.T, a, b *game) {
+	playOutFor(t, a, b, 1000, 0)
+}
+
+// playOutFor is playOut with rounds rounds, and a pause after each
+func playOutFor(t *testing.T, a, b *game, rounds int, pause time.Duration) {
+	finished := make(map[*game]bool)
+	for i := 0; i < rounds; i++ {
+		for _, g := range []*game{a, b} {
+			if g.over {
+				if !finished[g] {
+					if err := g.finish(); err != nil {
+						t.Fatal(err)
+					}
+					finished[g] = true
+				}
+				continue
+			}
+
+			if g.ourTurn() {
+				if err := g.fire(botShots(g.RemoteB, g.peerWrecks, g.salvoSize())); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			msg, err := g.match.readBGP()
+			if err != nil {
+				continue
+			}
+			if _, err := g.handle(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if finished[a] && finished[b] {
+			return
+		}
+		time.Sleep(pause)
+	}
+	t.Fatalf("Game did not end, %d moves made", len(a.moves))
+}
+
+func checkGame(t *testing.T, a, b *game) {
+	if a.won == b.won {
+		t.Fatalf("Both sides think they won: %v", a.won)
+	}
+	loser := a
+	if a.won {
+		loser = b
+	}
+	if loser.LocalB.shipsLeft() != 0 {
+		t.Errorf("The loser has %d ship cells left", loser.LocalB.shipsLeft())
+	}
+
+	if len(a.moves) != len(b.moves) {
+		t.Fatalf("Sides disagree on the number of moves: %d != %d",
+			len(a.moves), len(b.moves))
+	}
+	for c := range a.moves {
+		sa, sb := a.moves[c].shots(a.salvo), b.moves[c].shots(b.salvo)
+		if len(sa) != len(sb) {
+			t.Fatalf("Move %d: %v != %v", c, sa, sb)
+		}
+		for i := range sa {
+			if sa[i] != sb[i] {
+				t.Fatalf("Move %d: %v != %v", c, sa, sb)
+			}
+		}
+	}
+
+	for _, g := range []*game{a, b} {
+		msg, err := g.match.readBGP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done, err := g.checkReveal(msg)
+		if !done || err != nil {
+			t.Errorf("%s: board of the other side not verified: %v %v",
+				g.match.Name, done, err)
+		}
+	}
+}
+
+func TestLoopbackGame(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+	playOut(t, a, b)
+	checkGame(t, a, b)
+}
+
+func TestLoopbackSurrender(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+	lb := &gameLoop{g: b}
+
+	// a surrender on the peer's turn is refused
+	lb.input("surrender\n")
+	if b.over {
+		t.Fatal("Surrendered on the other side's turn")
+	}
+
+	if err := a.fire(botShots(a.RemoteB, a.peerWrecks, a.salvoSize())); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := mb.readBGP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.handle(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	lb.input("surrender\n")
+	if !b.over || !b.surrendered {
+		t.Fatal("Surrender on our turn not taken")
+	}
+	playOut(t, a, b)
+	if !a.won || b.won {
+		t.Fatalf("Wrong winner after surrender: %v %v", a.won, b.won)
+	}
+}
+
+func TestLoopbackRevealWait(t *testing.T) {
+	_, mb := setupLoopback(t)
+	b := newLoopbackGame(t, mb, false, false, false)
+	b.surrender()
+
+	timeout := *revealTimeout
+	*revealTimeout = 200 * time.Millisecond
+	defer func() { *revealTimeout = timeout }()
+
+	l := &gameLoop{g: b, routes: make(chan routeEvent),
+		calls: make(chan apiCall), done: make(chan struct{})}
+	waited := make(chan struct{})
+	go func() {
+		l.waitReveal()
+		close(waited)
+	}()
+
+	// the API is served while the board of the other side is awaited
+	v, err := l.call(func(l *gameLoop) (interface{}, error) {
+		return l.g.over, nil
+	})
+	if err != nil || v != true {
+		t.Fatalf("API call during the reveal wait: %v %v", v, err)
+	}
+
+	select {
+	case <-waited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reveal wait did not time out")
+	}
+}
+
+func TestLoopbackHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*historyDB = filepath.Join(dir, "history.db")
+	defer func() { *historyDB = "" }()
+
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+	a.peerASN = 65001
+	playOut(t, a, b)
+	if err := recordHistory(a); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openHistory(*historyDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	games, err := queryHistory(db, "WHERE opponent_asn = ?", 65001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(games) != 1 || games[0].moves != len(a.moves) || games[0].result != gameResult(a) {
+		t.Fatalf("history has %v, want the game of %d moves", games, len(a.moves))
+	}
+	var moves int
+	if err := db.QueryRow("SELECT COUNT(*) FROM moves").Scan(&moves); err != nil {
+		t.Fatal(err)
+	}
+	if moves != len(a.moves) {
+		t.Fatalf("history has %d moves, want %d", moves, len(a.moves))
+	}
+}
+
+func TestLoopbackSalvo(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, false, true, false)
+	b := newLoopbackGame(t, mb, true, true, false)
+	playOut(t, a, b)
+	checkGame(t, a, b)
+}
+
+// legacyOnly drops the large communities on the way, like a path that
+// doesn't pass them.
+type legacyOnly struct {
+	router
+}
+
+func (r legacyOnly) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	o, _, err := r.router.read(ctx, prefix)
+	return o, nil, err
+}
+
+func TestLoopbackBond(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	activeRouter = legacyOnly{activeRouter}
+	ma.bond, ma.peerBond = []string{"10.0.2.0/24", "10.0.3.0/24"}, []string{"10.0.4.0/24", "10.0.5.0/24"}
+	mb.bond, mb.peerBond = ma.peerBond, ma.bond
+
+	a := newLoopbackGame(t, ma, false, true, false)
+	b := newLoopbackGame(t, mb, true, true, false)
+	playOut(t, a, b)
+	checkGame(t, a, b)
+	if !a.havePeerCommit || !b.havePeerCommit {
+		t.Errorf("Board commitments didn't make it over the bond prefixes")
+	}
+}
+
+func TestLoopbackLossy(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	activeRouter = newSimRouter(activeRouter.(*loopbackRouter), simConfig{
+		delay:     time.Millisecond,
+		jitter:    3 * time.Millisecond,
+		reorder:   0.3,
+		duplicate: 0.2,
+		strip:     0.2,
+		seed:      1,
+	})
+
+	a := newLoopbackGame(t, ma, true, true, true)
+	b := newLoopbackGame(t, mb, false, true, true)
+	playOutFor(t, a, b, 20000, 200*time.Microsecond)
+	// the reveals are on their way too
+	time.Sleep(50 * time.Millisecond)
+	checkGame(t, a, b)
+}
+
+func TestLoopbackResults(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, true)
+	b := newLoopbackGame(t, mb, false, false, true)
+	playOut(t, a, b)
+	checkGame(t, a, b)
+
+	winner := a
+	if b.won {
+		winner = b
+	}
+	if len(winner.peerSunk) != len(fleet) {
+		t.Errorf("Winner was told about %d sunk ships, expected %d",
+			len(winner.peerSunk), len(fleet))
+	}
+}
+
+func TestLoopbackMatchmaker(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+	playOut(t, a, b)
+	checkGame(t, a, b)
+	if ha, hb := replayHash(a), replayHash(b); ha != hb {
+		t.Fatalf("Sides disagree on the replay: %s != %s", ha, hb)
+	}
+
+	mm := &matchmaker{
+		players:      make(map[string]*mmPlayer),
+		matches:      make(map[int]*mmMatch),
+		asnLow:       64512,
+		asnHigh:      64512,
+		usedASNs:     make(map[int]bool),
+		prefixes:     []string{"10.64.0.0/24", "10.64.1.0/24"},
+		usedPrefixes: make(map[string]bool),
+		ratings:      make(map[int]float64),
+	}
+	pubA, keyA, _ := ed25519.GenerateKey(nil)
+	pubB, keyB, _ := ed25519.GenerateKey(nil)
+	if _, err := mm.register("a", 65001, "", hex.EncodeToString(pubA)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mm.register("b", 65002, "", hex.EncodeToString(pubB)); err != nil {
+		t.Fatal(err)
+	}
+
+	asn := *localASN
+	defer func() { *localASN = asn }()
+	a.peerASN, b.peerASN = 65002, 65001
+	*localASN = 65001
+	ra := resultOf(a, false)
+	*localASN = 65002
+	rb := resultOf(b, false)
+	ra.Match, rb.Match = 1, 1
+
+	if err := mm.report(ra, signResult(keyB, ra)); err != errBadSignature {
+		t.Errorf("Result signed by the other side taken: %v", err)
+	}
+	for _, r := range []struct {
+		rec resultRecord
+		key ed25519.PrivateKey
+	}{{ra, keyA}, {rb, keyB}} {
+		if err := mm.report(r.rec, signResult(r.key, r.rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := mm.matches[1]
+	winner := "a"
+	if b.won {
+		winner = "b"
+	}
+	if g := m.game(0); g.Disputed || g.Winner != winner {
+		t.Errorf("Game counted for %q, disputed %v, not for %q", g.Winner, g.Disputed, winner)
+	}
+	if r := mm.rating(ra.WinnerASN); r <= eloStart {
+		t.Errorf("Winner rated %f", r)
+	}
+
+	// both sides report another game, but disagree on how it went
+	ra.Game, rb.Game = 1, 1
+	rb.ReplayHash = replayHash(&game{})
+	for _, r := range []struct {
+		rec resultRecord
+		key ed25519.PrivateKey
+	}{{ra, keyA}, {rb, keyB}} {
+		if err := mm.report(r.rec, signResult(r.key, r.rec)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g := m.game(1); !g.Disputed || g.Winner != "" {
+		t.Errorf("Mismatched reports counted for %q", g.Winner)
+	}
+	if m.Players[0].Disputed != 1 || m.Players[1].Disputed != 1 {
+		t.Errorf("Disputed %d and %d games", m.Players[0].Disputed, m.Players[1].Disputed)
+	}
+}
+
+func TestMatchmakerExpire(t *testing.T) {
+	mm := &matchmaker{
+		players:      make(map[string]*mmPlayer),
+		matches:      make(map[int]*mmMatch),
+		asnLow:       64512,
+		asnHigh:      64512,
+		usedASNs:     make(map[int]bool),
+		prefixes:     []string{"10.64.0.0/24", "10.64.1.0/24"},
+		usedPrefixes: make(map[string]bool),
+		ratings:      make(map[int]float64),
+		timeout:      time.Hour,
+	}
+	pub, _, _ := ed25519.GenerateKey(nil)
+	key := hex.EncodeToString(pub)
+	register := func(name string, asn int) *mmPlayer {
+		p, err := mm.register(name, asn, "", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	a := register("a", 65001)
+	register("b", 65002)
+	register("c", 65003)
+	d := register("d", 65004)
+	if d.match != nil {
+		t.Fatal("Paired without a community ASN left")
+	}
+
+	// a and b never report
+	mm.matches[1].lastSeen = time.Now().Add(-2 * time.Hour)
+	asg, err := mm.assignment(d.token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := mm.matches[1]; !m.Done || !m.Expired || a.match != nil {
+		t.Fatalf("Abandoned match not ended: done %v, expired %v", m.Done, m.Expired)
+	}
+	if asg == nil || asg.Match != 2 || asg.CommunityASN != 64512 {
+		t.Fatalf("Waiting players did not get the freed resources: %+v", asg)
+	}
+}
+
+func TestLoopbackCTF(t *testing.T) {
+	*ctfMode = true
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, true)
+	b := newLoopbackGame(t, mb, false, false, true)
+	*ctfMode = false
+	a.ctf, b.ctf = true, true
+	if a.LocalB.Flag == nil || b.LocalB.Flag == nil {
+		t.Fatal("No flag hidden")
+	}
+
+	// straight for the flag
+	if err := a.fire([]cell{*b.LocalB.Flag}); err != nil {
+		t.Fatal(err)
+	}
+	playOut(t, a, b)
+	if !a.won || !a.captured || b.won || !b.captured {
+		t.Fatalf("Flag not captured: won %v %v, captured %v %v", a.won, b.won, a.captured, b.captured)
+	}
+	if len(a.moves) != 2 || !a.moves[1].Captured {
+		t.Fatalf("Game went on for %d moves after the flag was shot", len(a.moves))
+	}
+	for _, g := range []*game{a, b} {
+		msg, err := g.match.readBGP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done, err := g.checkReveal(msg); !done || err != nil {
+			t.Errorf("%s: board of the other side not verified: %v %v", g.match.Name, done, err)
+		}
+	}
+
+	text := exportGame(stateOf(b))
+	s, err := importGame(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, text)
+	}
+	r, err := restoreGame(newMatch(s.CommunityASN, "", s.PeerPrefix), s)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, text)
+	}
+	if !r.over || r.won || !r.captured || r.commitment.Hash != b.commitment.Hash {
+		t.Errorf("Game restored from the notation differs\n%s", text)
+	}
+}
+
+func TestNotation(t *testing.T) {
+	for _, salvo := range []bool{false, true} {
+		ma, mb := setupLoopback(t)
+		a := newLoopbackGame(t, ma, true, salvo, true)
+		b := newLoopbackGame(t, mb, false, salvo, true)
+		playOut(t, a, b)
+
+		for _, g := range []*game{a, b} {
+			text := exportGame(stateOf(g))
+			s, err := importGame(strings.NewReader(text))
+			if err != nil {
+				t.Fatalf("%v\n%s", err, text)
+			}
+			r, err := restoreGame(newMatch(s.CommunityASN, "", s.PeerPrefix), s)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, text)
+			}
+
+			if r.over != g.over || r.won != g.won || r.LocalB.Board != g.LocalB.Board ||
+				r.RemoteB.Board != g.RemoteB.Board || r.commitment != g.commitment {
+				t.Errorf("Game restored from the notation differs\n%s", text)
+			}
+			if len(r.moves) != len(g.moves) {
+				t.Fatalf("%d moves restored, %d played", len(r.moves), len(g.moves))
+			}
+			for c := range g.moves {
+				rm, gm := r.moves[c], g.moves[c]
+				rm.At, gm.At = time.Time{}, time.Time{}
+				if !reflect.DeepEqual(rm, gm) {
+					t.Fatalf("Move %d restored as %+v, played %+v", c, rm, gm)
+				}
+			}
+		}
+	}
+}
+
+func TestLoopbackHandshake(t *testing.T) {
+	ma, mb := setupLoopback(t)
+
+	sessions := make(chan session, 2)
+	errs := make(chan error, 2)
+	for _, m := range []*match{ma, mb} {
+		go func(m *match) {
+			s, err := handshake(m)
+			if err != nil {
+				errs <- err
+				return
+			}
+			sessions <- s
+		}(m)
+	}
+
+	var got []session
+	for len(got) < 2 {
+		select {
+		case s := <-sessions:
+			got = append(got, s)
+		case err := <-errs:
+			t.Fatal(err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("Handshake did not finish")
+		}
+	}
+
+	if got[0].StartFirst == got[1].StartFirst {
+		t.Errorf("Both sides go first: %v", got[0].StartFirst)
+	}
+	if got[0].Codecs != supportedCodecs || got[1].Codecs != supportedCodecs {
+		t.Errorf("Codecs not negotiated: %#x %#x", got[0].Codecs, got[1].Codecs)
+	}
+	if got[0].Tag == 0 || got[0].Tag != got[1].Tag {
+		t.Errorf("Game tags don't match: %d %d", got[0].Tag, got[1].Tag)
+	}
+}
+
+func TestLoopbackGameTag(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	ma.tag, mb.tag = 517, 517
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+	playOut(t, a, b)
+	checkGame(t, a, b)
+
+	// the other side moving on to another game
+	mb.tag = 518
+	if err := mb.writeMove(bgpMessage{Counter: len(b.moves) + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ma.readBGP(); err != errOtherGame {
+		t.Errorf("Move of another game taken: %v", err)
+	}
+	mb.tag = 0
+	if err := mb.writeMove(bgpMessage{Counter: len(b.moves) + 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ma.readBGP(); err != errOtherGame {
+		t.Errorf("Untagged move taken: %v", err)
+	}
+}
+
+func TestLoopbackReject(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+
+	// handle reads what the other side announces and hands it to g
+	handle := func(g *game) bool {
+		msg, err := g.match.readBGP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := g.handle(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if err := a.fire([]cell{{3, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if !handle(b) {
+		t.Fatal("First move not applied")
+	}
+	if err := b.fire([]cell{{2, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if !handle(a) {
+		t.Fatal("Second move not applied")
+	}
+
+	// the same cell again
+	if err := a.fire([]cell{{3, 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if handle(b) || len(b.moves) != 2 {
+		t.Fatalf("Repeated shot was applied, %d moves", len(b.moves))
+	}
+	if !handle(a) || len(a.moves) != 2 || !a.ourTurn() {
+		t.Fatalf("Rejected move not taken back, %d moves", len(a.moves))
+	}
+	// the rejection is still announced but was dealt with already
+	if handle(a) || len(a.moves) != 2 {
+		t.Fatalf("Rejection handled twice, %d moves", len(a.moves))
+	}
+
+	if err := a.fire([]cell{{4, 4}}); err != nil {
+		t.Fatal(err)
+	}
+	if !handle(b) || len(b.moves) != 3 {
+		t.Fatalf("Move made again not applied, %d moves", len(b.moves))
+	}
+}
+
+// TestLoopbackLoop plays two whole games through their event loops at
+// the same time, run it with -race.
+func TestLoopbackLoop(t *testing.T) {
+	ma, mb := setupLoopback(t)
+
+	bot, hs := *botMode, *doHandshake
+	*botMode, *doHandshake = true, true
+	defer func() { *botMode, *doHandshake = bot, hs }()
+
+	errs := make(chan error, 2)
+	for _, m := range []*match{ma, mb} {
+		go func(m *match) {
+			errs <- playMatch(m, false)
+		}(m)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("Games did not finish")
+		}
+	}
+}
+
+func TestLoopbackRoyale(t *testing.T) {
+	useLoopback(t)
+
+	bot, hs, asn, as, prefix := *botMode, *doHandshake, *localASN, *communityAS, *ourPrefix
+	*botMode, *doHandshake, *localASN = true, false, 65001
+	*communityAS, *ourPrefix = 65000, "10.0.0.0/24"
+	defenders = defenderSpecs{{65001, "10.0.1.0/24"}}
+	*royaleDefend = true
+	defer func() {
+		*royaleDefend = false
+		*botMode, *doHandshake, *localASN = bot, hs, asn
+		*communityAS, *ourPrefix = as, prefix
+		defenders = nil
+	}()
+
+	d := newMatch(65000, "10.0.1.0/24", "10.0.0.0/24")
+	if err := addMatch(d); err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 2)
+	go func() {
+		errs <- playRoyale(nil)
+	}()
+	go func() {
+		errs <- playMatch(d, false)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(30 * time.Second):
+			t.Fatal("Battle royale did not finish")
+		}
+	}
+}
+
+func TestLoopbackRematchTimeout(t *testing.T) {
+	ma, mb := setupLoopback(t)
+	a := newLoopbackGame(t, ma, true, false, false)
+	b := newLoopbackGame(t, mb, false, false, false)
+	playOut(t, a, b)
+
+	timeout := *handshakeTimeout
+	*handshakeTimeout = 100 * time.Millisecond
+	defer func() { *handshakeTimeout = timeout }()
+
+	// b never asks for the next game
+	done := make(chan error, 1)
+	go func() {
+		done <- rematch(a)
+	}()
+	select {
+	case err := <-done:
+		if err != errNoAnswer {
+			t.Fatalf("Unanswered rematch ended with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unanswered rematch did not time out")
+	}
+}
+
+func TestBotWrecks(t *testing.T) {
+	b := newBoard(10, 10)
+	for x := 2; x <= 4; x++ {
+		b.Board[3][x] = stateHit
+	}
+	// a miss next to it, the last shot at (4, 3) sunk the cruiser
+	b.Board[3][5] = stateAttempt
+	g := &game{RemoteB: b}
+	g.markWreck(2, []cell{{4, 3}})
+	for x := 2; x <= 4; x++ {
+		if !g.peerWrecks[cell{x, 3}] {
+			t.Fatalf("%v not taken as the wreck: %v", cell{x, 3}, g.peerWrecks)
+		}
+	}
+
+	around := map[cell]bool{{1, 3}: true}
+	for x := 2; x <= 4; x++ {
+		around[cell{x, 2}], around[cell{x, 4}] = true, true
+	}
+	for _, s := range botShots(b, g.peerWrecks, 3) {
+		if around[s] {
+			t.Errorf("Bot hunts around a sunk ship at %v", s)
+		}
+	}
+	if s := botShots(b, nil, 1)[0]; !around[s] {
+		t.Errorf("Bot does not follow up on hits without wrecks, shot at %v", s)
+	}
+
+	// two lines of hits the destroyer could be either of
+	b = newBoard(10, 10)
+	b.Board[5][5], b.Board[5][6], b.Board[6][5] = stateHit, stateHit, stateHit
+	g = &game{RemoteB: b}
+	g.markWreck(4, []cell{{5, 5}})
+	if len(g.peerWrecks) != 0 {
+		t.Errorf("Ambiguous wreck taken as %v", g.peerWrecks)
+	}
+}
+
+func TestExpandCounter(t *testing.T) {
+	for _, c := range []struct{ wire, near, want int }{
+		{5, 3, 5},
+		{1, 3, 1},
+		{0, counterMod - 1, counterMod},
+		{counterMod - 1, counterMod, counterMod - 1},
+		{2, 3*counterMod + 1, 3*counterMod + 2},
+		{counterMod - 100, 0, -100},
+	} {
+		if got := expandCounter(c.wire, c.near); got != c.want {
+			t.Errorf("expandCounter(%d, %d) = %d, want %d", c.wire, c.near, got, c.want)
+		}
+	}
+}
+
+func TestLoopbackRematch(t *testing.T) {
+	ma, mb := setupLoopback(t)
+
+	bot, hs, best := *botMode, *doHandshake, *bestOf
+	*botMode, *doHandshake, *bestOf = true, true, 3
+	defer func() { *botMode, *doHandshake, *bestOf = bot, hs, best }()
+
+	errs := make(chan error, 2)
+	for _, m := range []*match{ma, mb} {
+		go func(m *match) {
+			errs <- playMatch(m, false)
+		}(m)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(60 * time.Second):
+			t.Fatal("Games did not finish")
+		}
+	}
+	if ma.gameID < 1 || ma.gameID != mb.gameID {
+		t.Fatalf("Played up to game %d and %d", ma.gameID, mb.gameID)
+	}
+}
+
+// flowLoopback is a loopback router that can announce FlowSpec rules,
+// it sends them on rules as they are announced and withdrawn
+type flowLoopback struct {
+	*loopbackRouter
+	rules chan bool
+}
+
+func (r flowLoopback) flow(ctx context.Context, rule flowRule, announce bool) error {
+	r.rules <- announce
+	return nil
+}
+
+func TestNuke(t *testing.T) {
+	ma, _ := setupLoopback(t)
+	mode, d := *nukeMode, *nukeDuration
+	*nukeMode, *nukeDuration = true, 10*time.Millisecond
+	defer func() { *nukeMode, *nukeDuration = mode, d }()
+
+	if localCodecs()&codecNuke != 0 {
+		t.Errorf("Nuke offered by a router that can't announce FlowSpec")
+	}
+	r := flowLoopback{activeRouter.(*loopbackRouter), make(chan bool, 2)}
+	activeRouter = &splitRouter{rx: r, tx: r}
+	if localCodecs()&codecNuke == 0 {
+		t.Errorf("Nuke not offered by a router that can announce FlowSpec")
+	}
+
+	start := time.Now()
+	if err := nuke(ma); err != nil {
+		t.Fatal(err)
+	}
+	if <-r.rules != true {
+		t.Fatal("Nuke not announced")
+	}
+	if wait := time.Since(start); wait >= *nukeDuration {
+		t.Errorf("Nuke waited %s for the withdrawal", wait)
+	}
+	select {
+	case announce := <-r.rules:
+		if announce {
+			t.Errorf("Nuke announced again")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Nuke not withdrawn")
+	}
+	nukesLeft.Wait()
+}
+
+func TestOpenBGPDWithdraw(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bgpctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a bgpctl that only writes down what it's asked
+	log := filepath.Join(dir, "log")
+	script := filepath.Join(dir, "bgpctl")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$@\" >> "+log+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := *bgpctlPath
+	*bgpctlPath = script
+	defer func() { *bgpctlPath = path }()
+
+	r := newOpenBGPDRouter()
+	m := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	for _, ms := range [][]*match{{m}, nil} {
+		if err := r.write(context.Background(), ms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); got != "network add 10.0.0.0/24\nnetwork delete 10.0.0.0/24\n" {
+		t.Errorf("bgpctl was asked:\n%s", got)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	m := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	m.peerASN = 65002
+	tag := func(asn uint32) bgpLargeCommunity {
+		return bgpLargeCommunity{Global: 65000, Data1: fieldOrigin, Data2: asn}
+	}
+	for _, c := range []struct {
+		large []bgpLargeCommunity
+		ok    bool
+	}{
+		{nil, false},
+		{[]bgpLargeCommunity{tag(65002)}, true},
+		{[]bgpLargeCommunity{tag(65003)}, false},
+		{[]bgpLargeCommunity{tag(65002), tag(65003)}, false},
+		// other games on the same route
+		{[]bgpLargeCommunity{tag(65002), {Global: 65100, Data1: fieldOrigin, Data2: 65003}}, true},
+	} {
+		if err := m.checkOrigin(c.large); (err == nil) != c.ok {
+			t.Errorf("checkOrigin(%v) = %v", c.large, err)
+		}
+	}
+
+	// the other side is not known, as without -peerASN and the handshake
+	m.peerASN = 0
+	if err := m.checkOrigin(nil); err != nil {
+		t.Errorf("checkOrigin of an untagged route with no peer ASN = %v", err)
+	}
+}
+
+// pathsRouter tells the AS paths it's given
+type pathsRouter struct {
+	router
+	routePaths
+}
+
+func TestCheckPath(t *testing.T) {
+	m := newMatch(65000, "10.0.0.0/24", "10.0.1.0/24")
+	m.peerASN = 65002
+	r := &pathsRouter{router: newLoopbackRouter()}
+	saved := activeRouter
+	activeRouter = r
+	defer func() { activeRouter = saved }()
+
+	for _, c := range []struct {
+		text string
+		ok   bool
+	}{
+		{"64496 65002", true},
+		{"64496 65003", false},
+		{"", false},
+		{"Empty AS path", false},
+		{"64496 {65002 65003}", false},
+		{"64496 {65003} 65002", true},
+	} {
+		r.set(m.PeerPrefix, parseASPath(c.text))
+		if err := m.checkPath(); (err == nil) != c.ok {
+			t.Errorf("checkPath with AS path %q = %v", c.text, err)
+		}
+	}
+
+	r.paths = nil
+	if err := m.checkPath(); err == nil {
+		t.Errorf("checkPath without a route passed")
+	}
+	m.peerASN = 0
+	if err := m.checkPath(); err != nil {
+		t.Errorf("checkPath with no peer ASN known = %v", err)
+	}
+}
+
+func TestParseASPath(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		want []uint32
+	}{
+		{" 65002 65001", []uint32{65002, 65001}},
+		{"65002 {65003 65004} 65001", []uint32{65002, 65001}},
+		{"65002 {65003 65004}", nil},
+		{"", []uint32{}},
+		{"Empty AS path", nil},
+	} {
+		got := parseASPath(c.text)
+		if fmt.Sprint(got) != fmt.Sprint(c.want) || (got == nil) != (c.want == nil) {
+			t.Errorf("parseASPath(%q) = %v, want %v", c.text, got, c.want)
+		}
+	}
+
+	// AS_SEQUENCE 65002 65001, then an AS_SET
+	b := []byte{2, 2, 0, 0, 0xfd, 0xea, 0, 0, 0xfd, 0xe9, 1, 1, 0, 0, 0xfd, 0xeb}
+	if got, err := parseBGPASPath(b, false); err != nil || got != nil {
+		t.Errorf("parseBGPASPath ending in an AS_SET = %v %v", got, err)
+	}
+	// an AS_SET, then AS_SEQUENCE 65002 65001
+	b = append(b[10:], b[:10]...)
+	if got, err := parseBGPASPath(b, false); err != nil || fmt.Sprint(got) != "[65002 65001]" {
+		t.Errorf("parseBGPASPath = %v %v", got, err)
+	}
+}
+
+// birdTestRoute is how bird 2 shows route all with the large communities
+// wrapped, and an older route of peer2 behind the best one
+const birdTestRoute = "1007-Table master4:\n" +
+	" 10.0.1.0/24          unicast [peer1 12:00:00.000 from 192.0.2.2] * (100) [AS65001i]\n" +
+	" \tvia 192.0.2.2 on eth0\n" +
+	"1008-\tType: BGP univ\n" +
+	"1012-\tBGP.origin: IGP\n" +
+	" \tBGP.as_path: 65001\n" +
+	" \tBGP.community: (65535,65281)\n" +
+	" \tBGP.large_community: (65000, 36, 1) (65000, 37, 2)\n" +
+	" \t\t(65000, 38, 3)\n" +
+	"1007-                     unicast [peer2 11:00:00.000 from 198.51.100.2] (100) [AS64496 65001i]\n" +
+	" \tvia 198.51.100.2 on eth1\n" +
+	"1008-\tType: BGP univ\n" +
+	"1012-\tBGP.origin: IGP\n" +
+	" \tBGP.as_path: 64496 65001\n" +
+	" \tBGP.community: (65000,1) (65000,2)\n" +
+	" \tBGP.large_community: (65000, 36, 9)\n"
+
+// TestParseBirdRoute checks that only the best route is read, and sets
+// bird wraps over more lines are read whole.
+func TestParseBirdRoute(t *testing.T) {
+	o, lo, path := parseBirdRoute(birdTestRoute)
+	if !reflect.DeepEqual(o, []bgpCommunity{{65535, 65281}}) {
+		t.Errorf("Communities %v, the older route was read too", o)
+	}
+	want := []bgpLargeCommunity{{65000, 36, 1}, {65000, 37, 2}, {65000, 38, 3}}
+	if !reflect.DeepEqual(lo, want) {
+		t.Errorf("Large communities %v, want %v", lo, want)
+	}
+	if !reflect.DeepEqual(path, []uint32{65001}) {
+		t.Errorf("AS path %v", path)
+	}
+}
+
+func BenchmarkCodec(b *testing.B) {
+	msg := bgpMessage{Counter: 1234, X: 3, Y: 7, HitOrMissOnLast: resultHit,
+		Extended: []extendedCommunity{{extSunk, 2}}}
+	for _, c := range moveCodecs {
+		b.Run(c.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				communities, large := c.codec.encode(msg)
+				for j := range communities {
+					communities[j].AS = 65000
+				}
+				for j := range large {
+					large[j].Global = 65000
+				}
+				if _, err := c.codec.decode(65000, communities, large); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// stuckRouter announces nothing, like a router that didn't take the
+// last config
+type stuckRouter struct {
+	*loopbackRouter
+}
+
+func (r stuckRouter) write(ctx context.Context, ms []*match) error {
+	return nil
+}
+
+func TestRouteDiff(t *testing.T) {
+	a, b := setupLoopback(t)
+	ga := newLoopbackGame(t, a, true, false, false)
+	gb := newLoopbackGame(t, b, false, false, false)
+
+	if err := ga.fire([]cell{{1, 2}}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.readBGP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gb.handle(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	d := diffOf(ga)
+	for _, c := range d.Ours {
+		if !c.Announced || !c.Router {
+			t.Errorf("%s differs right after announcing it", c.Community)
+		}
+	}
+	if d := diffOf(gb); d.Counter != 0 || d.SeenErr != "" || len(d.Seen) == 0 {
+		t.Errorf("diff of the other side saw move %d %q", d.Counter, d.SeenErr)
+	}
+
+	activeRouter = stuckRouter{activeRouter.(*loopbackRouter)}
+	if err := gb.fire([]cell{{3, 4}}); err != nil {
+		t.Fatal(err)
+	}
+	d = diffOf(gb)
+	missing := 0
+	for _, c := range d.Ours {
+		if !c.Router {
+			missing++
+		}
+	}
+	if missing == 0 {
+		t.Errorf("diff of a stuck router misses nothing")
+	}
+	if text := describeDiff(d, true); !strings.Contains(text, "not on the router") {
+		t.Errorf("describeDiff doesn't tell what's missing:\n%s", text)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "battleships")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"config", "log-level", "pollInterval", "readTimeout", "backend", "notifyWebhook"}
+	saved := make(map[string]string)
+	for _, name := range names {
+		saved[name] = flag.CommandLine.Lookup(name).Value.String()
+	}
+	poll := pollInterval
+	defer func() {
+		for name, value := range saved {
+			flag.Set(name, value)
+		}
+		setupLogging()
+		pollInterval = poll
+		loadedConfig.fs = nil
+	}()
+
+	path := filepath.Join(dir, "battleships.conf")
+	write := func(text string) {
+		if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("# a comment\nlog-level debug\n-pollInterval=2s\nreadTimeout 3s\nnotifyWebhook http://localhost/hook\nbotCmd ./bot\n")
+
+	fs := findCommand("serve").flagSet()
+	fs.Parse([]string{"-config", path, "-readTimeout", "7s"})
+	if err := setupConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if *logLevelName != "debug" || pollInterval != 2*time.Second || *readTimeout != 7*time.Second ||
+		*notifyWebhook != "http://localhost/hook" || *botCmd != "" {
+		t.Fatalf("config not taken: %s %s %s %q %q", *logLevelName, pollInterval, *readTimeout,
+			*notifyWebhook, *botCmd)
+	}
+
+	write("log-level debug\npollInterval 5s\nreadTimeout 4s\nbackend loopback\n")
+	changed, err := reloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(changed) != "[notifyWebhook pollInterval]" {
+		t.Errorf("reload changed %v", changed)
+	}
+	if pollInterval != 5*time.Second || *notifyWebhook != "" || *readTimeout != 7*time.Second ||
+		*backendName == "loopback" {
+		t.Errorf("reloaded to %s %q %s %s", pollInterval, *notifyWebhook, *readTimeout, *backendName)
+	}
+
+	write("log-level loud\npollInterval 1s\n")
+	if _, err := reloadConfig(); err == nil {
+		t.Errorf("reload took an unknown log level")
+	}
+	if *logLevelName != "debug" || pollInterval != 5*time.Second {
+		t.Errorf("failed reload left %s %s", *logLevelName, pollInterval)
+	}
+}
+
+// sessionLoopback is a loopback router that can tell the state of the
+// session to the other side
+type sessionLoopback struct {
+	*loopbackRouter
+	up bool
+}
+
+func (r sessionLoopback) session(ctx context.Context, prefix string) (bool, error) {
+	return r.up, nil
+}
+
+func TestSplitRouterSession(t *testing.T) {
+	plain := newLoopbackRouter()
+	down := sessionLoopback{newLoopbackRouter(), false}
+	up := sessionLoopback{newLoopbackRouter(), true}
+
+	for _, c := range []struct {
+		name   string
+		rx, tx router
+		can    bool
+		up     bool
+	}{
+		{"rx", down, up, true, false},
+		{"tx", plain, up, true, true},
+		{"neither", plain, plain, false, false},
+	} {
+		r := &splitRouter{rx: c.rx, tx: c.tx}
+		if got := canSession(r); got != c.can {
+			t.Errorf("%s: canSession = %v, want %v", c.name, got, c.can)
+		}
+		got, err := r.session(context.Background(), "10.0.1.0/24")
+		if c.can && (err != nil || got != c.up) {
+			t.Errorf("%s: session = %v %v, want %v", c.name, got, err, c.up)
+		}
+		if !c.can && err != errNoSession {
+			t.Errorf("%s: session without a router that can tell: %v", c.name, err)
+		}
+	}
+}
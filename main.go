@@ -1,110 +1,314 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
-	"log"
 	"os"
-	"time"
+	"strings"
 )
 
+var startfirst = flag.Bool("startfirst", false,
+	"set this if you are starting first, without -handshake")
+
 func main() {
-	startfirst := flag.Bool("startfirst", false, "set this if you are starting first")
-	resetPls := flag.Bool("reset", false, "reset bird")
-	flag.Parse()
+	err := runCommand(os.Args[1:])
+	// a nuke we launched stays up for -nukeDuration
+	nukesLeft.Wait()
+	if err != nil {
+		mainLog.Fatalf("%s", err.Error())
+	}
+}
 
-	if *resetPls {
-		resetBird()
-		os.Exit(0)
+// serveGame plays games without anyone at the keyboard, the moves are
+// picked by the bot. Every -game is played at the same time.
+func serveGame(args []string) error {
+	*botMode = true
+	handleSignals()
+	startAPI()
+
+	if len(extraGames) == 0 {
+		return playGame(args)
+	}
+	if *bondPrefixes != "" || *peerBondPrefixes != "" {
+		return fmt.Errorf("-bondPrefixes only work with a single game")
 	}
 
-	log.Printf("Running self test")
+	mainLog.Infof("Running self test")
 	testBGPCode()
-	log.Printf("yup")
+	mainLog.Infof("yup")
 
-	LocalB := makeBoard()
-	RemoteB := battleShipBoard{}
+	for _, m := range extraGames {
+		if m.Prefix == "" {
+			m.Prefix = *ourPrefix
+		}
+		if err := addMatch(m); err != nil {
+			return err
+		}
+	}
+	if err := lintRouter(extraGames); err != nil {
+		return err
+	}
+	defer demux(extraGames)()
+
+	errs := make(chan error, len(extraGames))
+	for _, m := range extraGames {
+		go func(m *match) {
+			err := playMatch(m, false)
+			if err != nil {
+				m.log.Errorf("Game failed: %s", err.Error())
+			}
+			errs <- err
+		}(m)
+	}
 
-	LocalB.Draw()
+	var failed error
+	for range extraGames {
+		if err := <-errs; err != nil {
+			failed = err
+		}
+	}
+	return failed
+}
 
-	gameCounter := 0
-	firstPlay := true
-	hitmiss := 0
+func playGame(args []string) error {
+	handleSignals()
+	startAPI()
 
-	fmt.Print("Your Side                   Player Two\n")
-	fmt.Print(combineBoard(LocalB, RemoteB))
+	mainLog.Infof("Running self test")
+	testBGPCode()
+	mainLog.Infof("yup")
 
-	reader := bufio.NewReader(os.Stdin)
+	m := newMatch(*communityAS, *ourPrefix, *monitoredPrefix)
+	if err := m.setBond(); err != nil {
+		return err
+	}
+	if *resumeFile != "" {
+		s, err := readNotation(*resumeFile)
+		if err != nil {
+			return err
+		}
+		if s.CommunityASN != m.ASN || s.PeerPrefix != m.PeerPrefix {
+			return fmt.Errorf("%s is a game on AS%d against %s", *resumeFile,
+				s.CommunityASN, s.PeerPrefix)
+		}
+		m.resume = &s
+	}
+	if err := addMatch(m); err != nil {
+		return err
+	}
+	if err := lintRouter([]*match{m}); err != nil {
+		return err
+	}
+	return playMatch(m, true)
+}
+
+// playMatch plays the games of m, draw is set if it's the only one and
+// the boards can be printed.
+func playMatch(m *match, draw bool) error {
+	if *bestOf > 1 && !*doHandshake {
+		return fmt.Errorf("Rematches need -handshake")
+	}
+	if *botCmd != "" && *botMode {
+		return errBotAndBotCmd
+	}
+	if *royaleDefend && (*localASN == 0 || *doHandshake) {
+		return fmt.Errorf("-defend needs -asn and -handshake=false")
+	}
+
+	if *teamList != "" {
+		if err := checkTeamFlags(); err != nil {
+			return err
+		}
+		if err := followTeam(m, draw); err != nil {
+			return err
+		}
+	}
+
+	var dash *dashboard
+	if draw {
+		dash = startDashboard(*httpListen, m.PeerPrefix)
+	}
+
+	var won, lost int
 	for {
-		var text string
-		var x, y int
-		if *startfirst {
-			fmt.Printf("[%06d] Next Move> ", gameCounter)
-			text, _ = reader.ReadString('\n')
-			if len(text) != 3 {
-				log.Printf("wrong length of command %d", len(text))
-				continue
-			}
-			x, y = cordsToNumbers(text)
-			if x == -1 || y == -1 {
-				continue
-			}
+		g, err := playRound(m, draw, dash)
+		if err != nil || g.forfeited && *forfeitWithdraw {
+			return err
+		}
 
-			fmt.Printf("Firing on %s...", text)
-			writeBGP(gameCounter, x, y, hitmiss)
-			firstPlay = false
+		if g.won {
+			won++
+		} else {
+			lost++
+		}
+		final := won > *bestOf/2 || lost > *bestOf/2
+		if err := reportResult(g, final); err != nil {
+			m.log.Errorf("Unable to report the result %s", err.Error())
+		}
+		if err := recordHistory(g); err != nil {
+			m.log.Errorf("Unable to keep the game in the history %s", err.Error())
+		}
+		if *bestOf <= 1 {
+			return nil
 		}
 
-		*startfirst = true
+		m.log.Infof("Game %d of best of %d over, you %d, the other side %d",
+			m.gameID+1, *bestOf, won, lost)
+		if won > *bestOf/2 {
+			m.log.Infof("You won the series %d-%d!", won, lost)
+			return nil
+		}
+		if lost > *bestOf/2 {
+			m.log.Infof("You lost the series %d-%d", won, lost)
+			return nil
+		}
 
-		fmt.Printf("waiting on players response...\n")
+		if err := rematch(g); err == errNoAnswer {
+			m.log.Warnf("The other side did not ask for game %d, the series ends %d-%d",
+				m.gameID+2, won, lost)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
 
-		for {
-			time.Sleep(time.Second)
-			var err error
-			var nx, ny int
-			tempgameCounter := 0
-			tempgameCounter, nx, ny, hitmiss, err = readBGP()
-			if err != nil {
-				fmt.Print("E")
-				continue
-			}
-			fmt.Print(".")
-
-			if tempgameCounter > gameCounter || gameCounter == 0 {
-				gameCounter = tempgameCounter + 1
-				// !! New move has happened
-				log.Printf("The other side played a %s%d", string(byte("A"[0])+byte(nx)), ny)
-
-				// First, process if we got a hit or not.
-
-				if !(firstPlay && *startfirst) {
-					if hitmiss == 1 {
-						RemoteB.Board[y][x] = stateHit
-						log.Printf("It's a Hit!")
-					} else {
-						RemoteB.Board[y][x] = stateAttempt
-						log.Printf("It's a Miss!")
-					}
-
-				}
-
-				// Now... did we get hit?
-				if LocalB.Board[ny][nx] == stateShip {
-					hitmiss = 1
-					LocalB.Board[ny][nx] = stateHit
-				} else {
-					hitmiss = 0
-					LocalB.Board[ny][nx] = stateAttempt
-				}
-
-				break
-			}
+// playRound plays a single game of m.
+func playRound(m *match, draw bool, dash *dashboard) (*game, error) {
+	if s := m.resume; s != nil {
+		m.resume = nil
+		return resumeRound(m, *s, draw, dash)
+	}
+
+	width, height := *boardWidth, *boardHeight
+	if !validBoardSize(width, height) {
+		return nil, fmt.Errorf("Board size has to be between %dx%d and %dx%d",
+			minBoardSize, minBoardSize, maxBoardSize, maxBoardSize)
+	}
+
+	if err := checkCodecFlag(); err != nil {
+		return nil, err
+	}
+
+	startFirst, results, nukes := *startfirst, false, false
+	peer := uint32(*peerASN)
+	codec := flagCodec()
+	tag := 0
+	if *doHandshake {
+		s, err := handshake(m)
+		if err != nil {
+			return nil, fmt.Errorf("Handshake failed %s", err.Error())
+		}
+		startFirst = s.StartFirst
+		results = s.Codecs&codecResults != 0
+		nukes = s.Codecs&codecNuke != 0
+		if nukes {
+			m.log.Warnf("Both sides set -nuke, the winner announces a FlowSpec rule toward the other one")
+		}
+		width, height = s.Width, s.Height
+		peer = s.PeerASN
+		codec = pickCodec(s.Codecs)
+		tag = s.Tag
+		m.log.Infof("Playing with the %s codec", codec.name)
+	}
+	m.peerASN = peer
+	m.codec = codec
+	m.tag = tag
+	checkRPKI(m, uint32(*localASN), peer)
+
+	if !fleetFits(width, height) {
+		return nil, fmt.Errorf("The fleet does not fit on %dx%d", width, height)
+	}
+
+	local, err := makeBoard(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if *placeShips && draw && !*botMode {
+		if local, err = placeFleet(os.Stdin, local); err != nil {
+			return nil, fmt.Errorf("Unable to place the ships %s", err.Error())
+		}
+	}
+	commitment, err := commitBoard(local)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to commit to board %s", err.Error())
+	}
+	m.addSession(commitment.commitCommunities()...)
+	if err := m.writeSession(); err != nil {
+		mainLog.Errorf("Unable to announce board commitment %s", err.Error())
+	}
+
+	if m.prop == nil {
+		m.prop = watchPropagation(m)
+	}
+
+	g := newGame(m, local, startFirst)
+	g.commitment = commitment
+	g.salvo = *salvoMode
+	g.ctf = *ctfMode
+	g.results = results
+	g.nukes = nukes
+	g.peerASN = peer
+
+	dash.update(g)
+	saveState(g)
+
+	return g, newGameLoop(g, draw, dash).run()
+}
+
+// parseShots reads n space separated coordinates, it returns nil if
+// they are not valid on b.
+func parseShots(text string, n int, b battleShipBoard) []cell {
+	fields := strings.Fields(text)
+	if len(fields) != n {
+		mainLog.Warnf("wrong number of coordinates %d, expected %d", len(fields), n)
+		return nil
+	}
+
+	shots := make([]cell, 0, n)
+	for _, f := range fields {
+		x, y := cordsToNumbers(f, b.Width, b.Height)
+		if x == -1 || y == -1 {
+			mainLog.Warnf("invalid coordinates %s", f)
+			return nil
 		}
+		shots = append(shots, cell{x, y})
+	}
+	return shots
+}
+
+// resumeRound carries on with a game written down with export, there is
+// no handshake as the other side is in the middle of it.
+func resumeRound(m *match, s gameState, draw bool, dash *dashboard) (*game, error) {
+	g, err := restoreGame(m, s)
+	if err != nil {
+		return nil, err
+	}
+	m.gameID = s.Round
+	m.tag = s.Tag
+	m.peerASN = uint32(*peerASN)
+	for i, c := range moveCodecs {
+		if c.name == s.Codec {
+			m.codec = &moveCodecs[i]
+		}
+	}
+	m.log.Infof("Resuming at move %d", len(g.moves))
 
-		fmt.Print("Your Side                   Player Two\n")
-		fmt.Print(combineBoard(LocalB, RemoteB))
+	m.addSession(g.commitment.commitCommunities()...)
+	if err := m.writeSession(); err != nil {
+		mainLog.Errorf("Unable to announce board commitment %s", err.Error())
+	}
+	if m.prop == nil {
+		m.prop = watchPropagation(m)
 	}
+	if c, last := g.lastOwn(); c < len(g.moves) && g.ours(c) {
+		if err := g.announce(c, last); err != nil {
+			return nil, err
+		}
+	}
+
+	dash.update(g)
+	saveState(g)
 
+	return g, newGameLoop(g, draw, dash).run()
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+A match is one game, played on its own community ASN and peer prefix.
+Several of them can run in one daemon, they share the bird config,
+where each one gets its own section, and the routes of the peer
+prefixes are polled once for all of them, each match only gets the
+communities of its ASN.
+
+With -asn everything a match announces is tagged with who sent it:
+
+(communityASN, fieldOrigin, ASN)
+
+Through a route server the communities of other games on the same
+community ASN can end up on the route we read. A route tagged with any
+other ASN than the one of the other side, from -peerASN or the
+handshake, or with more than one, is ignored. So is an untagged route
+once the ASN of the other side is known, as it tags whatever it sends.
+Without one untagged routes are taken as they are.
+*/
+
+const fieldOrigin = 11
+
+type match struct {
+	Name       string
+	ASN        int
+	Prefix     string
+	PeerPrefix string
+
+	log logger
+
+	// what we announce, the session communities are kept for the
+	// whole game and the chat ones until the next message
+	session     []bgpLargeCommunity
+	chat        []bgpLargeCommunity
+	chatID      int
+	move        []bgpCommunity
+	moveLarge   []bgpLargeCommunity
+	communities []bgpCommunity
+	large       []bgpLargeCommunity
+
+	// set if the peer prefix is polled by demux
+	feed chan routeCommunities
+
+	// set with -risLive
+	prop *propagation
+
+	// goes up with every rematch, see rematch.go
+	gameID int
+
+	// the origin tag the route of the other side has to carry, 0 for
+	// -peerASN
+	peerASN uint32
+	// the move codec of the handshake, nil for -codec
+	codec *codecInfo
+	// the game tag of the handshake, 0 without one
+	tag int
+
+	// the game of -resume, until it's picked up
+	resume *gameState
+
+	// what was seen and announced, see timeline.go
+	timeline timeline
+
+	// the bond prefixes of both sides and what goes on ours, see bond.go
+	bond, peerBond []string
+	bondRoutes     [][]bgpCommunity
+	bondGen        int
+	bondKey        string
+	bondLast       []bgpLargeCommunity
+}
+
+type routeCommunities struct {
+	communities []bgpCommunity
+	large       []bgpLargeCommunity
+	err         error
+}
+
+// gameSpecs is the -game flag, it can be given more than once.
+type gameSpecs []*match
+
+var extraGames gameSpecs
+
+func init() {
+	flag.Var(&extraGames, "game",
+		"A game to serve, as communityASN,peerprefix[,prefix], can be repeated. "+
+			"Without it the game on -communityASN and -peerprefix is served")
+}
+
+func (s *gameSpecs) String() string {
+	names := make([]string, 0, len(*s))
+	for _, m := range *s {
+		names = append(names, m.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+func (s *gameSpecs) Set(v string) error {
+	parts := strings.Split(v, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("Game has to be communityASN,peerprefix[,prefix]")
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid community ASN %s", parts[0])
+	}
+	prefix := ""
+	if len(parts) == 3 {
+		prefix = parts[2]
+	}
+	*s = append(*s, newMatch(int(asn), prefix, parts[1]))
+	return nil
+}
+
+func newMatch(asn int, prefix, peerPrefix string) *match {
+	name := fmt.Sprintf("%d-%s", asn, strings.Replace(peerPrefix, "/", "_", -1))
+	return &match{
+		Name:       name,
+		ASN:        asn,
+		Prefix:     prefix,
+		PeerPrefix: peerPrefix,
+		log:        logger{"engine/" + name},
+	}
+}
+
+// matches are all the games we announce communities for
+var matches []*match
+var matchesMu sync.Mutex
+
+func addMatch(m *match) error {
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+
+	for _, o := range matches {
+		if o.ASN == m.ASN && o.PeerPrefix == m.PeerPrefix {
+			return fmt.Errorf("Game %s is there twice", m.Name)
+		}
+	}
+	matches = append(matches, m)
+	return nil
+}
+
+// announce replaces the communities of the move, the session and chat
+// ones are announced along with them.
+func (m *match) announce(communities []bgpCommunity, large []bgpLargeCommunity) error {
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+
+	m.move, m.moveLarge = communities, large
+	m.stamp()
+	return writeMatches(matches)
+}
+
+// stamp puts together everything the match announces, with its ASN
+// filled in. It's called with matchesMu held.
+func (m *match) stamp() {
+	m.communities = make([]bgpCommunity, 0, len(m.move))
+	for _, c := range m.move {
+		c.AS = uint16(m.ASN)
+		m.communities = append(m.communities, c)
+	}
+
+	large := append(append(append([]bgpLargeCommunity{},
+		m.moveLarge...), m.session...), m.chat...)
+	if *localASN != 0 && (len(m.move) > 0 || len(large) > 0) {
+		large = append(large, bgpLargeCommunity{Data1: fieldOrigin, Data2: uint32(*localASN)})
+	}
+	m.large = make([]bgpLargeCommunity, 0, len(large))
+	for _, c := range large {
+		c.Global = uint32(m.ASN)
+		m.large = append(m.large, c)
+	}
+	m.stampBond()
+	m.sent()
+}
+
+// withdraw stops announcing anything for the match.
+func (m *match) withdraw() error {
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+
+	m.session, m.chat = nil, nil
+	m.move, m.moveLarge = nil, nil
+	m.stamp()
+	return writeMatches(matches)
+}
+
+// clear drops the move and session communities, the next announce
+// starts from scratch. Chat stays.
+func (m *match) clear() {
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+
+	m.session = nil
+	m.move, m.moveLarge = nil, nil
+}
+
+// say announces a chat message next to the current move.
+func (m *match) say(text string) error {
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+
+	m.chatID++
+	m.chat = chatCommunities(m.chatID, text)
+	m.stamp()
+	return writeMatches(matches)
+}
+
+// addSession adds communities to announce for the whole game, they go
+// out with the next announce.
+func (m *match) addSession(large ...bgpLargeCommunity) {
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+	m.session = append(m.session, large...)
+}
+
+// writeSession announces only the session communities, used before
+// the first move is made.
+func (m *match) writeSession() error {
+	return m.announce(nil, nil)
+}
+
+// moveCodec is the codec of the game, from the handshake or -codec
+func (m *match) moveCodec() *codecInfo {
+	if m.codec == nil {
+		return flagCodec()
+	}
+	return m.codec
+}
+
+// writeMove announces the move of msg with the codec of the game.
+func (m *match) writeMove(msg bgpMessage) error {
+	if m.tag != 0 {
+		msg.Extended = append(msg.Extended[:len(msg.Extended):len(msg.Extended)],
+			extendedCommunity{Type: extGameTag, Payload: m.tag})
+	}
+	return m.announce(m.moveCodec().codec.encode(msg))
+}
+
+func (m *match) readCommunities() ([]bgpCommunity, []bgpLargeCommunity, error) {
+	var r routeCommunities
+	if m.feed == nil {
+		r.communities, r.large, r.err = readCommunities(m.PeerPrefix)
+	} else if fed, ok := <-m.feed; ok {
+		r = fed
+	} else {
+		r.err = errDemuxStopped
+	}
+	if r.err == nil && len(m.peerBond) > 0 {
+		r.large = append(r.large, m.readBond()...)
+	}
+	return r.communities, r.large, r.err
+}
+
+func (m *match) readBGP() (bgpMessage, error) {
+	communities, large, err := m.readCommunities()
+	if err == nil {
+		err = m.checkSender(large)
+	}
+	if err != nil {
+		m.seen(communities, large, bgpMessage{}, err)
+		return bgpMessage{}, err
+	}
+	msg, err := m.moveCodec().codec.decode(m.ASN, communities, large)
+	if err == nil {
+		err = m.checkTag(msg)
+	}
+	m.seen(communities, large, msg, err)
+	return msg, err
+}
+
+var errOtherGame = fmt.Errorf("The move on the route is of another game, by its game tag")
+
+// checkTag tells if msg is of our game by its game tag. Once the
+// handshake gave the game a tag, a move without one is not ours either.
+func (m *match) checkTag(msg bgpMessage) error {
+	if m.tag == 0 {
+		return nil
+	}
+	if e, ok := msg.extended(extGameTag); !ok || e.Payload != m.tag {
+		return errOtherGame
+	}
+	return nil
+}
+
+func (m *match) readHello() (map[uint32]uint32, error) {
+	_, large, err := m.readCommunities()
+	if err == nil {
+		err = m.checkSender(large)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return helloFields(m.ASN, large), nil
+}
+
+var checkPath = flag.Bool("checkPath", true,
+	"Ignore the route of the other side if the router says it is originated "+
+		"by another ASN than the one of the other side")
+
+// checkSender tells if the route read is the one of the other side, by
+// its origin tag and its AS path.
+func (m *match) checkSender(large []bgpLargeCommunity) error {
+	if err := m.checkOrigin(large); err != nil {
+		return err
+	}
+	return m.checkPath()
+}
+
+// expectedPeer is the ASN of the other side, 0 if not known
+func (m *match) expectedPeer() uint32 {
+	if m.peerASN != 0 {
+		return m.peerASN
+	}
+	return uint32(*peerASN)
+}
+
+// checkPath makes sure the route to the peer prefix is originated by
+// the other side, so that nobody else can make moves for it. Routers
+// that don't tell the AS path are not checked, but a route whose origin
+// they can't tell, with no AS path or one ending in an AS set, is
+// refused.
+func (m *match) checkPath() error {
+	pr, ok := activeRouter.(pathRouter)
+	want := m.expectedPeer()
+	if !*checkPath || !ok || want == 0 {
+		return nil
+	}
+	path, ok := pr.path(m.PeerPrefix)
+	if !ok || len(path) == 0 {
+		return fmt.Errorf("Route to %s has no AS path the origin can be read of, it should be AS%d",
+			m.PeerPrefix, want)
+	}
+	if origin := path[len(path)-1]; origin != want {
+		return fmt.Errorf("Route to %s is originated by AS%d, not by the other side AS%d",
+			m.PeerPrefix, origin, want)
+	}
+	return nil
+}
+
+var errMingledOrigins = fmt.Errorf("Route carries the communities of more than one player")
+
+// checkOrigin tells if the route with the large communities large is
+// the one of the other side, see fieldOrigin.
+func (m *match) checkOrigin(large []bgpLargeCommunity) error {
+	want := m.expectedPeer()
+	origin := uint32(0)
+	for _, c := range large {
+		if c.Global != uint32(m.ASN) || c.Data1 != fieldOrigin {
+			continue
+		}
+		if origin != 0 && c.Data2 != origin {
+			return errMingledOrigins
+		}
+		origin = c.Data2
+	}
+	switch {
+	case want == 0:
+	case origin == 0:
+		return fmt.Errorf("Route carries no origin tag, the other side AS%d tags its communities", want)
+	case origin != want:
+		return fmt.Errorf("Route carries the communities of AS%d, not of the other side", origin)
+	}
+	return nil
+}
+
+var errDemuxStopped = fmt.Errorf("Routes are not read anymore")
+
+// demux polls the peer prefixes of ms every second, once per prefix,
+// and feeds every match the communities of its ASN. A match that did
+// not pick up the last poll yet only gets the newest one. The returned
+// func stops it, from then on the matches read errDemuxStopped.
+func demux(ms []*match) (stop func()) {
+	prefixes := make(map[string][]*match)
+	for _, m := range ms {
+		m.feed = make(chan routeCommunities, 1)
+		prefixes[m.PeerPrefix] = append(prefixes[m.PeerPrefix], m)
+	}
+
+	quit, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			for prefix, pms := range prefixes {
+				communities, large, err := readCommunities(prefix)
+				for _, m := range pms {
+					r := routeCommunities{err: err}
+					for _, c := range communities {
+						if c.AS == uint16(m.ASN) {
+							r.communities = append(r.communities, c)
+						}
+					}
+					for _, c := range large {
+						if c.Global == uint32(m.ASN) {
+							r.large = append(r.large, c)
+						}
+					}
+
+					select {
+					case <-m.feed:
+					default:
+					}
+					m.feed <- r
+				}
+			}
+			select {
+			case <-time.After(pollInterval):
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-stopped
+		for _, m := range ms {
+			close(m.feed)
+		}
+	}
+}
@@ -0,0 +1,721 @@
+package main
+
+import (
+	cr "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+The matchmaker pairs up players that register with it, and gives every
+pair a community ASN and a prefix for each side to announce. Players
+report every game once it's over, which goes on the leaderboard along
+with an Elo rating per ASN.
+
+POST /register  {"Name": "...", "ASN": 65001, "Mode": "ctf", "PublicKey": "..."} -> {"Token": "...", ...}
+GET  /match?token=...                                -> 204 while waiting, or the assignment
+POST /result    {"Record": {...}, "Signature": "..."}
+GET  /leaderboard
+
+The token only tells who asks for an assignment. The record is signed
+with the ed25519 key of the player (written by keygen), the public key
+of it is registered in hex, see result.go. A game counts once both
+sides reported it: if they agree on the ASNs, the number of moves, the
+winner and the hash of the replay the winner gets it, otherwise it's
+disputed for both. The match goes on until a game is reported as
+final, only then are its community ASN and prefixes handed out again
+and can the players register for another match. A match that goes
+-matchTimeout without a report is abandoned and ends the same way,
+games only one side reported are dropped from it.
+
+Players are only paired with ones asking for the same game mode, as
+written by modeName, classic if none is given. The assignment has it,
+the flags to play it are up to the player.
+*/
+
+var errNoToken = fmt.Errorf("Unknown token")
+var errUnknownMatch = fmt.Errorf("Unknown match")
+var errBadSignature = fmt.Errorf("Bad result signature")
+var errWrongPlayers = fmt.Errorf("Result is for other ASNs than the match")
+
+// Elo ratings start at eloStart and move by up to eloK a game
+const (
+	eloStart = 1500
+	eloK     = 32
+)
+
+type mmPlayer struct {
+	Name string
+	ASN  int
+
+	Wins, Losses, Disputed int
+	Rating                 float64 `json:",omitempty"`
+	// the results of the player are signed with, in hex
+	PublicKey string `json:",omitempty"`
+
+	token string
+	match *mmMatch
+	// the game mode asked for at the last registration
+	mode string
+}
+
+type mmMatch struct {
+	ID           int
+	CommunityASN int
+	Players      [2]*mmPlayer
+	Prefixes     [2]string
+	Mode         string `json:",omitempty"`
+	Started      time.Time
+
+	Games []*mmGame
+	Done  bool
+	// ended by -matchTimeout rather than a final report
+	Expired bool `json:",omitempty"`
+	// when the match started or was last reported on
+	lastSeen time.Time
+	// the result of state files from before games were reported one
+	// by one
+	Winner string `json:",omitempty"`
+}
+
+type mmGame struct {
+	Game       int
+	Moves      int
+	ReplayHash string
+	Winner     string `json:",omitempty"`
+	Disputed   bool   `json:",omitempty"`
+	// what each side reported, nil until it did
+	reports [2]*resultRecord
+	// the signatures, kept to show the result was reported by them
+	Signatures [2]string
+}
+
+// mmAssignment is what a player gets once it's paired up.
+type mmAssignment struct {
+	Match        int
+	CommunityASN int
+	Prefix       string
+	PeerPrefix   string
+	PeerName     string
+	PeerASN      int
+	Mode         string
+}
+
+type matchmaker struct {
+	mu      sync.Mutex
+	players map[string]*mmPlayer
+	waiting []*mmPlayer
+	matches map[int]*mmMatch
+	nextID  int
+
+	asnLow, asnHigh int
+	usedASNs        map[int]bool
+	prefixes        []string
+	usedPrefixes    map[string]bool
+
+	// Elo rating of every ASN that played
+	ratings map[int]float64
+
+	// how long a match goes without a report before it's abandoned, 0
+	// for no limit
+	timeout time.Duration
+
+	statePath string
+}
+
+// splitPrefix cuts pool into prefixes of length bits.
+func splitPrefix(pool string, bits int) ([]string, error) {
+	ip, n, err := net.ParseCIDR(pool)
+	if err != nil {
+		return nil, err
+	}
+	ones, size := n.Mask.Size()
+	if ip.To4() == nil || size != 32 {
+		return nil, fmt.Errorf("Only IPv4 prefix pools are supported")
+	}
+	if bits < ones || bits > 32 || bits-ones > 16 {
+		return nil, fmt.Errorf("Unable to split %s into /%d", pool, bits)
+	}
+
+	base := binary.BigEndian.Uint32(n.IP.To4())
+	o := make([]string, 0, 1<<uint(bits-ones))
+	for i := uint32(0); i < 1<<uint(bits-ones); i++ {
+		b := make(net.IP, 4)
+		binary.BigEndian.PutUint32(b, base+i<<uint(32-bits))
+		o = append(o, fmt.Sprintf("%s/%d", b, bits))
+	}
+	return o, nil
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := cr.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (mm *matchmaker) register(name string, asn int, mode, publicKey string) (*mmPlayer, error) {
+	if name == "" || asn <= 0 {
+		return nil, fmt.Errorf("Name and ASN are needed")
+	}
+	pub, err := parsePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if mode == "" {
+		mode = "classic"
+	}
+	m, err := parseModeName(mode)
+	if err != nil {
+		return nil, err
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	p := &mmPlayer{Name: name, ASN: asn, token: token, mode: modeName(m),
+		PublicKey: hex.EncodeToString(pub)}
+	mm.players[token] = p
+	mm.waiting = append(mm.waiting, p)
+	mm.expire(time.Now())
+	mm.pair()
+	return p, nil
+}
+
+// nextPair returns the first two waiting players asking for the same
+// game mode, -1 if there are none.
+func (mm *matchmaker) nextPair() (int, int) {
+	for i, a := range mm.waiting {
+		for j := i + 1; j < len(mm.waiting); j++ {
+			if mm.waiting[j].mode == a.mode {
+				return i, j
+			}
+		}
+	}
+	return -1, -1
+}
+
+// pair matches waiting players two by two, as long as there is
+// something to hand out to them.
+func (mm *matchmaker) pair() {
+	for {
+		i, j := mm.nextPair()
+		if i < 0 {
+			return
+		}
+		asn := mm.allocASN()
+		prefixes := mm.allocPrefixes(2)
+		if asn == 0 || prefixes == nil {
+			if asn != 0 {
+				delete(mm.usedASNs, asn)
+			}
+			mainLog.Warnf("No community ASN or prefix left, %d players waiting",
+				len(mm.waiting))
+			return
+		}
+
+		mm.nextID++
+		m := &mmMatch{
+			ID:           mm.nextID,
+			CommunityASN: asn,
+			Players:      [2]*mmPlayer{mm.waiting[i], mm.waiting[j]},
+			Mode:         mm.waiting[i].mode,
+			Started:      time.Now(),
+		}
+		m.lastSeen = m.Started
+		copy(m.Prefixes[:], prefixes)
+		m.Players[0].match, m.Players[1].match = m, m
+		mm.matches[m.ID] = m
+		mm.waiting = append(mm.waiting[:j], mm.waiting[j+1:]...)
+		mm.waiting = append(mm.waiting[:i], mm.waiting[i+1:]...)
+
+		mainLog.Infof("Match %d: %s vs %s on community ASN %d, %s",
+			m.ID, m.Players[0].Name, m.Players[1].Name, asn, m.Mode)
+	}
+}
+
+func (mm *matchmaker) allocASN() int {
+	for asn := mm.asnLow; asn <= mm.asnHigh; asn++ {
+		if !mm.usedASNs[asn] {
+			mm.usedASNs[asn] = true
+			return asn
+		}
+	}
+	return 0
+}
+
+func (mm *matchmaker) allocPrefixes(n int) []string {
+	o := make([]string, 0, n)
+	for _, p := range mm.prefixes {
+		if len(o) == n {
+			break
+		}
+		if !mm.usedPrefixes[p] {
+			o = append(o, p)
+		}
+	}
+	if len(o) < n {
+		return nil
+	}
+	for _, p := range o {
+		mm.usedPrefixes[p] = true
+	}
+	return o
+}
+
+func (mm *matchmaker) assignment(token string) (*mmAssignment, error) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	p, ok := mm.players[token]
+	if !ok {
+		return nil, errNoToken
+	}
+	mm.expire(time.Now())
+	m := p.match
+	if m == nil {
+		return nil, nil
+	}
+
+	i := 0
+	if m.Players[1] == p {
+		i = 1
+	}
+	return &mmAssignment{
+		Match:        m.ID,
+		CommunityASN: m.CommunityASN,
+		Prefix:       m.Prefixes[i],
+		PeerPrefix:   m.Prefixes[1-i],
+		PeerName:     m.Players[1-i].Name,
+		PeerASN:      m.Players[1-i].ASN,
+		Mode:         m.Mode,
+	}, nil
+}
+
+func (m *mmMatch) game(id int) *mmGame {
+	for _, g := range m.Games {
+		if g.Game == id {
+			return g
+		}
+	}
+	g := &mmGame{Game: id}
+	m.Games = append(m.Games, g)
+	return g
+}
+
+func (mm *matchmaker) rating(asn int) float64 {
+	if r, ok := mm.ratings[asn]; ok {
+		return r
+	}
+	return eloStart
+}
+
+// rate moves the Elo ratings of both ASNs after a game
+func (mm *matchmaker) rate(winner, loser int) {
+	rw, rl := mm.rating(winner), mm.rating(loser)
+	expected := 1 / (1 + math.Pow(10, (rl-rw)/400))
+	mm.ratings[winner] = rw + eloK*(1-expected)
+	mm.ratings[loser] = rl - eloK*(1-expected)
+}
+
+// settle counts game g of m once both sides reported it.
+func (mm *matchmaker) settle(m *mmMatch, g *mmGame) {
+	ra, rb := g.reports[0], g.reports[1]
+	a, b := m.Players[0], m.Players[1]
+
+	winner := -1
+	if ra.Moves == rb.Moves && ra.ReplayHash == rb.ReplayHash &&
+		ra.WinnerASN == rb.WinnerASN && a.ASN != b.ASN {
+		switch ra.WinnerASN {
+		case a.ASN:
+			winner = 0
+		case b.ASN:
+			winner = 1
+		}
+	}
+	g.Moves, g.ReplayHash = ra.Moves, ra.ReplayHash
+
+	if winner < 0 {
+		a.Disputed++
+		b.Disputed++
+		g.Disputed = true
+		mainLog.Warnf("Game %d of match %d is disputed, both sides reported different results",
+			g.Game, m.ID)
+		return
+	}
+
+	w, l := m.Players[winner], m.Players[1-winner]
+	w.Wins++
+	l.Losses++
+	g.Winner = w.Name
+	mm.rate(w.ASN, l.ASN)
+}
+
+// signer is the player of m that signed rec with sig, -1 if neither
+// did.
+func (m *mmMatch) signer(rec resultRecord, sig string) int {
+	for i, p := range m.Players {
+		pub, err := parsePublicKey(p.PublicKey)
+		if err == nil && p.ASN == rec.ASN && checkResult(pub, rec, sig) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (mm *matchmaker) report(rec resultRecord, sig string) error {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	m, ok := mm.matches[rec.Match]
+	if !ok {
+		return errUnknownMatch
+	}
+	i := m.signer(rec, sig)
+	if i < 0 {
+		return errBadSignature
+	}
+	if m.Done {
+		return nil
+	}
+	if rec.PeerASN != m.Players[1-i].ASN {
+		return errWrongPlayers
+	}
+	g := m.game(rec.Game)
+	if g.reports[i] != nil {
+		return nil
+	}
+	g.reports[i], g.Signatures[i] = &rec, sig
+	m.lastSeen = time.Now()
+	if g.reports[1-i] == nil {
+		return nil
+	}
+	mm.settle(m, g)
+
+	if rec.Final || g.reports[1-i].Final {
+		mm.end(m)
+	}
+	mm.save()
+	return nil
+}
+
+// end is over with m, its community ASN and prefixes go to the next
+// players and the players of it can register again for another match.
+func (mm *matchmaker) end(m *mmMatch) {
+	m.Done = true
+	a, b := m.Players[0], m.Players[1]
+	a.match, b.match = nil, nil
+	delete(mm.usedASNs, m.CommunityASN)
+	for _, prefix := range m.Prefixes {
+		delete(mm.usedPrefixes, prefix)
+	}
+	mm.pair()
+}
+
+// expire ends the matches that went mm.timeout without a report, it's
+// called with mm.mu held.
+func (mm *matchmaker) expire(now time.Time) {
+	if mm.timeout <= 0 {
+		return
+	}
+	expired := false
+	for _, m := range mm.matches {
+		if m.Done || now.Sub(m.lastSeen) < mm.timeout {
+			continue
+		}
+		mainLog.Warnf("Match %d: nothing reported for %s, abandoned", m.ID, mm.timeout)
+		// a game only one side reported can't be counted
+		games := m.Games[:0]
+		for _, g := range m.Games {
+			if g.reports[0] != nil && g.reports[1] != nil {
+				games = append(games, g)
+			}
+		}
+		m.Games = games
+		m.Expired = true
+		mm.end(m)
+		expired = true
+	}
+	if expired {
+		mm.save()
+	}
+}
+
+func (mm *matchmaker) leaderboard() []mmPlayer {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+
+	// the same player may have registered more than once, it's keyed
+	// by name and ASN
+	type key struct {
+		name string
+		asn  int
+	}
+	byPlayer := make(map[key]*mmPlayer)
+	for _, p := range mm.players {
+		k := key{p.Name, p.ASN}
+		if byPlayer[k] == nil {
+			byPlayer[k] = &mmPlayer{Name: p.Name, ASN: p.ASN}
+		}
+		e := byPlayer[k]
+		e.Wins += p.Wins
+		e.Losses += p.Losses
+		e.Disputed += p.Disputed
+		e.Rating = mm.rating(p.ASN)
+	}
+
+	o := make([]mmPlayer, 0, len(byPlayer))
+	for _, p := range byPlayer {
+		o = append(o, *p)
+	}
+	sort.Slice(o, func(i, j int) bool {
+		if o[i].Rating != o[j].Rating {
+			return o[i].Rating > o[j].Rating
+		}
+		if o[i].Wins != o[j].Wins {
+			return o[i].Wins > o[j].Wins
+		}
+		if o[i].Losses != o[j].Losses {
+			return o[i].Losses < o[j].Losses
+		}
+		return o[i].Name < o[j].Name
+	})
+	return o
+}
+
+type mmSavedState struct {
+	Matches []*mmMatch
+}
+
+// save writes the finished matches to the state file, it's called
+// with mm.mu held.
+func (mm *matchmaker) save() {
+	if mm.statePath == "" {
+		return
+	}
+
+	s := mmSavedState{}
+	for _, m := range mm.matches {
+		if m.Done {
+			s.Matches = append(s.Matches, m)
+		}
+	}
+	sort.Slice(s.Matches, func(i, j int) bool { return s.Matches[i].ID < s.Matches[j].ID })
+
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		mainLog.Errorf("Unable to encode matchmaker state %s", err.Error())
+		return
+	}
+	if err := writeFileAtomic(mm.statePath, b, 0644); err != nil {
+		mainLog.Errorf("Unable to write matchmaker state %s", err.Error())
+	}
+}
+
+// load restores the finished matches and the players of them, so that
+// the leaderboard survives a restart.
+func (mm *matchmaker) load() error {
+	b, err := ioutil.ReadFile(mm.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s mmSavedState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for _, m := range s.Matches {
+		if len(m.Games) == 0 && !m.Expired {
+			m.Games = []*mmGame{{Winner: m.Winner, Disputed: m.Winner == ""}}
+		}
+		for i, p := range m.Players {
+			// restored players can't be logged in as, and only count
+			// this match, the leaderboard adds them up
+			token, err := newToken()
+			if err != nil {
+				return err
+			}
+			r := &mmPlayer{Name: p.Name, ASN: p.ASN, token: token, PublicKey: p.PublicKey}
+			for _, g := range m.Games {
+				switch {
+				case g.Disputed:
+					r.Disputed++
+				case g.Winner == p.Name:
+					r.Wins++
+				default:
+					r.Losses++
+				}
+			}
+			mm.players[token] = r
+			m.Players[i] = r
+		}
+		// the ratings are played back game by game
+		for _, g := range m.Games {
+			a, b := m.Players[0], m.Players[1]
+			if g.Disputed {
+				continue
+			}
+			if g.Winner == a.Name {
+				mm.rate(a.ASN, b.ASN)
+			} else {
+				mm.rate(b.ASN, a.ASN)
+			}
+		}
+		mm.matches[m.ID] = m
+		if m.ID > mm.nextID {
+			mm.nextID = m.ID
+		}
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (mm *matchmaker) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Name      string
+			ASN       int
+			Mode      string
+			PublicKey string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err := mm.register(req.Name, req.ASN, req.Mode, req.PublicKey)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, struct {
+			Token string
+			Name  string
+			ASN   int
+		}{p.token, p.Name, p.ASN})
+	})
+
+	mux.HandleFunc("/match", func(w http.ResponseWriter, r *http.Request) {
+		a, err := mm.assignment(r.URL.Query().Get("token"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if a == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, a)
+	})
+
+	mux.HandleFunc("/result", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		var req resultReport
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := mm.report(req.Record, req.Signature); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/leaderboard", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, mm.leaderboard())
+	})
+
+	return mux
+}
+
+// runMatchmaker is the matchmaker command.
+func runMatchmaker(args []string) error {
+	fs := flag.NewFlagSet("matchmaker", flag.ExitOnError)
+	listen := fs.String("listen", ":8443", "Address to serve on")
+	cert := fs.String("cert", "", "TLS certificate, plain HTTP is served without it")
+	key := fs.String("key", "", "TLS key")
+	asnLow := fs.Int("asnLow", 64512, "Lowest community ASN to hand out")
+	asnHigh := fs.Int("asnHigh", 65534, "Highest community ASN to hand out")
+	pool := fs.String("prefixPool", "", "Prefix the players' prefixes are cut from")
+	prefixLen := fs.Int("prefixLen", 24, "Length of the prefixes handed out")
+	state := fs.String("state", "", "File to keep the results in")
+	timeout := fs.Duration("matchTimeout", 2*time.Hour,
+		"How long a match goes without a report before it's abandoned, 0 for no limit")
+	for _, name := range logFlags {
+		f := flag.CommandLine.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Parse(args)
+
+	if err := setupLogging(); err != nil {
+		return err
+	}
+
+	if *asnLow <= 0 || *asnHigh > 65535 || *asnLow > *asnHigh {
+		return fmt.Errorf("Invalid community ASN range %d-%d", *asnLow, *asnHigh)
+	}
+	if *pool == "" {
+		return fmt.Errorf("-prefixPool is needed")
+	}
+	prefixes, err := splitPrefix(*pool, *prefixLen)
+	if err != nil {
+		return err
+	}
+
+	mm := &matchmaker{
+		players:      make(map[string]*mmPlayer),
+		matches:      make(map[int]*mmMatch),
+		asnLow:       *asnLow,
+		asnHigh:      *asnHigh,
+		usedASNs:     make(map[int]bool),
+		prefixes:     prefixes,
+		usedPrefixes: make(map[string]bool),
+		ratings:      make(map[int]float64),
+		statePath:    *state,
+		timeout:      *timeout,
+	}
+	if mm.statePath != "" {
+		if err := mm.load(); err != nil {
+			return fmt.Errorf("Unable to load matchmaker state %s", err.Error())
+		}
+	}
+
+	mainLog.Infof("Matchmaker serving on %s, %d prefixes to hand out", *listen, len(prefixes))
+	if *cert != "" {
+		return http.ListenAndServeTLS(*listen, *cert, *key, mm.handler())
+	}
+	mainLog.Warnf("No -cert given, serving plain HTTP")
+	return http.ListenAndServe(*listen, mm.handler())
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+)
+
+/*
+The extended types (the E field of type 3 communities) known to the
+game. Types 1 to 5 are acted on by game.handle itself, 6 by rematch and
+7 by match.readBGP, 8 to 11 are kept for the game to grow into (acks, a
+surrender of its own) and 12 to 15 are free for experiments.
+
+A side ignores extended types it doesn't know, so an experimental type
+can be tried out without a new protocol version: register it with a
+handler from an init func and it gets every community of its type the
+other side announces, along the move it came with.
+*/
+
+const (
+	extExperimentalFirst = 12
+	extExperimentalLast  = 15
+)
+
+// extHandler acts on an extended community of the other side. The
+// route is read again every poll, so it sees the same community many
+// times and has to tell a new one from an old one itself.
+type extHandler func(g *game, msg bgpMessage, e extendedCommunity) error
+
+type extType struct {
+	name   string
+	handle extHandler
+}
+
+var extTypes = map[int]*extType{
+	extResyncRequest: {name: "resync request"},
+	extReplay:        {name: "replay"},
+	extGameOver:      {name: "game over"},
+	extSunk:          {name: "sunk"},
+	extProtocolError: {name: "protocol error"},
+	extNewGame:       {name: "new game"},
+	extGameTag:       {name: "game tag"},
+}
+
+// registerExtended adds an extended type, it has to be done before any
+// game starts.
+func registerExtended(t int, name string, h extHandler) error {
+	if t < 1 || t > 15 {
+		return fmt.Errorf("Extended type %d does not fit in 4 bits", t)
+	}
+	if _, ok := extTypes[t]; ok {
+		return fmt.Errorf("Extended type %d is already %s", t, extTypes[t].name)
+	}
+	extTypes[t] = &extType{name: name, handle: h}
+	return nil
+}
+
+// dispatchExtended hands the extended communities of msg to the
+// handlers of their types, the ones without one are left to handle.
+func (g *game) dispatchExtended(msg bgpMessage) {
+	for _, e := range msg.Extended {
+		t, ok := extTypes[e.Type]
+		if !ok || t.handle == nil {
+			continue
+		}
+		if err := t.handle(g, msg, e); err != nil {
+			g.match.log.Warnf("Unable to handle %s: %s", t.name, err.Error())
+		}
+	}
+}
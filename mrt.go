@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+import-mrt reads MRT update dumps (RFC 6396), as RIPE RIS and
+RouteViews publish them, and puts together the games that were played
+over the routes in them. Every move is kept with the time the first
+collector peer saw it and how many of them did, which shows how far a
+game made it into the DFZ.
+
+Only BGP4MP messages are read, RIB dumps are skipped. Files can be
+gzip or bzip2 compressed.
+*/
+
+const (
+	mrtBGP4MP   = 16
+	mrtBGP4MPET = 17
+
+	mrtMessage         = 1
+	mrtMessageAS4      = 4
+	mrtMessageLocal    = 6
+	mrtMessageAS4Local = 7
+)
+
+var errMRTShort = fmt.Errorf("MRT record too short")
+
+type mrtRecord struct {
+	at      time.Time
+	typ     int
+	subtype int
+	body    []byte
+}
+
+type replayMove struct {
+	Counter int
+	Prefix  string
+	// how many collector peers saw the move, and when the last of them
+	// did first
+	Peers    int
+	LastSeen time.Time
+	move
+}
+
+// mrtReplay is a game as seen in the dumps, Boards has the shots fired
+// at each of the Prefixes.
+type mrtReplay struct {
+	CommunityASN  int
+	Prefixes      []string
+	Width, Height int
+	Salvo         bool
+	Moves         []replayMove
+	Boards        [][][]string
+	Winner        string
+}
+
+// mrtSide is what was seen of the announcements of one prefix
+type mrtSide struct {
+	asn    int
+	prefix string
+	hello  map[uint32]uint32
+	msgs   map[int]bgpMessage
+	seen   map[int]time.Time
+	peers  map[int]map[string]bool
+	last   map[int]time.Time
+	// highest counter seen, the ones after a wrap follow it
+	latest int
+}
+
+func openMRT(path string) (io.ReadCloser, io.Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(3)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, gz, nil
+	case string(magic) == "BZh":
+		return f, bzip2.NewReader(br), nil
+	}
+	return f, br, nil
+}
+
+func readMRTRecord(r io.Reader) (rec mrtRecord, err error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return rec, err
+	}
+	rec.at = time.Unix(int64(binary.BigEndian.Uint32(header[0:4])), 0)
+	rec.typ = int(binary.BigEndian.Uint16(header[4:6]))
+	rec.subtype = int(binary.BigEndian.Uint16(header[6:8]))
+	length := binary.BigEndian.Uint32(header[8:12])
+	if length > 1<<24 {
+		return rec, errMRTShort
+	}
+
+	rec.body = make([]byte, length)
+	if _, err := io.ReadFull(r, rec.body); err != nil {
+		return rec, err
+	}
+
+	if rec.typ == mrtBGP4MPET {
+		if len(rec.body) < 4 {
+			return rec, errMRTShort
+		}
+		usec := binary.BigEndian.Uint32(rec.body[0:4])
+		rec.at = rec.at.Add(time.Duration(usec) * time.Microsecond)
+		rec.body = rec.body[4:]
+	}
+	return rec, nil
+}
+
+// parseBGP4MP returns the peer and the UPDATE in a BGP4MP message
+// record, ok is false for anything else.
+func parseBGP4MP(rec mrtRecord) (peer string, u bmpUpdate, ok bool, err error) {
+	if rec.typ != mrtBGP4MP && rec.typ != mrtBGP4MPET {
+		return "", u, false, nil
+	}
+
+	asSize := 2
+	switch rec.subtype {
+	case mrtMessage, mrtMessageLocal:
+	case mrtMessageAS4, mrtMessageAS4Local:
+		asSize = 4
+	default:
+		return "", u, false, nil
+	}
+
+	b := rec.body
+	if len(b) < 2*asSize+4 {
+		return "", u, false, errMRTShort
+	}
+	b = b[2*asSize+2:]
+	ipSize := 4
+	if binary.BigEndian.Uint16(b[0:2]) == 2 {
+		ipSize = 16
+	}
+	b = b[2:]
+	if len(b) < 2*ipSize+19 {
+		return "", u, false, errMRTShort
+	}
+	peer = net.IP(b[0:ipSize]).String()
+	b = b[2*ipSize:]
+	if b[18] != 2 {
+		return peer, u, false, nil
+	}
+
+	u, err = parseBGPUpdate(b, asSize == 2)
+	return peer, u, err == nil, err
+}
+
+// gameASNs are the ASNs the communities of a route could be a game on
+func gameASNs(asn int, communities []bgpCommunity) []int {
+	if asn != 0 {
+		return []int{asn}
+	}
+	seen := make(map[int]bool)
+	var o []int
+	for _, c := range communities {
+		if !seen[int(c.AS)] {
+			seen[int(c.AS)] = true
+			o = append(o, int(c.AS))
+		}
+	}
+	return o
+}
+
+func (s *mrtSide) add(msg bgpMessage, hello map[uint32]uint32, at time.Time, peer string) {
+	if len(hello) > 0 {
+		s.hello = hello
+	}
+	if _, ok := msg.extended(extResyncRequest); ok {
+		return
+	}
+
+	msg.Counter = expandCounter(msg.Counter, s.latest)
+	if msg.Counter > s.latest {
+		s.latest = msg.Counter
+	}
+
+	if first, ok := s.seen[msg.Counter]; !ok || at.Before(first) {
+		s.seen[msg.Counter] = at
+		s.msgs[msg.Counter] = msg
+	}
+	if s.peers[msg.Counter] == nil {
+		s.peers[msg.Counter] = make(map[string]bool)
+	}
+	if !s.peers[msg.Counter][peer] && at.After(s.last[msg.Counter]) {
+		s.last[msg.Counter] = at
+	}
+	s.peers[msg.Counter][peer] = true
+}
+
+func (s *mrtSide) overlaps(o *mrtSide) bool {
+	for c := range s.msgs {
+		if _, ok := o.msgs[c]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pairSides puts together the prefixes that played each other, the two
+// sides of a game use the same ASN and never the same counter.
+func pairSides(sides map[string]*mrtSide) [][]*mrtSide {
+	keys := make([]string, 0, len(sides))
+	for k := range sides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	paired := make(map[string]bool)
+	var games [][]*mrtSide
+	for i, a := range keys {
+		if paired[a] {
+			continue
+		}
+		game := []*mrtSide{sides[a]}
+		for _, b := range keys[i+1:] {
+			sa, sb := sides[a], sides[b]
+			if paired[b] || sa.asn != sb.asn || sa.overlaps(sb) {
+				continue
+			}
+			game = append(game, sb)
+			paired[b] = true
+			break
+		}
+		paired[a] = true
+		games = append(games, game)
+	}
+	return games
+}
+
+func buildReplay(sides []*mrtSide) mrtReplay {
+	r := mrtReplay{
+		CommunityASN: sides[0].asn,
+		Width:        *boardWidth,
+		Height:       *boardHeight,
+	}
+	for _, s := range sides {
+		r.Prefixes = append(r.Prefixes, s.prefix)
+		if size, ok := s.hello[helloBoardSize]; ok {
+			r.Width, r.Height = int(size>>8), int(size&0xff)
+		}
+		if mode, ok := s.hello[helloMode]; ok {
+			r.Salvo = mode&modeSalvo != 0
+		}
+	}
+
+	for i, s := range sides {
+		for c, msg := range s.msgs {
+			m := messageMove(msg, r.Salvo)
+			m.At = s.seen[c]
+			r.Moves = append(r.Moves, replayMove{
+				Counter:  c,
+				Prefix:   s.prefix,
+				Peers:    len(s.peers[c]),
+				LastSeen: s.last[c],
+				move:     m,
+			})
+			if m.GameOver && len(sides) == 2 {
+				r.Winner = sides[1-i].prefix
+			}
+		}
+	}
+	sort.Slice(r.Moves, func(i, j int) bool {
+		return r.Moves[i].Counter < r.Moves[j].Counter
+	})
+
+	if !validBoardSize(r.Width, r.Height) {
+		return r
+	}
+
+	boards := make(map[string]*battleShipBoard)
+	for _, s := range sides {
+		b := newBoard(r.Width, r.Height)
+		boards[s.prefix] = &b
+	}
+	// results of a move only come with the next one
+	for i, rm := range r.Moves {
+		if rm.GameOver || i+1 >= len(r.Moves) || len(sides) != 2 {
+			continue
+		}
+		next := r.Moves[i+1]
+		if next.Counter != rm.Counter+1 || next.Prefix == rm.Prefix {
+			continue
+		}
+		target := boards[next.Prefix]
+		for j, s := range rm.shots(r.Salvo) {
+			if !target.inside(s.X, s.Y) {
+				continue
+			}
+			if next.hit(j, r.Salvo) {
+				target.Board[s.Y][s.X] = stateHit
+			} else {
+				target.Board[s.Y][s.X] = stateAttempt
+			}
+		}
+	}
+	for _, s := range sides {
+		r.Boards = append(r.Boards, boardStrings(*boards[s.prefix]))
+	}
+	return r
+}
+
+// importMRT is the import-mrt command.
+func importMRT(args []string) error {
+	fs := flag.NewFlagSet("import-mrt", flag.ExitOnError)
+	out := fs.String("o", "", "Write the replay file here instead of stdout")
+	asn := fs.Int("communityASN", 23456,
+		"The community AS the games were played on, 0 to look at all of them")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import-mrt [flags] <file>...\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	for _, name := range logFlags {
+		f := flag.CommandLine.Lookup(name)
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Parse(args)
+
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("import-mrt needs MRT files to read")
+	}
+
+	sides := make(map[string]*mrtSide)
+	for _, path := range fs.Args() {
+		f, r, err := openMRT(path)
+		if err != nil {
+			return err
+		}
+
+		records := 0
+		for {
+			rec, err := readMRTRecord(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("%s: %s", path, err.Error())
+			}
+			records++
+
+			peer, u, ok, err := parseBGP4MP(rec)
+			if err != nil {
+				mainLog.Debugf("%s: skipping record %d: %s", path, records, err.Error())
+			}
+			if !ok || len(u.announced) == 0 {
+				continue
+			}
+
+			for _, a := range gameASNs(*asn, u.route.communities) {
+				msg, err := decodeMessage(a, u.route.communities, u.route.large)
+				if err != nil {
+					continue
+				}
+				hello := helloFields(a, u.route.large)
+				for _, prefix := range u.announced {
+					key := fmt.Sprintf("%d %s", a, prefix)
+					s, ok := sides[key]
+					if !ok {
+						s = &mrtSide{
+							asn:    a,
+							prefix: prefix,
+							msgs:   make(map[int]bgpMessage),
+							seen:   make(map[int]time.Time),
+							peers:  make(map[int]map[string]bool),
+							last:   make(map[int]time.Time),
+						}
+						sides[key] = s
+					}
+					s.add(msg, hello, rec.at, peer)
+				}
+			}
+		}
+		f.Close()
+		mainLog.Infof("Read %d records from %s", records, path)
+	}
+
+	replays := []mrtReplay{}
+	for _, g := range pairSides(sides) {
+		r := buildReplay(g)
+		if len(g) == 1 {
+			mainLog.Warnf("Only one side of the game of %s on AS%d was seen",
+				g[0].prefix, g[0].asn)
+		}
+		mainLog.Infof("Found a game of %d moves between %v on AS%d",
+			len(r.Moves), r.Prefixes, r.CommunityASN)
+		replays = append(replays, r)
+	}
+
+	b, err := json.MarshalIndent(replays, "", "\t")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if *out == "" {
+		_, err := os.Stdout.Write(b)
+		return err
+	}
+	return writeFileAtomic(*out, b, 0644)
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var resumeFile = flag.String("resume", "",
+	"Carry on with the game written down in this file, see export, "+
+		"instead of starting a new one")
+
+/*
+A game can be written down in a notation a bit like PGN, a header of
+tags and then the moves:
+
+[Game "23456-10.0.1.0_24"]
+[CommunityASN "23456"]
+[PeerPrefix "10.0.1.0/24"]
+[Board "10x10"]
+[Mode "classic"]               salvo, ctf or salvo+ctf
+[StartFirst "yes"]             we made the first move
+[Codec "legacy"]
+[Results "no"]                 the results codec was negotiated
+[Round "0"]                    the game ID, see rematch.go
+[GameTag "517"]                the game tag, see handshake.go, 0 for none
+[Fleet "5 4 3 3 2"]
+[Ships "B2v5 D0h4 H3v3 A7h3 F9h2"]
+[Flag "E5"]                    only in capture the flag
+[Salt "9f86d081884c7d659a2feaa0c55ad015"]
+[Result "won"]                 won, lost or * if it's not over
+
+1. A0 J9x 2. B0x#4 J8 3. ...
+
+Everything is from the point of view of the side that wrote it down, the
+ships and the salt are its own. A ship is the cell of its top or left
+end, h if it lies along a row or v along a column, and its size, in the
+order of the fleet.
+
+The moves are numbered by the counters, two moves to a number starting
+from 1. A shot is marked with x if it hit, and #i for every ship i the
+move sunk, which is known once the other side made its next move. Shots
+of a salvo are separated by commas. The move of the side that lost is
+end, resign if it gave up or captured if its flag was shot.
+*/
+
+var errBadNotation = fmt.Errorf("Not a game in the notation of export")
+
+var notationTag = regexp.MustCompile(`^\[(\w+) "([^"]*)"\]$`)
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// shipNotation writes s as its top left cell, h or v and its size
+func shipNotation(s ship) string {
+	dir := "v"
+	if s.Sideways {
+		dir = "h"
+	}
+	return fmt.Sprintf("%s%s%d", cell{s.X, s.Y}, dir, s.Size)
+}
+
+var shipNotationRegex = regexp.MustCompile(`^([A-Z])(\d+)([hv])(\d+)$`)
+
+func parseShipNotation(text string) (ship, error) {
+	m := shipNotationRegex.FindStringSubmatch(text)
+	if m == nil {
+		return ship{}, fmt.Errorf("Invalid ship %s", text)
+	}
+	y, _ := strconv.Atoi(m[2])
+	size, _ := strconv.Atoi(m[4])
+	return ship{X: int(m[1][0] - 'A'), Y: y, Size: size, Sideways: m[3] == "h"}, nil
+}
+
+// exportGame writes the game of s down in the notation above.
+func exportGame(s gameState) string {
+	result := "*"
+	if s.Over && s.Won {
+		result = "won"
+	} else if s.Over {
+		result = "lost"
+	}
+	mode := uint32(modeClassic)
+	if s.Salvo {
+		mode |= modeSalvo
+	}
+	if s.CTF {
+		mode |= modeFlag
+	}
+	fleetSizes := make([]string, len(s.Fleet))
+	for i, size := range s.Fleet {
+		fleetSizes[i] = strconv.Itoa(size)
+	}
+	ships := make([]string, len(s.Ships))
+	for i, sh := range s.Ships {
+		ships[i] = shipNotation(sh)
+	}
+
+	tags := [][2]string{
+		{"Game", s.Name},
+		{"CommunityASN", strconv.Itoa(s.CommunityASN)},
+		{"PeerPrefix", s.PeerPrefix},
+		{"Board", fmt.Sprintf("%dx%d", s.Width, s.Height)},
+		{"Mode", modeName(mode)},
+		{"StartFirst", yesNo(s.StartFirst)},
+		{"Codec", s.Codec},
+		{"Results", yesNo(s.Results)},
+		{"Round", strconv.Itoa(s.Round)},
+		{"GameTag", strconv.Itoa(s.Tag)},
+		{"Fleet", strings.Join(fleetSizes, " ")},
+		{"Ships", strings.Join(ships, " ")},
+	}
+	if s.Flag != nil {
+		tags = append(tags, [2]string{"Flag", s.Flag.String()})
+	}
+	tags = append(tags, [2]string{"Salt", s.Salt}, [2]string{"Result", result})
+
+	var b strings.Builder
+	for _, tag := range tags {
+		fmt.Fprintf(&b, "[%s \"%s\"]\n", tag[0], tag[1])
+	}
+	b.WriteString("\n")
+
+	line := ""
+	for c := range s.Moves {
+		text := moveNotation(s.Moves, c, s.Salvo)
+		if c%2 == 0 {
+			text = fmt.Sprintf("%d. %s", c/2+1, text)
+		}
+		if line != "" && len(line)+1+len(text) > 72 {
+			b.WriteString(line + "\n")
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += text
+	}
+	if line != "" {
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+// moveNotation writes move c of moves, marked with its results if the
+// move after it is there.
+func moveNotation(moves []move, c int, salvo bool) string {
+	m := moves[c]
+	if m.GameOver && m.Surrender {
+		return "resign"
+	}
+	if m.GameOver && m.Captured {
+		return "captured"
+	}
+	if m.GameOver {
+		return "end"
+	}
+
+	var next *move
+	if c+1 < len(moves) {
+		next = &moves[c+1]
+	}
+	shots := m.shots(salvo)
+	texts := make([]string, len(shots))
+	for i, s := range shots {
+		texts[i] = s.String()
+		if next != nil && next.hit(i, salvo) {
+			texts[i] += "x"
+		}
+	}
+	text := strings.Join(texts, ",")
+	if next != nil {
+		for _, i := range next.Sunk {
+			text += fmt.Sprintf("#%d", i)
+		}
+	}
+	return text
+}
+
+var moveNotationRegex = regexp.MustCompile(`^([A-Z]\d+x?)((?:,[A-Z]\d+x?)*)((?:#\d+)*)$`)
+
+// importGame reads a game written down by exportGame, the moves are
+// only parsed, restoreGame checks that they make sense.
+func importGame(r io.Reader) (gameState, error) {
+	var s gameState
+	var tokens []string
+	tags := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if m := notationTag.FindStringSubmatch(line); m != nil {
+			tags[m[1]] = m[2]
+			continue
+		}
+		tokens = append(tokens, strings.Fields(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		return s, err
+	}
+	if tags["Board"] == "" || tags["Ships"] == "" {
+		return s, errBadNotation
+	}
+
+	var err error
+	s.Name, s.PeerPrefix, s.Codec, s.Salt = tags["Game"], tags["PeerPrefix"], tags["Codec"], tags["Salt"]
+	if tags["Mode"] != "" {
+		mode, err := parseModeName(tags["Mode"])
+		if err != nil {
+			return s, err
+		}
+		s.Salvo, s.CTF = mode&modeSalvo != 0, mode&modeFlag != 0
+	}
+	s.StartFirst = tags["StartFirst"] == "yes"
+	s.Results = tags["Results"] == "yes"
+	if s.CommunityASN, err = strconv.Atoi(tags["CommunityASN"]); err != nil {
+		return s, fmt.Errorf("Invalid CommunityASN %s", tags["CommunityASN"])
+	}
+	if tags["Round"] != "" {
+		if s.Round, err = strconv.Atoi(tags["Round"]); err != nil {
+			return s, fmt.Errorf("Invalid Round %s", tags["Round"])
+		}
+	}
+	if tags["GameTag"] != "" {
+		if s.Tag, err = strconv.Atoi(tags["GameTag"]); err != nil || s.Tag < 0 || s.Tag > 1023 {
+			return s, fmt.Errorf("Invalid GameTag %s", tags["GameTag"])
+		}
+	}
+	if _, err := fmt.Sscanf(tags["Board"], "%dx%d", &s.Width, &s.Height); err != nil ||
+		!validBoardSize(s.Width, s.Height) {
+		return s, fmt.Errorf("Invalid board %s", tags["Board"])
+	}
+	for _, f := range strings.Fields(tags["Fleet"]) {
+		size, err := strconv.Atoi(f)
+		if err != nil || size < 1 || size > 15 {
+			return s, errBadFleet
+		}
+		s.Fleet = append(s.Fleet, size)
+	}
+	for _, f := range strings.Fields(tags["Ships"]) {
+		sh, err := parseShipNotation(f)
+		if err != nil {
+			return s, err
+		}
+		s.Ships = append(s.Ships, sh)
+	}
+	if f := tags["Flag"]; f != "" {
+		x, y := cordsToNumbers(f, s.Width, s.Height)
+		if x == -1 || y == -1 {
+			return s, fmt.Errorf("Invalid Flag %s", f)
+		}
+		s.Flag = &cell{x, y}
+	}
+
+	// the results of a move come with the next one
+	var hits int
+	var sunk []int
+	for _, t := range tokens {
+		if strings.HasSuffix(t, ".") {
+			if _, err := strconv.Atoi(strings.TrimSuffix(t, ".")); err == nil {
+				continue
+			}
+		}
+
+		m := move{HitOrMissOnLast: hits & 1}
+		if s.Results {
+			if hits&1 != 0 && len(sunk) > 0 {
+				m.HitOrMissOnLast = resultSunk
+			}
+			m.Sunk = sunk
+		}
+		if s.Salvo {
+			m.SalvoHits = hits
+		}
+		hits, sunk = 0, nil
+
+		switch t {
+		case "end", "resign", "captured":
+			m.GameOver, m.Surrender, m.Captured = true, t == "resign", t == "captured"
+			s.Moves = append(s.Moves, m)
+			continue
+		}
+
+		parts := moveNotationRegex.FindStringSubmatch(t)
+		if parts == nil {
+			return s, fmt.Errorf("Invalid move %s", t)
+		}
+		for i, text := range strings.Split(parts[1]+parts[2], ",") {
+			x, y := cordsToNumbers(strings.TrimSuffix(text, "x"), s.Width, s.Height)
+			if x == -1 || y == -1 {
+				return s, fmt.Errorf("Invalid move %s", t)
+			}
+			if strings.HasSuffix(text, "x") {
+				hits |= 1 << uint(i)
+			}
+			m.Salvo = append(m.Salvo, cell{x, y})
+		}
+		for _, i := range strings.Split(parts[3], "#")[1:] {
+			ship, _ := strconv.Atoi(i)
+			sunk = append(sunk, ship)
+		}
+		m.X, m.Y = m.Salvo[0].X, m.Salvo[0].Y
+		if !s.Salvo {
+			if len(m.Salvo) != 1 {
+				return s, fmt.Errorf("Salvo %s in a classic game", t)
+			}
+			m.Salvo = nil
+		}
+		s.Moves = append(s.Moves, m)
+	}
+	return s, nil
+}
+
+// restoreGame plays the moves of s again on a new game of m, to check
+// them and to get the boards back.
+func restoreGame(m *match, s gameState) (*game, error) {
+	var salt [16]byte
+	b, err := hex.DecodeString(s.Salt)
+	if err != nil || len(b) != len(salt) {
+		return nil, fmt.Errorf("Invalid salt %s", s.Salt)
+	}
+	copy(salt[:], b)
+
+	if len(s.Fleet) > 0 {
+		fleet, fleetNames = nil, nil
+		for _, size := range s.Fleet {
+			fleet = append(fleet, size)
+			fleetNames = append(fleetNames, shipSizeNames[size])
+		}
+	}
+	if len(s.Ships) != len(fleet) {
+		return nil, fmt.Errorf("%d ships for a fleet of %d", len(s.Ships), len(fleet))
+	}
+
+	local := newBoard(s.Width, s.Height)
+	for i, sh := range s.Ships {
+		if sh.Size != fleet[i] || !local.setShip(sh, stateEmpty, stateShip) {
+			return nil, fmt.Errorf("Ship %s doesn't fit", shipNotation(sh))
+		}
+		local.Ships = append(local.Ships, sh)
+	}
+
+	if s.CTF {
+		if s.Flag == nil || !local.inside(s.Flag.X, s.Flag.Y) ||
+			local.Board[s.Flag.Y][s.Flag.X] != stateEmpty {
+			return nil, fmt.Errorf("No flag for capture the flag, or it's on a ship")
+		}
+		local.Flag = s.Flag
+	}
+
+	g := newGame(m, local, s.StartFirst)
+	g.commitment = boardCommitment{Salt: salt, Layout: packLayout(local), Flag: local.Flag}
+	g.commitment.Hash = layoutHash(salt, g.commitment.Layout, local.Flag)
+	g.salvo = s.Salvo
+	g.ctf = s.CTF
+	g.results = s.Results
+
+	for c, mv := range s.Moves {
+		if g.over && !(mv.GameOver && g.ours(c)) {
+			return nil, fmt.Errorf("Move %d after the game was over", c)
+		}
+		if !g.ours(c) && g.validate(mv) != 0 {
+			return nil, fmt.Errorf("Move %d of the other side is illegal", c)
+		}
+		g.apply(mv)
+		if mv.GameOver && g.ours(c) {
+			g.over, g.won, g.surrendered = true, false, mv.Surrender
+		}
+	}
+	return g, nil
+}
+
+// readNotation reads the game in the file at path.
+func readNotation(path string) (gameState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return gameState{}, err
+	}
+	defer f.Close()
+	return importGame(f)
+}
+
+// exportState is the export command, it writes the game of a file of
+// -stateDir down in the notation.
+func exportState(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "Write the game here instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s export [flags] <state file>\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("export needs the state file of a game")
+	}
+
+	s, err := readState(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(s.Ships) == 0 || s.Salt == "" {
+		return fmt.Errorf("%s was written by an older version, it has no ships", fs.Arg(0))
+	}
+
+	text := exportGame(s)
+	if *out == "" {
+		_, err := io.WriteString(os.Stdout, text)
+		return err
+	}
+	return writeFileAtomic(*out, []byte(text), 0644)
+}
+
+// importNotation is the import command, it checks a game written down
+// in the notation, prints its boards and puts it in -stateDir if set.
+func importNotation(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("import needs a game file")
+	}
+	s, err := readNotation(args[0])
+	if err != nil {
+		return err
+	}
+
+	m := newMatch(s.CommunityASN, "", s.PeerPrefix)
+	m.Name = s.Name
+	m.log = logger{"import"}
+	g, err := restoreGame(m, s)
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(boardTitles(g.LocalB, "You", "Them"))
+	fmt.Print(combineBoard(g.LocalB, g.RemoteB))
+	state := "not over"
+	if g.over && g.won {
+		state = "won"
+	} else if g.over {
+		state = "lost"
+	}
+	fmt.Printf("%d moves, %s\n", len(g.moves), state)
+
+	if *stateDir != "" {
+		s.Over, s.Won = g.over, g.won
+		s.Local, s.Remote = boardStrings(g.LocalB), boardStrings(g.RemoteB)
+		writeState(s)
+	}
+	return nil
+}
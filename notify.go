@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var notifyWebhook = flag.String("notifyWebhook", "",
+	"POST a JSON notification to this URL when it's your turn")
+
+var notifyDesktop = flag.Bool("notifyDesktop", false,
+	"Show a desktop notification when it's your turn")
+
+var notifySlack = flag.String("notifySlack", "",
+	"Slack (or Mattermost) incoming webhook URL to tell when it's your turn")
+
+var notifyMatrix = flag.String("notifyMatrix", "",
+	"Matrix room to tell when it's your turn, like https://matrix.org/!room:matrix.org")
+
+var notifyMatrixToken = flag.String("notifyMatrixToken", "",
+	"Access token of the Matrix user sending the -notifyMatrix messages")
+
+var notifyIRC = flag.String("notifyIRC", "",
+	"IRC channel to tell when it's your turn, like irc.libera.chat:6667/#channel")
+
+/*
+Moves take a while to go through BGP, so instead of staring at the
+prompt you can be told when the move of the other side lands. Every
+hook set is fired, the webhook gets a notification as JSON:
+
+POST -notifyWebhook
+{"Game":"65000-10.2.0.0_24","Move":12,"Shots":["C4"],"Over":false,"Won":false,
+ "Text":"..."}
+*/
+
+type notification struct {
+	Game  string
+	Move  int
+	Shots []string
+	Over  bool
+	Won   bool
+	Text  string
+}
+
+// how long a hook gets before it's given up on
+const notifyTimeout = 10 * time.Second
+
+type notifier struct {
+	name string
+	send func(ctx context.Context, n notification) error
+}
+
+func notifiers() []notifier {
+	o := []notifier{}
+	if *notifyWebhook != "" {
+		o = append(o, notifier{"webhook", notifyPost})
+	}
+	if *notifyDesktop {
+		o = append(o, notifier{"desktop", notifyLocal})
+	}
+	if *notifySlack != "" {
+		o = append(o, notifier{"slack", notifySlackMessage})
+	}
+	if *notifyMatrix != "" {
+		o = append(o, notifier{"matrix", notifyMatrixMessage})
+	}
+	if *notifyIRC != "" {
+		o = append(o, notifier{"irc", notifyIRCMessage})
+	}
+	return o
+}
+
+// notifyMove tells the hooks about the last move of the other side, if
+// there is anyone at the other end to tell. They run in the background
+// so that a slow hook does not hold up the game.
+func notifyMove(g *game) {
+	if *botMode && !*apiMoves {
+		return
+	}
+	hooks := notifiers()
+	if len(hooks) == 0 || len(g.moves) == 0 {
+		return
+	}
+
+	c := len(g.moves) - 1
+	n := notification{
+		Game: g.match.Name,
+		Move: c,
+		Over: g.over,
+		Won:  g.won,
+	}
+	if !g.moves[c].GameOver {
+		for _, s := range g.moves[c].shots(g.salvo) {
+			n.Shots = append(n.Shots, s.String())
+		}
+	}
+	switch {
+	case g.over && g.won:
+		n.Text = fmt.Sprintf("bgp-battleships %s: you won!", n.Game)
+	case g.over:
+		n.Text = fmt.Sprintf("bgp-battleships %s: all your ships are sunk, you lost", n.Game)
+	default:
+		n.Text = fmt.Sprintf("bgp-battleships %s: the other side fired on %s, your turn",
+			n.Game, strings.Join(n.Shots, " "))
+	}
+
+	for _, h := range hooks {
+		go func(h notifier) {
+			ctx, cancel := context.WithTimeout(routerCtx, notifyTimeout)
+			defer cancel()
+			if err := h.send(ctx, n); err != nil {
+				notifyLog.Errorf("Unable to notify over %s %s", h.name, err.Error())
+			}
+		}(h)
+	}
+}
+
+func postJSON(ctx context.Context, method, url string, v interface{}, header http.Header) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Server said %s", resp.Status)
+	}
+	return nil
+}
+
+func notifyPost(ctx context.Context, n notification) error {
+	return postJSON(ctx, "POST", *notifyWebhook, n, nil)
+}
+
+func notifySlackMessage(ctx context.Context, n notification) error {
+	return postJSON(ctx, "POST", *notifySlack, map[string]string{"text": n.Text}, nil)
+}
+
+// notifyLocal uses notify-send, or osascript on macOS
+func notifyLocal(ctx context.Context, n notification) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.CommandContext(ctx, "osascript", "-e",
+			fmt.Sprintf("display notification %q with title \"bgp-battleships\"", n.Text))
+	} else {
+		cmd = exec.CommandContext(ctx, "notify-send", "bgp-battleships", n.Text)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s", err.Error(), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// notifyMatrixMessage sends a m.notice message with the client-server
+// API, the room comes after the homeserver in -notifyMatrix.
+func notifyMatrixMessage(ctx context.Context, n notification) error {
+	u, err := url.Parse(*notifyMatrix)
+	if err != nil {
+		return err
+	}
+	room := strings.TrimPrefix(u.Path, "/")
+	if room == "" {
+		return fmt.Errorf("No room in %s", *notifyMatrix)
+	}
+	txn := fmt.Sprintf("bgpbs%d", time.Now().UnixNano())
+	send := fmt.Sprintf("%s://%s/_matrix/client/r0/rooms/%s/send/m.room.message/%s",
+		u.Scheme, u.Host, url.PathEscape(room), txn)
+
+	header := http.Header{"Authorization": {"Bearer " + *notifyMatrixToken}}
+	body := map[string]string{"msgtype": "m.notice", "body": n.Text}
+	return postJSON(ctx, "PUT", send, body, header)
+}
+
+// notifyIRCMessage connects, joins the channel, says the text and
+// leaves again, enough for a channel without a password.
+func notifyIRCMessage(ctx context.Context, n notification) error {
+	i := strings.Index(*notifyIRC, "/")
+	if i == -1 {
+		return fmt.Errorf("No channel in %s", *notifyIRC)
+	}
+	addr, channel := (*notifyIRC)[:i], (*notifyIRC)[i+1:]
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	nick := fmt.Sprintf("bgpbs%04d", rand.Intn(10000))
+	fmt.Fprintf(conn, "NICK %s\r\nUSER %s 0 * :bgp-battleships\r\n", nick, nick)
+
+	r := bufio.NewReader(conn)
+	sent := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && sent {
+			// the server closing the link after our QUIT
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "PING" {
+			fmt.Fprintf(conn, "PONG %s\r\n", fields[1])
+			continue
+		}
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[1] {
+		case "001":
+			// registered
+			fmt.Fprintf(conn, "JOIN %s\r\nPRIVMSG %s :%s\r\nQUIT\r\n", channel, channel, n.Text)
+			sent = true
+		case "433":
+			return fmt.Errorf("Nick %s is taken", nick)
+		}
+		if fields[0] == "ERROR" && !sent {
+			return fmt.Errorf("Server said %s", strings.TrimSpace(line))
+		}
+	}
+}
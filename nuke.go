@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var nukeMode = flag.Bool("nuke", false,
+	"Joke mode: when you sink the last ship of the other side, announce a "+
+		"FlowSpec rule toward its prefix as a victory lap. Needs -nuke on "+
+		"both sides and the exabgp backend")
+
+var nukeDuration = flag.Duration("nukeDuration", time.Minute,
+	"How long the -nuke FlowSpec rule stays announced")
+
+/*
+The nuke is a FlowSpec rule that drops UDP traffic to port 9 (discard)
+of the prefix of the other side, nothing of value goes there so it does
+no harm, but it shows up in their router. It's only announced if both
+sides set -nuke, which is negotiated as the codecNuke codec, and only
+by the side that sunk the last ship. The codec is only offered if the
+router backend can announce FlowSpec. The nuke is withdrawn by a timer
+after -nukeDuration while the game goes on, or right away when we are
+stopped. A command that is done otherwise waits for it before exiting.
+
+Don't run it on a session that carries FlowSpec anywhere but the lab.
+*/
+
+// flowRule is a FlowSpec rule that discards what it matches
+type flowRule struct {
+	Destination string
+	Protocol    int
+	Port        int
+}
+
+// flowRouter is a backend that can announce FlowSpec rules
+type flowRouter interface {
+	flow(ctx context.Context, r flowRule, announce bool) error
+}
+
+var errNoFlowSpec = fmt.Errorf("The router backend can't announce FlowSpec rules")
+
+func nukeRule(prefix string) flowRule {
+	return flowRule{Destination: prefix, Protocol: 17, Port: 9}
+}
+
+// canFlow tells if r can announce FlowSpec rules, the routers that pass
+// them on only can if what they pass them on to can.
+func canFlow(r router) bool {
+	switch r := r.(type) {
+	case *splitRouter:
+		return canFlow(r.tx)
+	case *bmpRouter:
+		return canFlow(r.tx)
+	}
+	_, ok := r.(flowRouter)
+	return ok
+}
+
+func writeFlow(r flowRule, announce bool) error {
+	fr, ok := activeRouter.(flowRouter)
+	if !ok {
+		return errNoFlowSpec
+	}
+	ctx, cancel := context.WithTimeout(routerCtx, *writeTimeout)
+	defer cancel()
+	return fr.flow(ctx, r, announce)
+}
+
+// the nukes announced, with the timers that withdraw them
+var (
+	nukesMu      sync.Mutex
+	pendingNukes = make(map[flowRule]*time.Timer)
+	nukesLeft    sync.WaitGroup
+)
+
+// nuke announces the nuke toward the other side of m, and withdraws it
+// again after -nukeDuration. Another one at the same prefix only
+// pushes the withdrawal back.
+func nuke(m *match) error {
+	r := nukeRule(m.PeerPrefix)
+	if err := writeFlow(r, true); err != nil {
+		return err
+	}
+	m.log.Infof("Nuke launched at %s, withdrawing it in %s", m.PeerPrefix, *nukeDuration)
+
+	nukesMu.Lock()
+	defer nukesMu.Unlock()
+	if t, ok := pendingNukes[r]; ok {
+		t.Reset(*nukeDuration)
+		return nil
+	}
+	nukesLeft.Add(1)
+	pendingNukes[r] = time.AfterFunc(*nukeDuration, func() {
+		withdrawNuke(r)
+	})
+	return nil
+}
+
+// withdrawNuke withdraws the nuke r, if it's still announced.
+func withdrawNuke(r flowRule) {
+	nukesMu.Lock()
+	t, ok := pendingNukes[r]
+	delete(pendingNukes, r)
+	nukesMu.Unlock()
+	if !ok {
+		return
+	}
+	defer nukesLeft.Done()
+	t.Stop()
+
+	if err := writeFlow(r, false); err != nil {
+		mainLog.Errorf("Unable to withdraw the nuke at %s %s", r.Destination, err.Error())
+		return
+	}
+	mainLog.Infof("Nuke at %s withdrawn", r.Destination)
+}
+
+// withdrawNukes withdraws every nuke still announced, without waiting
+// for -nukeDuration.
+func withdrawNukes() {
+	nukesMu.Lock()
+	var rules []flowRule
+	for r := range pendingNukes {
+		rules = append(rules, r)
+	}
+	nukesMu.Unlock()
+	for _, r := range rules {
+		withdrawNuke(r)
+	}
+}
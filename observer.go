@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var observeMRT = flag.String("observeMRT", "",
+	"Read the routes from this MRT update dump as it is written, like the one of "+
+		"bird's mrt protocol, instead of asking the router for them")
+
+/*
+-observeMRT is for the box that gets a full table but whose router can't
+be touched: the routes are read from an MRT (RFC 6396) dump of the BGP
+updates the daemon on the box writes, and the moves are announced
+through the backend as always, say an ExaBGP session to a friendly
+router. The kernel routing table can't be used for this, netlink doesn't
+carry the communities.
+
+The dump is followed like tail -f, from its start so that the routes
+there already are known. A dump that shrinks or is replaced by a new
+file, as log rotation does, is read again from its start. A peer
+whose session leaves Established (a BGP4MP state change) has its routes
+dropped. For bird 2:
+
+protocol mrt {
+	table "master4";
+	filename "/var/lib/bird/updates.mrt";
+	where net ~ [ 10.0.0.0/8+ ];
+}
+
+bgpdump -m reads the same files, to look at what was seen.
+*/
+
+const (
+	mrtStateChange    = 0
+	mrtStateChangeAS4 = 5
+
+	bgpEstablished = 6
+)
+
+// observerRouter is a bmpRouter fed from an MRT dump rather than BMP
+type observerRouter struct {
+	*bmpRouter
+	path string
+}
+
+func newObserverRouter(tx router, path string) (*observerRouter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	r := &observerRouter{
+		bmpRouter: newBMPRoutes(tx),
+		path:      path,
+	}
+	go r.follow()
+	observerLog.Infof("Following the updates in %s", path)
+	return r, nil
+}
+
+// countingReader counts what was read through it, the offset of the
+// next MRT record when a read comes up short
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (r *observerRouter) follow() {
+	var f *os.File
+	var cr *countingReader
+	var offset int64
+	for {
+		if f == nil {
+			var err error
+			if f, err = os.Open(r.path); err != nil {
+				observerLog.Errorf("Unable to open %s %s", r.path, err.Error())
+				time.Sleep(pollInterval)
+				continue
+			}
+			offset = 0
+			cr = &countingReader{r: bufio.NewReader(f)}
+		}
+
+		rec, err := readMRTRecord(cr)
+		if err == nil {
+			offset = cr.n
+			r.record(rec)
+			continue
+		}
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			observerLog.Errorf("Unable to read %s %s", r.path, err.Error())
+		}
+
+		// wait for the rest of the record, or for a new dump
+		time.Sleep(pollInterval)
+		if r.replaced(f, offset) {
+			observerLog.Infof("%s was replaced, reading it from the start", r.path)
+			f.Close()
+			f = nil
+			continue
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			f = nil
+			continue
+		}
+		cr = &countingReader{r: bufio.NewReader(f), n: offset}
+	}
+}
+
+// replaced tells if the dump at path is no longer f, or was truncated
+// before offset
+func (r *observerRouter) replaced(f *os.File, offset int64) bool {
+	now, err := os.Stat(r.path)
+	if err != nil {
+		return false
+	}
+	was, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(now, was) || now.Size() < offset
+}
+
+func (r *observerRouter) record(rec mrtRecord) {
+	if peer, down := parseBGP4MPState(rec); down {
+		r.peerDown(peer)
+		return
+	}
+	peer, u, ok, err := parseBGP4MP(rec)
+	if err != nil {
+		observerLog.Warnf("Bad update in %s: %s", r.path, err.Error())
+		return
+	}
+	if !ok {
+		return
+	}
+	u.peer, u.at = peer, rec.at
+	u.route.peer, u.route.at = peer, rec.at
+	r.update(u)
+}
+
+// parseBGP4MPState returns the peer of a BGP4MP state change record that
+// takes a session out of Established.
+func parseBGP4MPState(rec mrtRecord) (peer string, down bool) {
+	if rec.typ != mrtBGP4MP && rec.typ != mrtBGP4MPET {
+		return "", false
+	}
+	asSize := 2
+	switch rec.subtype {
+	case mrtStateChange:
+	case mrtStateChangeAS4:
+		asSize = 4
+	default:
+		return "", false
+	}
+
+	b := rec.body
+	if len(b) < 2*asSize+4 {
+		return "", false
+	}
+	b = b[2*asSize+2:]
+	ipSize := 4
+	if binary.BigEndian.Uint16(b[0:2]) == 2 {
+		ipSize = 16
+	}
+	b = b[2:]
+	if len(b) < 2*ipSize+4 {
+		return "", false
+	}
+	peer = net.IP(b[0:ipSize]).String()
+	b = b[2*ipSize:]
+	old, state := binary.BigEndian.Uint16(b[0:2]), binary.BigEndian.Uint16(b[2:4])
+	return peer, old == bgpEstablished && state != bgpEstablished
+}
+
+func (r *observerRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	route, ok := r.routes[prefix]
+	if !ok {
+		return nil, nil, fmt.Errorf("No route to %s in %s", prefix, r.path)
+	}
+	return route.communities, route.large, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var bgpctlPath = flag.String("bgpctl", "bgpctl",
+	"The bgpctl binary, for the openbgpd backend")
+
+var bgpctlSocket = flag.String("bgpctlSocket", "",
+	"Control socket of bgpd, the default one of bgpctl if empty")
+
+/*
+The openbgpd backend announces the prefixes with bgpctl network add,
+so bgpd needs no config change other than a neighbor to play with, and
+reads the routes from bgpctl show rib detail.
+*/
+
+type openbgpdRouter struct {
+	routePaths
+	routeSessions
+
+	mu        sync.Mutex
+	announced map[string]bool
+}
+
+var bgpctlCommunitiesRegex = regexp.MustCompile(`(?m)^\s*Communities: (.*)$`)
+var bgpctlLargeCommunitiesRegex = regexp.MustCompile(`(?m)^\s*Large Communities: (.*)$`)
+
+func newOpenBGPDRouter() *openbgpdRouter {
+	return &openbgpdRouter{announced: make(map[string]bool)}
+}
+
+// bgpctl runs bgpctl with args, killing it if it takes longer than
+// timeout or ctx is done.
+func bgpctl(ctx context.Context, timeout time.Duration, args ...string) (string, error) {
+	what := strings.Join(args, " ")
+	if *bgpctlSocket != "" {
+		args = append([]string{"-s", *bgpctlSocket}, args...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, *bgpctlPath, args...)
+	cmd.Stdout, cmd.Stderr = &out, &stderr
+	openbgpdLog.Debugf("bgpctl %s", what)
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", fmt.Errorf("bgpctl %s: %s", what, ctx.Err().Error())
+		}
+		return "", fmt.Errorf("bgpctl %s failed: %s %s", what, err.Error(),
+			strings.TrimSpace(stderr.String()))
+	}
+	return out.String(), nil
+}
+
+// bgpctlChange runs a bgpctl command that changes what bgpd
+// announces, with -dry-run it's only shown.
+func bgpctlChange(ctx context.Context, args ...string) (string, error) {
+	if *dryRun {
+		dryRunCommand("bgpctl", strings.Join(args, " "))
+		return "", nil
+	}
+	return bgpctl(ctx, *writeTimeout, args...)
+}
+
+// parseBgpctlPath picks the AS path out of bgpctl show rib detail, it's
+// the line after the prefix.
+func parseBgpctlPath(out string) []uint32 {
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "BGP routing table entry for") && i+1 < len(lines) {
+			return parseASPath(lines[i+1])
+		}
+	}
+	return nil
+}
+
+// parseBgpctlRib picks the communities out of bgpctl show rib detail,
+// well known ones that are shown by name are skipped.
+func parseBgpctlRib(out string) (o []bgpCommunity, lo []bgpLargeCommunity) {
+	for _, line := range bgpctlCommunitiesRegex.FindAllStringSubmatch(out, -1) {
+		for _, f := range strings.Fields(line[1]) {
+			bits := strings.Split(f, ":")
+			if len(bits) != 2 {
+				continue
+			}
+			as, err1 := strconv.ParseUint(bits[0], 10, 16)
+			data, err2 := strconv.ParseUint(bits[1], 10, 16)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			o = append(o, bgpCommunity{AS: uint16(as), Data: uint16(data)})
+		}
+	}
+
+	for _, line := range bgpctlLargeCommunitiesRegex.FindAllStringSubmatch(out, -1) {
+		for _, f := range strings.Fields(line[1]) {
+			bits := strings.Split(f, ":")
+			if len(bits) != 3 {
+				continue
+			}
+			var v [3]uint32
+			ok := true
+			for i, b := range bits {
+				n, err := strconv.ParseUint(b, 10, 32)
+				if err != nil {
+					ok = false
+				}
+				v[i] = uint32(n)
+			}
+			if ok {
+				lo = append(lo, bgpLargeCommunity{Global: v[0], Data1: v[1], Data2: v[2]})
+			}
+		}
+	}
+	return o, lo
+}
+
+func (r *openbgpdRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	out, err := bgpctl(ctx, *readTimeout, "show", "rib", "detail", prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !strings.Contains(out, "BGP routing table entry for") {
+		return nil, nil, fmt.Errorf("No route to %s in bgpd", prefix)
+	}
+	o, lo := parseBgpctlRib(out)
+	r.set(prefix, parseBgpctlPath(out))
+	if m := bgpctlNeighborRegex.FindStringSubmatch(out); m != nil {
+		r.setSession(prefix, m[1])
+	}
+	return o, lo, nil
+}
+
+// write announces the prefixes again with the communities of the
+// matches on them, bgpctl network add can't change a network that is
+// there already so it's deleted first. Only the networks we added are
+// ever deleted, the ones of bgpd.conf or of the operator stay.
+func (r *openbgpdRouter) write(ctx context.Context, ms []*match) error {
+	routes := make(map[string][]string)
+	for _, m := range ms {
+		if m.Prefix == "" {
+			return fmt.Errorf("Game %s needs a prefix to announce", m.Name)
+		}
+		args := routes[m.Prefix]
+		for _, c := range m.communities {
+			args = append(args, "community", fmt.Sprintf("%d:%d", c.AS, c.Data))
+		}
+		for _, c := range m.large {
+			args = append(args, "large-community",
+				fmt.Sprintf("%d:%d:%d", c.Global, c.Data1, c.Data2))
+		}
+		routes[m.Prefix] = args
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefixes := make([]string, 0, len(routes))
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	for prefix := range r.announced {
+		if _, ok := routes[prefix]; ok {
+			continue
+		}
+		if _, err := bgpctlChange(ctx, "network", "delete", prefix); err != nil {
+			return err
+		}
+		delete(r.announced, prefix)
+	}
+
+	for _, prefix := range prefixes {
+		if r.announced[prefix] {
+			if _, err := bgpctlChange(ctx, "network", "delete", prefix); err != nil {
+				return err
+			}
+		}
+		args := append([]string{"network", "add", prefix}, routes[prefix]...)
+		if _, err := bgpctlChange(ctx, args...); err != nil {
+			delete(r.announced, prefix)
+			return err
+		}
+		r.announced[prefix] = true
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+
+	"github.com/mgutz/ansi"
+)
+
+var noTouch = flag.Bool("noTouch", false,
+	"Place our ships so that none of them touch another, not even on a corner")
+
+// how many times to start over when the ships placed first leave no
+// room for the others
+const layoutAttempts = 1000
+
+// randomLayout places every ship of the fleet on a free spot picked at
+// random among all the ones it fits on. If noTouch is set a ship is
+// only put where none of the cells around it has a ship.
+func randomLayout(width, height int, noTouch bool) (battleShipBoard, error) {
+	for attempt := 0; attempt < layoutAttempts; attempt++ {
+		b := newBoard(width, height)
+		placed := true
+		for _, size := range fleet {
+			spots := freeSpots(b, size, noTouch)
+			if len(spots) == 0 {
+				placed = false
+				break
+			}
+			s := spots[rand.Intn(len(spots))]
+			b.setShip(s, stateEmpty, stateShip)
+			b.Ships = append(b.Ships, s)
+		}
+		if placed {
+			return b, nil
+		}
+	}
+	return battleShipBoard{}, fmt.Errorf("Unable to place the fleet on %dx%d", width, height)
+}
+
+// freeSpots lists where a ship of size fits on b.
+func freeSpots(b battleShipBoard, size int, noTouch bool) []ship {
+	var o []ship
+	for y := 0; y < b.Height; y++ {
+		for x := 0; x < b.Width; x++ {
+			for _, sideways := range []bool{false, true} {
+				s := ship{X: x, Y: y, Size: size, Sideways: sideways}
+				if size == 1 && sideways {
+					// the same spot twice
+					continue
+				}
+				if spotFree(b, s, noTouch) {
+					o = append(o, s)
+				}
+			}
+		}
+	}
+	return o
+}
+
+func spotFree(b battleShipBoard, s ship, noTouch bool) bool {
+	for _, c := range s.cells() {
+		if !b.inside(c.X, c.Y) || b.Board[c.Y][c.X] != stateEmpty {
+			return false
+		}
+		if !noTouch {
+			continue
+		}
+		for dy := -1; dy <= 1; dy++ {
+			for dx := -1; dx <= 1; dx++ {
+				x, y := c.X+dx, c.Y+dy
+				if b.inside(x, y) && b.Board[y][x] == stateShip {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+var placeShips = flag.Bool("place", false,
+	"Place the ships at the keyboard before the game starts")
+
+var cselected = ansi.ColorCode("green+h:green")
+var cconflict = ansi.ColorCode("magenta+h:magenta")
+
+const placeHelp = `Place your ships, keys can be chained like "ddr" and followed by Enter:
+  w a s d   move the ship     r   rotate it
+  n p       next/previous     x   place everything at random
+  done      start the game
+`
+
+const placeFlagHelp = `  flag E5   hide the flag there, on a cell without a ship
+`
+
+// placer lets the player move the ships of a layout around, they're
+// kept inside the board but can be put on top of each other until the
+// layout is done.
+type placer struct {
+	width, height int
+	ships         []ship
+	sel           int
+	noTouch       bool
+	// nil unless we play capture the flag
+	flag *cell
+}
+
+// conflicts returns the cells of ships that are on another ship, or
+// next to one with noTouch.
+func (p *placer) conflicts() map[cell]bool {
+	o := make(map[cell]bool)
+	for i, a := range p.ships {
+		for j, b := range p.ships {
+			if i == j {
+				continue
+			}
+			for _, ca := range a.cells() {
+				for _, cb := range b.cells() {
+					dx, dy := ca.X-cb.X, ca.Y-cb.Y
+					if ca == cb || p.noTouch && dx*dx <= 1 && dy*dy <= 1 {
+						o[ca] = true
+					}
+				}
+			}
+		}
+	}
+	return o
+}
+
+func (p *placer) board() battleShipBoard {
+	b := newBoard(p.width, p.height)
+	for _, s := range p.ships {
+		b.setShip(s, stateEmpty, stateShip)
+		b.Ships = append(b.Ships, s)
+	}
+	b.Flag = p.flag
+	return b
+}
+
+// flagFree tells if the flag is not under a ship
+func (p *placer) flagFree() bool {
+	b := p.board()
+	return p.flag == nil || b.Board[p.flag.Y][p.flag.X] == stateEmpty
+}
+
+// fit moves the selected ship back inside the board
+func (p *placer) fit() {
+	s := &p.ships[p.sel]
+	w, h := 1, s.Size
+	if s.Sideways {
+		w, h = s.Size, 1
+	}
+	if s.X+w > p.width {
+		s.X = p.width - w
+	}
+	if s.Y+h > p.height {
+		s.Y = p.height - h
+	}
+	if s.X < 0 {
+		s.X = 0
+	}
+	if s.Y < 0 {
+		s.Y = 0
+	}
+}
+
+func (p *placer) key(k rune) {
+	s := &p.ships[p.sel]
+	switch k {
+	case 'w':
+		s.Y--
+	case 's':
+		s.Y++
+	case 'a':
+		s.X--
+	case 'd':
+		s.X++
+	case 'r':
+		s.Sideways = !s.Sideways
+	case 'n':
+		p.sel = (p.sel + 1) % len(p.ships)
+	case 'p':
+		p.sel = (p.sel + len(p.ships) - 1) % len(p.ships)
+	}
+	p.fit()
+}
+
+func (p *placer) Draw() string {
+	conflicts := p.conflicts()
+	selected := make(map[cell]bool)
+	for _, c := range p.ships[p.sel].cells() {
+		selected[c] = true
+	}
+	b := p.board()
+
+	out := b.Draw()
+	// redraw the cells that stand out, Draw has no notion of them
+	lines := strings.Split(out, "\n")
+	for y := 0; y < p.height; y++ {
+		row := fmt.Sprintf("%*d|", b.labelWidth(), y)
+		for x := 0; x < p.width; x++ {
+			c := cell{x, y}
+			switch {
+			case b.flagAt(c) && b.Board[y][x] == stateEmpty:
+				row += cflag + square + ansi.DefaultBG + ansi.DefaultFG
+			case conflicts[c], b.flagAt(c):
+				row += cconflict + square + ansi.DefaultBG + ansi.DefaultFG
+			case selected[c]:
+				row += cselected + square + ansi.DefaultBG + ansi.DefaultFG
+			default:
+				row += b.Board[y][x].Draw()
+			}
+			row += "|"
+		}
+		lines[y+1] = row + fmt.Sprintf("%*d", b.labelWidth(), y)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// placeFleet lets the player move the ships of b around, one line of
+// keys at a time, until the layout is valid and they're done.
+func placeFleet(r io.Reader, b battleShipBoard) (battleShipBoard, error) {
+	p := &placer{
+		width:   b.Width,
+		height:  b.Height,
+		ships:   append([]ship(nil), b.Ships...),
+		noTouch: *noTouch,
+		flag:    b.Flag,
+	}
+	reader := bufio.NewReader(r)
+
+	fmt.Print(placeHelp)
+	if p.flag != nil {
+		fmt.Print(placeFlagHelp)
+	}
+	for {
+		fmt.Print(p.Draw())
+		fmt.Printf("[%s] Place> ", shipName(p.sel))
+
+		text, err := reader.ReadString('\n')
+		if err != nil {
+			return battleShipBoard{}, err
+		}
+		text = strings.ToLower(strings.TrimSpace(text))
+
+		if f := strings.TrimPrefix(text, "flag "); p.flag != nil && f != text {
+			x, y := cordsToNumbers(f, p.width, p.height)
+			if x == -1 || y == -1 {
+				fmt.Printf("invalid coordinates %s\n", f)
+				continue
+			}
+			p.flag = &cell{x, y}
+			continue
+		}
+
+		switch text {
+		case "done":
+			if !p.flagFree() {
+				fmt.Printf("The flag is under a ship\n")
+				continue
+			}
+			if len(p.conflicts()) == 0 {
+				return p.board(), nil
+			}
+			if p.noTouch {
+				fmt.Printf("Some ships are on or next to another one\n")
+			} else {
+				fmt.Printf("Some ships are on top of another one\n")
+			}
+		case "x":
+			nb, err := randomLayout(p.width, p.height, p.noTouch)
+			if err != nil {
+				fmt.Printf("%s\n", err.Error())
+				continue
+			}
+			p.ships = nb.Ships
+			if !p.flagFree() {
+				nb.hideFlag()
+				p.flag = nb.Flag
+			}
+		default:
+			for _, k := range text {
+				p.key(k)
+			}
+		}
+	}
+}
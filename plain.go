@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var plainMode = flag.Bool("plain", false,
+	"Tell the game in plain sentences instead of drawing the boards, for screen "+
+		"readers and serial consoles")
+
+/*
+With -plain nothing is drawn: no colours, no boards, no progress dots.
+Every move of the other side is told in a few sentences instead, like
+
+Your shot at B7: miss. Opponent fired at D3: hit on your cruiser.
+
+and the prompt takes cells as usual. A few more commands work at the
+prompt, plain or not: board reads out both boards, status the score and
+diff what the router announces, see diff.go.
+*/
+
+// progress prints the dots and Es of waiting on the other side, unless
+// they'd only be read out.
+func progress(s string) {
+	if !*plainMode {
+		fmt.Print(s)
+	}
+}
+
+// shipAt is the index of the ship of b on c, -1 if there is none.
+func (b *battleShipBoard) shipAt(c cell) int {
+	for i, s := range b.Ships {
+		for _, sc := range s.cells() {
+			if sc == c {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func joinCells(cells []cell) string {
+	o := make([]string, len(cells))
+	for i, c := range cells {
+		o[i] = c.String()
+	}
+	return strings.Join(o, ", ")
+}
+
+// describeLast tells what the last move of the other side did, or how
+// the game starts if there is none yet.
+func describeLast(g *game) string {
+	c := len(g.moves) - 1
+	if c < 0 {
+		who := "The opponent goes first."
+		if g.startFirst {
+			who = "You go first."
+		}
+		return fmt.Sprintf("New game on a %d by %d board, columns A to %c, rows 0 to %d. %s "+
+			"Type a cell like B7 to fire, board to hear the boards, status for the score.\n",
+			g.LocalB.Width, g.LocalB.Height, 'A'+g.LocalB.Width-1, g.LocalB.Height-1, who)
+	}
+	if g.ours(c) {
+		return ""
+	}
+	return describeMove(g, c)
+}
+
+// describeMove tells the results of our last move and the shots of the
+// other side in move c.
+func describeMove(g *game, c int) string {
+	m := g.moves[c]
+	var o []string
+
+	if c > 0 {
+		for i, s := range g.moves[c-1].shots(g.salvo) {
+			result := "miss"
+			if m.hit(i, g.salvo) {
+				result = "hit"
+			}
+			o = append(o, fmt.Sprintf("Your shot at %s: %s.", s, result))
+		}
+	}
+	for _, i := range m.Sunk {
+		o = append(o, fmt.Sprintf("You sunk their %s.", shipName(i)))
+	}
+
+	switch {
+	case m.GameOver && m.Surrender:
+		o = append(o, "The opponent surrendered, you won.")
+	case m.GameOver && m.Captured:
+		o = append(o, "You captured their flag, you won.")
+	case m.GameOver:
+		o = append(o, "All their ships are sunk, you won.")
+	default:
+		for _, s := range m.shots(g.salvo) {
+			ship := g.LocalB.shipAt(s)
+			if ship < 0 || g.LocalB.Board[s.Y][s.X] != stateHit {
+				o = append(o, fmt.Sprintf("Opponent fired at %s: miss.", s))
+				continue
+			}
+			o = append(o, fmt.Sprintf("Opponent fired at %s: hit on your %s.", s, shipName(ship)))
+		}
+		for _, i := range g.sunk {
+			o = append(o, fmt.Sprintf("They sunk your %s.", shipName(i)))
+		}
+		if g.over && g.captured {
+			o = append(o, "They captured your flag, you lost.")
+		} else if g.over {
+			o = append(o, "All your ships are sunk, you lost.")
+		} else {
+			o = append(o, "Your turn.")
+		}
+	}
+	return strings.Join(o, " ") + "\n"
+}
+
+// describeBoards reads out both boards, ship by ship for ours and the
+// shots for theirs.
+func describeBoards(g *game) string {
+	var b strings.Builder
+	local, remote := &g.LocalB, &g.RemoteB
+
+	fmt.Fprintf(&b, "Your board:")
+	var misses []cell
+	for y := 0; y < local.Height; y++ {
+		for x := 0; x < local.Width; x++ {
+			if local.Board[y][x] == stateAttempt {
+				misses = append(misses, cell{x, y})
+			}
+		}
+	}
+	for i, s := range local.Ships {
+		cells := s.cells()
+		var hits []cell
+		for _, c := range cells {
+			if local.Board[c.Y][c.X] == stateHit {
+				hits = append(hits, c)
+			}
+		}
+		state := "not hit"
+		switch {
+		case len(hits) == len(cells):
+			state = "sunk"
+		case len(hits) > 0:
+			state = "hit at " + joinCells(hits)
+		}
+		fmt.Fprintf(&b, " Your %s at %s to %s, %s.", shipName(i), cells[0], cells[len(cells)-1], state)
+	}
+	if len(misses) > 0 {
+		fmt.Fprintf(&b, " The opponent missed at %s.", joinCells(misses))
+	}
+	if local.Flag != nil {
+		fmt.Fprintf(&b, " Your flag is at %s.", local.Flag)
+	}
+
+	var hits []cell
+	misses = nil
+	for y := 0; y < remote.Height; y++ {
+		for x := 0; x < remote.Width; x++ {
+			switch remote.Board[y][x] {
+			case stateHit:
+				hits = append(hits, cell{x, y})
+			case stateAttempt:
+				misses = append(misses, cell{x, y})
+			}
+		}
+	}
+	fmt.Fprintf(&b, "\nTheir board:")
+	if len(hits)+len(misses) == 0 {
+		fmt.Fprintf(&b, " No shots yet.")
+	}
+	if len(hits) > 0 {
+		fmt.Fprintf(&b, " Hits at %s.", joinCells(hits))
+	}
+	if len(misses) > 0 {
+		fmt.Fprintf(&b, " Misses at %s.", joinCells(misses))
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+// describeStatus tells the score and whose turn it is.
+func describeStatus(g *game) string {
+	turn := "the opponent's turn"
+	switch {
+	case g.over && g.won:
+		turn = "over, you won"
+	case g.over:
+		turn = "over, you lost"
+	case g.ourTurn():
+		turn = "your turn"
+	}
+	offline := ""
+	if !g.offlineSince.IsZero() {
+		offline = " The opponent is offline."
+	}
+	score := fmt.Sprintf("you sunk %d of theirs", len(g.peerSunk))
+	if !g.results {
+		// without the results codec only the hits are known
+		hits := 0
+		for y := 0; y < g.RemoteB.Height; y++ {
+			for x := 0; x < g.RemoteB.Width; x++ {
+				if g.RemoteB.Board[y][x] == stateHit {
+					hits++
+				}
+			}
+		}
+		score = fmt.Sprintf("you hit their ships %d times", hits)
+	}
+	return fmt.Sprintf("Move %d, %s. You have %d of %d ships afloat, %s.%s\n",
+		len(g.moves), turn, g.LocalB.shipsAfloat(), len(g.LocalB.Ships), score, offline)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var probeTimeout = flag.Duration("probeTimeout", 2*time.Minute,
+	"How long probe waits for the other side")
+
+/*
+Some networks strip communities, or only the standard or the large
+ones, and a game over them stalls without saying why. probe, run on
+both sides, announces a known pattern and echoes back what it sees of
+the pattern of the other side:
+
+(communityASN, 0x0a5a) and (communityASN, 0x35a5), type 0 so no game
+  reads them as a move
+(communityASN, probeLarge+i, probeLargeValues[i])
+(communityASN, probeEcho, what we saw of the pattern of the other side)
+
+The echo is a bitmask, bits 0 and 1 are the standard communities and
+2 and 3 the large ones. Our pattern missing on their side is stripping
+on the way to them, theirs missing on ours on the way to us.
+*/
+
+const (
+	probeLarge = 120 // and 121
+	probeEcho  = 122
+)
+
+var probeValues = []uint16{0x0a5a, 0x35a5}
+var probeLargeValues = []uint32{0xa5a5a5a5, 0x5a5a5a5a}
+
+const probeAll = 0xf
+
+// how long we keep announcing after we are done, so that the other
+// side gets to see our echo too
+const probeLinger = 10
+
+// probeSeen returns what of the probe pattern is in a route, and the
+// echo of the other side if there is one.
+func probeSeen(communities []bgpCommunity, large []bgpLargeCommunity) (seen, echo uint32, echoed bool) {
+	for _, c := range communities {
+		for i, v := range probeValues {
+			if c.AS == uint16(*communityAS) && c.Data == v {
+				seen |= 1 << uint(i)
+			}
+		}
+	}
+	for _, c := range large {
+		if c.Global != uint32(*communityAS) {
+			continue
+		}
+		for i, v := range probeLargeValues {
+			if c.Data1 == probeLarge+uint32(i) && c.Data2 == v {
+				seen |= 1 << uint(2+i)
+			}
+		}
+		if c.Data1 == probeEcho {
+			echo, echoed = c.Data2, true
+		}
+	}
+	return seen, echo, echoed
+}
+
+func probeCommunities(seen uint32) ([]bgpCommunity, []bgpLargeCommunity) {
+	var communities []bgpCommunity
+	for _, v := range probeValues {
+		communities = append(communities, bgpCommunity{Data: v})
+	}
+	var large []bgpLargeCommunity
+	for i, v := range probeLargeValues {
+		large = append(large, sessionCommunity(probeLarge+uint32(i), v))
+	}
+	return communities, append(large, sessionCommunity(probeEcho, seen))
+}
+
+// probeMissing describes what's missing of the pattern in a bitmask
+func probeMissing(seen uint32) string {
+	var o []string
+	if seen&0x3 != 0x3 {
+		o = append(o, "standard")
+	}
+	if seen&0xc != 0xc {
+		o = append(o, "large")
+	}
+	return strings.Join(o, " and ")
+}
+
+func runProbe(args []string) error {
+	handleSignals()
+
+	m := newMatch(*communityAS, *ourPrefix, *monitoredPrefix)
+	if err := addMatch(m); err != nil {
+		return err
+	}
+	defer m.withdraw()
+
+	var seen, echo uint32
+	routed, echoed := false, false
+	announce := func() error {
+		return m.announce(probeCommunities(seen))
+	}
+	if err := announce(); err != nil {
+		return err
+	}
+
+	mainLog.Infof("Announcing the probe pattern, waiting for the other side to echo it...")
+	deadline := time.Now().Add(*probeTimeout)
+	for linger := -1; linger != 0 && time.Now().Before(deadline); {
+		time.Sleep(pollInterval)
+		if linger > 0 {
+			linger--
+		}
+
+		communities, large, err := readCommunities(m.PeerPrefix)
+		if err != nil {
+			progress("E")
+			continue
+		}
+		routed = true
+
+		s, e, ok := probeSeen(communities, large)
+		if ok {
+			echo, echoed = e, true
+		}
+		if s|seen != seen {
+			seen |= s
+			if err := announce(); err != nil {
+				mainLog.Errorf("Unable to announce echo %s", err.Error())
+			}
+		}
+		if linger < 0 && seen == probeAll && echoed && echo == probeAll {
+			linger = probeLinger
+		}
+	}
+	fmt.Println()
+
+	if !routed {
+		return fmt.Errorf("Never saw a route to %s", m.PeerPrefix)
+	}
+	ok := true
+	if seen != probeAll {
+		ok = false
+		mainLog.Warnf("The %s communities of the other side are stripped on the way to us",
+			probeMissing(seen))
+	}
+	switch {
+	case !echoed && seen&0xc == 0xc:
+		ok = false
+		mainLog.Warnf("The other side never echoed our pattern, it's not running probe " +
+			"or our communities are stripped on the way to it")
+	case !echoed:
+		ok = false
+		mainLog.Warnf("The other side never echoed our pattern, but large communities " +
+			"don't make it to us so we can't tell")
+	case echo != probeAll:
+		ok = false
+		mainLog.Warnf("Our %s communities are stripped on the way to the other side",
+			probeMissing(echo))
+	}
+	if ok {
+		mainLog.Infof("All communities make it through in both directions")
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var configFile = flag.String("config", "",
+	"Read flags from this file, one per line, and again on SIGHUP or POST /reload")
+
+/*
+-config is a file of flags, one per line, as name value or name=value,
+with # comments:
+
+log-level debug
+pollInterval 2s
+notifyWebhook https://example.com/hook
+notifyDesktop
+
+Flags given on the command line win over the file, and the file may
+have flags the command doesn't take so that play, serve and the others
+can share one.
+
+SIGHUP, POST /reload or ctl reload read it again while the games go on,
+the router connection and the games are left alone. The flags in
+reloadable take effect right away, a flag taken out of the file goes
+back to its default. Everything else is set up once, changing it only
+gets a warning that it takes a restart. A new -templateFile is checked
+as at startup (see -lint) and announced, if it doesn't pass the old one
+stays.
+*/
+
+// reloadable are the flags that can change while playing, with what
+// has to be done once they do
+var reloadable = map[string]func() error{
+	"log-level":           setupLogging,
+	"log-format":          setupLogging,
+	"pollInterval":        setupPollInterval,
+	"templateFile":        reannounce,
+	"softReconfigure":     nil,
+	"notifyWebhook":       nil,
+	"notifyDesktop":       nil,
+	"notifySlack":         nil,
+	"notifyMatrix":        nil,
+	"notifyMatrixToken":   nil,
+	"notifyIRC":           nil,
+	"minAnnounceInterval": nil,
+	"dialTimeout":         nil,
+	"readTimeout":         nil,
+	"writeTimeout":        nil,
+	"birdRetry":           nil,
+	"checkPath":           nil,
+	"timelineSize":        nil,
+}
+
+var errNoConfig = fmt.Errorf("No -config to reload")
+
+// loadedConfig is what -config set, to tell what changed on a reload
+var loadedConfig struct {
+	mu      sync.Mutex
+	fs      *flag.FlagSet
+	cmdline map[string]bool
+	values  map[string]string
+}
+
+// readConfigFile returns the flags in path by name.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line, ""
+		if i := strings.IndexAny(line, "= \t"); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		name = strings.TrimLeft(name, "-")
+		f := flag.CommandLine.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("%s:%d: unknown flag %s", path, n, name)
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && value == "" {
+			value = "true"
+		}
+		values[name] = value
+	}
+	return values, sc.Err()
+}
+
+// setupConfig sets the flags of -config that fs takes and weren't given
+// on the command line, it's called once they are parsed.
+func setupConfig(fs *flag.FlagSet) error {
+	if fs.Lookup("config") != nil && *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return err
+		}
+		cmdline := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) {
+			cmdline[f.Name] = true
+		})
+		for name, value := range values {
+			if cmdline[name] || fs.Lookup(name) == nil {
+				delete(values, name)
+				continue
+			}
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s", *configFile, err.Error())
+			}
+		}
+
+		c := &loadedConfig
+		c.mu.Lock()
+		c.fs, c.cmdline, c.values = fs, cmdline, values
+		c.mu.Unlock()
+	}
+	return setupPollInterval()
+}
+
+func setupPollInterval() error {
+	if *pollEvery <= 0 {
+		return fmt.Errorf("-pollInterval has to be more than 0")
+	}
+	pollInterval = *pollEvery
+	return nil
+}
+
+// reannounce checks a new -templateFile and announces the games with
+// it.
+func reannounce() error {
+	matchesMu.Lock()
+	ms := append([]*match(nil), matches...)
+	matchesMu.Unlock()
+	if activeRouter == nil || len(ms) == 0 {
+		return nil
+	}
+	if err := lintRouter(ms); err != nil {
+		return err
+	}
+	matchesMu.Lock()
+	defer matchesMu.Unlock()
+	return writeMatches(matches)
+}
+
+// reloadConfig reads -config again and sets the reloadable flags that
+// changed, it returns their names.
+func reloadConfig() ([]string, error) {
+	c := &loadedConfig
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fs == nil {
+		return nil, errNoConfig
+	}
+	values, err := readConfigFile(*configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for name := range values {
+		names[name] = c.fs.Lookup(name) != nil && !c.cmdline[name]
+	}
+	for name := range c.values {
+		names[name] = true
+	}
+	var sorted []string
+	for name, ok := range names {
+		if ok {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	var changed []string
+	old := make(map[string]string)
+	kept := make(map[string]string)
+	for _, name := range sorted {
+		value, set := values[name]
+		before, was := c.values[name]
+		if set == was && value == before {
+			kept[name] = value
+			continue
+		}
+		if _, ok := reloadable[name]; !ok {
+			mainLog.Warnf("-%s changed in %s, it takes a restart", name, *configFile)
+			if was {
+				kept[name] = before
+			}
+			continue
+		}
+
+		f := c.fs.Lookup(name)
+		if !set {
+			value = f.DefValue
+		}
+		old[name] = f.Value.String()
+		if err := c.fs.Set(name, value); err != nil {
+			restoreFlags(c.fs, old)
+			return nil, fmt.Errorf("%s: -%s: %s", *configFile, name, err.Error())
+		}
+		if set {
+			kept[name] = value
+		}
+		changed = append(changed, name)
+	}
+
+	// the hooks run once each, in the order of the flags
+	done := make(map[string]bool)
+	for _, name := range changed {
+		hook := reloadable[name]
+		key := fmt.Sprintf("%p", hook)
+		if hook == nil || done[key] {
+			continue
+		}
+		done[key] = true
+		if err := hook(); err != nil {
+			restoreFlags(c.fs, old)
+			for _, name := range changed {
+				if h := reloadable[name]; h != nil {
+					h()
+				}
+			}
+			return nil, fmt.Errorf("Not reloading %s, -%s: %s", *configFile, name, err.Error())
+		}
+	}
+
+	c.values = kept
+	if len(changed) > 0 {
+		mainLog.Infof("Reloaded %s, changed %s", *configFile, strings.Join(changed, ", "))
+	} else {
+		mainLog.Infof("Reloaded %s, nothing changed", *configFile)
+	}
+	return changed, nil
+}
+
+func restoreFlags(fs *flag.FlagSet, old map[string]string) {
+	for name, value := range old {
+		fs.Set(name, value)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var bestOf = flag.Int("bestOf", 1,
+	"Play a series of this many games over the same session, it ends once "+
+		"a side won more than half of them. Both sides have to pick the same")
+
+/*
+Once a game is over and both boards are revealed, a side that wants to
+play again announces extNewGame with the ID of the next game along its
+last move. When it sees the other side ask for the same game, or
+already announce its hello, it drops everything of the last game and
+runs the handshake again, which picks who goes first anew. The game ID
+is announced in the hello:
+
+(communityASN, helloGameID, ID)
+
+and moves with another ID than the one being played are left alone, so
+that what's left of the last game isn't taken for the next one.
+*/
+
+// readGameID returns the game ID of the hello in large, if any.
+func readGameID(large []bgpLargeCommunity) (int, bool) {
+	for _, c := range large {
+		if c.Data1 == helloGameID {
+			return int(c.Data2), true
+		}
+	}
+	return 0, false
+}
+
+// rematch asks the other side for the next game and waits until it
+// wants it too, then clears what we announce for the last one. It gives
+// up with errNoAnswer after -handshakeTimeout.
+func rematch(g *game) error {
+	m := g.match
+	next := m.gameID + 1
+
+	c, last := g.lastOwn()
+	if err := g.announce(c, last, extendedCommunity{extNewGame, next % 1024}); err != nil {
+		return err
+	}
+	m.log.Infof("Asking the other side for game %d...", next+1)
+
+	start := time.Now()
+	for {
+		time.Sleep(pollInterval)
+		if answerLate(start) {
+			return errNoAnswer
+		}
+
+		communities, large, err := m.readCommunities()
+		if err != nil {
+			progress("E")
+			continue
+		}
+		if hello := helloFields(m.ASN, large); hello[helloGameID] == uint32(next) {
+			break
+		}
+		msg, err := decodeMessage(m.ASN, communities, large)
+		if e, ok := msg.extended(extNewGame); err == nil && ok && e.Payload == next%1024 {
+			break
+		}
+		progress(".")
+	}
+
+	m.gameID = next
+	m.clear()
+	return nil
+}
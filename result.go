@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	cr "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var resultServer = flag.String("resultServer", "",
+	"URL of the matchmaker to report the result of every game to")
+
+var resultKey = flag.String("resultKey", "",
+	"File with the ed25519 key our results are signed with, see keygen, "+
+		"its public key is the one registered with the matchmaker")
+
+var resultMatch = flag.Int("resultMatch", 0,
+	"ID of the match the matchmaker paired us in")
+
+// resultRecord is what a side reports of a game, from its side. Both
+// sides of a game have to report the same moves, winner and replay.
+type resultRecord struct {
+	Match      int
+	Game       int
+	ASN        int
+	PeerASN    int
+	Moves      int
+	WinnerASN  int
+	ReplayHash string
+	// the last game of the match, the players are free afterwards
+	Final bool
+}
+
+type resultReport struct {
+	Record    resultRecord
+	Signature string
+}
+
+// signResult is the ed25519 signature of the JSON of rec by the key of
+// the player.
+func signResult(key ed25519.PrivateKey, rec resultRecord) string {
+	b, _ := json.Marshal(rec)
+	return hex.EncodeToString(ed25519.Sign(key, b))
+}
+
+// checkResult tells if sig is the signature of rec by the player with
+// the public key pub.
+func checkResult(pub ed25519.PublicKey, rec resultRecord, sig string) bool {
+	b, _ := json.Marshal(rec)
+	s, err := hex.DecodeString(sig)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(pub, b, s)
+}
+
+// parsePublicKey reads an ed25519 public key written out in hex
+func parsePublicKey(text string) (ed25519.PublicKey, error) {
+	b, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("Public key has to be %d bytes in hex", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
+
+// readResultKey reads the key written by keygen, the seed of it in
+// hex.
+func readResultKey(path string) (ed25519.PrivateKey, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(text)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not a key written by keygen", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// keygen is the keygen command, it writes a new key for signing
+// results and shows the public key to register with.
+func keygen(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("keygen needs the file to write the key to")
+	}
+	pub, key, err := ed25519.GenerateKey(cr.Reader)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key.Seed())); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Println(hex.EncodeToString(pub))
+	return nil
+}
+
+// replayHash is the SHA-256 of the moves of g in a form both sides
+// agree on, only what went over the wire is in it.
+func replayHash(g *game) string {
+	var b strings.Builder
+	for c, m := range g.moves {
+		fmt.Fprintf(&b, "%d:", c)
+		if !m.GameOver {
+			for _, s := range m.shots(g.salvo) {
+				fmt.Fprintf(&b, "%s ", s)
+			}
+		}
+		if g.salvo {
+			fmt.Fprintf(&b, "hits %d", m.SalvoHits)
+		} else {
+			fmt.Fprintf(&b, "result %d", m.HitOrMissOnLast)
+		}
+		fmt.Fprintf(&b, " sunk %v over %v\n", m.Sunk, m.GameOver)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// resultOf is what we report of g
+func resultOf(g *game, final bool) resultRecord {
+	rec := resultRecord{
+		Match:      *resultMatch,
+		Game:       g.match.gameID,
+		ASN:        *localASN,
+		PeerASN:    int(g.peerASN),
+		Moves:      len(g.moves),
+		WinnerASN:  int(g.peerASN),
+		ReplayHash: replayHash(g),
+		Final:      final,
+	}
+	if g.won {
+		rec.WinnerASN = *localASN
+	}
+	return rec
+}
+
+// reportResult sends the result of g to -resultServer, if there's one.
+func reportResult(g *game, final bool) error {
+	if *resultServer == "" {
+		return nil
+	}
+	if g.peerASN == 0 || *localASN == 0 {
+		return fmt.Errorf("Reporting results needs -asn, and -peerASN or the handshake")
+	}
+	if *resultKey == "" {
+		return fmt.Errorf("Reporting results needs -resultKey")
+	}
+	key, err := readResultKey(*resultKey)
+	if err != nil {
+		return err
+	}
+
+	rec := resultOf(g, final)
+	b, err := json.Marshal(resultReport{rec, signResult(key, rec)})
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: *writeTimeout}
+	resp, err := client.Post(strings.TrimRight(*resultServer, "/")+"/result",
+		"application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Matchmaker said %s", resp.Status)
+	}
+
+	g.match.log.Infof("Reported game %d to the matchmaker", rec.Game+1)
+	return nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+var risLive = flag.Bool("risLive", false,
+	"Watch RIPE RIS Live for our moves, to see how long they take to reach the route collectors")
+
+var risLiveURL = flag.String("risLiveURL", "wss://ris-live.ripe.net/v1/ws/?client=bgp-battleships",
+	"The RIS Live websocket")
+
+/*
+With -risLive every game subscribes to the updates of its own prefix
+on RIS Live. Once one of our moves shows up at a collector peer, the
+time since it was announced is how long it took to get there, the
+slowest peer so far is how long it took to get around.
+*/
+
+type risMessage struct {
+	Type string `json:"type"`
+	Data struct {
+		Timestamp     float64     `json:"timestamp"`
+		Host          string      `json:"host"`
+		Peer          string      `json:"peer"`
+		Type          string      `json:"type"`
+		Community     [][2]uint32 `json:"community"`
+		Announcements []struct {
+			Prefixes []string `json:"prefixes"`
+		} `json:"announcements"`
+		Withdrawals []string `json:"withdrawals"`
+	} `json:"data"`
+}
+
+// propagationStat is how far one of our moves got
+type propagationStat struct {
+	sent        time.Time
+	first, last time.Time
+	peers       map[string]bool
+}
+
+// propagation tracks when our moves reach the collectors, it's shared
+// between the game and the RIS Live goroutine. A nil propagation does
+// nothing.
+type propagation struct {
+	m *match
+
+	mu    sync.Mutex
+	moves map[int]*propagationStat
+	// our last move, counters on the wire are expanded around it
+	last int
+}
+
+func watchPropagation(m *match) *propagation {
+	if !*risLive {
+		return nil
+	}
+	if m.Prefix == "" {
+		m.log.Warnf("No prefix to look for on RIS Live")
+		return nil
+	}
+
+	p := &propagation{m: m, moves: make(map[int]*propagationStat)}
+	go risWatch(m.Prefix, p.update)
+	return p
+}
+
+// risWatch hands the updates of prefix on RIS Live to f, for good.
+func risWatch(prefix string, f func(risMessage)) {
+	for {
+		err := risSubscribe(prefix, f)
+		risLog.Warnf("RIS Live connection lost %s, reconnecting", err.Error())
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func risSubscribe(prefix string, f func(risMessage)) error {
+	conn, err := wsDial(*risLiveURL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub, _ := json.Marshal(map[string]interface{}{
+		"type": "ris_subscribe",
+		"data": map[string]interface{}{
+			"prefix": prefix,
+			"type":   "UPDATE",
+		},
+	})
+	if err := conn.writeFrame(wsText, sub); err != nil {
+		return err
+	}
+	risLog.Infof("Watching %s on RIS Live", prefix)
+
+	for {
+		b, err := conn.readMessage()
+		if err == io.EOF {
+			return fmt.Errorf("closed by RIS Live")
+		}
+		if err != nil {
+			return err
+		}
+
+		var msg risMessage
+		if err := json.Unmarshal(b, &msg); err != nil {
+			risLog.Debugf("Ignoring message from RIS Live: %s", string(b))
+			continue
+		}
+		if msg.Type == "ris_error" {
+			risLog.Errorf("RIS Live error: %s", string(b))
+			continue
+		}
+		if msg.Type != "ris_message" || msg.Data.Type != "UPDATE" {
+			continue
+		}
+		f(msg)
+	}
+}
+
+func (p *propagation) update(msg risMessage) {
+	for _, prefix := range msg.Data.Withdrawals {
+		if prefix == p.m.Prefix {
+			limiter.withdrawn(p.m, msg.Data.Host+" "+msg.Data.Peer)
+		}
+	}
+
+	ours := false
+	for _, a := range msg.Data.Announcements {
+		for _, prefix := range a.Prefixes {
+			ours = ours || prefix == p.m.Prefix
+		}
+	}
+	if !ours {
+		return
+	}
+
+	communities := make([]bgpCommunity, 0, len(msg.Data.Community))
+	for _, c := range msg.Data.Community {
+		communities = append(communities, bgpCommunity{AS: uint16(c[0]), Data: uint16(c[1])})
+	}
+	gm, err := decodeMessage(p.m.ASN, communities, nil)
+	if err != nil {
+		return
+	}
+
+	sec, frac := math.Modf(msg.Data.Timestamp)
+	at := time.Unix(int64(sec), int64(frac*1e9))
+	peer := msg.Data.Host + " " + msg.Data.Peer
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := expandCounter(gm.Counter, p.last)
+	s, ok := p.moves[c]
+	if !ok || s.sent.IsZero() {
+		// not one of our moves, or an old one announced again
+		return
+	}
+	if s.peers[peer] {
+		return
+	}
+	s.peers[peer] = true
+	if s.first.IsZero() || at.Before(s.first) {
+		s.first = at
+		p.m.log.Infof("Move %d reached %s after %s", c, peer,
+			at.Sub(s.sent).Round(time.Millisecond))
+	}
+	if at.After(s.last) {
+		s.last = at
+	}
+}
+
+// sent records when our move c was announced.
+func (p *propagation) sent(c int, at time.Time) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.moves[c] = &propagationStat{sent: at, peers: make(map[string]bool)}
+	p.last = c
+}
+
+// delay returns how long move c took to reach the first and the last
+// collector peer so far, and how many saw it.
+func (p *propagation) delay(c int) (first, last time.Duration, peers int) {
+	if p == nil {
+		return 0, 0, 0
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.moves[c]
+	if !ok || len(s.peers) == 0 {
+		return 0, 0, 0
+	}
+	return s.first.Sub(s.sent), s.last.Sub(s.sent), len(s.peers)
+}
+
+// writeMetrics writes the propagation of every move in the Prometheus
+// text format.
+func (p *propagation) writeMetrics(w io.Writer) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	counters := make([]int, 0, len(p.moves))
+	for c := range p.moves {
+		counters = append(counters, c)
+	}
+	p.mu.Unlock()
+	sort.Ints(counters)
+
+	for _, c := range counters {
+		first, last, peers := p.delay(c)
+		if peers == 0 {
+			continue
+		}
+		labels := fmt.Sprintf(`game="%s",move="%d"`, p.m.Name, c)
+		fmt.Fprintf(w, "battleships_move_propagation_first_seconds{%s} %g\n", labels, first.Seconds())
+		fmt.Fprintf(w, "battleships_move_propagation_last_seconds{%s} %g\n", labels, last.Seconds())
+		fmt.Fprintf(w, "battleships_move_propagation_peers{%s} %d\n", labels, peers)
+	}
+}
+
+// risRouter reads the route of the other side from RIS Live, for
+// -rxBackend ris. A move is only seen once it got to a collector, which
+// can take a while, and only the 16 bit communities are read so the
+// game has to be played with -codec legacy.
+type risRouter struct {
+	mu      sync.Mutex
+	routes  map[string]bmpRoute
+	watched map[string]bool
+}
+
+var errRISReadOnly = fmt.Errorf("RIS Live can only be read from, announce through -backend")
+
+func newRISRouter() *risRouter {
+	return &risRouter{routes: make(map[string]bmpRoute), watched: make(map[string]bool)}
+}
+
+func (r *risRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.watched[prefix] {
+		r.watched[prefix] = true
+		go risWatch(prefix, func(msg risMessage) { r.update(prefix, msg) })
+	}
+	route, ok := r.routes[prefix]
+	if !ok {
+		return nil, nil, fmt.Errorf("No route to %s on RIS Live yet", prefix)
+	}
+	return route.communities, nil, nil
+}
+
+func (r *risRouter) write(ctx context.Context, ms []*match) error {
+	return errRISReadOnly
+}
+
+// update keeps the route of the last collector peer that announced
+// prefix, until that peer withdraws it.
+func (r *risRouter) update(prefix string, msg risMessage) {
+	peer := msg.Data.Host + " " + msg.Data.Peer
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, w := range msg.Data.Withdrawals {
+		if route, ok := r.routes[w]; ok && w == prefix && route.peer == peer {
+			delete(r.routes, w)
+		}
+	}
+	for _, a := range msg.Data.Announcements {
+		for _, p := range a.Prefixes {
+			if p != prefix {
+				continue
+			}
+			route := bmpRoute{peer: peer}
+			for _, c := range msg.Data.Community {
+				route.communities = append(route.communities,
+					bgpCommunity{AS: uint16(c[0]), Data: uint16(c[1])})
+			}
+			r.routes[prefix] = route
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var backendName = flag.String("backend", "bird",
+	"Router to play through: bird, exabgp, openbgpd or loopback")
+
+var rxBackend = flag.String("rxBackend", "",
+	"Read the other side's route through another router than -backend: bird, exabgp, "+
+		"openbgpd, loopback, bmp (see -bmpListen), mrt (see -observeMRT) or ris (RIS Live)")
+
+var dialTimeout = flag.Duration("dialTimeout", 5*time.Second,
+	"How long to wait for a connection to the router")
+
+var readTimeout = flag.Duration("readTimeout", 30*time.Second,
+	"How long to wait for the router to answer")
+
+var writeTimeout = flag.Duration("writeTimeout", 10*time.Second,
+	"How long to wait for the router to take a command")
+
+// router is what the communities are announced and read through, the
+// calls give up once ctx is done.
+type router interface {
+	// read returns the communities on the route to prefix
+	read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error)
+	// write announces the communities of all the matches, on their
+	// prefixes, and nothing else
+	write(ctx context.Context, ms []*match) error
+}
+
+var activeRouter router
+
+// pathRouter is a router that knows the AS path of the routes it reads,
+// the origin of the route of the other side is checked with it.
+type pathRouter interface {
+	// path returns the AS path of the route to prefix when it was
+	// last read, the origin last
+	path(prefix string) ([]uint32, bool)
+}
+
+// routePaths keeps the AS paths of the routes last read, for the
+// routers that get them along with the communities.
+type routePaths struct {
+	mu    sync.Mutex
+	paths map[string][]uint32
+}
+
+func (p *routePaths) set(prefix string, path []uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paths == nil {
+		p.paths = make(map[string][]uint32)
+	}
+	p.paths[prefix] = path
+}
+
+func (p *routePaths) path(prefix string) ([]uint32, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path, ok := p.paths[prefix]
+	return path, ok
+}
+
+// parseASPath reads an AS path written out as ASNs separated by
+// spaces, AS sets in braces are skipped as they have no single origin.
+// It's nil if the path can't be read or ends in an AS set, as then
+// there's no telling who originated the route.
+func parseASPath(text string) []uint32 {
+	path := []uint32{}
+	inSet, lastSet := false, false
+	for _, f := range strings.Fields(text) {
+		if strings.HasPrefix(f, "{") {
+			inSet = true
+		}
+		if inSet {
+			inSet, lastSet = !strings.HasSuffix(f, "}"), true
+			continue
+		}
+		asn, err := strconv.ParseUint(f, 10, 32)
+		if err != nil {
+			return nil
+		}
+		path, lastSet = append(path, uint32(asn)), false
+	}
+	if lastSet {
+		return nil
+	}
+	return path
+}
+
+// routerCtx is cancelled on shutdown, which aborts whatever the router
+// is being asked.
+var routerCtx, stopRouter = context.WithCancel(context.Background())
+
+var pollEvery = flag.Duration("pollInterval", time.Second,
+	"How often the route of the other side is read")
+
+// how often the route of the other side is read, -pollInterval
+var pollInterval = time.Second
+
+func newBackend(name string) (router, error) {
+	switch name {
+	case "bird":
+		return newBirdRouter(), nil
+	case "exabgp":
+		return newExaBGPRouter(*exabgpIn, *exabgpOut)
+	case "openbgpd":
+		return newOpenBGPDRouter(), nil
+	case "loopback":
+		if c := flagSimConfig(); c.enabled() {
+			return newSimRouter(newLoopbackRouter(), c), nil
+		}
+		return newLoopbackRouter(), nil
+	}
+	return nil, fmt.Errorf("Unknown backend %s", name)
+}
+
+// setupRouter picks the routers of -backend and -rxBackend, it has to
+// be called once the flags are parsed.
+func setupRouter() error {
+	tx, err := newBackend(*backendName)
+	if err != nil {
+		return err
+	}
+
+	rx := *rxBackend
+	switch {
+	case *bmpListen != "" && *observeMRT != "":
+		return fmt.Errorf("The routes come from either -bmpListen or -observeMRT")
+	case rx == "" && *bmpListen != "":
+		rx = "bmp"
+	case rx == "" && *observeMRT != "":
+		rx = "mrt"
+	}
+	if (*bmpListen != "" && rx != "bmp") || (*observeMRT != "" && rx != "mrt") {
+		return fmt.Errorf("-rxBackend %s doesn't go with -bmpListen or -observeMRT", rx)
+	}
+
+	switch rx {
+	case "", *backendName:
+		activeRouter = tx
+	case "bmp":
+		if *bmpListen == "" {
+			return fmt.Errorf("-rxBackend bmp needs -bmpListen")
+		}
+		r, err := newBMPRouter(tx, *bmpListen)
+		if err != nil {
+			return err
+		}
+		activeRouter = r
+	case "mrt":
+		if *observeMRT == "" {
+			return fmt.Errorf("-rxBackend mrt needs -observeMRT")
+		}
+		r, err := newObserverRouter(tx, *observeMRT)
+		if err != nil {
+			return err
+		}
+		activeRouter = r
+	case "ris":
+		activeRouter = &splitRouter{rx: newRISRouter(), tx: tx}
+	default:
+		r, err := newBackend(rx)
+		if err != nil {
+			return err
+		}
+		activeRouter = &splitRouter{rx: r, tx: tx}
+	}
+	return nil
+}
+
+// splitRouter reads through one router and announces through another
+type splitRouter struct {
+	rx, tx router
+}
+
+func (r *splitRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	return r.rx.read(ctx, prefix)
+}
+
+func (r *splitRouter) write(ctx context.Context, ms []*match) error {
+	return r.tx.write(ctx, ms)
+}
+
+func (r *splitRouter) path(prefix string) ([]uint32, bool) {
+	pr, ok := r.rx.(pathRouter)
+	if !ok {
+		return nil, false
+	}
+	return pr.path(prefix)
+}
+
+// session asks rx, the route of the other side is read there, or tx if
+// rx can't tell and tx has a session to the other side (-peerSession).
+func (r *splitRouter) session(ctx context.Context, prefix string) (bool, error) {
+	for _, half := range []router{r.rx, r.tx} {
+		if canSession(half) {
+			return half.(sessionRouter).session(ctx, prefix)
+		}
+	}
+	return false, errNoSession
+}
+
+func (r *splitRouter) flow(ctx context.Context, rule flowRule, announce bool) error {
+	fr, ok := r.tx.(flowRouter)
+	if !ok {
+		return errNoFlowSpec
+	}
+	return fr.flow(ctx, rule, announce)
+}
+
+func readCommunities(prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	return activeRouter.read(routerCtx, prefix)
+}
+
+func writeMatches(ms []*match) error {
+	if err := limiter.wait(routerCtx); err != nil {
+		return err
+	}
+	return activeRouter.write(routerCtx, withBonds(ms))
+}
+
+// watchContext calls abort if ctx is done before the returned func is
+// called, to break off I/O that doesn't take a context.
+func watchContext(ctx context.Context, abort func()) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			abort()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// resetBird stops announcing any game communities.
+func resetBird() error {
+	return writeMatches(nil)
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+In a battle royale one attacker plays several defenders at once, with
+a single route. Every shot of the attacker lands on the boards of all
+the defenders still in the game, each defender answers on its own
+prefix as in a plain game. The attacker plays one game per defender,
+each with its own copy of its board, and only moves once every
+defender has answered.
+
+The S field of the attacker's move can't tell every defender its own
+result, so it's 0 and the results are large communities keyed by the
+ASN of the defender:
+
+(communityASN, royaleResult + S + 4 if the attacker lost to it, ASN)
+
+Defenders are plain games started with -defend, -asn,
+-handshake=false and without -startfirst, they pick their result out
+of the route if they see one for their ASN. The attacker always goes first and reveals its
+board once the last of its games is over, as every defender sees it.
+*/
+
+const royaleResult = 96 // to royaleResult+7
+
+const royaleLost = 4
+
+// defenderSpecs is the -defender flag, it can be given more than once.
+type defenderSpecs []defenderSpec
+
+type defenderSpec struct {
+	ASN    uint32
+	Prefix string
+}
+
+var defenders defenderSpecs
+
+var royaleDefend = flag.Bool("defend", false,
+	"Defend in a battle royale, our results are read by -asn from the route of the attacker")
+
+func init() {
+	flag.Var(&defenders, "defender",
+		"A defender of the battle royale, as ASN,peerprefix, can be repeated")
+}
+
+func (s *defenderSpecs) String() string {
+	o := make([]string, 0, len(*s))
+	for _, d := range *s {
+		o = append(o, fmt.Sprintf("%d,%s", d.ASN, d.Prefix))
+	}
+	return strings.Join(o, " ")
+}
+
+func (s *defenderSpecs) Set(v string) error {
+	parts := strings.Split(v, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("Defender has to be ASN,peerprefix")
+	}
+	asn, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || asn == 0 {
+		return fmt.Errorf("Invalid defender ASN %s", parts[0])
+	}
+	*s = append(*s, defenderSpec{uint32(asn), parts[1]})
+	return nil
+}
+
+// royaleView puts the result of the last move of the attacker on us in
+// msg, as if it came in a plain game.
+func royaleView(msg bgpMessage, asn uint32) bgpMessage {
+	for _, c := range msg.Large {
+		if c.Data2 != asn || c.Data1 < royaleResult || c.Data1 >= royaleResult+8 {
+			continue
+		}
+		v := int(c.Data1 - royaleResult)
+		msg.HitOrMissOnLast = v &^ royaleLost
+		if v&royaleLost != 0 {
+			msg.Extended = append(append([]extendedCommunity{}, msg.Extended...),
+				extendedCommunity{Type: extGameOver, Payload: gameOverSunk})
+		}
+	}
+	return msg
+}
+
+type royalePending struct {
+	c int
+	m move
+}
+
+// royale puts the moves of the games of the attacker together on its
+// single route.
+type royale struct {
+	out   *match
+	games []*game
+	asns  []uint32
+
+	pending map[*game]royalePending
+	// finish was called on the game
+	finished map[*game]bool
+	// what we last announced, to announce it again with the reveal
+	last royalePending
+}
+
+// announce takes the move c of g, the route is only written once every
+// game still going has made its move c.
+func (r *royale) announce(g *game, c int, m move) error {
+	r.pending[g] = royalePending{c, m}
+	for _, o := range r.games {
+		if p, ok := r.pending[o]; !o.over && (!ok || p.c != c) {
+			return nil
+		}
+	}
+	r.last = royalePending{c, m}
+	return r.write()
+}
+
+func (r *royale) write() error {
+	var large []bgpLargeCommunity
+	for i, g := range r.games {
+		p, ok := r.pending[g]
+		if !ok {
+			continue
+		}
+		v := uint32(p.m.HitOrMissOnLast)
+		if p.m.GameOver {
+			v |= royaleLost
+		}
+		large = append(large, bgpLargeCommunity{Data1: royaleResult + v, Data2: r.asns[i]})
+	}
+	m := r.last.m
+	return r.out.writeMove(bgpMessage{Counter: r.last.c, X: m.X, Y: m.Y, Large: large})
+}
+
+func (r *royale) alive() []*game {
+	var o []*game
+	for _, g := range r.games {
+		if !g.over {
+			o = append(o, g)
+		}
+	}
+	return o
+}
+
+func (r *royale) ourTurn() bool {
+	alive := r.alive()
+	for _, g := range alive {
+		if !g.ourTurn() {
+			return false
+		}
+	}
+	return len(alive) > 0
+}
+
+// finishLost tells the defenders that sunk all our ships that they won,
+// the board is only revealed at the end.
+func (r *royale) finishLost() {
+	for i, g := range r.games {
+		if !g.over || r.finished[g] {
+			continue
+		}
+		r.finished[g] = true
+		if g.won {
+			mainLog.Infof("All ships of AS%d are sunk", r.asns[i])
+			continue
+		}
+		mainLog.Infof("AS%d sunk all your ships", r.asns[i])
+		if err := g.finish(); err != nil {
+			g.match.log.Errorf("Unable to announce game over %s", err.Error())
+		}
+	}
+}
+
+func (r *royale) reveal(commitment boardCommitment) error {
+	r.out.addSession(commitment.revealCommunities()...)
+	return r.write()
+}
+
+// playRoyale attacks every -defender at once.
+func playRoyale(args []string) error {
+	handleSignals()
+
+	if len(defenders) == 0 {
+		return fmt.Errorf("A battle royale needs at least one -defender")
+	}
+	if *salvoMode {
+		return fmt.Errorf("A battle royale can't be played with -salvo")
+	}
+	if *ctfMode {
+		return fmt.Errorf("A battle royale can't be played with -ctf")
+	}
+	width, height := *boardWidth, *boardHeight
+	if !validBoardSize(width, height) || !fleetFits(width, height) {
+		return fmt.Errorf("The fleet does not fit on %dx%d", width, height)
+	}
+
+	out := newMatch(*communityAS, *ourPrefix, "")
+	if err := addMatch(out); err != nil {
+		return err
+	}
+
+	local, err := makeBoard(width, height)
+	if err != nil {
+		return err
+	}
+	commitment, err := commitBoard(local)
+	if err != nil {
+		return fmt.Errorf("Unable to commit to board %s", err.Error())
+	}
+	out.addSession(commitment.commitCommunities()...)
+	if err := out.writeSession(); err != nil {
+		mainLog.Errorf("Unable to announce board commitment %s", err.Error())
+	}
+
+	r := &royale{
+		out:      out,
+		pending:  make(map[*game]royalePending),
+		finished: make(map[*game]bool),
+	}
+	var ms []*match
+	for _, d := range defenders {
+		// only read, out announces for all of them
+		m := newMatch(*communityAS, "", d.Prefix)
+		m.peerASN = d.ASN
+		ms = append(ms, m)
+
+		g := newGame(m, local, true)
+		g.commitment = commitment
+		g.royale = r
+		r.games = append(r.games, g)
+		r.asns = append(r.asns, d.ASN)
+		saveState(g)
+	}
+	stop := demux(ms)
+	l := newRoyaleLoop(r, commitment)
+	err = l.run()
+	// the readers only see done once demux stopped feeding them
+	stop()
+	l.readers.Wait()
+	return err
+}
+
+type royaleRoute struct {
+	i  int
+	ev routeEvent
+}
+
+// royaleLoop is gameLoop for the attacker of a battle royale, the
+// boards shown and shot at by the bot are the ones of target.
+type royaleLoop struct {
+	r          *royale
+	commitment boardCommitment
+	target     int
+
+	lines  chan string
+	routes chan royaleRoute
+	done   chan struct{}
+	// the last chat message of every defender that was shown
+	chatShown []int
+	// the route readers of every game
+	readers sync.WaitGroup
+
+	prompted bool
+}
+
+func newRoyaleLoop(r *royale, commitment boardCommitment) *royaleLoop {
+	l := &royaleLoop{
+		r:          r,
+		commitment: commitment,
+		routes:     make(chan royaleRoute),
+		done:       make(chan struct{}),
+	}
+	for range r.games {
+		l.chatShown = append(l.chatShown, -1)
+	}
+	if !*botMode {
+		l.lines = make(chan string)
+		go readLines(os.Stdin, l.lines, l.done)
+	}
+	for i, g := range r.games {
+		l.readers.Add(1)
+		go func(i int, m *match) {
+			defer l.readers.Done()
+			l.poll(i, m)
+		}(i, g.match)
+	}
+	return l
+}
+
+func (l *royaleLoop) poll(i int, m *match) {
+	for {
+		msg, err := m.readBGP()
+		select {
+		case l.routes <- royaleRoute{i, routeEvent{msg, err}}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *royaleLoop) targetGame() *game {
+	g := l.r.games[l.target]
+	if g.over {
+		if alive := l.r.alive(); len(alive) > 0 {
+			for i, o := range l.r.games {
+				if o == alive[0] {
+					l.target = i
+				}
+			}
+			return alive[0]
+		}
+	}
+	return g
+}
+
+func (l *royaleLoop) printBoards() {
+	if *botMode {
+		return
+	}
+	g := l.targetGame()
+	fmt.Print(boardTitles(g.LocalB, "Your Side",
+		fmt.Sprintf("AS%d (%d/%d)", l.r.asns[l.target], l.target+1, len(l.r.games))))
+	fmt.Print(combineBoard(g.LocalB, g.RemoteB))
+}
+
+func (l *royaleLoop) run() error {
+	defer close(l.done)
+	r := l.r
+
+	l.printBoards()
+	for len(r.alive()) > 0 {
+		if r.ourTurn() {
+			if *botMode {
+				g := l.targetGame()
+				l.fire(botShots(g.RemoteB, g.peerWrecks, 1))
+				continue
+			}
+			if !l.prompted {
+				l.prompted = true
+				fmt.Printf("[%06d] AS%d Next Move> ", len(l.targetGame().moves), r.asns[l.target])
+			}
+		}
+
+		select {
+		case text := <-l.lines:
+			l.input(text)
+		case rr := <-l.routes:
+			l.route(rr)
+		}
+
+		for _, g := range r.games {
+			g.checkTimer()
+		}
+		r.finishLost()
+	}
+	return l.finish()
+}
+
+func (l *royaleLoop) input(text string) {
+	r := l.r
+	l.prompted = false
+
+	switch fields := strings.Fields(text); {
+	case len(fields) == 0:
+	case fields[0] == "say":
+		if err := r.out.say(strings.TrimSpace(text[4:])); err != nil {
+			mainLog.Errorf("Unable to announce chat message %s", err.Error())
+		}
+	case fields[0] == "target" && len(fields) == 2:
+		i, err := strconv.Atoi(fields[1])
+		if err != nil || i < 1 || i > len(r.games) {
+			fmt.Printf("Target has to be 1 to %d\n", len(r.games))
+			return
+		}
+		l.target = i - 1
+		l.printBoards()
+	case !r.ourTurn():
+		fmt.Printf("Not your turn yet\n")
+	case fields[0] == "surrender":
+		for _, g := range r.alive() {
+			g.surrender()
+		}
+	default:
+		if shots := parseShots(text, 1, l.targetGame().RemoteB); shots != nil {
+			l.fire(shots)
+		}
+	}
+}
+
+// fire shoots at every defender still in the game.
+func (l *royaleLoop) fire(shots []cell) {
+	mainLog.Infof("Firing on %v...", shots)
+	for _, g := range l.r.alive() {
+		if err := g.fire(shots); err != nil {
+			g.match.log.Errorf("Unable to announce move %s", err.Error())
+		}
+		saveState(g)
+	}
+}
+
+func (l *royaleLoop) route(rr royaleRoute) {
+	if rr.ev.err != nil {
+		return
+	}
+	g := l.r.games[rr.i]
+	if g.over {
+		return
+	}
+
+	newMove, err := g.handle(rr.ev.msg)
+	if err != nil {
+		g.match.log.Errorf("Unable to announce resync %s", err.Error())
+	}
+	if g.chatSeen != l.chatShown[rr.i] {
+		l.chatShown[rr.i] = g.chatSeen
+		if *botMode {
+			g.match.log.Infof("AS%d says %s", l.r.asns[rr.i], g.chatText)
+		} else {
+			fmt.Printf("\n<AS%d> %s\n", l.r.asns[rr.i], g.chatText)
+		}
+	}
+	if newMove {
+		saveState(g)
+		if rr.i == l.target && l.r.ourTurn() {
+			l.printBoards()
+		}
+	}
+}
+
+// finish reveals our board once every game is over and waits for the
+// defenders to reveal theirs.
+func (l *royaleLoop) finish() error {
+	r := l.r
+
+	won := 0
+	for _, g := range r.games {
+		if g.won {
+			won++
+		}
+	}
+	mainLog.Infof("Battle royale over, you won against %d of %d defenders", won, len(r.games))
+
+	if err := r.reveal(l.commitment); err != nil {
+		mainLog.Errorf("Unable to reveal board %s", err.Error())
+	}
+
+	waiting := make(map[int]bool)
+	for i, g := range r.games {
+		saveState(g)
+		if !g.forfeited {
+			waiting[i] = true
+		}
+	}
+
+	mainLog.Infof("Waiting on the defenders to reveal their boards...")
+	expired, stop := revealExpired()
+	defer stop()
+	for len(waiting) > 0 {
+		var rr royaleRoute
+		select {
+		case rr = <-l.routes:
+		case <-expired:
+			for i := range waiting {
+				mainLog.Errorf("AS%d did not reveal its board within %s", r.asns[i], *revealTimeout)
+			}
+			return nil
+		}
+		if !waiting[rr.i] || rr.ev.err != nil {
+			continue
+		}
+		done, err := r.games[rr.i].checkReveal(rr.ev.msg)
+		if !done {
+			continue
+		}
+		delete(waiting, rr.i)
+		if err != nil {
+			mainLog.Errorf("Unable to verify the board of AS%d: %s", r.asns[rr.i], err.Error())
+		} else {
+			mainLog.Infof("Board of AS%d verified, no ships were moved", r.asns[rr.i])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var rpkiValidator = flag.String("rpki", "",
+	"URL of a Routinator to check the origin of both game prefixes with, "+
+		"like http://localhost:8323")
+
+/*
+Plenty of networks drop RPKI invalid routes by now, a game prefix that
+is invalid never makes it to the other side and the game just stalls.
+With -rpki both prefixes are looked up in the validity API of
+Routinator once the origin ASNs are known:
+
+GET /api/v1/validity/AS65000/192.0.2.0/24
+*/
+
+type rpkiValidity struct {
+	ValidatedRoute struct {
+		Validity struct {
+			State       string `json:"state"`
+			Description string `json:"description"`
+		} `json:"validity"`
+	} `json:"validated_route"`
+}
+
+// rpkiState returns the validity of prefix originated by asn, valid,
+// invalid or not-found, and why.
+func rpkiState(ctx context.Context, asn uint32, prefix string) (string, string, error) {
+	url := fmt.Sprintf("%s/api/v1/validity/AS%d/%s",
+		strings.TrimRight(*rpkiValidator, "/"), asn, prefix)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("Validator said %s", resp.Status)
+	}
+
+	var v rpkiValidity
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return "", "", err
+	}
+	return v.ValidatedRoute.Validity.State, v.ValidatedRoute.Validity.Description, nil
+}
+
+// checkRPKI warns if either game prefix is RPKI invalid, an ASN of 0
+// is not known and its prefix is not checked.
+func checkRPKI(m *match, ourASN, peerASN uint32) {
+	if *rpkiValidator == "" {
+		return
+	}
+
+	for _, p := range []struct {
+		who    string
+		asn    uint32
+		prefix string
+	}{
+		{"our", ourASN, m.Prefix},
+		{"the other side's", peerASN, m.PeerPrefix},
+	} {
+		if p.asn == 0 || p.prefix == "" {
+			rpkiLog.Debugf("Not checking %s prefix, its origin is not known", p.who)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(routerCtx, *readTimeout)
+		state, why, err := rpkiState(ctx, p.asn, p.prefix)
+		cancel()
+		if err != nil {
+			rpkiLog.Errorf("Unable to check %s from AS%d %s", p.prefix, p.asn, err.Error())
+			continue
+		}
+
+		if state == "invalid" {
+			rpkiLog.Warnf("!!! %s prefix %s from AS%d is RPKI invalid (%s), "+
+				"networks dropping invalids won't pass it on and the game may stall",
+				p.who, p.prefix, p.asn, why)
+		} else {
+			rpkiLog.Infof("%s from AS%d is RPKI %s", p.prefix, p.asn, state)
+		}
+	}
+}
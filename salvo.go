@@ -0,0 +1,63 @@
+package main
+
+/*
+In salvo mode all the shots of a move are sent as large communities,
+next to the counter and position communities which carry the first
+one as usual:
+
+(communityASN, salvoShot+i, X << 8 | Y)
+(communityASN, salvoHits, bit i set if shot i of the last move hit)
+*/
+
+const (
+	salvoShot = 40 // up to maxSalvo shots
+	salvoHits = 56
+)
+
+const maxSalvo = 16
+
+func salvoCommunities(m move) []bgpLargeCommunity {
+	o := make([]bgpLargeCommunity, 0, len(m.Salvo)+1)
+	for i, s := range m.Salvo {
+		o = append(o, sessionCommunity(salvoShot+uint32(i),
+			uint32(s.X<<8|s.Y)))
+	}
+	return append(o, sessionCommunity(salvoHits, uint32(m.SalvoHits)))
+}
+
+// hasSalvoHits tells if the hits of the last move are there, every
+// salvo move has them, the one ending the game too.
+func hasSalvoHits(large []bgpLargeCommunity) bool {
+	for _, c := range large {
+		if c.Data1 == salvoHits {
+			return true
+		}
+	}
+	return false
+}
+
+// readSalvo returns the shots and hits of a salvo, shots is nil if they
+// are missing or not numbered from 0 up.
+func readSalvo(large []bgpLargeCommunity) (shots []cell, hits int) {
+	found := make(map[uint32]cell)
+	for _, c := range large {
+		if c.Data1 >= salvoShot && c.Data1 < salvoShot+maxSalvo {
+			found[c.Data1-salvoShot] = cell{
+				X: int(c.Data2 >> 8 & 0xff),
+				Y: int(c.Data2 & 0xff),
+			}
+		}
+		if c.Data1 == salvoHits {
+			hits = int(c.Data2)
+		}
+	}
+
+	for i := uint32(0); i < uint32(len(found)); i++ {
+		s, ok := found[i]
+		if !ok {
+			return nil, hits
+		}
+		shots = append(shots, s)
+	}
+	return shots, hits
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var peerSession = flag.String("peerSession", "",
+	"The BGP session the route of the other side comes over, a bird protocol or a bgpd "+
+		"neighbor address, it's taken from the route without it")
+
+/*
+When the BGP session the game goes over drops, the other side is
+offline rather than slow: the routers that can tell (bird, openbgpd,
+and BMP or -observeMRT by the peer down messages) are asked for the
+state of the session every sessionPoll. While it's down the UI says so
+and the turn timer of -turnTimeout stands still, nobody forfeits
+because their link died.
+
+The session is the one the route of the other side was last read from,
+or -peerSession.
+*/
+
+// how often the session of the other side is looked at
+var sessionPoll = 5 * time.Second
+
+var errNoSession = fmt.Errorf("No session known for the route yet, see -peerSession")
+
+// sessionRouter is a router that can tell if the BGP session carrying
+// the route to prefix is up.
+type sessionRouter interface {
+	session(ctx context.Context, prefix string) (bool, error)
+}
+
+// routeSessions keeps the sessions the routes were last read from
+type routeSessions struct {
+	mu       sync.Mutex
+	sessions map[string]string
+}
+
+func (s *routeSessions) setSession(prefix, session string) {
+	if session == "" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]string)
+	}
+	s.sessions[prefix] = session
+}
+
+func (s *routeSessions) sessionOf(prefix string) (string, error) {
+	if *peerSession != "" {
+		return *peerSession, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[prefix]
+	if !ok {
+		return "", errNoSession
+	}
+	return session, nil
+}
+
+// the protocol in the first line of show route, like
+// 10.0.1.0/24 unicast [peer1 12:00:00] * (100) [AS65001i]
+var birdRouteProtocolRegex = regexp.MustCompile(`\[([^\s\]]+)[\s\]]`)
+
+func birdRouteProtocol(reply string) string {
+	m := birdRouteProtocolRegex.FindStringSubmatch(reply)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// parseBirdProtocol tells from show protocols if a BGP protocol is
+// established, its line goes like
+// 1002-peer1      BGP        ---        up     12:00:00.000  Established
+func parseBirdProtocol(reply, name string) (bool, error) {
+	for _, line := range strings.Split(reply, "\n") {
+		if len(line) > 5 && line[4] == '-' {
+			line = line[5:]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != name {
+			continue
+		}
+		return fields[3] == "up" && strings.Contains(line, "Established"), nil
+	}
+	return false, fmt.Errorf("No protocol %s in bird", name)
+}
+
+func (r *birdRouter) session(ctx context.Context, prefix string) (bool, error) {
+	name, err := r.sessionOf(prefix)
+	if err != nil {
+		return false, err
+	}
+	reply, err := birdCommand(ctx, "show protocols "+name)
+	if err != nil {
+		return false, err
+	}
+	return parseBirdProtocol(reply, name)
+}
+
+var bgpctlNeighborRegex = regexp.MustCompile(`Neighbor (\S+)`)
+var bgpctlStateRegex = regexp.MustCompile(`BGP state = (\w+)`)
+
+func (r *openbgpdRouter) session(ctx context.Context, prefix string) (bool, error) {
+	neighbor, err := r.sessionOf(prefix)
+	if err != nil {
+		return false, err
+	}
+	out, err := bgpctl(ctx, *readTimeout, "show", "neighbor", neighbor)
+	if err != nil {
+		return false, err
+	}
+	m := bgpctlStateRegex.FindStringSubmatch(out)
+	if m == nil {
+		return false, fmt.Errorf("No neighbor %s in bgpd", neighbor)
+	}
+	return m[1] == "Established", nil
+}
+
+// session is down once the peer the route came from went down, and up
+// again with its next route.
+func (r *bmpRouter) session(ctx context.Context, prefix string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peer := *peerSession
+	if peer == "" {
+		peer = r.peers[prefix]
+	}
+	if peer == "" {
+		return false, errNoSession
+	}
+	return !r.down[peer], nil
+}
+
+// canSession tells if r can tell the state of the session of the other
+// side, splitRouter only can if either of its halves can.
+func canSession(r router) bool {
+	if r, ok := r.(*splitRouter); ok {
+		return canSession(r.rx) || canSession(r.tx)
+	}
+	_, ok := r.(sessionRouter)
+	return ok
+}
+
+// watchSession tells the loop when the session of the other side goes
+// down or comes back, until the game is done.
+func (l *gameLoop) watchSession(sr sessionRouter) {
+	m := l.g.match
+	up := true
+	for {
+		select {
+		case <-time.After(sessionPoll):
+		case <-l.done:
+			return
+		}
+
+		now, err := sr.session(routerCtx, m.PeerPrefix)
+		if err != nil {
+			m.log.Debugf("Unable to tell the state of the session %s", err.Error())
+			continue
+		}
+		if now == up {
+			continue
+		}
+		up = now
+		select {
+		case l.sessions <- up:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// session acts on the session of the other side going down or up.
+func (l *gameLoop) session(up bool) {
+	g := l.g
+	g.setOnline(up)
+	if up {
+		g.match.log.Infof("The session to the other side is back up")
+	} else {
+		g.match.log.Warnf("The session to the other side is down, it's offline")
+		if *turnTimeout > 0 {
+			g.match.log.Infof("The turn timer stands still until it's back")
+		}
+	}
+	if l.draw {
+		if up {
+			fmt.Printf("\nOpponent back online\n")
+		} else {
+			fmt.Printf("\nOpponent offline\n")
+		}
+	}
+	l.dash.update(g)
+}
+
+// setOnline pauses the turn timer while the other side is offline.
+func (g *game) setOnline(up bool) {
+	offline := !g.offlineSince.IsZero()
+	switch {
+	case !up && !offline:
+		g.offlineSince = time.Now()
+	case up && offline:
+		g.addPause(g.offlinePause())
+		g.offlineSince = time.Time{}
+	}
+}
+
+// offlinePause is how much of the current turn the other side has been
+// offline for.
+func (g *game) offlinePause() time.Duration {
+	if g.offlineSince.IsZero() {
+		return 0
+	}
+	from := g.offlineSince
+	if start := g.turnStart(); start.After(from) {
+		from = start
+	}
+	return time.Since(from)
+}
+
+func (g *game) addPause(d time.Duration) {
+	if g.pausedTurn != len(g.moves) {
+		g.pausedTurn, g.paused = len(g.moves), 0
+	}
+	g.paused += d
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+var signalsOnce sync.Once
+
+// handleSignals cleans up on SIGINT and SIGTERM, so the game
+// communities don't stay announced once we are gone. A second signal
+// kills us right away if the cleanup hangs. SIGHUP reloads -config.
+func handleSignals() {
+	signalsOnce.Do(func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-ch
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+			mainLog.Infof("Got %s, withdrawing the game communities", sig)
+			os.Exit(shutdown())
+		}()
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if _, err := reloadConfig(); err != nil {
+					mainLog.Errorf("Unable to reload %s", err.Error())
+				}
+			}
+		}()
+	})
+}
+
+// shutdown saves the games and stops announcing them, it returns the
+// exit code. What the router is doing is aborted, then matchesMu is
+// taken and never released so no new write can start.
+func shutdown() int {
+	saveStates()
+	withdrawNukes()
+
+	stopRouter()
+	matchesMu.Lock()
+	// a team member that never led has no router
+	if activeRouter == nil {
+		return 0
+	}
+	if err := activeRouter.write(context.Background(), nil); err != nil {
+		mainLog.Errorf("Unable to withdraw the game communities %s", err.Error())
+		return 1
+	}
+	return 0
+}
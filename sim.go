@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var simDelay = flag.Duration("simDelay", 0,
+	"With -backend loopback, how long an update takes to show up on the other side")
+
+var simJitter = flag.Duration("simJitter", 0,
+	"With -backend loopback, up to this much more delay, different for every update, "+
+		"so that updates overtake each other")
+
+var simReorder = flag.Float64("simReorder", 0,
+	"With -backend loopback, the chance that the route before an update shows up "+
+		"again after it")
+
+var simDuplicate = flag.Float64("simDuplicate", 0,
+	"With -backend loopback, the chance that an older route shows up again after an update")
+
+var simStrip = flag.Float64("simStrip", 0,
+	"With -backend loopback, the chance that an update first shows up with its 16 bit "+
+		"or its large communities stripped")
+
+var simSeed = flag.Int64("simSeed", 0,
+	"The seed of the -sim flags, to play the same mess again, 0 for a random one")
+
+/*
+The loopback backend can make the routes get around as badly as they do
+in the DFZ, to try the resyncs and rejections of the game without any
+router:
+
+	serve -backend loopback -simDelay 2s -simJitter 3s -simReorder 0.2 \
+		-simStrip 0.1 -game ... -game ...
+
+Every update gets delivered after -simDelay plus some of -simJitter, so
+a later update can arrive before an earlier one. On top of that an
+update can be followed by the route before it (-simReorder) or an older
+one (-simDuplicate, one of the last simHistory), or arrive with a kind
+of communities stripped first (-simStrip). Like BGP the route always
+ends up at the last update: whatever was delivered out of order is
+followed by the last route again.
+*/
+
+// how many of the last routes -simDuplicate picks from
+const simHistory = 4
+
+type simConfig struct {
+	delay, jitter             time.Duration
+	reorder, duplicate, strip float64
+	seed                      int64
+}
+
+func flagSimConfig() simConfig {
+	return simConfig{
+		delay:     *simDelay,
+		jitter:    *simJitter,
+		reorder:   *simReorder,
+		duplicate: *simDuplicate,
+		strip:     *simStrip,
+		seed:      *simSeed,
+	}
+}
+
+func (c simConfig) enabled() bool {
+	return c.delay > 0 || c.jitter > 0 || c.reorder > 0 || c.duplicate > 0 || c.strip > 0
+}
+
+// simEvent is a route arriving, latest is set for the last route at the
+// time it arrives.
+type simEvent struct {
+	at     time.Time
+	route  *loopbackRoute
+	latest bool
+}
+
+// simRouter is a loopback router with the -sim flags, the routes are
+// announced to the loopback router right away and the other side sees
+// them as the events of a prefix play out.
+type simRouter struct {
+	*loopbackRouter
+	config simConfig
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	events map[string][]simEvent
+	// the last routes of every prefix, the newest last, nil if it was
+	// withdrawn
+	history map[string][]*loopbackRoute
+	// when the last event of every prefix is due
+	horizon map[string]time.Time
+}
+
+func newSimRouter(lr *loopbackRouter, config simConfig) *simRouter {
+	seed := config.seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	mainLog.Infof("Simulating a lossy path, seed %d", seed)
+	return &simRouter{
+		loopbackRouter: lr,
+		config:         config,
+		rand:           rand.New(rand.NewSource(seed)),
+		events:         make(map[string][]simEvent),
+		history:        make(map[string][]*loopbackRoute),
+		horizon:        make(map[string]time.Time),
+	}
+}
+
+func (r *simRouter) write(ctx context.Context, ms []*match) error {
+	if err := r.loopbackRouter.write(ctx, ms); err != nil {
+		return err
+	}
+	r.loopbackRouter.mu.Lock()
+	routes := r.loopbackRouter.routes
+	r.loopbackRouter.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	prefixes := make(map[string]bool)
+	for p := range routes {
+		prefixes[p] = true
+	}
+	for p := range r.history {
+		prefixes[p] = true
+	}
+	for p := range prefixes {
+		var cur *loopbackRoute
+		if route, ok := routes[p]; ok {
+			cur = &route
+		}
+		hist := r.history[p]
+		if len(hist) > 0 && sameSimRoute(hist[len(hist)-1], cur) {
+			continue
+		}
+		r.schedule(p, now, cur, hist)
+		if hist = append(hist, cur); len(hist) > simHistory {
+			hist = hist[1:]
+		}
+		r.history[p] = hist
+	}
+	return nil
+}
+
+func sameSimRoute(a, b *loopbackRoute) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return fmt.Sprint(*a) == fmt.Sprint(*b)
+}
+
+func (r *simRouter) chance(p float64) bool {
+	return p > 0 && r.rand.Float64() < p
+}
+
+func (r *simRouter) jitter() time.Duration {
+	if r.config.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(r.rand.Int63n(int64(r.config.jitter)))
+}
+
+// schedule plans how the update of p to cur gets around, hist are the
+// routes before it.
+func (r *simRouter) schedule(p string, now time.Time, cur *loopbackRoute, hist []*loopbackRoute) {
+	at := now.Add(r.config.delay + r.jitter())
+	var evs []simEvent
+
+	if cur != nil && r.chance(r.config.strip) {
+		stripped := *cur
+		if r.rand.Intn(2) == 0 {
+			stripped.communities = nil
+		} else {
+			stripped.large = nil
+		}
+		evs = append(evs, simEvent{at: at, route: &stripped})
+		at = at.Add(time.Millisecond + r.jitter())
+	}
+	evs = append(evs, simEvent{at: at, route: cur})
+
+	last := at
+	if len(hist) > 0 && r.chance(r.config.reorder) {
+		last = at.Add(time.Millisecond + r.jitter())
+		evs = append(evs, simEvent{at: last, route: hist[len(hist)-1]})
+	}
+	if len(hist) > 0 && r.chance(r.config.duplicate) {
+		s := at.Add(time.Millisecond + r.jitter())
+		evs = append(evs, simEvent{at: s, route: hist[r.rand.Intn(len(hist))]})
+		if s.After(last) {
+			last = s
+		}
+	}
+	// whatever is still on its way or came out of order, the last
+	// route has the final word
+	if h := r.horizon[p]; last != at || h.After(at) {
+		if h.After(last) {
+			last = h
+		}
+		last = last.Add(time.Millisecond)
+		evs = append(evs, simEvent{at: last, latest: true})
+	}
+	r.horizon[p] = last
+	r.events[p] = append(r.events[p], evs...)
+}
+
+func (r *simRouter) read(ctx context.Context, prefix string) ([]bgpCommunity, []bgpLargeCommunity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	evs := r.events[prefix]
+	best := -1
+	for i, ev := range evs {
+		if ev.at.After(now) {
+			continue
+		}
+		if best < 0 || !ev.at.Before(evs[best].at) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil, nil, fmt.Errorf("No route to %s", prefix)
+	}
+
+	ev := evs[best]
+	// the ones before it won't be seen again
+	kept := evs[:0]
+	for _, e := range evs {
+		if !e.at.Before(ev.at) {
+			kept = append(kept, e)
+		}
+	}
+	r.events[prefix] = kept
+
+	route := ev.route
+	if ev.latest {
+		hist := r.history[prefix]
+		route = hist[len(hist)-1]
+	}
+	if route == nil {
+		return nil, nil, fmt.Errorf("No route to %s", prefix)
+	}
+	return route.communities, route.large, nil
+}
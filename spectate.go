@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+type spectatedMove struct {
+	player   int
+	move     move
+	resolved bool
+}
+
+// spectatedSettings picks the board size and mode from the handshake
+// of both players, falling back to the flags.
+func spectatedSettings(prefixes []string) (width, height int, salvo bool) {
+	width, height, salvo = *boardWidth, *boardHeight, *salvoMode
+
+	for i, prefix := range prefixes {
+		hello, err := readHello(prefix)
+		if err != nil {
+			spectateLog.Warnf("Unable to read the handshake of %s: %s", prefix, err.Error())
+			continue
+		}
+		size, ok := hello[helloBoardSize]
+		if !ok {
+			continue
+		}
+		w, h := int(size>>8), int(size&0xff)
+		if i == 0 || w < width {
+			width = w
+		}
+		if i == 0 || h < height {
+			height = h
+		}
+		salvo = hello[helloMode]&modeSalvo != 0
+	}
+	return width, height, salvo
+}
+
+// spectate follows the game between two prefixes, every player's board
+// shows the shots fired at it by the other one.
+func spectate(prefixA, prefixB string) {
+	prefixes := []string{prefixA, prefixB}
+	width, height, salvo := spectatedSettings(prefixes)
+	if !validBoardSize(width, height) {
+		spectateLog.Fatalf("Players announced an invalid board size %dx%d", width, height)
+	}
+
+	boards := []battleShipBoard{newBoard(width, height), newBoard(width, height)}
+	moves := make(map[int]*spectatedMove)
+	latest := 0
+
+	spectateLog.Infof("Spectating %s vs %s on %dx%d", prefixA, prefixB, width, height)
+
+	for {
+		time.Sleep(pollInterval)
+
+		changed := false
+		for i, prefix := range prefixes {
+			msg, err := readBGPFrom(prefix)
+			if err != nil {
+				progress("E")
+				continue
+			}
+			if _, ok := msg.extended(extResyncRequest); ok {
+				// just an old move announced again
+				continue
+			}
+			msg.Counter = expandCounter(msg.Counter, latest)
+			if _, ok := moves[msg.Counter]; ok || msg.Counter < 0 {
+				continue
+			}
+			if msg.Counter > latest {
+				latest = msg.Counter
+			}
+
+			m := messageMove(msg, salvo)
+			moves[msg.Counter] = &spectatedMove{player: i, move: m}
+			changed = true
+
+			for _, ship := range m.Sunk {
+				spectateLog.Infof("[%06d] %s lost its %s", msg.Counter, prefix, shipName(ship))
+			}
+			if !m.GameOver {
+				spectateLog.Infof("[%06d] %s fired at %v", msg.Counter, prefix, m.shots(salvo))
+			}
+		}
+
+		if !changed {
+			progress(".")
+			continue
+		}
+
+		// results of a move only come with the next one
+		for c, sm := range moves {
+			next, ok := moves[c+1]
+			if sm.resolved || !ok {
+				continue
+			}
+
+			target := &boards[1-sm.player]
+			for i, s := range sm.move.shots(salvo) {
+				if !target.inside(s.X, s.Y) {
+					continue
+				}
+				if next.move.hit(i, salvo) {
+					target.Board[s.Y][s.X] = stateHit
+				} else {
+					target.Board[s.Y][s.X] = stateAttempt
+				}
+			}
+			sm.resolved = true
+		}
+
+		fmt.Print(boardTitles(boards[0], prefixA, prefixB))
+		fmt.Print(combineBoard(boards[0], boards[1]))
+
+		for _, sm := range moves {
+			if sm.move.GameOver && sm.move.Surrender {
+				spectateLog.Infof("%s surrendered, %s won!",
+					prefixes[sm.player], prefixes[1-sm.player])
+				return
+			}
+			if sm.move.GameOver {
+				spectateLog.Infof("All ships of %s are sunk, %s won!",
+					prefixes[sm.player], prefixes[1-sm.player])
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+)
+
+var stateDir = flag.String("stateDir", "",
+	"Write the state of every game to a file named after it in this directory")
+
+type gameState struct {
+	Name          string
+	CommunityASN  int
+	PeerPrefix    string
+	Width, Height int
+	Salvo         bool
+	CTF           bool `json:",omitempty"`
+	StartFirst    bool
+	Local, Remote [][]string
+	Moves         []move
+	Over, Won     bool
+	// we were stopped in the middle of the game
+	Interrupted bool `json:",omitempty"`
+
+	// the rest is only needed to export the game, see notation.go
+	Codec   string `json:",omitempty"`
+	Results bool   `json:",omitempty"`
+	Round   int    `json:",omitempty"`
+	Tag     int    `json:",omitempty"`
+	Fleet   []int  `json:",omitempty"`
+	Ships   []ship `json:",omitempty"`
+	Flag    *cell  `json:",omitempty"`
+	Salt    string `json:",omitempty"`
+}
+
+// the last state saved of every game, to write it again on shutdown
+var states = make(map[string]gameState)
+var statesMu sync.Mutex
+
+// saveState writes the state of g to its file in -stateDir, if set.
+func saveState(g *game) {
+	if *stateDir == "" {
+		return
+	}
+
+	s := stateOf(g)
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	states[s.Name] = s
+	writeState(s)
+}
+
+func stateOf(g *game) gameState {
+	m := g.match
+	return gameState{
+		Name:         m.Name,
+		CommunityASN: m.ASN,
+		PeerPrefix:   m.PeerPrefix,
+		Width:        g.LocalB.Width,
+		Height:       g.LocalB.Height,
+		Salvo:        g.salvo,
+		CTF:          g.ctf,
+		StartFirst:   g.startFirst,
+		Local:        boardStrings(g.LocalB),
+		Remote:       boardStrings(g.RemoteB),
+		Moves:        append([]move(nil), g.moves...),
+		Over:         g.over,
+		Won:          g.won,
+
+		Codec:   m.moveCodec().name,
+		Results: g.results,
+		Round:   m.gameID,
+		Tag:     m.tag,
+		Fleet:   append([]int(nil), fleet...),
+		Ships:   g.LocalB.Ships,
+		Flag:    g.LocalB.Flag,
+		Salt:    hex.EncodeToString(g.commitment.Salt[:]),
+	}
+}
+
+// saveStates writes the state of every game again, the ones that are
+// not over are marked as interrupted.
+func saveStates() {
+	if *stateDir == "" {
+		return
+	}
+
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	for _, s := range states {
+		s.Interrupted = !s.Over
+		writeState(s)
+	}
+}
+
+func writeState(s gameState) {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		mainLog.Errorf("Unable to encode the state of %s %s", s.Name, err.Error())
+		return
+	}
+
+	path := filepath.Join(*stateDir, s.Name+".json")
+	if err := writeFileAtomic(path, b, 0644); err != nil {
+		mainLog.Errorf("Unable to write the state of %s %s", s.Name, err.Error())
+	}
+}
+
+func readState(path string) (s gameState, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	return s, err
+}
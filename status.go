@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+)
+
+// decodeCommunity describes a game community, and what's wrong with it
+// if anything.
+func decodeCommunity(c bgpCommunity) (kind, text, problem string) {
+	r := numberToBitReader(c.Data)
+	switch t := r.Uint8(2); t {
+	case typeCounter:
+		return "counter", fmt.Sprintf("counter %d", r.Uint16(14)), ""
+	case typePosition:
+		x := r.Uint16(4)
+		pad1 := r.Uint16(2)
+		y := r.Uint16(4)
+		hit := r.Uint16(2)
+		pad2 := r.Uint16(2)
+		text = fmt.Sprintf("position %s, last move %s", cell{int(x), int(y)},
+			map[uint16]string{resultMiss: "missed", resultHit: "hit",
+				resultSunk: "hit and sunk a ship"}[hit])
+		if pad1 != 0 || pad2 != 0 {
+			problem = "padding bits are set"
+		} else if hit > resultSunk {
+			problem = fmt.Sprintf("hit flag is %d", hit)
+		}
+		return "position", text, problem
+	case typeExtended:
+		e := r.Uint8(4)
+		p := r.Uint16(10)
+		t, ok := extTypes[int(e)]
+		if !ok {
+			return "extended", fmt.Sprintf("extended type %d, payload %d", e, p),
+				"unknown extended type"
+		}
+		return fmt.Sprintf("extended %d", e),
+			fmt.Sprintf("%s, payload %d", t.name, p), ""
+	default:
+		for i, v := range probeValues {
+			if c.Data == v {
+				return fmt.Sprintf("probe %d", i), fmt.Sprintf("probe pattern %d", i), ""
+			}
+		}
+		return "invalid", fmt.Sprintf("type %d", t), "invalid community type"
+	}
+}
+
+// decodeLargeCommunity describes a game large community.
+func decodeLargeCommunity(c bgpLargeCommunity) (text string, problem string) {
+	f, v := c.Data1, c.Data2
+	switch {
+	case f == helloVersion:
+		return fmt.Sprintf("hello: protocol version %d", v), ""
+	case f == helloCodecs:
+		return fmt.Sprintf("hello: codecs %#x", v), ""
+	case f == helloBoardSize:
+		return fmt.Sprintf("hello: board %dx%d", v>>8, v&0xff), ""
+	case f == helloASN:
+		return fmt.Sprintf("hello: AS%d", v), ""
+	case f >= helloCommit && f < helloCommit+8:
+		return fmt.Sprintf("hello: seed commitment word %d: %08x", f-helloCommit, v), ""
+	case f >= helloSalt && f < helloSalt+4:
+		return fmt.Sprintf("hello: seed salt word %d: %08x", f-helloSalt, v), ""
+	case f == helloSeed:
+		return fmt.Sprintf("hello: seed %#08x", v), ""
+	case f == helloMode:
+		return fmt.Sprintf("hello: mode %d (%s)", v, modeName(v)), ""
+	case f == helloGameID:
+		return fmt.Sprintf("hello: game %d", v), ""
+	case f == fieldOrigin:
+		return fmt.Sprintf("origin: AS%d", v), ""
+	case f == moveCounter:
+		return fmt.Sprintf("move: counter %d", v), ""
+	case f == movePosition:
+		return fmt.Sprintf("move: X %d Y %d S %d", v>>16&0xff, v>>8&0xff, v&0xff), ""
+	case f == moveExtended:
+		t, ok := extTypes[int(v>>16)]
+		if !ok {
+			return fmt.Sprintf("move: extended type %d, payload %d", v>>16, v&0xffff),
+				"unknown extended type"
+		}
+		return fmt.Sprintf("move: %s, payload %d", t.name, v&0xffff), ""
+	case f == helloFleet || f == helloFleet+1:
+		return fmt.Sprintf("hello: fleet word %d, ship sizes %v", f-helloFleet,
+			readFleetWords([2]uint32{v, 0})), ""
+	case f >= boardCommit && f < boardCommit+8:
+		return fmt.Sprintf("board commitment word %d: %08x", f-boardCommit, v), ""
+	case f >= boardSalt && f < boardSalt+4:
+		return fmt.Sprintf("board salt word %d: %08x", f-boardSalt, v), ""
+	case f >= boardLayout && f < boardLayout+8:
+		return fmt.Sprintf("board layout word %d: %08x", f-boardLayout, v), ""
+	case f >= salvoShot && f < salvoShot+maxSalvo:
+		text = fmt.Sprintf("salvo shot %d: %s", f-salvoShot, cell{int(v >> 8), int(v & 0xff)})
+		if v>>8 >= maxBoardSize || v&0xff >= maxBoardSize {
+			problem = "shot outside of any board"
+		}
+		return text, problem
+	case f == boardFlag:
+		return fmt.Sprintf("board flag: %s", cell{int(v >> 8), int(v & 0xff)}), ""
+	case f == salvoHits:
+		return fmt.Sprintf("salvo hits %016b", v), ""
+	case f >= royaleResult && f < royaleResult+8:
+		text = fmt.Sprintf("battle royale: result %d for AS%d", (f-royaleResult)&^royaleLost, v)
+		if (f-royaleResult)&royaleLost != 0 {
+			text += ", the attacker lost"
+		}
+		return text, ""
+	case f == probeLarge || f == probeLarge+1:
+		text = fmt.Sprintf("probe pattern %d: %#08x", f-probeLarge, v)
+		if v != probeLargeValues[f-probeLarge] {
+			problem = "probe pattern was changed on the way"
+		}
+		return text, problem
+	case f == probeEcho:
+		return fmt.Sprintf("probe echo %04b", v), ""
+	case f == chatHeader:
+		return fmt.Sprintf("chat: message %d, %d characters", v>>8, v&0xff), ""
+	case f >= chatText && f < chatText+chatWords:
+		return fmt.Sprintf("chat: word %d", f-chatText), ""
+	}
+	return fmt.Sprintf("field %d: %d", f, v), "unknown field"
+}
+
+// showStatus dumps the communities announced on the peer prefix, the
+// game ones decoded.
+func showStatus(args []string) error {
+	communities, large, err := readCommunities(*monitoredPrefix)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d communities and %d large communities on %s\n",
+		len(communities), len(large), *monitoredPrefix)
+
+	problems := 0
+	report := func(problem string) {
+		if problem != "" {
+			fmt.Printf("    !! %s\n", problem)
+			problems++
+		}
+	}
+
+	seen := map[bgpCommunity]bool{}
+	kinds := map[string]bool{}
+	for _, c := range communities {
+		if c.AS != uint16(*communityAS) {
+			fmt.Printf("  (%d,%d)\n", c.AS, c.Data)
+			continue
+		}
+
+		kind, text, problem := decodeCommunity(c)
+		fmt.Printf("  (%d,%d) %s\n", c.AS, c.Data, text)
+		report(problem)
+		if seen[c] {
+			report("duplicate community")
+		} else if kinds[kind] {
+			report("another " + kind + " community is announced")
+		}
+		seen[c], kinds[kind] = true, true
+	}
+
+	seenLarge := map[bgpLargeCommunity]bool{}
+	fields := map[uint32]bool{}
+	for _, c := range large {
+		if c.Global != uint32(*communityAS) {
+			fmt.Printf("  (%d, %d, %d)\n", c.Global, c.Data1, c.Data2)
+			continue
+		}
+
+		text, problem := decodeLargeCommunity(c)
+		fmt.Printf("  (%d, %d, %d) %s\n", c.Global, c.Data1, c.Data2, text)
+		report(problem)
+		if seenLarge[c] {
+			report("duplicate community")
+		} else if fields[c.Data1] && c.Data1 != moveExtended &&
+			(c.Data1 < royaleResult || c.Data1 >= royaleResult+8) {
+			report("another value is announced for this field")
+		}
+		seenLarge[c], fields[c.Data1] = true, true
+	}
+
+	game := make([]bgpLargeCommunity, 0, len(large))
+	for _, c := range large {
+		if c.Global == uint32(*communityAS) {
+			game = append(game, c)
+		}
+	}
+	if _, text, ok := readChat(game); ok {
+		fmt.Printf("Chat: %s\n", text)
+	}
+
+	if !kinds["counter"] || !kinds["position"] {
+		fmt.Printf("No complete move announced\n")
+	}
+	if problems > 0 {
+		fmt.Printf("%d problems found\n", problems)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var teamList = flag.String("team", "",
+	"Play one side as a team, the -api addresses of all the instances of it "+
+		"separated by commas, the first one that is up leads")
+
+var teamVote = flag.Duration("teamVote", 30*time.Second,
+	"How long the team votes on each of our moves, the bot picks one if nobody voted")
+
+/*
+A team is several instances playing the same side of a game, like the
+audience of a meetup voting on the next shot. They all have -team with
+the -api addresses of every instance, -api is their own one.
+
+Only the leader plays the game and touches the router, the others follow
+it over the control API: they show the boards and send what is typed at
+their prompt as votes. Anybody can vote with ctl vote too.
+
+GET  /team                     who we think leads
+GET  /games/<name>/export      the game in the notation of export
+POST /games/<name>/vote        {"Shots": ["A1"], "Voter": "alice"}
+
+On our turn the leader takes votes for -teamVote and then fires the
+shots with the most votes, the ones voted for first win a tie. Voting
+again replaces the vote, a voter without a name is its IP address.
+
+The leader is the first instance of -team that is up, unless one that is
+up already follows another one that is up, so an instance coming back
+doesn't take over from a running leader. A follower keeps the last
+export of the game, if the leader goes away the next one in line
+carries on with it as -resume would. If the instances can't see each
+other two of them may lead at once, keep them close.
+*/
+
+var teamLog = logger{"team"}
+
+var errNotTeam = fmt.Errorf("Not a team game, see -team")
+
+var teamClient = &http.Client{Timeout: 2 * time.Second}
+
+// how often followers look at the leader
+var teamPoll = 2 * time.Second
+
+// the leader we follow, or our own -api once we lead
+var teamLeader struct {
+	mu   sync.Mutex
+	addr string
+}
+
+func currentLeader() string {
+	teamLeader.mu.Lock()
+	defer teamLeader.mu.Unlock()
+	return teamLeader.addr
+}
+
+func setLeader(addr string) {
+	teamLeader.mu.Lock()
+	defer teamLeader.mu.Unlock()
+	if teamLeader.addr != addr {
+		teamLog.Infof("%s leads the team", addr)
+	}
+	teamLeader.addr = addr
+}
+
+func teamMembers() []string {
+	var o []string
+	for _, a := range strings.Split(*teamList, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			o = append(o, a)
+		}
+	}
+	return o
+}
+
+func checkTeamFlags() error {
+	if *teamList == "" {
+		return nil
+	}
+	for _, a := range teamMembers() {
+		if a == *apiListen {
+			return nil
+		}
+	}
+	return fmt.Errorf("-api has to be one of the -team addresses")
+}
+
+type apiTeam struct {
+	Leader string
+}
+
+func serveAPITeam(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, apiTeam{currentLeader()})
+}
+
+// electLeader asks every member of the team who it follows and returns
+// who we should.
+func electLeader() string {
+	members := teamMembers()
+	up := make(map[string]bool)
+	claims := make(map[string]bool)
+	for _, a := range members {
+		if a == *apiListen {
+			up[a] = true
+			continue
+		}
+		var t apiTeam
+		if err := teamGet(a, "/team", &t); err != nil {
+			continue
+		}
+		up[a] = true
+		if t.Leader != "" {
+			claims[t.Leader] = true
+		}
+	}
+
+	for _, a := range members {
+		if up[a] && claims[a] {
+			return a
+		}
+	}
+	for _, a := range members {
+		if up[a] {
+			return a
+		}
+	}
+	return *apiListen
+}
+
+func teamGet(addr, path string, v interface{}) error {
+	resp, err := teamClient.Get("http://" + addr + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	if s, ok := v.(*string); ok {
+		*s = string(body)
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
+
+func teamPost(addr, path string, req, v interface{}) error {
+	b, _ := json.Marshal(req)
+	resp, err := teamClient.Post("http://"+addr+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, v)
+}
+
+var teamRouterOnce sync.Once
+var teamRouterErr error
+
+// followTeam follows the leader of the team until we are the one
+// leading, the game is then picked up where the last leader left it.
+func followTeam(m *match, draw bool) error {
+	var lines chan string
+	if draw && !*botMode {
+		lines = make(chan string)
+		done := make(chan struct{})
+		defer close(done)
+		go readLines(os.Stdin, lines, done)
+	}
+
+	export, shown := "", -1
+	for {
+		leader := electLeader()
+		setLeader(leader)
+		if leader == *apiListen {
+			break
+		}
+
+		var text string
+		if err := teamGet(leader, "/games/"+m.Name+"/export", &text); err == nil {
+			export = text
+		}
+		var b apiBoards
+		if err := teamGet(leader, "/games/"+m.Name, &b); err == nil && b.Moves != shown {
+			shown = b.Moves
+			if draw {
+				printAPIBoards(b)
+				if b.OurTurn {
+					fmt.Printf("[%06d] Vote> ", b.Moves)
+				}
+			}
+		}
+
+		select {
+		case <-time.After(teamPoll):
+		case text := <-lines:
+			var v apiVotes
+			err := teamPost(leader, "/games/"+m.Name+"/vote",
+				map[string]interface{}{"Shots": strings.Fields(text), "Voter": *apiListen}, &v)
+			if err != nil {
+				fmt.Printf("Vote not taken: %s\n", err.Error())
+			} else {
+				printVotes(v)
+			}
+		}
+	}
+
+	if export != "" {
+		s, err := importGame(strings.NewReader(export))
+		if err != nil {
+			return fmt.Errorf("Unable to read the game of the last leader %s", err.Error())
+		}
+		m.resume = &s
+	}
+
+	// the router is only set up by the leader
+	teamRouterOnce.Do(func() {
+		teamRouterErr = setupRouter()
+	})
+	return teamRouterErr
+}
+
+// ballot is the votes on our next move, kept by the game loop of the
+// leader.
+type ballot struct {
+	counter  int
+	deadline *time.Timer
+	closes   time.Time
+	votes    map[string]string
+	// when every choice was first voted for
+	first map[string]int
+	seq   int
+}
+
+type apiVotes struct {
+	apiGame
+	Votes  map[string]int
+	Closes time.Time
+}
+
+// open starts taking votes on the move with counter c, if it's not
+// done already.
+func (b *ballot) open(c int) {
+	if b.deadline != nil && b.counter == c {
+		return
+	}
+	b.stop()
+	b.counter = c
+	b.votes = make(map[string]string)
+	b.first = make(map[string]int)
+	b.deadline = time.NewTimer(*teamVote)
+	b.closes = time.Now().Add(*teamVote)
+	teamLog.Infof("Taking votes on move %d for %s", c, *teamVote)
+}
+
+func (b *ballot) stop() {
+	if b != nil && b.deadline != nil {
+		b.deadline.Stop()
+		b.deadline = nil
+	}
+}
+
+// closed fires when the vote is over, a nil channel never does
+func (b *ballot) closed() <-chan time.Time {
+	if b == nil || b.deadline == nil {
+		return nil
+	}
+	return b.deadline.C
+}
+
+func (b *ballot) vote(voter string, shots []cell) {
+	names := make([]string, len(shots))
+	for i, c := range shots {
+		names[i] = c.String()
+	}
+	choice := strings.Join(names, " ")
+	if _, ok := b.first[choice]; !ok {
+		b.first[choice] = b.seq
+		b.seq++
+	}
+	b.votes[voter] = choice
+	teamLog.Infof("%s votes for %s", voter, choice)
+}
+
+func (b *ballot) tally() map[string]int {
+	o := make(map[string]int)
+	for _, choice := range b.votes {
+		o[choice]++
+	}
+	return o
+}
+
+// winner returns the choice with the most votes, "" if nobody voted
+func (b *ballot) winner() string {
+	tally := b.tally()
+	choices := make([]string, 0, len(tally))
+	for c := range tally {
+		choices = append(choices, c)
+	}
+	sort.Slice(choices, func(i, j int) bool {
+		a, c := choices[i], choices[j]
+		if tally[a] != tally[c] {
+			return tally[a] > tally[c]
+		}
+		return b.first[a] < b.first[c]
+	})
+	if len(choices) == 0 {
+		return ""
+	}
+	return choices[0]
+}
+
+// elect fires the shots the team voted for once the vote is over
+func (l *gameLoop) elect() {
+	b, g := l.ballot, l.g
+	b.deadline = nil
+
+	shots := botShots(g.RemoteB, g.peerWrecks, g.salvoSize())
+	if choice := b.winner(); choice != "" {
+		shots = parseShots(choice, g.salvoSize(), g.RemoteB)
+		teamLog.Infof("The team voted for %s with %d of %d votes", choice,
+			b.tally()[choice], len(b.votes))
+	} else {
+		teamLog.Infof("Nobody voted, the bot picks")
+	}
+	l.fire(shots)
+}
+
+func (l *gameLoop) votes() apiVotes {
+	v := apiVotes{apiGame: gameInfo(l.g), Votes: make(map[string]int)}
+	if b := l.ballot; b != nil && b.deadline != nil {
+		v.Votes = b.tally()
+		v.Closes = b.closes
+	}
+	return v
+}
+
+func printVotes(v apiVotes) {
+	choices := make([]string, 0, len(v.Votes))
+	for c := range v.Votes {
+		choices = append(choices, c)
+	}
+	sort.Slice(choices, func(i, j int) bool { return v.Votes[choices[i]] > v.Votes[choices[j]] })
+	for _, c := range choices {
+		fmt.Printf("  %-12s %d\n", c, v.Votes[c])
+	}
+	if !v.Closes.IsZero() {
+		fmt.Printf("Vote closes in %s\n", time.Until(v.Closes).Round(time.Second))
+	}
+}
+
+// voterName is the voter of a request that didn't give one
+func voterName(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
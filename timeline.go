@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var timelineFile = flag.String("timeline", "",
+	"Append every route read and every announcement of the games to this file, "+
+		"to look into a desync with debug timeline")
+
+var timelineSize = flag.Int("timelineSize", 2000,
+	"How many of the last timeline events every game keeps, GET /games/<name>/timeline")
+
+/*
+The timeline of a game is what it saw of the route of the other side
+(seen), what it announced (sent) and what it made of it (local), with
+the time of each. A seen snapshot is only recorded when it changes, it
+was visible until the next one. The last -timelineSize events of every
+game are kept in memory and served by the control API, -timeline
+appends all of them to a file as JSON, one event per line.
+
+debug timeline goes through them and marks where the two sides stopped
+agreeing: the other side announcing a move we don't have, a move
+rejected by either side or a resync.
+*/
+
+const (
+	timelineSeen  = "seen"
+	timelineSent  = "sent"
+	timelineLocal = "local"
+)
+
+type timelineEvent struct {
+	At          time.Time
+	Game        string
+	Kind        string
+	Communities []string `json:",omitempty"`
+	Err         string   `json:",omitempty"`
+	// the counter decoded from what was seen, -1 if nothing was
+	Counter int
+	// how many moves the game had, for local events
+	Moves int
+	Note  string `json:",omitempty"`
+	// the two sides stopped agreeing here
+	Diverged bool `json:",omitempty"`
+}
+
+type timeline struct {
+	mu       sync.Mutex
+	events   []timelineEvent
+	lastSeen string
+	// the route last read and the event of when it was first seen,
+	// for diff
+	route routeCommunities
+	seen  timelineEvent
+}
+
+var timelineOut struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func communityStrings(communities []bgpCommunity, large []bgpLargeCommunity) []string {
+	o := make([]string, 0, len(communities)+len(large))
+	for _, c := range communities {
+		o = append(o, fmt.Sprintf("(%d,%d)", c.AS, c.Data))
+	}
+	for _, c := range large {
+		o = append(o, fmt.Sprintf("(%d,%d,%d)", c.Global, c.Data1, c.Data2))
+	}
+	return o
+}
+
+func (t *timeline) add(ev timelineEvent) {
+	t.mu.Lock()
+	if ev.Kind == timelineSeen {
+		key := fmt.Sprint(ev.Communities, ev.Err)
+		if key == t.lastSeen {
+			t.mu.Unlock()
+			return
+		}
+		t.lastSeen, t.seen = key, ev
+	}
+	t.events = append(t.events, ev)
+	if n := len(t.events) - *timelineSize; n > 0 {
+		t.events = append(t.events[:0], t.events[n:]...)
+	}
+	t.mu.Unlock()
+
+	if *timelineFile == "" {
+		return
+	}
+	timelineOut.mu.Lock()
+	defer timelineOut.mu.Unlock()
+	if timelineOut.f == nil {
+		f, err := os.OpenFile(*timelineFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			mainLog.Errorf("Unable to open the timeline %s", err.Error())
+			*timelineFile = ""
+			return
+		}
+		timelineOut.f = f
+	}
+	b, _ := json.Marshal(ev)
+	timelineOut.f.Write(append(b, '\n'))
+}
+
+func (t *timeline) list() []timelineEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]timelineEvent(nil), t.events...)
+}
+
+// seen records what was read from the route of the other side.
+func (m *match) seen(communities []bgpCommunity, large []bgpLargeCommunity, msg bgpMessage, err error) {
+	ev := timelineEvent{At: time.Now(), Game: m.Name, Kind: timelineSeen,
+		Communities: communityStrings(communities, large), Counter: msg.Counter}
+	if err != nil {
+		ev.Err, ev.Counter = err.Error(), -1
+	}
+	m.timeline.mu.Lock()
+	m.timeline.route = routeCommunities{communities, large, err}
+	m.timeline.mu.Unlock()
+	m.timeline.add(ev)
+}
+
+// sent records what the match announces, with matchesMu held.
+func (m *match) sent() {
+	m.timeline.add(timelineEvent{At: time.Now(), Game: m.Name, Kind: timelineSent,
+		Communities: communityStrings(m.communities, m.large), Counter: -1})
+}
+
+// note records what the game made of a move.
+func (g *game) note(diverged bool, format string, args ...interface{}) {
+	m := g.match
+	m.timeline.add(timelineEvent{At: time.Now(), Game: m.Name, Kind: timelineLocal,
+		Counter: -1, Moves: len(g.moves), Note: fmt.Sprintf(format, args...), Diverged: diverged})
+}
+
+func readTimeline(r io.Reader) ([]timelineEvent, error) {
+	var events []timelineEvent
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var ev timelineEvent
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("Not a timeline of -timeline: %s", err.Error())
+		}
+		events = append(events, ev)
+	}
+	return events, sc.Err()
+}
+
+// timelineState is what a game knew at a point of its timeline
+type timelineState struct {
+	moves          int
+	events         int
+	fromAt, lastAt time.Time
+	seen, sent     *timelineEvent
+	// where it first diverged, and what both sides announced then
+	firstDiverged              *timelineEvent
+	divergedSeen, divergedSent *timelineEvent
+}
+
+// checkTimeline marks the seen events where the other side is at a
+// move we don't have.
+func checkTimeline(events []timelineEvent) {
+	moves := make(map[string]int)
+	for i := range events {
+		ev := &events[i]
+		switch ev.Kind {
+		case timelineLocal:
+			moves[ev.Game] = ev.Moves
+		case timelineSeen:
+			if ev.Counter < 0 {
+				continue
+			}
+			if c := expandCounter(ev.Counter, moves[ev.Game]); c > moves[ev.Game] {
+				ev.Diverged = true
+				ev.Note = fmt.Sprintf("the other side is at move %d, we have %d moves",
+					c, moves[ev.Game])
+			}
+		}
+	}
+}
+
+func printTimeline(w io.Writer, events []timelineEvent, game string) {
+	checkTimeline(events)
+
+	states := make(map[string]*timelineState)
+	var names []string
+	for i := range events {
+		ev := &events[i]
+		if game != "" && ev.Game != game {
+			continue
+		}
+		s := states[ev.Game]
+		if s == nil {
+			s = &timelineState{fromAt: ev.At}
+			states[ev.Game] = s
+			names = append(names, ev.Game)
+		}
+		s.events++
+		s.lastAt = ev.At
+
+		mark := "  "
+		if ev.Diverged {
+			mark = "!!"
+			if s.firstDiverged == nil {
+				s.firstDiverged, s.divergedSeen, s.divergedSent = ev, s.seen, s.sent
+			}
+		}
+		fmt.Fprintf(w, "%s %s %-20s %-5s %s\n", mark, ev.At.Format("15:04:05.000"),
+			ev.Game, ev.Kind, describeEvent(*ev))
+
+		switch ev.Kind {
+		case timelineSeen:
+			s.seen = ev
+		case timelineSent:
+			s.sent = ev
+		case timelineLocal:
+			s.moves = ev.Moves
+		}
+	}
+
+	for _, name := range names {
+		s := states[name]
+		fmt.Fprintf(w, "\n%s: %d events from %s to %s, %d moves\n", name, s.events,
+			s.fromAt.Format(time.RFC3339), s.lastAt.Format(time.RFC3339), s.moves)
+		if s.firstDiverged == nil {
+			fmt.Fprintf(w, "  the two sides agreed all along\n")
+			continue
+		}
+		fmt.Fprintf(w, "  first diverged at %s: %s\n",
+			s.firstDiverged.At.Format("15:04:05.000"), describeEvent(*s.firstDiverged))
+		if s.divergedSeen != nil {
+			fmt.Fprintf(w, "  the other side had announced since %s: %s\n",
+				s.divergedSeen.At.Format("15:04:05.000"), describeEvent(*s.divergedSeen))
+		}
+		if s.divergedSent != nil {
+			fmt.Fprintf(w, "  we had announced since %s: %s\n",
+				s.divergedSent.At.Format("15:04:05.000"), describeEvent(*s.divergedSent))
+		}
+	}
+}
+
+func describeEvent(ev timelineEvent) string {
+	var parts []string
+	if ev.Kind == timelineSeen && ev.Counter >= 0 {
+		parts = append(parts, fmt.Sprintf("#%d", ev.Counter))
+	}
+	if ev.Kind == timelineLocal {
+		parts = append(parts, fmt.Sprintf("[%d moves]", ev.Moves))
+	}
+	if ev.Note != "" {
+		parts = append(parts, ev.Note)
+	}
+	if ev.Err != "" {
+		parts = append(parts, "error: "+ev.Err)
+	}
+	if ev.Kind != timelineLocal {
+		if len(ev.Communities) == 0 {
+			parts = append(parts, "nothing")
+		}
+		parts = append(parts, strings.Join(ev.Communities, " "))
+	}
+	return strings.TrimSpace(strings.Join(parts, " "))
+}
+
+// runDebug is the debug command, only debug timeline for now.
+func runDebug(args []string) error {
+	if len(args) == 0 || args[0] != "timeline" {
+		return fmt.Errorf("Usage: %s debug timeline [-api addr] [-game name] [file]", os.Args[0])
+	}
+
+	fs := flag.NewFlagSet("debug timeline", flag.ExitOnError)
+	addr := fs.String("api", "", "Get the timeline from the control API of a running play or serve instead")
+	game := fs.String("game", "", "Only show this game, needed with -api")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s debug timeline [-api addr] [-game name] [file]\n\n"+
+			"Show what the games saw and announced, from a -timeline file, and where "+
+			"the two sides stopped agreeing.\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	var events []timelineEvent
+	switch {
+	case *addr != "":
+		if *game == "" {
+			return fmt.Errorf("-api needs -game, see ctl games")
+		}
+		resp, err := http.Get("http://" + *addr + "/games/" + *game + "/timeline")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s", resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			return err
+		}
+	case fs.NArg() == 1:
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if events, err = readTimeline(f); err != nil {
+			return err
+		}
+	default:
+		fs.Usage()
+		return fmt.Errorf("debug timeline needs a -timeline file or -api")
+	}
+
+	printTimeline(os.Stdout, events, *game)
+	return nil
+}
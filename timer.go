@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var turnTimeout = flag.Duration("turnTimeout", 0,
+	"How long the other side has for a move before it forfeits, 0 for no limit")
+
+var revealTimeout = flag.Duration("revealTimeout", 5*time.Minute,
+	"How long to wait on the other side to reveal its board once the game is over, 0 for no limit")
+
+var forfeitWithdraw = flag.Bool("forfeitWithdraw", false,
+	"Withdraw the game communities once the other side forfeits")
+
+// revealExpired fires once -revealTimeout is up, stop stops the timer.
+func revealExpired() (<-chan time.Time, func()) {
+	if *revealTimeout <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTimer(*revealTimeout)
+	return t.C, func() { t.Stop() }
+}
+
+// observe records when the move with counter c was first seen, made by
+// us or read from the other side. time.Now carries a monotonic reading,
+// so clock changes don't mess with the timer.
+func (g *game) observe(c int) {
+	if _, ok := g.seen[c]; !ok {
+		g.seen[c] = time.Now()
+	}
+}
+
+func (g *game) turnStart() time.Time {
+	if t, ok := g.seen[len(g.moves)-1]; ok {
+		return t
+	}
+	return g.started
+}
+
+// turnWaited is how long the current turn has been going on for, not
+// counting the time the other side was offline, see session.go.
+func (g *game) turnWaited() time.Duration {
+	waited := time.Since(g.turnStart()) - g.offlinePause()
+	if g.pausedTurn == len(g.moves) {
+		waited -= g.paused
+	}
+	return waited
+}
+
+// checkTimer warns the other side once half of -turnTimeout is gone on
+// its turn, and declares a forfeit once all of it is, it returns true
+// then.
+func (g *game) checkTimer() bool {
+	if *turnTimeout == 0 || g.over || g.ourTurn() {
+		return false
+	}
+
+	waited := g.turnWaited()
+	if waited >= *turnTimeout {
+		g.match.log.Warnf("The other side did not move for %s, it forfeits",
+			waited.Round(time.Second))
+		g.over, g.won, g.forfeited = true, true, true
+		return true
+	}
+
+	if waited >= *turnTimeout/2 && g.warned != len(g.moves) {
+		g.warned = len(g.moves)
+		g.match.log.Warnf("The other side did not move for %s, it forfeits in %s",
+			waited.Round(time.Second), (*turnTimeout - waited).Round(time.Second))
+		if err := g.match.say("hurry up, your turn is running out"); err != nil {
+			g.match.log.Errorf("Unable to announce chat message %s", err.Error())
+		}
+	}
+	return false
+}